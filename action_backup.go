@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/urfave/cli.v2"
+	"io"
+	"os"
+)
+
+func actionBackup(cc *cli.Context) error {
+	path := cc.Args().First()
+	if path == "" {
+		return cli.Exit("Usage: hiqty backup <file>", 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	snap, err := TakeSnapshot(rconn)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if path != "-" {
+		fmt.Printf("Backed up %d keys to %s.\n", len(snap.Keys), path)
+	}
+	return nil
+}
+
+func actionRestore(cc *cli.Context) error {
+	path := cc.Args().First()
+	if path == "" {
+		return cli.Exit("Usage: hiqty restore <file>", 1)
+	}
+
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		defer f.Close()
+		r = f
+	}
+	var snap Snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return cli.Exit("Invalid backup: "+err.Error(), 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	overwrite := cc.Bool("overwrite")
+	version, err := SchemaVersion(rconn)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if version != 0 && version != snap.SchemaVersion && !overwrite {
+		return cli.Exit(fmt.Sprintf("The backup is at schema version %d, but the data already here is at %d; use --overwrite to replace it", snap.SchemaVersion, version), 1)
+	}
+
+	n, err := RestoreSnapshot(rconn, &snap, overwrite)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Restored %d keys before failing: %s", n, err), 1)
+	}
+	fmt.Printf("Restored %d of %d keys.\n", n, len(snap.Keys))
+	if snap.SchemaVersion < CurrentSchemaVersion() {
+		fmt.Printf("The backup is from an older release; run hiqty migrate before starting.\n")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"gopkg.in/urfave/cli.v2"
+)
+
+func actionCleanup(cc *cli.Context) error {
+	token := cc.String("token")
+	if token == "" {
+		return cli.Exit("Missing bot token", 1)
+	}
+
+	sessions := []*discordgo.Session{}
+	for _, t := range append([]string{token}, cc.StringSlice("linked-token")...) {
+		session, err := discordgo.New("Bot " + t)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		sessions = append(sessions, session)
+	}
+	members, err := FetchMembership(sessions)
+	if err != nil {
+		return cli.Exit("Couldn't list guilds: "+err.Error(), 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	keys, err := StaleKeys(rconn, members)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	if cc.Bool("dry-run") {
+		fmt.Printf("Would delete %d stale keys:\n", len(keys))
+		for _, key := range keys {
+			fmt.Printf("  DEL %s\n", key)
+		}
+		return nil
+	}
+
+	if err := DeleteKeys(rconn, keys); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	fmt.Printf("Deleted %d stale keys.\n", len(keys))
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/urfave/cli.v2"
+)
+
+func actionCtl(cc *cli.Context) error {
+	usage := "Usage: hiqty ctl <guild-id> play|pause|stop|skip"
+	if cc.Args().Len() != 2 {
+		return cli.Exit(usage, 1)
+	}
+	gid, verb := cc.Args().Get(0), cc.Args().Get(1)
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	q := Queue{GuildID: gid, BotID: cc.String("bot")}
+	var state string
+	switch verb {
+	case "play":
+		state = StatePlaying
+	case "pause":
+		state = StatePaused
+	case "stop":
+		state = StateStopped
+	case "skip":
+		ok, err := Skip(rconn, ActivePlaylistQueue(rconn, q))
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		if !ok {
+			return cli.Exit("Nothing is playing", 1)
+		}
+		fmt.Println("Skipped.")
+		return nil
+	default:
+		return cli.Exit(usage, 1)
+	}
+
+	if err := SetQueueState(rconn, q, state); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	fmt.Printf("State is now %s.\n", state)
+	return nil
+}
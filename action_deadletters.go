@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/urfave/cli.v2"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func actionDeadLetters(cc *cli.Context) error {
+	gid := cc.Args().First()
+	if gid == "" {
+		return cli.Exit("Usage: hiqty deadletters <guild-id>", 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	q := Queue{GuildID: gid, BotID: cc.String("bot")}
+	if cc.Bool("requeue") {
+		n, err := RequeueDeadLetters(rconn, q)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		fmt.Printf("Requeued %d tracks.\n", n)
+	}
+
+	dls, err := DeadLetters(rconn, q)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if len(dls) == 0 {
+		fmt.Printf("No dead letters.\n")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSERVICE\tERROR\tURL")
+	for _, dl := range dls {
+		// Show what can be made out of it, like `hiqty queue` does.
+		var raw struct {
+			ServiceID string
+			URL       string
+		}
+		json.Unmarshal([]byte(dl.Envelope), &raw)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", dl.Time.Local().Format(time.Stamp), raw.ServiceID, dl.Error, raw.URL)
+	}
+	return w.Flush()
+}
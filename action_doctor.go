@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"github.com/sencrash/hiqty/media"
+	"gopkg.in/urfave/cli.v2"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// A doctor runs checks, and keeps count of the ones that failed.
+type doctor struct {
+	failed int
+}
+
+func (d *doctor) ok(what, format string, args ...interface{}) {
+	fmt.Printf("[ OK ] %s: %s\n", what, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(what, format string, args ...interface{}) {
+	fmt.Printf("[WARN] %s: %s\n", what, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(what, format string, args ...interface{}) {
+	d.failed++
+	fmt.Printf("[FAIL] %s: %s\n", what, fmt.Sprintf(format, args...))
+}
+
+func actionDoctor(cc *cli.Context) error {
+	d := &doctor{}
+
+	// Discord tokens.
+	tokens := cc.StringSlice("linked-token")
+	if token := cc.String("token"); token != "" {
+		tokens = append([]string{token}, tokens...)
+	} else {
+		d.fail("Discord", "no bot token given; pass --token or set HIQTY_BOT_TOKEN")
+	}
+	for i, token := range tokens {
+		what := "Discord"
+		if i > 0 || cc.String("token") == "" {
+			what = "Discord (linked)"
+		}
+		session, err := discordgo.New("Bot " + token)
+		if err == nil {
+			var user *discordgo.User
+			if user, err = session.User("@me"); err == nil {
+				d.ok(what, "logged in as %s#%s (%s)", user.Username, user.Discriminator, user.ID)
+				continue
+			}
+		}
+		d.fail(what, "%s; check that the token is a bot token, and hasn't been reset", err)
+	}
+
+	// Redis, and whether keyspace events can be enabled.
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+	if _, err := rconn.Do("PING"); err != nil {
+		d.fail("Redis", "%s; check --redis, and that the server is running", err)
+	} else {
+		d.ok("Redis", "connected to %s", cc.String("redis"))
+		checkDoctorRedis(d, rconn)
+	}
+
+	// ffmpeg.
+	if path, err := exec.LookPath(cc.String("ffmpeg")); err != nil {
+		d.fail("ffmpeg", "%s; install it, or point --ffmpeg at it", err)
+	} else {
+		d.ok("ffmpeg", "found at %s", path)
+	}
+
+	// Services, and their credentials.
+	svcs := media.Services()
+	sids := []string{}
+	for sid := range svcs {
+		sids = append(sids, sid)
+	}
+	sort.Strings(sids)
+	if len(sids) == 0 {
+		d.fail("Services", "none are registered; eg. SoundCloud needs --soundcloud-client-id")
+	}
+	for _, sid := range sids {
+		what := "Service " + sid
+		pinger, ok := svcs[sid].(media.Pinger)
+		if !ok {
+			d.ok(what, "registered (it has no health check)")
+			continue
+		}
+		if err := pinger.Ping(); err != nil {
+			d.fail(what, "%s; check its credentials", err)
+			continue
+		}
+		d.ok(what, "credentials accepted")
+	}
+
+	for _, url := range cc.StringSlice("test-url") {
+		what := "Resolve " + url
+		tracks, err := ResolveURL(rconn, url)
+		switch {
+		case err != nil:
+			d.fail(what, "%s", friendlyError(err))
+		case len(tracks) == 0:
+			d.fail(what, "no service recognizes that URL")
+		default:
+			d.ok(what, "%d track(s), eg. %q", len(tracks), tracks[0].GetInfo().Title)
+		}
+	}
+
+	if d.failed > 0 {
+		return cli.Exit(fmt.Sprintf("\n%d check(s) failed.", d.failed), 1)
+	}
+	fmt.Println("\nEverything looks good.")
+	return nil
+}
+
+// checkDoctorRedis checks the data's schema version, and whether keyspace events can be used.
+func checkDoctorRedis(d *doctor, rconn redis.Conn) {
+	v, err := SchemaVersion(rconn)
+	switch {
+	case err != nil:
+		d.fail("Schema", "%s", err)
+	case v == CurrentSchemaVersion():
+		d.ok("Schema", "version %d", v)
+	case v > CurrentSchemaVersion():
+		d.fail("Schema", "data is at version %d, which is newer than this release; upgrade hiqty", v)
+	case v == 0:
+		if keys, err := scanKeys(rconn, "hiqty:*"); err != nil || len(keys) > 0 {
+			d.fail("Schema", "data predates schema versioning; run hiqty migrate")
+		} else {
+			d.ok("Schema", "empty database")
+		}
+	default:
+		d.fail("Schema", "data is at version %d, but this release needs %d; run hiqty migrate", v, CurrentSchemaVersion())
+	}
+
+	values, err := redis.Strings(rconn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		d.warn("Keyspace events", "CONFIG isn't allowed (%s); player states will be polled, see --state-poll-interval", err)
+		return
+	}
+	if len(values) == 2 && strings.ContainsAny(values[1], "KA") {
+		d.ok("Keyspace events", "enabled (%q)", values[1])
+		return
+	}
+	d.ok("Keyspace events", "can be enabled; hiqty run will do so")
+}
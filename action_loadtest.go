@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/urfave/cli.v2"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"runtime/pprof"
+	"text/tabwriter"
+	"time"
+)
+
+func actionLoadTest(cc *cli.Context) error {
+	ffmpeg := cc.String("ffmpeg")
+	var fixture []byte
+	var err error
+	if path := cc.String("fixture"); path != "" {
+		fixture, err = ioutil.ReadFile(path)
+	} else {
+		fixture, err = GenerateFixture(ffmpeg, time.Minute)
+	}
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	defer signal.Stop(quit)
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	lt := LoadTest{
+		Guilds:   cc.Int("guilds"),
+		Duration: cc.Duration("duration"),
+		Fixture:  fixture,
+		Bitrate:  cc.Int("bitrate"),
+		FFmpeg:   ffmpeg,
+		Stream:   streamConfig(cc),
+	}
+	if spares := cc.Int("encoder-spares"); spares > 0 {
+		lt.Encoders = &EncoderPool{FFmpeg: ffmpeg, Size: spares}
+		poolCtx, stopPool := context.WithCancel(context.Background())
+		defer stopPool()
+		go lt.Encoders.Run(poolCtx)
+	}
+
+	if path := cc.String("cpu-profile"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	report, err := lt.Run(ctx)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	if path := cc.String("mem-profile"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		defer f.Close()
+		if err := pprof.Lookup("allocs").WriteTo(f, 0); err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+	}
+
+	late := 0.0
+	if report.Packets > 0 {
+		late = float64(report.Late) / float64(report.Packets) * 100
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Guilds:\t%d\n", report.Guilds)
+	fmt.Fprintf(w, "Elapsed:\t%s\n", report.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Tracks started:\t%d\n", report.Tracks)
+	fmt.Fprintf(w, "Packets:\t%d (%d late, %.2f%%)\n", report.Packets, report.Late, late)
+	fmt.Fprintf(w, "Startup:\t%s\n", formatDurationStats(report.Startup))
+	fmt.Fprintf(w, "Jitter:\t%s\n", formatDurationStats(report.Jitter))
+	fmt.Fprintf(w, "CPU per stream:\t%.2f%% (hiqty), %.2f%% (ffmpeg) of a core\n", report.CPUPerStream*100, report.EncoderCPUPerStream*100)
+	fmt.Fprintf(w, "Allocations:\t%.1f KiB/s, %.0f/s\n", report.AllocBytesPerSecond/1024, report.AllocsPerSecond)
+	w.Flush()
+	return nil
+}
+
+func formatDurationStats(s DurationStats) string {
+	return fmt.Sprintf("mean %s, p99 %s, max %s", s.Mean.Round(time.Microsecond), s.P99.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+}
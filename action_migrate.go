@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"gopkg.in/urfave/cli.v2"
+)
+
+func actionMigrate(cc *cli.Context) error {
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	from, err := SchemaVersion(rconn)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if err := Migrate(rconn, func(format string, args ...interface{}) {
+		fmt.Printf(format+"\n", args...)
+	}); err != nil {
+		return cli.Exit("Migration failed: "+err.Error(), 1)
+	}
+
+	if to := CurrentSchemaVersion(); from == to {
+		fmt.Printf("Already at schema version %d.\n", to)
+	} else {
+		fmt.Printf("Migrated from schema version %d to %d.\n", from, to)
+	}
+	return nil
+}
+
+// checkSchema refuses to run against data from another release.
+func checkSchema(pool *redis.Pool) error {
+	rconn := pool.Get()
+	defer rconn.Close()
+	return CheckSchema(rconn)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"gopkg.in/urfave/cli.v2"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+func actionPs(cc *cli.Context) error {
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	keys, err := scanKeys(rconn, "hiqty:server:*:state")
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GUILD\tBOT\tSTATE\tQUEUED\tPLAYING\tINSTANCE")
+	for _, key := range keys {
+		gid, bid, ok := parseServerKey(key)
+		if !ok {
+			continue
+		}
+		q := Queue{GuildID: gid, BotID: bid}
+		if q.StateKey() != key {
+			continue
+		}
+
+		state, err := redis.String(rconn.Do("GET", key))
+		if err == redis.ErrNil || state == "" {
+			continue
+		}
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+
+		pq := ActivePlaylistQueue(rconn, q)
+		length, err := redis.Int(rconn.Do("LLEN", pq.PlaylistKey()))
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		current := "-"
+		if data, err := redis.Bytes(rconn.Do("GET", pq.NowPlayingKey())); err == nil {
+			var envelope TrackEnvelope
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				current = "(undecodable)"
+			} else {
+				current = envelope.Track.GetInfo().Title
+			}
+		}
+
+		instance := "-"
+		lock, err := redis.String(rconn.Do("GET", q.PlayerLockKey()))
+		switch {
+		case err == nil && PlayerLockHolder(lock) != "":
+			instance = PlayerLockHolder(lock)
+		case err == nil:
+			instance = "(unknown)"
+		case err != redis.ErrNil:
+			return cli.Exit(err.Error(), 1)
+		}
+
+		if bid == "" {
+			bid = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", gid, bid, state, length, current, instance)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/urfave/cli.v2"
+)
+
+func actionPurge(cc *cli.Context) error {
+	gid := cc.Args().First()
+	if (gid == "") == !cc.Bool("all-stale") {
+		return cli.Exit("Usage: hiqty purge <guild-id>, or hiqty purge --all-stale", 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	var keys []string
+	var err error
+	if gid != "" {
+		keys, err = PlaybackKeys(rconn, gid)
+	} else {
+		keys, err = StalePlaybackKeys(rconn)
+	}
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	if cc.Bool("dry-run") {
+		fmt.Printf("Would delete %d keys:\n", len(keys))
+		for _, key := range keys {
+			fmt.Printf("  DEL %s\n", key)
+		}
+		return nil
+	}
+
+	if err := DeleteKeys(rconn, keys); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	fmt.Printf("Deleted %d keys.\n", len(keys))
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"gopkg.in/urfave/cli.v2"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func actionQueue(cc *cli.Context) error {
+	gid := cc.Args().First()
+	if gid == "" {
+		return cli.Exit("Usage: hiqty queue <guild-id>", 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	q := Queue{GuildID: gid, BotID: cc.String("bot")}
+	state, err := redis.String(rconn.Do("GET", q.StateKey()))
+	if err != nil && err != redis.ErrNil {
+		return cli.Exit(err.Error(), 1)
+	}
+	cid, err := redis.String(rconn.Do("GET", q.ChannelKey()))
+	if err != nil && err != redis.ErrNil {
+		return cli.Exit(err.Error(), 1)
+	}
+	lockTTL, err := redis.Int64(rconn.Do("PTTL", q.PlayerLockKey()))
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	pq := PlaylistQueue(rconn, q, cid)
+	playing, err := redis.Bytes(rconn.Do("GET", pq.NowPlayingKey()))
+	if err != nil && err != redis.ErrNil {
+		return cli.Exit(err.Error(), 1)
+	}
+	items, err := redis.ByteSlices(rconn.Do("LRANGE", pq.PlaylistKey(), 0, -1))
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	orNone := func(s string) string {
+		if s == "" {
+			return "(none)"
+		}
+		return s
+	}
+	fmt.Printf("State:    %s\n", orNone(state))
+	fmt.Printf("Channel:  %s\n", orNone(cid))
+	holder := "an instance"
+	if lock, err := redis.String(rconn.Do("GET", q.PlayerLockKey())); err == nil && PlayerLockHolder(lock) != "" {
+		holder = PlayerLockHolder(lock)
+	}
+	switch {
+	case lockTTL > 0:
+		fmt.Printf("Player:   locked by %s (expires in %s)\n", holder, time.Duration(lockTTL)*time.Millisecond)
+	case lockTTL == -1:
+		fmt.Printf("Player:   locked by %s (never expires!)\n", holder)
+	default:
+		fmt.Printf("Player:   not locked; no instance is playing\n")
+	}
+	fmt.Printf("Playlist: %s (%d tracks)\n", pq.PlaylistKey(), len(items))
+	if playing == nil && len(items) == 0 {
+		return nil
+	}
+
+	// The playing track is #0, and the queued ones are numbered from 1, like in chat and the API.
+	fmt.Printf("\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSERVICE\tGAIN\tTITLE\tURL")
+	row := func(pos int, data []byte) {
+		var envelope TrackEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			// Show what can be made out of it; an unknown service is a common reason.
+			var raw struct {
+				ServiceID string
+				URL       string
+			}
+			json.Unmarshal(data, &raw)
+			fmt.Fprintf(w, "%d\t%s\t\t(undecodable: %s)\t%s\n", pos, raw.ServiceID, err, raw.URL)
+			return
+		}
+		summary := SummarizeTrack(envelope)
+		title := summary.Title
+		if summary.Artist != "" {
+			title = summary.Artist + " - " + title
+		}
+		gain := "-"
+		if envelope.Gain != 0 {
+			gain = fmt.Sprintf("%+gdB", envelope.Gain)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", pos, envelope.ServiceID, gain, title, summary.URL)
+	}
+	if playing != nil {
+		row(0, playing)
+	}
+	for i, data := range items {
+		row(i+1, data)
+	}
+	return w.Flush()
+}
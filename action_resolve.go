@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"gopkg.in/urfave/cli.v2"
+	"os"
+)
+
+func actionResolve(cc *cli.Context) error {
+	url := cc.Args().First()
+	if url == "" {
+		return cli.Exit("Usage: hiqty resolve <url>", 1)
+	}
+
+	report := ResolveForReport(url)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if report.Error != "" || len(report.Tracks) == 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"gopkg.in/urfave/cli.v2"
+	"os"
+	"time"
+)
+
+func actionStatsExport(cc *cli.Context) error {
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if s := cc.String("to"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return cli.Exit("Invalid --to: "+err.Error(), 1)
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -30)
+	if s := cc.String("from"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return cli.Exit("Invalid --from: "+err.Error(), 1)
+		}
+		from = t
+	}
+	if from.After(to) {
+		return cli.Exit("--from must not be after --to", 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	report, err := ReadStatsReport(rconn, from, to)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	switch cc.String("format") {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"date", "metric", "value"})
+		for _, row := range report.Rows() {
+			w.Write(row[:])
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+	default:
+		return cli.Exit("Unknown format: "+cc.String("format"), 1)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/urfave/cli.v2"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+func actionTokenCreate(cc *cli.Context) error {
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	token, err := CreateAPIToken(rconn, cc.String("scope"), cc.String("guild"))
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	fmt.Printf("Token created. Keep it secret; it can't be shown again.\n")
+	fmt.Printf("\n")
+	fmt.Printf("Authorization: Bearer %s\n", token)
+	return nil
+}
+
+func actionTokenList(cc *cli.Context) error {
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	tokens, err := ListAPITokens(rconn)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	hashes := []string{}
+	for hash, t := range tokens {
+		if gid := cc.String("guild"); gid != "" && t.GuildID != gid {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return tokens[hashes[i]].Created < tokens[hashes[j]].Created })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSCOPE\tGUILD\tCREATED")
+	for _, hash := range hashes {
+		t := tokens[hash]
+		gid := t.GuildID
+		if gid == "" {
+			gid = "(any)"
+		}
+		created := time.Unix(t.Created, 0).UTC().Format("2006-01-02 15:04:05")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", APITokenID(hash), t.Scope, gid, created)
+	}
+	return w.Flush()
+}
+
+func actionTokenRevoke(cc *cli.Context) error {
+	token := cc.Args().First()
+	if token == "" {
+		return cli.Exit("Usage: hiqty token revoke <token>", 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	// Tokens can't be shown again, so lost ones can be revoked by the ID `hiqty token list` shows.
+	hash := HashToken(token)
+	if cc.Bool("id") {
+		var err error
+		if hash, err = FindAPITokenHash(rconn, token); err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		if hash == "" {
+			return cli.Exit("No such token", 1)
+		}
+	}
+
+	if cc.Bool("dry-run") {
+		t, err := lookupAPITokenHash(rconn, hash)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		if t == nil {
+			return cli.Exit("No such token", 1)
+		}
+		fmt.Printf("Would revoke %s token %s:\n", t.Scope, APITokenID(hash))
+		if t.GuildID != "" {
+			fmt.Printf("  SREM %s %s\n", KeyForServerAPITokens(t.GuildID), hash)
+		}
+		fmt.Printf("  DEL %s\n", KeyForAPIToken(hash))
+		return nil
+	}
+
+	ok, err := revokeAPITokenHash(rconn, hash)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if !ok {
+		return cli.Exit("No such token", 1)
+	}
+	fmt.Println("Token revoked.")
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/urfave/cli.v2"
+)
+
+func actionWebhookCreate(cc *cli.Context) error {
+	gid := cc.Args().First()
+	if gid == "" {
+		return cli.Exit("Usage: hiqty webhook create <guild-id>", 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	token, err := CreateWebhook(rconn, gid)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	fmt.Printf("Webhook created for guild %s. Keep the token secret; it can't be shown again.\n", gid)
+	fmt.Printf("\n")
+	fmt.Printf("POST /webhooks/%s\n", token)
+	fmt.Printf("{\"url\": \"https://...\", \"requester\": \"...\"}\n")
+	return nil
+}
+
+func actionWebhookRevoke(cc *cli.Context) error {
+	token := cc.Args().First()
+	if token == "" {
+		return cli.Exit("Usage: hiqty webhook revoke <token>", 1)
+	}
+
+	pool := newPool(cc)
+	defer pool.Close()
+	rconn := pool.Get()
+	defer rconn.Close()
+
+	if cc.Bool("dry-run") {
+		gid, err := LookupWebhook(rconn, token)
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		if gid == "" {
+			return cli.Exit("No such webhook", 1)
+		}
+		fmt.Printf("Would revoke webhook for guild %s:\n", gid)
+		fmt.Printf("  DEL %s\n", KeyForWebhook(HashToken(token)))
+		return nil
+	}
+
+	ok, err := RevokeWebhook(rconn, token)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if !ok {
+		return cli.Exit("No such webhook", 1)
+	}
+	fmt.Println("Webhook revoked.")
+	return nil
+}
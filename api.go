@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"github.com/sencrash/hiqty/media"
+	"net/http"
+	"strings"
+)
+
+// An apiHandler handles a request to a guild's API endpoint.
+type apiHandler func(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string)
+
+// NowPlayingResponse describes a guild's playback state.
+type NowPlayingResponse struct {
+	State string        `json:"state"`
+	Track *TrackSummary `json:"track"`
+}
+
+// QueueResponse lists what's playing in a guild, if anything, and the tracks queued after it; the
+// first of those is at index 1.
+type QueueResponse struct {
+	Playing *QueuedTrack  `json:"playing"`
+	Tracks  []QueuedTrack `json:"tracks"`
+}
+
+// QueuedTrack is a track in a playlist, along with its gain adjustment.
+type QueuedTrack struct {
+	*TrackSummary
+	Gain float64 `json:"gain"`
+}
+
+// TrackSummary is a serializable summary of a track.
+type TrackSummary struct {
+	ServiceID string `json:"service"`
+	Title     string `json:"title"`
+	URL       string `json:"url"`
+	Artist    string `json:"artist"`
+	CoverURL  string `json:"cover_url"`
+}
+
+// SummarizeTrack summarizes a track.
+func SummarizeTrack(envelope TrackEnvelope) *TrackSummary {
+	info := envelope.Track.GetInfo()
+	if info.Title == "" && media.IsStub(envelope.Track) {
+		info.Title = "(not looked up yet)"
+	}
+	return &TrackSummary{
+		ServiceID: envelope.ServiceID,
+		Title:     info.Title,
+		URL:       info.URL,
+		Artist:    info.User.Name,
+		CoverURL:  info.CoverURL,
+	}
+}
+
+// HandleAPI routes /api/guilds/<gid>/<endpoint> requests, checking that the caller's token has
+// the scope required for the endpoint.
+func (s *HTTPServer) HandleAPI(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/guilds/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	gid, endpoint := parts[0], parts[1]
+
+	var scope string
+	var handler apiHandler
+	switch {
+	case req.Method == "GET" && endpoint == "nowplaying":
+		scope, handler = ScopeRead, s.apiNowPlaying
+	case req.Method == "GET" && endpoint == "queue":
+		scope, handler = ScopeRead, s.apiListQueue
+	case req.Method == "POST" && endpoint == "queue":
+		scope, handler = ScopeQueue, s.apiQueue
+	case req.Method == "DELETE" && endpoint == "queue":
+		scope, handler = ScopeAdmin, s.apiRemove
+	case req.Method == "POST" && endpoint == "move":
+		scope, handler = ScopeAdmin, s.apiMove
+	case req.Method == "GET" && endpoint == "state":
+		scope, handler = ScopeRead, s.apiState
+	case req.Method == "PUT" && endpoint == "state":
+		scope, handler = ScopeAdmin, s.apiSetState
+	case req.Method == "GET" && endpoint == "events":
+		scope, handler = ScopeRead, s.apiEvents
+	case req.Method == "POST" && endpoint == "skip":
+		scope, handler = ScopeAdmin, s.apiSkip
+	case req.Method == "PUT" && endpoint == "gain":
+		scope, handler = ScopeAdmin, s.apiSetGain
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	token, err := authenticate(s.authProviders(), rconn, req)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't authenticate request")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "missing or invalid credentials")
+		return
+	}
+	if !token.Allows(scope, gid) {
+		writeError(w, http.StatusForbidden, "token doesn't have the "+scope+" scope for this guild")
+		return
+	}
+
+	handler(w, req, rconn, gid)
+}
+
+// apiNowPlaying handles GET /api/guilds/<gid>/nowplaying.
+func (s *HTTPServer) apiNowPlaying(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	state, err := readAPIState(rconn, gid)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't get state")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	res := NowPlayingResponse{State: state}
+	envelope, err := ReadNowPlaying(rconn, ActivePlaylistQueue(rconn, GuildQueue(gid)))
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't get current track")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if envelope != nil {
+		res.Track = SummarizeTrack(*envelope)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// apiListQueue handles GET /api/guilds/<gid>/queue.
+func (s *HTTPServer) apiListQueue(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	q := ActivePlaylistQueue(rconn, GuildQueue(gid))
+	playing, err := ReadNowPlaying(rconn, q)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't get current track")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	datas, err := redis.ByteSlices(rconn.Do("LRANGE", q.PlaylistKey(), 0, -1))
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't get playlist")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	res := QueueResponse{Tracks: []QueuedTrack{}}
+	if playing != nil {
+		res.Playing = &QueuedTrack{SummarizeTrack(*playing), playing.Gain}
+	}
+	for _, data := range datas {
+		var envelope TrackEnvelope
+		if json.Unmarshal(data, &envelope) != nil {
+			continue
+		}
+		res.Tracks = append(res.Tracks, QueuedTrack{SummarizeTrack(envelope), envelope.Gain})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// apiQueue handles POST /api/guilds/<gid>/queue, which takes the same body as a webhook.
+func (s *HTTPServer) apiQueue(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	s.queueFromRequest(w, req, rconn, gid)
+}
+
+// apiRemove handles DELETE /api/guilds/<gid>/queue, with a body of {"index": 1}, which removes a
+// queued track. The playing track (index 0) can't be removed; skip it instead.
+func (s *HTTPServer) apiRemove(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	var body struct {
+		Index int `json:"index"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if body.Index < 1 {
+		writeError(w, http.StatusBadRequest, "index must be 1 or more; skip the playing track instead")
+		return
+	}
+
+	ok, err := RemoveTrack(rconn, ActivePlaylistQueue(rconn, GuildQueue(gid)), body.Index)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't remove track")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no track at that index")
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// apiMove handles POST /api/guilds/<gid>/move, with a body of {"from": 3, "to": 1}, which moves a
+// queued track to another position. The playing track (index 0) stays where it is.
+func (s *HTTPServer) apiMove(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	var body struct {
+		From int `json:"from"`
+		To   int `json:"to"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if body.From < 1 || body.To < 1 {
+		writeError(w, http.StatusBadRequest, "indices must be 1 or more; the playing track can't be moved")
+		return
+	}
+
+	ok, err := MoveTrack(rconn, ActivePlaylistQueue(rconn, GuildQueue(gid)), body.From, body.To)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't move track")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no track at that index")
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// apiState handles GET /api/guilds/<gid>/state.
+func (s *HTTPServer) apiState(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	state, err := readAPIState(rconn, gid)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't get state")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"state": state})
+}
+
+// apiSetState handles PUT /api/guilds/<gid>/state, with a body of {"state": "playing|paused|stopped"}.
+func (s *HTTPServer) apiSetState(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if body.State != StatePlaying && body.State != StatePaused && body.State != StateStopped {
+		writeError(w, http.StatusBadRequest, "state must be playing, paused or stopped")
+		return
+	}
+	if err := SetQueueState(rconn, GuildQueue(gid), body.State); err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't set state")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// apiSkip handles POST /api/guilds/<gid>/skip, which skips the playing track.
+func (s *HTTPServer) apiSkip(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	ok, err := Skip(rconn, ActivePlaylistQueue(rconn, GuildQueue(gid)))
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't skip track")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"skipped": ok})
+}
+
+// apiSetGain handles PUT /api/guilds/<gid>/gain, with a body of {"index": 1, "gain": -3}, which
+// adjusts the volume of a queued track, in dB. The playing track (index 0) can't be adjusted.
+func (s *HTTPServer) apiSetGain(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	var body struct {
+		Index int     `json:"index"`
+		Gain  float64 `json:"gain"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if body.Index < 1 {
+		writeError(w, http.StatusBadRequest, "index must be 1 or more; the playing track can't be adjusted")
+		return
+	}
+	if body.Gain < MinGain || body.Gain > MaxGain {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("gain must be between %gdB and %+gdB", MinGain, MaxGain))
+		return
+	}
+
+	ok, err := SetTrackGain(rconn, ActivePlaylistQueue(rconn, GuildQueue(gid)), body.Index, body.Gain)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't set track gain")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no track at that index")
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// readAPIState reads a guild's player state; guilds that have never played are stopped.
+func readAPIState(rconn redis.Conn, gid string) (string, error) {
+	state, err := redis.String(rconn.Do("GET", KeyForServerState(gid)))
+	if err == redis.ErrNil || state == "" {
+		return StateStopped, nil
+	}
+	return state, err
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+)
+
+// An AuthProvider authenticates requests to the HTTP API. Providers describe what a request is
+// allowed to do in terms of an APIToken, regardless of what kind of credentials it carried.
+type AuthProvider interface {
+	// Authenticate returns what a request is allowed to do, or nil if it doesn't carry any
+	// credentials the provider recognizes.
+	Authenticate(rconn redis.Conn, req *http.Request) (*APIToken, error)
+}
+
+// authenticate tries each provider in turn, returning the first match.
+func authenticate(providers []AuthProvider, rconn redis.Conn, req *http.Request) (*APIToken, error) {
+	for _, p := range providers {
+		token, err := p.Authenticate(rconn, req)
+		if err != nil || token != nil {
+			return token, err
+		}
+	}
+	return nil, nil
+}
+
+// bearerToken returns the bearer token from a request's Authorization header, if any. Browsers
+// can't set headers on WebSocket connections, so those may pass it as ?access_token= instead.
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			return req.URL.Query().Get("access_token")
+		}
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// ParseAuthGrant parses a grant of access to a credential, in the form "scope[/guild]=credential",
+// eg. "admin=s3cret" or "read/1234567890=overlay.example.com".
+func ParseAuthGrant(s string) (string, APIToken, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", APIToken{}, errors.New("expected scope[/guild]=credential: " + s)
+	}
+	scope := strings.SplitN(parts[0], "/", 2)
+	t := APIToken{Scope: scope[0]}
+	if len(scope) == 2 {
+		t.GuildID = scope[1]
+	}
+	if scopeRanks[t.Scope] == 0 {
+		return "", APIToken{}, errors.New("unknown scope: " + t.Scope)
+	}
+	return parts[1], t, nil
+}
+
+// RedisTokenAuth authenticates bearer tokens created with `hiqty token create` or from chat.
+type RedisTokenAuth struct{}
+
+func (RedisTokenAuth) Authenticate(rconn redis.Conn, req *http.Request) (*APIToken, error) {
+	token := bearerToken(req)
+	if token == "" {
+		return nil, nil
+	}
+	return LookupAPIToken(rconn, token)
+}
+
+// StaticTokenAuth authenticates bearer tokens given on the command line, for deployments that
+// manage secrets elsewhere.
+type StaticTokenAuth struct {
+	Tokens map[string]APIToken
+}
+
+func (a StaticTokenAuth) Authenticate(_ redis.Conn, req *http.Request) (*APIToken, error) {
+	token := bearerToken(req)
+	if token == "" {
+		return nil, nil
+	}
+	for secret, t := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+			t := t
+			return &t, nil
+		}
+	}
+	return nil, nil
+}
+
+// ClientCertAuth authenticates clients by the common name of a TLS client certificate, which the
+// HTTPServer has verified against its client CA.
+type ClientCertAuth struct {
+	Names map[string]APIToken
+}
+
+func (a ClientCertAuth) Authenticate(_ redis.Conn, req *http.Request) (*APIToken, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	t, ok := a.Names[req.TLS.VerifiedChains[0][0].Subject.CommonName]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+// OIDCAuth authenticates bearer tokens that are ID tokens from an OpenID Connect provider, eg. an
+// existing SSO setup. Scopes and guilds are taken from custom claims; tokens without a guild are
+// refused, as the provider may issue them for anything, unless AllowGlobal is set.
+type OIDCAuth struct {
+	Issuer      string
+	Verifier    *oidc.IDTokenVerifier // Checks signatures, issuer, audience and expiry
+	ScopeClaim  string
+	GuildClaim  string
+	AllowGlobal bool // Accept tokens without a guild claim, for every guild
+}
+
+// NewOIDCAuth discovers an OpenID Connect provider, to accept ID tokens it issued for an audience.
+// Its signing keys are fetched when first needed, and again whenever it rotates them, using the
+// given client.
+func NewOIDCAuth(client *http.Client, issuer, audience string) (*OIDCAuth, error) {
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), client), issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCAuth{
+		Issuer:   issuer,
+		Verifier: provider.Verifier(&oidc.Config{ClientID: audience}),
+	}, nil
+}
+
+func (a *OIDCAuth) Authenticate(_ redis.Conn, req *http.Request) (*APIToken, error) {
+	token := bearerToken(req)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+
+	idToken, err := a.Verifier.Verify(req.Context(), token)
+	if err != nil {
+		log.WithError(err).WithField("issuer", a.Issuer).Debug("HTTPServer: Couldn't verify OIDC token")
+		return nil, nil
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	scope, _ := claims[a.ScopeClaim].(string)
+	var gid string
+	if a.GuildClaim != "" {
+		gid, _ = claims[a.GuildClaim].(string)
+	}
+	if gid == "" && !a.AllowGlobal {
+		log.WithField("claim", a.GuildClaim).Debug("HTTPServer: Refusing OIDC token without a guild claim")
+		return nil, nil
+	}
+	t := &APIToken{Scope: scope, GuildID: gid}
+	if !idToken.IssuedAt.IsZero() {
+		t.Created = idToken.IssuedAt.Unix()
+	}
+	return t, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAuthGrant(t *testing.T) {
+	token, grant, err := ParseAuthGrant("admin=s3cret")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", token)
+	assert.Equal(t, APIToken{Scope: ScopeAdmin}, grant)
+
+	token, grant, err = ParseAuthGrant("read/1234=overlay.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "overlay.example.com", token)
+	assert.Equal(t, APIToken{Scope: ScopeRead, GuildID: "1234"}, grant)
+
+	_, _, err = ParseAuthGrant("god=s3cret")
+	assert.Error(t, err)
+	_, _, err = ParseAuthGrant("admin")
+	assert.Error(t, err)
+}
+
+func TestStaticTokenAuth(t *testing.T) {
+	auth := StaticTokenAuth{Tokens: map[string]APIToken{"s3cret": {Scope: ScopeQueue}}}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	token, err := auth.Authenticate(nil, req)
+	assert.NoError(t, err)
+	assert.Equal(t, &APIToken{Scope: ScopeQueue}, token)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	token, err = auth.Authenticate(nil, req)
+	assert.NoError(t, err)
+	assert.Nil(t, token)
+}
+
+func TestBearerTokenQuery(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?access_token=s3cret", nil)
+	assert.Equal(t, "", bearerToken(req))
+
+	req.Header.Set("Upgrade", "websocket")
+	assert.Equal(t, "s3cret", bearerToken(req))
+
+	req.Header.Set("Authorization", "Bearer other")
+	assert.Equal(t, "other", bearerToken(req))
+}
+
+func TestOIDCAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	authWith := func(auth *OIDCAuth, jwt string) *APIToken {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		token, err := auth.Authenticate(nil, req)
+		assert.NoError(t, err)
+		return token
+	}
+
+	auth, err := NewOIDCAuth(srv.Client(), srv.URL, "hiqty")
+	if !assert.NoError(t, err) {
+		return
+	}
+	auth.ScopeClaim = "hiqty_scope"
+	auth.GuildClaim = "hiqty_guild"
+	exp := time.Now().Add(time.Hour).Unix()
+
+	token := authWith(auth, sign(map[string]interface{}{
+		"iss": srv.URL, "aud": []string{"hiqty"}, "exp": exp, "iat": 1000,
+		"hiqty_scope": "admin", "hiqty_guild": "1234",
+	}))
+	assert.Equal(t, &APIToken{Scope: ScopeAdmin, GuildID: "1234", Created: 1000}, token)
+
+	// Wrong audience, wrong issuer, expired.
+	assert.Nil(t, authWith(auth, sign(map[string]interface{}{"iss": srv.URL, "aud": "other", "exp": exp})))
+	assert.Nil(t, authWith(auth, sign(map[string]interface{}{"iss": "https://evil.example.com", "aud": "hiqty", "exp": exp})))
+	assert.Nil(t, authWith(auth, sign(map[string]interface{}{"iss": srv.URL, "aud": "hiqty", "exp": time.Now().Add(-time.Hour).Unix()})))
+
+	// Tampered payloads don't verify.
+	valid := sign(map[string]interface{}{"iss": srv.URL, "aud": "hiqty", "exp": exp, "hiqty_scope": "read"})
+	forged, _ := json.Marshal(map[string]interface{}{"iss": srv.URL, "aud": "hiqty", "exp": exp, "hiqty_scope": "admin"})
+	tampered := strings.Split(valid, ".")
+	tampered[1] = base64.RawURLEncoding.EncodeToString(forged)
+	assert.Nil(t, authWith(auth, tampered[0]+"."+tampered[1]+"."+tampered[2]))
+
+	// Tokens without a guild are only accepted for every guild if that's allowed.
+	global := map[string]interface{}{"iss": srv.URL, "aud": "hiqty", "exp": exp, "iat": 1000, "hiqty_scope": "read"}
+	assert.Nil(t, authWith(auth, sign(global)))
+	auth.AllowGlobal = true
+	assert.Equal(t, &APIToken{Scope: ScopeRead, Created: 1000}, authWith(auth, sign(global)))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// API token scopes; each scope includes everything the ones before it allow.
+const (
+	ScopeRead  = "read"  // Read playback state, eg. for now-playing overlays
+	ScopeQueue = "queue" // Queue tracks
+	ScopeAdmin = "admin" // Control playback
+)
+
+var scopeRanks = map[string]int{ScopeRead: 1, ScopeQueue: 2, ScopeAdmin: 3}
+
+// An APIToken grants access to the HTTP API.
+type APIToken struct {
+	Scope   string `redis:"scope"`
+	GuildID string `redis:"guild"` // Guild the token is limited to, or "" for any guild
+	Created int64  `redis:"created"`
+}
+
+// Allows returns whether the token grants the given scope on the given guild.
+func (t APIToken) Allows(scope, gid string) bool {
+	if t.GuildID != "" && t.GuildID != gid {
+		return false
+	}
+	return scopeRanks[t.Scope] >= scopeRanks[scope]
+}
+
+// CreateAPIToken creates a token, returning its secret value.
+func CreateAPIToken(rconn redis.Conn, scope, gid string) (string, error) {
+	if scopeRanks[scope] == 0 {
+		return "", errors.New("unknown scope: " + scope)
+	}
+
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	hash := HashToken(token)
+	t := APIToken{Scope: scope, GuildID: gid, Created: time.Now().Unix()}
+	if _, err := rconn.Do("HMSET", redis.Args{}.Add(KeyForAPIToken(hash)).AddFlat(&t)...); err != nil {
+		return "", err
+	}
+
+	// Keep track of guilds' tokens, so they can be listed and revoked from chat.
+	if gid != "" {
+		if _, err := rconn.Do("SADD", KeyForServerAPITokens(gid), hash); err != nil {
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+// RevokeAPIToken deletes a token. Returns false if there was no such token.
+func RevokeAPIToken(rconn redis.Conn, token string) (bool, error) {
+	return revokeAPITokenHash(rconn, HashToken(token))
+}
+
+// APITokenID returns a short, non-secret identifier for a token, from its hash.
+func APITokenID(hash string) string {
+	return hash[:8]
+}
+
+// ListGuildAPITokens lists tokens limited to a guild, by hash.
+func ListGuildAPITokens(rconn redis.Conn, gid string) (map[string]APIToken, error) {
+	hashes, err := redis.Strings(rconn.Do("SMEMBERS", KeyForServerAPITokens(gid)))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := map[string]APIToken{}
+	for _, hash := range hashes {
+		values, err := redis.Values(rconn.Do("HGETALL", KeyForAPIToken(hash)))
+		if err != nil {
+			return nil, err
+		}
+		var t APIToken
+		if len(values) == 0 || redis.ScanStruct(values, &t) != nil {
+			continue
+		}
+		tokens[hash] = t
+	}
+	return tokens, nil
+}
+
+// ListAPITokens lists all tokens, including ones that aren't limited to a guild, by hash.
+func ListAPITokens(rconn redis.Conn) (map[string]APIToken, error) {
+	keys, err := scanKeys(rconn, KeyForAPIToken("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := map[string]APIToken{}
+	for _, key := range keys {
+		hash := strings.TrimPrefix(key, KeyForAPIToken(""))
+		t, err := lookupAPITokenHash(rconn, hash)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			tokens[hash] = *t
+		}
+	}
+	return tokens, nil
+}
+
+// FindAPITokenHash returns the hash of the token with an ID, or "" if there's no such token. IDs
+// are short, so this is an error if several tokens share it.
+func FindAPITokenHash(rconn redis.Conn, id string) (string, error) {
+	tokens, err := ListAPITokens(rconn)
+	if err != nil {
+		return "", err
+	}
+	found := ""
+	for hash := range tokens {
+		if APITokenID(hash) != id {
+			continue
+		}
+		if found != "" {
+			return "", errors.New("several tokens have the ID " + id)
+		}
+		found = hash
+	}
+	return found, nil
+}
+
+// RevokeGuildAPIToken revokes a guild's token by its ID. Returns false if there's no such token.
+func RevokeGuildAPIToken(rconn redis.Conn, gid, id string) (bool, error) {
+	hashes, err := redis.Strings(rconn.Do("SMEMBERS", KeyForServerAPITokens(gid)))
+	if err != nil {
+		return false, err
+	}
+	for _, hash := range hashes {
+		if APITokenID(hash) == id {
+			return revokeAPITokenHash(rconn, hash)
+		}
+	}
+	return false, nil
+}
+
+func revokeAPITokenHash(rconn redis.Conn, hash string) (bool, error) {
+	t, err := lookupAPITokenHash(rconn, hash)
+	if err != nil || t == nil {
+		return false, err
+	}
+	if t.GuildID != "" {
+		if _, err := rconn.Do("SREM", KeyForServerAPITokens(t.GuildID), hash); err != nil {
+			return false, err
+		}
+	}
+	n, err := redis.Int(rconn.Do("DEL", KeyForAPIToken(hash)))
+	return n > 0, err
+}
+
+// LookupAPIToken looks up a token, returning nil if there's no such token.
+func LookupAPIToken(rconn redis.Conn, token string) (*APIToken, error) {
+	return lookupAPITokenHash(rconn, HashToken(token))
+}
+
+func lookupAPITokenHash(rconn redis.Conn, hash string) (*APIToken, error) {
+	values, err := redis.Values(rconn.Do("HGETALL", KeyForAPIToken(hash)))
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	var t APIToken
+	if err := redis.ScanStruct(values, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
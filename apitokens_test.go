@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAPITokenAllows(t *testing.T) {
+	read := APIToken{Scope: ScopeRead}
+	assert.True(t, read.Allows(ScopeRead, "1"))
+	assert.False(t, read.Allows(ScopeQueue, "1"))
+
+	admin := APIToken{Scope: ScopeAdmin, GuildID: "1"}
+	assert.True(t, admin.Allows(ScopeQueue, "1"))
+	assert.False(t, admin.Allows(ScopeRead, "2"))
+}
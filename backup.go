@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// A Snapshot is a portable copy of everything hiqty keeps in Redis, for `hiqty backup` and
+// `hiqty restore`. Unlike an RDB file, it can be restored into any Redis version.
+type Snapshot struct {
+	Created       time.Time     `json:"created"`
+	SchemaVersion int           `json:"schema_version"`
+	Keys          []SnapshotKey `json:"keys"`
+}
+
+// A SnapshotKey is a single key in a Snapshot.
+type SnapshotKey struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`          // "string", "list", "hash" or "set"
+	TTL  int64  `json:"ttl,omitempty"` // Milliseconds left, if the key expires
+
+	String string            `json:"string,omitempty"`
+	List   []string          `json:"list,omitempty"`
+	Hash   map[string]string `json:"hash,omitempty"`
+	Set    []string          `json:"set,omitempty"`
+}
+
+// Player locks are held by running instances, and mean nothing anywhere else; neither do
+// notifications of past state changes.
+func isBackedUp(key string) bool {
+	return strings.HasPrefix(key, "hiqty:") && !strings.HasSuffix(key, ":player_lock") && key != KeyStateStream
+}
+
+// TakeSnapshot copies all keys, along with how long they have left if they expire.
+func TakeSnapshot(rconn redis.Conn) (*Snapshot, error) {
+	version, err := SchemaVersion(rconn)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := scanKeys(rconn, "hiqty:*")
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{Created: time.Now().UTC(), SchemaVersion: version, Keys: []SnapshotKey{}}
+	for _, key := range keys {
+		if !isBackedUp(key) {
+			continue
+		}
+		sk, err := snapshotKey(rconn, key)
+		if err != nil {
+			return nil, errors.Wrap(err, key)
+		}
+		if sk != nil {
+			snap.Keys = append(snap.Keys, *sk)
+		}
+	}
+	return snap, nil
+}
+
+// snapshotKey copies a single key, or returns nil if it's gone by now.
+func snapshotKey(rconn redis.Conn, key string) (*SnapshotKey, error) {
+	typ, err := redis.String(rconn.Do("TYPE", key))
+	if err != nil {
+		return nil, err
+	}
+	sk := &SnapshotKey{Key: key, Type: typ}
+	switch typ {
+	case "none":
+		return nil, nil
+	case "string":
+		sk.String, err = redis.String(rconn.Do("GET", key))
+	case "list":
+		sk.List, err = redis.Strings(rconn.Do("LRANGE", key, 0, -1))
+	case "hash":
+		sk.Hash, err = redis.StringMap(rconn.Do("HGETALL", key))
+	case "set":
+		sk.Set, err = redis.Strings(rconn.Do("SMEMBERS", key))
+	default:
+		return nil, errors.New("unsupported type: " + typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := redis.Int64(rconn.Do("PTTL", key))
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		sk.TTL = ttl
+	}
+	return sk, nil
+}
+
+// RestoreSnapshot writes a snapshot's keys, returning how many were written. Keys that already
+// exist are skipped, unless overwrite is set. Keys that have expired since the snapshot was taken
+// are restored with what they had left at the time.
+func RestoreSnapshot(rconn redis.Conn, snap *Snapshot, overwrite bool) (int, error) {
+	n := 0
+	for _, sk := range snap.Keys {
+		if !overwrite {
+			exists, err := redis.Bool(rconn.Do("EXISTS", sk.Key))
+			if err != nil {
+				return n, err
+			}
+			if exists {
+				continue
+			}
+		}
+
+		rconn.Send("MULTI")
+		rconn.Send("DEL", sk.Key)
+		switch sk.Type {
+		case "string":
+			rconn.Send("SET", sk.Key, sk.String)
+		case "list":
+			if len(sk.List) > 0 {
+				rconn.Send("RPUSH", redis.Args{}.Add(sk.Key).AddFlat(sk.List)...)
+			}
+		case "hash":
+			if len(sk.Hash) > 0 {
+				rconn.Send("HMSET", redis.Args{}.Add(sk.Key).AddFlat(sk.Hash)...)
+			}
+		case "set":
+			if len(sk.Set) > 0 {
+				rconn.Send("SADD", redis.Args{}.Add(sk.Key).AddFlat(sk.Set)...)
+			}
+		default:
+			rconn.Do("DISCARD")
+			return n, errors.Errorf("%s: unsupported type: %s", sk.Key, sk.Type)
+		}
+		if sk.TTL > 0 {
+			rconn.Send("PEXPIRE", sk.Key, sk.TTL)
+		}
+		if _, err := rconn.Do("EXEC"); err != nil {
+			return n, errors.Wrap(err, sk.Key)
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIsBackedUp(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"hiqty:server:123:playlist":          true,
+		"hiqty:server:123:settings":          true,
+		"hiqty:server:123:bot:456:state":     true,
+		"hiqty:schema_version":               true,
+		"hiqty:server:123:player_lock":       false,
+		"hiqty:server:123:bot:4:player_lock": false,
+		"other:key":                          false,
+	} {
+		assert.Equal(t, expected, isBackedUp(key), key)
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// A Bus carries notifications of changes to player states (see Queue.StateKey) to the
+// PlayerControllers of all instances.
+//
+// Redis keyspace events need no help from whoever changes a state, but managed Redis services
+// often don't allow enabling them; other buses need every change announced with Notify, which
+// SetQueueState takes care of.
+type Bus interface {
+	// Subscribe watches a key. Subscribing also sends an event, so the current state can be
+	// picked up.
+	Subscribe(key string)
+
+	// Unsubscribe undoes a previous Subscribe().
+	Unsubscribe(key string)
+
+	// Run returns a pipeline of subscribed keys that have changed, until the context expires.
+	Run(ctx context.Context) (<-chan string, error)
+
+	// Notify announces that a key has changed.
+	Notify(key string) error
+}
+
+// Available buses, for --bus.
+const (
+	BusKeyspace = "keyspace" // Redis keyspace events, falling back to polling
+	BusPoll     = "poll"     // Polling Redis
+	BusStreams  = "streams"  // A Redis stream
+	BusNATS     = "nats"     // A NATS subject
+)
+
+// The bus in use, which state changes are announced on; nil for none (eg. in tests).
+var stateBus Bus
+
+// SetQueueState sets a queue's player state, and announces the change on the bus.
+func SetQueueState(rconn redis.Conn, q Queue, state string) error {
+	if _, err := rconn.Do("SET", q.StateKey(), state); err != nil {
+		return err
+	}
+	return NotifyBus(q.StateKey())
+}
+
+// NotifyBus announces that a key has changed on the bus in use, if any.
+func NotifyBus(key string) error {
+	if stateBus == nil {
+		return nil
+	}
+	return stateBus.Notify(key)
+}
+
+// NewBus creates a bus by name.
+func NewBus(name string, pool *redis.Pool, db int, pollInterval time.Duration, natsURL string) (Bus, error) {
+	switch name {
+	case BusKeyspace, "":
+		return &KeyspaceBus{Pool: pool, DB: db, Fallback: &PollBus{Pool: pool, Interval: pollInterval}}, nil
+	case BusPoll:
+		return &PollBus{Pool: pool, Interval: pollInterval}, nil
+	case BusStreams:
+		return &StreamBus{Pool: pool}, nil
+	case BusNATS:
+		if natsURL == "" {
+			return nil, errors.New("the nats bus requires --nats-url")
+		}
+		return &NATSBus{URL: natsURL}, nil
+	}
+	return nil, errors.New("unknown bus: " + name)
+}
+
+// subscriptions tracks the keys a bus is subscribed to, for buses that have to filter events
+// themselves, and queues up an event for each new subscription.
+type subscriptions struct {
+	mutex   sync.Mutex
+	keys    map[string]bool
+	pending []string
+	signal  chan struct{}
+}
+
+func (s *subscriptions) init() {
+	if s.keys == nil {
+		s.keys = map[string]bool{}
+		s.signal = make(chan struct{}, 1)
+	}
+}
+
+func (s *subscriptions) add(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.init()
+	s.keys[key] = true
+	s.pending = append(s.pending, key)
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriptions) remove(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.init()
+	delete(s.keys, key)
+}
+
+func (s *subscriptions) has(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.keys[key]
+}
+
+func (s *subscriptions) list() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// newlySubscribed returns a channel that's signalled when keys are subscribed to; take them with
+// takePending.
+func (s *subscriptions) newlySubscribed() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.init()
+	return s.signal
+}
+
+func (s *subscriptions) takePending() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
+
+// forward runs a bus's event loop: sends keys from changes that are subscribed to, and an event
+// for each new subscription, until the context expires or changes is closed.
+func (s *subscriptions) forward(ctx context.Context, changes <-chan string) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+
+		send := func(key string) bool {
+			select {
+			case keys <- key:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		signal := s.newlySubscribed()
+		for {
+			for _, key := range s.takePending() {
+				if !send(key) {
+					return
+				}
+			}
+
+			select {
+			case key, ok := <-changes:
+				if !ok {
+					return
+				}
+				if s.has(key) && !send(key) {
+					return
+				}
+			case <-signal:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return keys
+}
+
+// A KeyspaceBus watches keys through Redis keyspace events, falling back to another bus if those
+// can't be enabled.
+type KeyspaceBus struct {
+	Pool     *redis.Pool
+	DB       int // The pool's database index
+	Fallback Bus
+
+	watcher    *Watcher
+	subscribed map[string]bool
+	fallen     bool
+	mutex      sync.Mutex
+}
+
+func (b *KeyspaceBus) Subscribe(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.fallen {
+		b.Fallback.Subscribe(key)
+		return
+	}
+	if b.subscribed == nil {
+		b.subscribed = map[string]bool{}
+	}
+	b.subscribed[key] = true
+	if b.watcher != nil {
+		b.watcher.Subscribe(b.DB, key)
+	}
+}
+
+func (b *KeyspaceBus) Unsubscribe(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.fallen {
+		b.Fallback.Unsubscribe(key)
+		return
+	}
+	delete(b.subscribed, key)
+	if b.watcher != nil {
+		b.watcher.Unsubscribe(b.DB, key)
+	}
+}
+
+// Run enables keyspace events and starts watching the keys subscribed to so far.
+//
+// If the connection drops, eg. because Redis restarted, it's reestablished with backoff, and every
+// key is subscribed to again. Subscriptions are confirmed with an event for each key, same as when
+// they're first made, so everything watched is rechecked for whatever changed in the meantime.
+func (b *KeyspaceBus) Run(ctx context.Context) (<-chan string, error) {
+	conn := b.Pool.Get()
+	if err := enableKeyspaceEvents(conn); err != nil {
+		conn.Close()
+		if b.Fallback == nil {
+			return nil, err
+		}
+		WatcherLog.WithError(err).Warn("Couldn't enable keyspace events; falling back")
+
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.fallen = true
+		for key := range b.subscribed {
+			b.Fallback.Subscribe(key)
+		}
+		return b.Fallback.Run(ctx)
+	}
+
+	keys := make(chan string)
+	go func() {
+		defer ReportPanic(WatcherLog, "KeyspaceBus", nil)
+		defer close(keys)
+
+		for {
+			b.watch(ctx, conn, keys)
+			if ctx.Err() != nil {
+				return
+			}
+
+			for backoff := WatcherReconnectMinBackoff; ; backoff *= 2 {
+				if backoff > WatcherReconnectMaxBackoff {
+					backoff = WatcherReconnectMaxBackoff
+				}
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+
+				// If Redis restarted, it's forgotten that keyspace events were enabled.
+				conn = b.Pool.Get()
+				err := enableKeyspaceEvents(conn)
+				if err == nil {
+					break
+				}
+				conn.Close()
+				WatcherLog.WithError(err).WithField("backoff", backoff).Error("[KeyspaceBus] Couldn't reconnect")
+			}
+			WatcherLog.Info("[KeyspaceBus] Reconnected")
+		}
+	}()
+	return keys, nil
+}
+
+// watch watches the subscribed keys on a connection, forwarding changes to keys until the context
+// expires or the connection fails, and closes it afterwards.
+func (b *KeyspaceBus) watch(ctx context.Context, conn redis.Conn, keys chan<- string) {
+	b.mutex.Lock()
+	watcher := &Watcher{redis.PubSubConn{Conn: conn}}
+	b.watcher = watcher
+	for key := range b.subscribed {
+		watcher.Subscribe(b.DB, key)
+	}
+	changes := watcher.Run(ctx)
+	b.mutex.Unlock()
+
+	// The watcher's still receiving on the connection, so rather than closing it from under it, it's
+	// unsubscribed from everything, and the connection's only closed once it's done.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			b.mutex.Lock()
+			watcher.Stop()
+			b.mutex.Unlock()
+		case <-stop:
+		}
+	}()
+
+	for key := range changes {
+		select {
+		case keys <- key:
+		case <-ctx.Done():
+		}
+	}
+	close(stop)
+	<-stopped
+
+	// Subscriptions made until the next connection is up are made on it when it is.
+	b.mutex.Lock()
+	b.watcher = nil
+	b.mutex.Unlock()
+	conn.Close()
+}
+
+func enableKeyspaceEvents(conn redis.Conn) error {
+	_, err := conn.Do("CONFIG", "SET", "notify-keyspace-events", "AKE")
+	return err
+}
+
+// Notify does nothing; Redis sends keyspace events by itself.
+func (b *KeyspaceBus) Notify(key string) error {
+	return nil
+}
+
+// A PollBus polls subscribed keys for changes. Keys are considered changed when first seen, same
+// as a keyspace event subscription is confirmed with an event.
+type PollBus struct {
+	Pool     *redis.Pool
+	Interval time.Duration // Defaults to 2s
+
+	subs subscriptions
+}
+
+func (b *PollBus) Subscribe(key string)   { b.subs.add(key) }
+func (b *PollBus) Unsubscribe(key string) { b.subs.remove(key) }
+
+// Notify does nothing; changes are picked up on the next poll.
+func (b *PollBus) Notify(key string) error {
+	return nil
+}
+
+func (b *PollBus) Run(ctx context.Context) (<-chan string, error) {
+	interval := b.Interval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		seen := map[string]string{}
+		for {
+			changed, err := b.pollKeys(b.subs.list(), seen)
+			if err != nil {
+				WatcherLog.WithError(err).Error("Couldn't poll states")
+			}
+			for _, key := range changed {
+				select {
+				case keys <- key:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return keys, nil
+}
+
+// pollKeys reads the given keys, returning the ones that have changed since they were last seen.
+// Keys that are no longer polled are forgotten.
+func (b *PollBus) pollKeys(keys []string, seen map[string]string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	rconn := b.Pool.Get()
+	defer rconn.Close()
+
+	values, err := redis.Strings(rconn.Do("MGET", redis.Args{}.AddFlat(keys)...))
+	if err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	polled := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		polled[key] = true
+		if old, ok := seen[key]; !ok || old != values[i] {
+			seen[key] = values[i]
+			changed = append(changed, key)
+		}
+	}
+	for key := range seen {
+		if !polled[key] {
+			delete(seen, key)
+		}
+	}
+	return changed, nil
+}
+
+// Approximate number of entries the state change stream is trimmed to.
+const stateStreamMaxLen = 10000
+
+// A StreamBus carries changes over a Redis stream (see KeyStateStream), which works on managed
+// Redis services that don't allow enabling keyspace events, without polling.
+type StreamBus struct {
+	Pool *redis.Pool
+
+	subs subscriptions
+}
+
+func (b *StreamBus) Subscribe(key string)   { b.subs.add(key) }
+func (b *StreamBus) Unsubscribe(key string) { b.subs.remove(key) }
+
+// Notify appends a change to the stream.
+func (b *StreamBus) Notify(key string) error {
+	rconn := b.Pool.Get()
+	defer rconn.Close()
+
+	_, err := rconn.Do("XADD", KeyStateStream, "MAXLEN", "~", stateStreamMaxLen, "*", "key", key)
+	return err
+}
+
+// Run reads changes from the stream, starting with the ones made from now on.
+func (b *StreamBus) Run(ctx context.Context) (<-chan string, error) {
+	conn := b.Pool.Get()
+	if _, err := conn.Do("PING"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	changes := make(chan string)
+	go func() {
+		defer ReportPanic(WatcherLog, "StreamBus", nil)
+		defer close(changes)
+		defer func() { conn.Close() }() // It's replaced after errors
+
+		lastID := "$"
+		for ctx.Err() == nil {
+			// Block for a while at a time, to notice the context expiring.
+			reply, err := conn.Do("XREAD", "BLOCK", 1000, "STREAMS", KeyStateStream, lastID)
+			if err != nil {
+				WatcherLog.WithError(err).Error("[StreamBus] Read failed")
+				conn.Close()
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+					return
+				}
+				conn = b.Pool.Get()
+				continue
+			}
+			entries, err := parseStreamReply(reply)
+			if err != nil {
+				WatcherLog.WithError(err).Error("[StreamBus] Couldn't parse entries")
+				continue
+			}
+			for _, e := range entries {
+				lastID = e.ID
+				select {
+				case changes <- e.Fields["key"]:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return b.subs.forward(ctx, changes), nil
+}
+
+// A streamEntry is an entry read from a Redis stream.
+type streamEntry struct {
+	ID     string
+	Fields map[string]string
+}
+
+// parseStreamReply parses the reply to an XREAD of a single stream; nil means it timed out.
+func parseStreamReply(reply interface{}) ([]streamEntry, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, errors.New("malformed stream")
+	}
+	items, err := redis.Values(stream[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(items))
+	for _, item := range items {
+		parts, err := redis.Values(item, nil)
+		if err != nil || len(parts) != 2 {
+			return nil, errors.New("malformed stream entry")
+		}
+		id, err := redis.String(parts[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := redis.StringMap(parts[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, streamEntry{ID: id, Fields: fields})
+	}
+	return entries, nil
+}
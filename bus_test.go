@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionsForward(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var subs subscriptions
+	subs.add("a")
+	changes := make(chan string)
+	keys := subs.forward(ctx, changes)
+
+	// Subscribing sends an event of its own; changes to other keys are ignored.
+	assert.Equal(t, "a", <-keys)
+	changes <- "b"
+	changes <- "a"
+	assert.Equal(t, "a", <-keys)
+
+	subs.add("b")
+	assert.Equal(t, "b", <-keys)
+	subs.remove("a")
+	changes <- "a"
+	changes <- "b"
+	assert.Equal(t, "b", <-keys)
+}
+
+func TestParseStreamReply(t *testing.T) {
+	entries, err := parseStreamReply(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	reply := []interface{}{
+		[]interface{}{[]byte(KeyStateStream), []interface{}{
+			[]interface{}{[]byte("1-0"), []interface{}{[]byte("key"), []byte("hiqty:server:1:state")}},
+			[]interface{}{[]byte("2-0"), []interface{}{[]byte("key"), []byte("hiqty:server:2:state")}},
+		}},
+	}
+	entries, err = parseStreamReply(reply)
+	assert.NoError(t, err)
+	assert.Equal(t, []streamEntry{
+		{ID: "1-0", Fields: map[string]string{"key": "hiqty:server:1:state"}},
+		{ID: "2-0", Fields: map[string]string{"key": "hiqty:server:2:state"}},
+	}, entries)
+}
+
+func TestNATSPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// A server that takes a login and a message, answering pings along the way.
+	received := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(`INFO {"max_payload":1048576}` + "\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			received <- line
+			if line == "PING" {
+				conn.Write([]byte("PONG\r\n"))
+			}
+		}
+	}()
+
+	bus := &NATSBus{URL: "nats://s3cret@" + l.Addr().String()}
+	defer bus.Close()
+	assert.NoError(t, bus.Notify("hiqty:server:1:state"))
+
+	connect := <-received
+	assert.True(t, strings.HasPrefix(connect, "CONNECT "), connect)
+	assert.Contains(t, connect, `"auth_token":"s3cret"`)
+	assert.Contains(t, connect, `"name":"hiqty"`)
+	assert.Equal(t, "PING", <-received)
+	assert.Equal(t, "PUB "+NATSSubject+" 20", <-received)
+	assert.Equal(t, "hiqty:server:1:state", <-received)
+	assert.Equal(t, "PING", <-received)
+}
+
+// readRESPCommand reads a command sent to a Redis server.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var l int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &l); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, l+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:l])
+	}
+	return args, nil
+}
+
+func TestKeyspaceBusReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// A server that confirms subscriptions and unsubscriptions, then hangs up on the first connection
+	// that made a subscription.
+	go func() {
+		for hangUp := true; ; {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, hangUp bool) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readRESPCommand(r)
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(args[0]) {
+					case "SUBSCRIBE":
+						fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+						if hangUp {
+							return
+						}
+					case "ECHO":
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(args[1]), args[1])
+					case "UNSUBSCRIBE":
+						fmt.Fprintf(conn, "*3\r\n$11\r\nunsubscribe\r\n$%d\r\n%s\r\n:0\r\n", len("hiqty:server:1:state"), "hiqty:server:1:state")
+					default:
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}(conn, hangUp)
+			hangUp = false
+		}
+	}()
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", l.Addr().String()) }}
+	defer pool.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := &KeyspaceBus{Pool: pool}
+	bus.Subscribe("hiqty:server:1:state")
+	keys, err := bus.Run(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The subscription is confirmed again after reconnecting.
+	for i := 0; i < 2; i++ {
+		select {
+		case key := <-keys:
+			assert.Equal(t, "hiqty:server:1:state", key)
+		case <-time.After(WatcherReconnectMinBackoff + 5*time.Second):
+			t.Fatal("no event")
+		}
+	}
+
+	// Stopping unsubscribes, rather than closing the connection from under the watcher.
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-keys:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("bus didn't stop")
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mvdan/xurls"
+	"github.com/sencrash/hiqty/media"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Longest soundboard clip that can be added.
+const MaxClipLength = 15 * time.Second
+
+// Most soundboard clips a guild can have.
+const MaxClips = 50
+
+// Most clips waiting to be played at once; any more are dropped.
+const MaxQueuedClips = 3
+
+// How long a clip waits to be played before it's dropped, eg. because the player's busy starting a
+// track; a clip played long after it was asked for is more annoying than useful.
+const ClipQueueExpiry = 15 * time.Second
+
+// How long someone has to wait between playing clips.
+const ClipCooldown = 5 * time.Second
+
+// What names of clips, stations and the like can look like.
+var namePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// AddClip adds a soundboard clip to a guild, replacing any with the same name.
+func AddClip(rconn redis.Conn, gid, name string, envelope TrackEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	_, err = rconn.Do("HSET", KeyForServerClips(gid), name, data)
+	return err
+}
+
+// RemoveClip removes one of a guild's soundboard clips, returning false if there's no such clip.
+func RemoveClip(rconn redis.Conn, gid, name string) (bool, error) {
+	return redis.Bool(rconn.Do("HDEL", KeyForServerClips(gid), name))
+}
+
+// Clips returns the names of a guild's soundboard clips, in alphabetical order.
+func Clips(rconn redis.Conn, gid string) ([]string, error) {
+	names, err := redis.Strings(rconn.Do("HKEYS", KeyForServerClips(gid)))
+	sort.Strings(names)
+	return names, err
+}
+
+// Clip returns one of a guild's soundboard clips, or nil if there's no such clip.
+func Clip(rconn redis.Conn, gid, name string) (*TrackEnvelope, error) {
+	data, err := redis.Bytes(rconn.Do("HGET", KeyForServerClips(gid), name))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var envelope TrackEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// QueueClip has a queue's Player play a clip as soon as it can, returning false if too many are
+// waiting already.
+func QueueClip(rconn redis.Conn, q Queue, name string) (bool, error) {
+	key := q.ClipQueueKey()
+	rconn.Send("MULTI")
+	rconn.Send("LLEN", key)
+	rconn.Send("RPUSH", key, name)
+	rconn.Send("LTRIM", key, 0, MaxQueuedClips-1)
+	rconn.Send("PEXPIRE", key, int64(ClipQueueExpiry/time.Millisecond))
+	replies, err := redis.Ints(rconn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	NotifyBus(key)
+	return replies[0] < MaxQueuedClips, nil
+}
+
+// TakeClip takes the next clip waiting to be played by a queue's Player, returning nil if there is
+// none. Clips that have been removed since they were queued are skipped.
+func TakeClip(rconn redis.Conn, q Queue) (*TrackEnvelope, error) {
+	for {
+		name, err := redis.String(rconn.Do("LPOP", q.ClipQueueKey()))
+		if err == redis.ErrNil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if envelope, err := Clip(rconn, q.GuildID, name); envelope != nil || err != nil {
+			return envelope, err
+		}
+	}
+}
+
+// activeChannel returns the voice channel a queue's Player is in, or "" if it isn't running.
+func (r *Responder) activeChannel(q Queue) (string, error) {
+	state, err := r.Store.State(q)
+	if err != nil || state == StateStopped || state == "" {
+		return "", err
+	}
+	return r.Store.Channel(q)
+}
+
+// clipCooldown returns whether a user has played a clip too recently to play another, and if not,
+// starts their cooldown.
+func clipCooldown(rconn redis.Conn, gid, uid string) (bool, error) {
+	reply, err := rconn.Do("SET", KeyForServer(gid, "clip_cooldown:"+uid), 1, "NX", "PX", int64(ClipCooldown/time.Millisecond))
+	return reply == nil && err == nil, err
+}
+
+// cmdClip lists, plays, adds or removes the guild's soundboard clips: short sounds that can be
+// played on command, holding the music for as long as they last.
+func cmdClip(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	if len(args) == 0 {
+		names, err := Clips(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't list clips")
+			return
+		}
+		if len(names) == 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, "There are no clips; add one with `clip add <name> <url>`.")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "Clips: `"+strings.Join(names, "`, `")+"`")
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		cmdClipAdd(r, rconn, msg, channel, args[1:])
+		return
+	case "remove":
+		if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+			r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to remove clips.")
+			return
+		}
+		if len(args) != 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, "Usage: `clip remove <name>`")
+			return
+		}
+		name := strings.ToLower(args[1])
+		ok, err := RemoveClip(rconn, channel.GuildID, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't remove clip")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no clip called `%s`.", name))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Removed clip `%s`.", name))
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	q := r.queue(channel.GuildID)
+	if envelope, err := Clip(rconn, channel.GuildID, name); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get clip")
+		return
+	} else if envelope == nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no clip called `%s`.", name))
+		return
+	}
+
+	// Clips play over whatever the bot is doing in voice, so only the people listening get to.
+	cid, err := r.activeChannel(q)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get active channel")
+		return
+	}
+	if cid == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, "I'm not in a voice channel right now.")
+		return
+	}
+	if r.voiceChannel(channel.GuildID, msg.Author.ID) != cid {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You must be in <#%s> to play clips.", cid))
+		return
+	}
+	if r.djLocked(rconn, q, msg.ChannelID, msg.Author.ID) {
+		return
+	}
+
+	if cooling, err := clipCooldown(rconn, channel.GuildID, msg.Author.ID); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't check clip cooldown")
+		return
+	} else if cooling {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You can only play a clip every %s.", ClipCooldown))
+		return
+	}
+	ok, err := QueueClip(rconn, q, name)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't queue clip")
+		return
+	}
+	if !ok {
+		r.reply(msg.ChannelID, msg.Author.ID, "There are too many clips waiting to play already.")
+	}
+}
+
+// cmdClipAdd adds a soundboard clip, from a link to a single track that's short enough.
+func cmdClipAdd(r *Responder, rconn redis.Conn, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to add clips.")
+		return
+	}
+	if len(args) != 2 || !xurls.Strict().MatchString(args[1]) {
+		r.reply(msg.ChannelID, msg.Author.ID, "Usage: `clip add <name> <url>`")
+		return
+	}
+	name, url := strings.ToLower(args[0]), strings.Trim(args[1], "<>")
+	if !namePattern.MatchString(name) || name == "add" || name == "remove" {
+		r.reply(msg.ChannelID, msg.Author.ID, "Clip names can only have letters, numbers, dashes and underscores, and can't be `add` or `remove`.")
+		return
+	}
+
+	names, err := Clips(rconn, channel.GuildID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't list clips")
+		return
+	}
+	if len(names) >= MaxClips && !containsString(names, name) {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There can only be %d clips; remove one first.", MaxClips))
+		return
+	}
+
+	tracks, err := ResolveURL(rconn, url)
+	if err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, friendlyError(err))
+		return
+	}
+	if len(tracks) != 1 || media.IsStub(tracks[0]) {
+		r.reply(msg.ChannelID, msg.Author.ID, "A clip has to be a link to a single track.")
+		return
+	}
+	track := tracks[0]
+	if length := track.GetInfo().Duration; length == 0 || length > MaxClipLength {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Clips can be %s long at most.", MaxClipLength))
+		return
+	}
+	if ok, reason := Playable(rconn, channel.GuildID, channel.NSFW, track); !ok {
+		r.reply(msg.ChannelID, msg.Author.ID, "Can't play that: "+reason)
+		return
+	}
+
+	envelope := TrackEnvelope{ServiceID: track.GetServiceID(), Track: track, URL: url, NSFW: channel.NSFW}
+	if err := AddClip(rconn, channel.GuildID, name, envelope); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't add clip")
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Added clip `%s`; play it with `clip %s`.", name, name))
+}
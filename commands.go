@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/sencrash/hiqty/media"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Command handles a chat command addressed to the bot, eg. "@hiqty settings".
+type Command func(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string)
+
+// Commands lists all available chat commands, by name.
+var Commands = map[string]Command{
+	"settings":   cmdSettings,
+	"services":   cmdServices,
+	"gain":       cmdGain,
+	"status":     cmdStatus,
+	"template":   cmdTemplate,
+	"owner":      cmdOwner,
+	"lock":       cmdLock,
+	"unlock":     cmdUnlock,
+	"schedule":   cmdSchedule,
+	"clip":       cmdClip,
+	"say":        cmdSay,
+	"station":    cmdStation,
+	"fav":        cmdFav,
+	"favs":       cmdFavs,
+	"myplaylist": cmdMyPlaylist,
+	"prefs":      cmdPrefs,
+	"similar":    cmdSimilar,
+	"search":     cmdSearch,
+	"stats":      cmdStats,
+	"filter":     cmdFilter,
+}
+
+// Bounds for per-track gain adjustments, in dB.
+const (
+	MinGain = -30.0
+	MaxGain = 20.0
+)
+
+// cmdSettings lists, shows or changes per-guild settings.
+func cmdSettings(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	// With no arguments, list all settings and their current values.
+	if len(args) == 0 {
+		lines := []string{}
+		for _, s := range Settings {
+			v, err := ReadSetting(rconn, channel.GuildID, s.Name)
+			if err != nil {
+				ResponderLog.WithError(err).Error("Couldn't read setting")
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("**%s**: `%s` - %s", s.Name, v, s.Description))
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "Settings:\n"+strings.Join(lines, "\n"))
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	if name == "apitoken" {
+		cmdSettingsAPIToken(r, msg, channel, args[1:])
+		return
+	}
+	if name == "webhook" {
+		cmdSettingsWebhook(r, msg, channel, args[1:])
+		return
+	}
+	if name == "statuspage" {
+		cmdSettingsStatusPage(r, msg, channel, args[1:])
+		return
+	}
+	if FindSetting(name) == nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no setting called `%s`.", name))
+		return
+	}
+
+	if len(args) == 1 {
+		v, err := ReadSetting(rconn, channel.GuildID, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't read setting")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s**: `%s`", name, v))
+		return
+	}
+
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to change settings.")
+		return
+	}
+
+	v, err := WriteSetting(rconn, channel.GuildID, name, strings.Join(args[1:], " "))
+	if err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Couldn't change `%s`: %s", name, err.Error()))
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s** is now `%s`.", name, v))
+}
+
+// cmdServices lists available services, and what they support.
+func cmdServices(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	if len(media.Services()) == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, "No services are available right now.")
+		return
+	}
+
+	lines := []string{}
+	for sid, svc := range media.Services() {
+		caps := svc.Capabilities().List()
+		if len(caps) == 0 {
+			caps = []string{"single tracks only"}
+		}
+		lines = append(lines, fmt.Sprintf("**%s**: %s", sid, strings.Join(caps, ", ")))
+	}
+	sort.Strings(lines)
+	r.reply(msg.ChannelID, msg.Author.ID, "Services:\n"+strings.Join(lines, "\n"))
+}
+
+// cmdStatus shows the health of each service.
+func cmdStatus(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	disabled, err := DisabledServices(rconn)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't read disabled services")
+	}
+
+	lines := []string{}
+	for sid := range media.Services() {
+		if disabled[sid] {
+			lines = append(lines, fmt.Sprintf("**%s**: disabled", sid))
+			continue
+		}
+		health, err := ReadServiceHealth(rconn, sid)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't read service health")
+			continue
+		}
+		line := fmt.Sprintf("**%s**: %s", sid, health.Status)
+		if health.Error != "" && health.Status != HealthOK {
+			line += fmt.Sprintf(" (`%s`)", health.Error)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	r.reply(msg.ChannelID, msg.Author.ID, "Service status:\n"+strings.Join(lines, "\n"))
+}
+
+// cmdSettingsAPIToken lets guild admins create, list and revoke API tokens for their guild.
+func cmdSettingsAPIToken(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to manage API tokens.")
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	usage := "Usage: `settings apitoken create [read|queue|admin]`, `settings apitoken list`, `settings apitoken revoke <id>`"
+	if len(args) == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "create":
+		scope := ScopeRead
+		if len(args) > 1 {
+			scope = strings.ToLower(args[1])
+		}
+		token, err := CreateAPIToken(rconn, scope, channel.GuildID)
+		if err != nil {
+			r.reply(msg.ChannelID, msg.Author.ID, "Couldn't create token: "+err.Error())
+			return
+		}
+
+		// Never post the token itself in a public channel.
+		dm, err := r.Session.UserChannelCreate(msg.Author.ID)
+		if err == nil {
+			_, err = r.Session.ChannelMessageSend(dm.ID, fmt.Sprintf("Your `%s` API token for **%s**: `%s`\nKeep it secret; it can't be shown again.", scope, channel.GuildID, token))
+		}
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't send token")
+			RevokeAPIToken(rconn, token)
+			r.reply(msg.ChannelID, msg.Author.ID, "Couldn't DM you the token; do you have DMs disabled?")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Created a `%s` token with ID `%s`; check your DMs.", scope, APITokenID(HashToken(token))))
+	case "list":
+		tokens, err := ListGuildAPITokens(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't list tokens")
+			return
+		}
+		if len(tokens) == 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, "This server has no API tokens.")
+			return
+		}
+		lines := []string{}
+		for hash, t := range tokens {
+			lines = append(lines, fmt.Sprintf("`%s`: %s", APITokenID(hash), t.Scope))
+		}
+		sort.Strings(lines)
+		r.reply(msg.ChannelID, msg.Author.ID, "API tokens:\n"+strings.Join(lines, "\n"))
+	case "revoke":
+		if len(args) < 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, usage)
+			return
+		}
+		ok, err := RevokeGuildAPIToken(rconn, channel.GuildID, args[1])
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't revoke token")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, "There's no token with that ID.")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "Token revoked.")
+	default:
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+	}
+}
+
+// cmdSettingsWebhook lets guild admins add, list and remove outgoing webhooks for their guild.
+func cmdSettingsWebhook(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to manage webhooks.")
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	usage := "Usage: `settings webhook add <url> [event...]`, `settings webhook list`, `settings webhook remove <id>`\nEvents: `" + strings.Join(EventTypes(), "`, `") + "`"
+	if len(args) == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if len(args) < 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, usage)
+			return
+		}
+		// Webhook URLs are often secrets themselves; don't leave them lying around in chat.
+		if err := r.Session.ChannelMessageDelete(msg.ChannelID, msg.ID); err != nil {
+			ResponderLog.WithError(err).Warn("Couldn't delete webhook message")
+		}
+
+		url := strings.Trim(args[1], "<>")
+		secret, err := NewToken()
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't generate webhook secret")
+			return
+		}
+		n := Notification{URL: url, Events: args[2:], Secret: secret}
+		if err := AddNotification(rconn, channel.GuildID, n); err != nil {
+			r.reply(msg.ChannelID, msg.Author.ID, "Couldn't add webhook: "+err.Error())
+			return
+		}
+
+		if !isDiscordWebhook(url) {
+			dm, err := r.Session.UserChannelCreate(msg.Author.ID)
+			if err == nil {
+				_, err = r.Session.ChannelMessageSend(dm.ID, fmt.Sprintf("Payloads sent to webhook `%s` in **%s** are signed with: `%s`", NotificationID(url), channel.GuildID, secret))
+			}
+			if err != nil {
+				ResponderLog.WithError(err).Warn("Couldn't send webhook secret")
+			}
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Added webhook `%s`.", NotificationID(url)))
+	case "list":
+		notifications, err := ListNotifications(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't list webhooks")
+			return
+		}
+		if len(notifications) == 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, "This server has no webhooks.")
+			return
+		}
+		lines := []string{}
+		for id, n := range notifications {
+			events := "all events"
+			if len(n.Events) > 0 {
+				events = strings.Join(n.Events, ", ")
+			}
+			host := n.URL
+			if u, err := neturl.Parse(n.URL); err == nil {
+				host = u.Host
+			}
+			lines = append(lines, fmt.Sprintf("`%s`: %s (%s)", id, host, events))
+		}
+		sort.Strings(lines)
+		r.reply(msg.ChannelID, msg.Author.ID, "Webhooks:\n"+strings.Join(lines, "\n"))
+	case "remove":
+		if len(args) < 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, usage)
+			return
+		}
+		ok, err := RemoveNotification(rconn, channel.GuildID, args[1])
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't remove webhook")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, "There's no webhook with that ID.")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "Webhook removed.")
+	default:
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+	}
+}
+
+// cmdGain adjusts the volume of a queued track, eg. "gain 2 -3dB". The currently playing track
+// (index 0) can't be changed, as it's already being encoded.
+func cmdGain(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	usage := "Usage: `gain <index> <adjustment>`, eg. `gain 1 -3dB`"
+	if len(args) != 2 {
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+		return
+	}
+	idx, err := strconv.Atoi(args[0])
+	if err != nil || idx < 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+		return
+	}
+	if idx == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, "Can't change the volume of a track that's already playing.")
+		return
+	}
+	gain, err := parseGain(args[1])
+	if err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, err.Error())
+		return
+	}
+
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionVoiceMuteMembers) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Mute Members permission to adjust track volume.")
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	q := r.queue(channel.GuildID)
+	if r.djLocked(rconn, q, msg.ChannelID, msg.Author.ID) {
+		return
+	}
+	ok, err := SetTrackGain(rconn, ActivePlaylistQueue(rconn, q), idx, gain)
+	if err != nil {
+		ResponderLog.WithError(err).WithField("gid", channel.GuildID).Error("Couldn't set track gain")
+		return
+	}
+	if !ok {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no track at position %d.", idx))
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Track %d will play at %+gdB.", idx, gain))
+}
+
+// parseGain parses a gain adjustment, eg. "-3dB", "+2.5db" or "0".
+func parseGain(s string) (float64, error) {
+	gain, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(s), "db"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("`%s` isn't a valid gain; try something like `-3dB`.", s)
+	}
+	if gain < MinGain || gain > MaxGain {
+		return 0, fmt.Errorf("Gain must be between %gdB and %+gdB.", MinGain, MaxGain)
+	}
+	return gain, nil
+}
+
+// cmdTemplate lists, shows, changes or resets the guild's message templates.
+func cmdTemplate(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	if len(args) == 0 {
+		names := []string{}
+		for name := range Templates {
+			names = append(names, "`"+name+"`")
+		}
+		sort.Strings(names)
+		r.reply(msg.ChannelID, msg.Author.ID, "Templates: "+strings.Join(names, ", ")+"\nUsage: `template <name>`, `template <name> <text>`, `template <name> reset`")
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	if _, ok := Templates[name]; !ok {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no template called `%s`.", name))
+		return
+	}
+
+	if len(args) == 1 {
+		text, err := ReadTemplate(rconn, channel.GuildID, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't read template")
+			return
+		}
+		if text == "" {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s** is empty.", name))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s**: ```%s```", name, text))
+		return
+	}
+
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to change templates.")
+		return
+	}
+
+	if len(args) == 2 && strings.ToLower(args[1]) == "reset" {
+		if err := ResetTemplate(rconn, channel.GuildID, name); err != nil {
+			ResponderLog.WithError(err).Error("Couldn't reset template")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s** has been reset.", name))
+		return
+	}
+
+	// Take the text verbatim from the message, rather than from the whitespace-split arguments.
+	text := msg.Content[strings.Index(msg.Content, args[0])+len(args[0]):]
+	if err := WriteTemplate(rconn, channel.GuildID, name, strings.TrimSpace(text)); err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Couldn't change `%s`: %s", name, err.Error()))
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s** has been changed.", name))
+}
+
+// cmdSettingsStatusPage shows, enables or disables a guild's public status page.
+func cmdSettingsStatusPage(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	if len(args) == 0 {
+		slug, err := StatusPageSlug(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't look up status page")
+			return
+		}
+		if slug == "" {
+			r.reply(msg.ChannelID, msg.Author.ID, "This server has no status page. Turn it on with `settings statuspage on`.")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "Status page: "+r.statusPageURL(slug))
+		return
+	}
+
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to change the status page.")
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+		slug, err := EnableStatusPage(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't enable status page")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "Anyone with this link can see what's playing: "+r.statusPageURL(slug)+"\nRun this again for a new link, if it's been shared too widely.")
+	case "off":
+		if err := DisableStatusPage(rconn, channel.GuildID); err != nil {
+			ResponderLog.WithError(err).Error("Couldn't disable status page")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "The status page is gone.")
+	default:
+		r.reply(msg.ChannelID, msg.Author.ID, "Usage: `settings statuspage`, `settings statuspage on|off`")
+	}
+}
+
+// statusPageURL returns the link to a status page; just its path, if the public URL isn't known.
+func (r *Responder) statusPageURL(slug string) string {
+	return strings.TrimRight(r.URL, "/") + "/status/" + slug
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseGain(t *testing.T) {
+	for s, gain := range map[string]float64{
+		"-3dB":   -3,
+		"+2.5db": 2.5,
+		"0":      0,
+		"-30":    -30,
+	} {
+		v, err := parseGain(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, gain, v, s)
+	}
+
+	for _, s := range []string{"", "loud", "-31dB", "+21dB", "3dBs"} {
+		_, err := parseGain(s)
+		assert.Error(t, err, s)
+	}
+}
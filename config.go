@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/urfave/cli.v2"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// A ConfigFile holds flag values loaded from a YAML config file (see --config), by flag name.
+//
+// Keys are flag names; nested sections are joined with dashes, so these are the same:
+//
+//	twitch-channel: example
+//	twitch:
+//	  channel: example
+//
+// Lists set repeatable flags, eg. linked-token or plugin. Flags given on the command line or in
+// the environment take precedence over the config file.
+type ConfigFile map[string][]string
+
+// LoadConfigFile loads a config file.
+func LoadConfigFile(path string) (ConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfigFile(data)
+}
+
+// ParseConfigFile parses the contents of a config file.
+func ParseConfigFile(data []byte) (ConfigFile, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	cfg := ConfigFile{}
+	if err := cfg.flatten("", doc); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg ConfigFile) flatten(prefix string, doc map[string]interface{}) error {
+	for key, v := range doc {
+		name := prefix + key
+		if _, ok := cfg[name]; ok {
+			return errors.Errorf("%s: set more than once", name)
+		}
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := cfg.flatten(name+"-", v); err != nil {
+				return err
+			}
+		case []interface{}:
+			for _, item := range v {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}:
+					return errors.Errorf("%s: lists can only contain plain values", name)
+				}
+				cfg[name] = append(cfg[name], fmt.Sprint(item))
+			}
+		case nil:
+		default:
+			cfg[name] = []string{fmt.Sprint(v)}
+		}
+	}
+	return nil
+}
+
+// Check returns an error if the file sets anything that isn't a flag of the app or its commands.
+func (cfg ConfigFile) Check(app *cli.App) error {
+	known := map[string]bool{}
+	addFlagNames(known, app.Flags)
+	addCommandFlagNames(known, app.Commands)
+
+	unknown := []string{}
+	for name := range cfg {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.New("unknown settings: " + strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Apply sets flags in a context from the config file, unless they've already been set.
+func (cfg ConfigFile) Apply(cc *cli.Context, flags []cli.Flag) error {
+	for _, f := range flags {
+		names := f.Names()
+		if cc.IsSet(names[0]) {
+			continue
+		}
+		for _, name := range names {
+			values, ok := cfg[name]
+			if !ok {
+				continue
+			}
+			for _, value := range values {
+				if err := cc.Set(names[0], value); err != nil {
+					return errors.Wrap(err, name)
+				}
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func addFlagNames(known map[string]bool, flags []cli.Flag) {
+	for _, f := range flags {
+		for _, name := range f.Names() {
+			known[name] = true
+		}
+	}
+}
+
+func addCommandFlagNames(known map[string]bool, cmds []*cli.Command) {
+	for _, cmd := range cmds {
+		addFlagNames(known, cmd.Flags)
+		addCommandFlagNames(known, cmd.Subcommands)
+	}
+}
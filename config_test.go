@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v2"
+	"testing"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	cfg, err := ParseConfigFile([]byte(`
+redis: redis://localhost/2
+http-retries: 3
+twitch:
+  channel: example
+  quota-window: 30m
+linked-token: [abc, def]
+plugin: []
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigFile{
+		"redis":               {"redis://localhost/2"},
+		"http-retries":        {"3"},
+		"twitch-channel":      {"example"},
+		"twitch-quota-window": {"30m"},
+		"linked-token":        {"abc", "def"},
+	}, cfg)
+
+	_, err = ParseConfigFile([]byte("twitch-channel: a\ntwitch:\n  channel: b\n"))
+	assert.EqualError(t, err, "twitch-channel: set more than once")
+}
+
+func TestConfigFileApply(t *testing.T) {
+	cfg := ConfigFile{
+		"redis":  {"redis://localhost/2"},
+		"t":      {"from-file"},
+		"plugin": {"http://a", "http://b"},
+		"bogus":  {"x"},
+	}
+
+	var redis, token string
+	var plugins []string
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "redis", Value: "127.0.0.1:6379"},
+			&cli.StringSliceFlag{Name: "plugin"},
+		},
+		Commands: []*cli.Command{
+			&cli.Command{
+				Name:  "run",
+				Flags: []cli.Flag{&cli.StringFlag{Name: "token", Aliases: []string{"t"}}},
+				Before: func(cc *cli.Context) error {
+					return cfg.Apply(cc, cc.Command.Flags)
+				},
+				Action: func(cc *cli.Context) error {
+					redis, token, plugins = cc.String("redis"), cc.String("token"), cc.StringSlice("plugin")
+					return nil
+				},
+			},
+		},
+		Before: func(cc *cli.Context) error {
+			return cfg.Apply(cc, cc.App.Flags)
+		},
+	}
+	assert.EqualError(t, cfg.Check(app), "unknown settings: bogus")
+
+	// Flags take precedence.
+	assert.NoError(t, app.Run([]string{"hiqty", "--plugin", "http://c", "run"}))
+	assert.Equal(t, "redis://localhost/2", redis)
+	assert.Equal(t, "from-file", token)
+	assert.Equal(t, []string{"http://c"}, plugins)
+}
@@ -4,13 +4,63 @@ import (
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"strings"
+	"time"
 )
 
 const (
 	StatePlaying = "playing"
+	StatePaused  = "paused" // The player stays in its channel, but holds the current track
 	StateStopped = "stopped"
 )
 
+// How long after posting a request a user can edit it to change what was queued.
+const MessageEditWindow = 5 * time.Minute
+
+// How long a player lock is held for without being extended; this is how long it takes for another
+// instance to take over a crashed one's players.
+const PlayerLockExpiry = 10 * time.Second
+
+// How often to retry spawning players that are locked by another instance.
+const PlayerLockRetryInterval = 3 * time.Second
+
+// How often a player rereads its queue regardless of being told it's changed (see Player.Wake), in
+// case a change went unannounced, eg. on a bus that doesn't carry playlist changes.
+const PlayerRecheckInterval = 30 * time.Second
+
+// How often a player checks on a voice connection that isn't ready yet, as discordgo doesn't
+// announce when it is.
+const VoiceReadyPollInterval = 250 * time.Millisecond
+
+// How long a player waits for a dropped voice connection to come back on its own, eg. after being
+// moved to another voice server, before it reconnects from scratch.
+const VoiceReconnectTimeout = 15 * time.Second
+
+// How long a player waits for a voice connection to take an Opus packet before taking it to have
+// dropped; discordgo stops taking them without saying so when its connection goes away.
+const OpusSendTimeout = time.Second
+
+// How often a player records how far into the playing track it is, so it can be resumed from about
+// there if the instance crashes or is redeployed.
+const ResumeCheckpointInterval = 5 * time.Second
+
+// How long the KeyspaceBus waits before reconnecting after its connection drops, at first and at
+// most; it doubles with each failed attempt.
+const (
+	WatcherReconnectMinBackoff = time.Second
+	WatcherReconnectMaxBackoff = 30 * time.Second
+)
+
+// Maximum number of URLs in a single message to resolve at the same time.
+const MaxConcurrentResolves = 4
+
+// Most tracks queued at once that are announced one by one; any more are summed up in a single
+// embed, listing this many of them.
+const MaxAnnouncedTracks = 5
+
+// Maximum length of each line summing up a playlist's skipped tracks, so the summary stays well
+// under Discord's limit on message length.
+const MaxSkippedSummaryLine = 300
+
 // Required permissions for the bot to function.
 const RequiredPermissions = discordgo.PermissionReadMessages | discordgo.PermissionSendMessages | discordgo.PermissionVoiceConnect | discordgo.PermissionVoiceSpeak | discordgo.PermissionVoiceUseVAD
 
@@ -26,9 +76,116 @@ func KeyForServerState(gid string) string { return KeyForServer(gid, "state") }
 // KeyForServerState returns the redis key for a server's active channel.
 func KeyForServerChannel(gid string) string { return KeyForServer(gid, "channel") }
 
+// KeyForServerBot returns the redis key for the given subkey of a linked bot's queue in a server.
+func KeyForServerBot(gid, bid, key string) string { return KeyForServer(gid, "bot:"+bid+":"+key) }
+
 // KeyForServerPlayerLock returns the redis key for a server's player lock.
 func KeyForServerPlayerLock(gid string) string { return KeyForServer(gid, "player_lock") }
 
+// KeyForServerSettings returns the redis key for a server's settings.
+func KeyForServerSettings(gid string) string { return KeyForServer(gid, "settings") }
+
+// KeyForServerTemplates returns the redis key for a server's message templates.
+func KeyForServerTemplates(gid string) string { return KeyForServer(gid, "templates") }
+
+// KeyForServerAPITokens returns the redis key for the set of API tokens limited to a server.
+func KeyForServerAPITokens(gid string) string { return KeyForServer(gid, "apitokens") }
+
+// KeyForServerNotifications returns the redis key for a server's outgoing webhooks.
+func KeyForServerNotifications(gid string) string { return KeyForServer(gid, "notifications") }
+
+// KeyForServerStatusPage returns the redis key for the slug of a server's public status page.
+func KeyForServerStatusPage(gid string) string { return KeyForServer(gid, "status_page") }
+
+// KeyForServerTwitchQuota returns the redis key for a Twitch viewer's request quota in a server.
+func KeyForServerTwitchQuota(gid, viewer string) string {
+	return KeyForServer(gid, "twitch_quota:"+strings.ToLower(viewer))
+}
+
+// KeyForServerClips returns the redis key for a server's soundboard clips.
+func KeyForServerClips(gid string) string { return KeyForServer(gid, "clips") }
+
+// KeyForServerSchedules returns the redis key for a server's scheduled playlists.
+func KeyForServerSchedules(gid string) string { return KeyForServer(gid, "schedules") }
+
+// KeyForServerStats returns the redis key for a server's listening statistics.
+func KeyForServerStats(gid string) string { return KeyForServer(gid, "stats") }
+
+// KeyForServerStatsTracks returns the redis key for how often each track has played in a server.
+func KeyForServerStatsTracks(gid string) string { return KeyForServer(gid, "stats:tracks") }
+
+// KeyForServerStatsRequesters returns the redis key for how many of each user's requests have
+// played in a server.
+func KeyForServerStatsRequesters(gid string) string { return KeyForServer(gid, "stats:requesters") }
+
+// KeyForServerFilters returns the redis key for a server's custom filter presets.
+func KeyForServerFilters(gid string) string { return KeyForServer(gid, "filters") }
+
+// KeyForServerStation returns the redis key for the name of the station a server is in.
+func KeyForServerStation(gid string) string { return KeyForServer(gid, "station") }
+
+// KeyForServerStationTrack returns the redis key for what a server's station is playing.
+func KeyForServerStationTrack(gid string) string { return KeyForServer(gid, "station_track") }
+
+// KeyForEvents returns the redis pub/sub channel for a server's playback events.
+func KeyForEvents(gid string) string { return "hiqty:events:" + gid }
+
+// KeyForUser returns the redis key for a user's given subkey; unlike a server's, these follow the
+// user across servers.
+func KeyForUser(uid, key string) string { return fmt.Sprintf("hiqty:user:%s:%s", uid, key) }
+
+// KeyForUserFavorites returns the redis key for a user's favorite tracks.
+func KeyForUserFavorites(uid string) string { return KeyForUser(uid, "favorites") }
+
+// KeyForUserPreferences returns the redis key for a user's preferences.
+func KeyForUserPreferences(uid string) string { return KeyForUser(uid, "preferences") }
+
+// KeyForUserPlaylists returns the redis key for the set of a user's personal playlists' names.
+func KeyForUserPlaylists(uid string) string { return KeyForUser(uid, "playlists") }
+
+// KeyForUserPlaylist returns the redis key for one of a user's personal playlists.
+func KeyForUserPlaylist(uid, name string) string { return KeyForUser(uid, "playlist:"+name) }
+
+// KeyForStation returns the redis key for a station, by its name.
+func KeyForStation(name string) string { return "hiqty:station:" + name }
+
+// KeyForStationGuilds returns the redis key for the set of servers in a station.
+func KeyForStationGuilds(name string) string { return KeyForStation(name) + ":guilds" }
+
+// KeyForWebhook returns the redis key for a webhook, by the hash of its token.
+func KeyForWebhook(hash string) string { return "hiqty:webhook:" + hash }
+
+// KeyForStatusPage returns the redis key for a public status page, by its slug.
+func KeyForStatusPage(slug string) string { return "hiqty:status_page:" + slug }
+
+// KeyForAPIToken returns the redis key for an API token, by the hash of the token.
+func KeyForAPIToken(hash string) string { return "hiqty:apitoken:" + hash }
+
+// KeyForDashboardSession returns the redis key for a dashboard login session, by the hash of its
+// cookie.
+func KeyForDashboardSession(hash string) string { return "hiqty:dashboard_session:" + hash }
+
+// KeyForServiceHealth returns the redis key for a service's last health check.
+func KeyForServiceHealth(sid string) string { return "hiqty:health:" + sid }
+
+// KeyForStats returns the redis key for a day's usage statistics.
+func KeyForStats(day time.Time) string { return "hiqty:stats:" + day.UTC().Format("2006-01-02") }
+
+// KeyForStatsGuilds returns the redis key for a day's recorded guild sizes.
+func KeyForStatsGuilds(day time.Time) string { return KeyForStats(day) + ":guilds" }
+
+// KeyDisabledServices is the redis key for the set of services the bot's owners have disabled.
+const KeyDisabledServices = "hiqty:disabled_services"
+
+// KeyStateStream is the redis key for the stream of player state changes, for the streams bus.
+const KeyStateStream = "hiqty:state_changes"
+
+// KeySchedules is the redis key for when every server's schedules run next.
+const KeySchedules = "hiqty:schedules"
+
+// KeySchemaVersion is the redis key for the schema version of the stored data.
+const KeySchemaVersion = "hiqty:schema_version"
+
 // TopicForKeyspaceEvent returns the topic for keyspace events on the given key.
 func TopicForKeyspaceEvent(db int, key string) string {
 	return fmt.Sprintf("__keyspace@%d__:%s", db, key)
@@ -0,0 +1,8 @@
+package main
+
+import "time"
+
+// Resource usage isn't available on Windows, so load tests can't report CPU time there.
+func cpuTime() (self, children time.Duration) {
+	return 0, 0
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Cron is a parsed cron expression, saying at which minutes something should happen.
+type Cron struct {
+	minute, hour, dom, month, dow uint64 // Bit sets of the values each field allows
+	anyDOM, anyDOW                bool   // Whether the day fields were left as "*"
+}
+
+var cronWeekdays = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+var cronMonths = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// ParseCron parses a standard five-field cron expression (minute, hour, day of month, month and day
+// of week), eg. "0 20 * * fri", or the friendlier "every friday 20:00". The latter takes a day, a
+// weekday (Monday to Friday), the weekend, or any of the days of the week separated by commas, eg.
+// "every sat,sun 12:30".
+func ParseCron(spec string) (Cron, error) {
+	fields := strings.Fields(strings.ToLower(spec))
+	if len(fields) == 3 && fields[0] == "every" {
+		return parseEvery(fields[1], fields[2])
+	}
+	if len(fields) != 5 {
+		return Cron{}, errors.New("expected a cron expression, eg. `0 20 * * fri`, or eg. `every friday 20:00`")
+	}
+
+	var c Cron
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return c, errors.Wrap(err, "minute")
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return c, errors.Wrap(err, "hour")
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return c, errors.Wrap(err, "day of month")
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return c, errors.Wrap(err, "month")
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return c, errors.Wrap(err, "day of week")
+	}
+
+	// Both 0 and 7 are Sunday.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.anyDOM = strings.HasPrefix(fields[2], "*")
+	c.anyDOW = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// parseEvery parses the friendly form of a cron expression; see ParseCron.
+func parseEvery(day, clock string) (Cron, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return Cron{}, errors.Errorf("expected a time of day, eg. 20:00, not `%s`", clock)
+	}
+
+	var dow string
+	switch day {
+	case "day":
+		dow = "*"
+	case "weekday":
+		dow = "1-5"
+	case "weekend":
+		dow = "sat,sun"
+	default:
+		days := strings.Split(day, ",")
+		for i, d := range days {
+			var n int
+			ok := len(d) >= 3
+			if ok {
+				n, ok = cronWeekdays[d[:3]]
+			}
+			if !ok || !strings.HasPrefix(strings.ToLower(time.Weekday(n).String()), d) {
+				return Cron{}, errors.Errorf("expected day, weekday, weekend or a day of the week, not `%s`", d)
+			}
+			days[i] = d[:3]
+		}
+		dow = strings.Join(days, ",")
+	}
+	return ParseCron(fmt.Sprintf("%d %d * * %s", t.Minute(), t.Hour(), dow))
+}
+
+// parseCronField parses a field of a cron expression: a comma-separated list of values, ranges
+// (eg. "1-5") or "*", each optionally with a step (eg. "*/15"). Values can also be given by name.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, errors.Errorf("invalid step: `%s`", part)
+			}
+			step, part = n, part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], min, max, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = parseCronValue(bounds[1], min, max, names); err != nil {
+					return 0, err
+				}
+			}
+			if hi < lo {
+				return 0, errors.Errorf("invalid range: `%s`", part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, min, max int, names map[string]int) (int, error) {
+	if v, ok := names[s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, errors.Errorf("expected a value from %d to %d, not `%s`", min, max, s)
+	}
+	return v, nil
+}
+
+// Next returns the first time after t that the expression matches, in t's location, or the zero
+// time if it doesn't match any within 5 years, eg. "0 0 30 2 *". Like the days of the month that
+// don't exist, clock times skipped by a DST transition are skipped.
+func (c Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	limit := t.AddDate(5, 0, 0)
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+
+	// Always make progress, even if a DST transition sends the clock back.
+	advance := func(next time.Time) {
+		if next.After(t) {
+			t = next
+		} else {
+			t = t.Add(time.Minute)
+		}
+	}
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			advance(time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+		case !c.matchesDay(t):
+			advance(time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			advance(time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc))
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			advance(t.Add(time.Minute))
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay returns whether the expression matches a day. Like in cron, if both the day of month
+// and the day of week are restricted, matching either is enough.
+func (c Cron) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyDOM && c.anyDOW:
+		return true
+	case c.anyDOM:
+		return dow
+	case c.anyDOW:
+		return dom
+	}
+	return dom || dow
+}
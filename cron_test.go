@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{"0 20 * * fri", "*/15 9-17 * * 1-5", "30 8 1,15 * *", "0 0 * jan,jul sun", "every day 8:30", "every Friday 20:00", "every sat,sun 12:00", "every weekday 07:00"} {
+		_, err := ParseCron(spec)
+		assert.NoError(t, err, spec)
+	}
+	for _, spec := range []string{"", "0 20 * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "every fri", "every fryday 20:00", "every fr 20:00", "every day 25:00"} {
+		_, err := ParseCron(spec)
+		assert.Error(t, err, spec)
+	}
+
+	friendly, _ := ParseCron("every friday 20:00")
+	cron, _ := ParseCron("0 20 * * 5")
+	assert.Equal(t, cron, friendly)
+
+	// 7 is Sunday, like 0.
+	sunday, _ := ParseCron("0 0 * * 7")
+	assert.True(t, sunday.matchesDay(time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestCronNext(t *testing.T) {
+	now := time.Date(2026, 10, 15, 21, 30, 15, 0, time.UTC) // A Thursday
+
+	for spec, next := range map[string]time.Time{
+		"0 20 * * fri":        time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC),
+		"every day 21:31":     time.Date(2026, 10, 15, 21, 31, 0, 0, time.UTC),
+		"every day 21:30":     time.Date(2026, 10, 16, 21, 30, 0, 0, time.UTC),
+		"*/15 * * * *":        time.Date(2026, 10, 15, 21, 45, 0, 0, time.UTC),
+		"0 9 * * 1-5":         time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC),
+		"0 12 1 * *":          time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":          time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		"every weekend 10:00": time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC),
+
+		// With both days restricted, either one matches.
+		"0 0 20 * mon": time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+	} {
+		cron, err := ParseCron(spec)
+		if assert.NoError(t, err, spec) {
+			assert.Equal(t, next, cron.Next(now), spec)
+		}
+	}
+
+	never, _ := ParseCron("0 0 30 2 *")
+	assert.True(t, never.Next(now).IsZero())
+}
+
+func TestCronNextDST(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip("No timezone database")
+	}
+
+	// Clocks go back from 03:00 to 02:00 on October 25th, 2026; 20:00 stays 20:00 local time.
+	cron, _ := ParseCron("every day 20:00")
+	next := cron.Next(time.Date(2026, 10, 24, 21, 0, 0, 0, oslo))
+	assert.Equal(t, time.Date(2026, 10, 25, 20, 0, 0, 0, oslo), next)
+	assert.Equal(t, 19, next.UTC().Hour())
+
+	// Clocks go forward from 02:00 to 03:00 on March 29th, 2026, so 02:30 doesn't happen that day.
+	cron, _ = ParseCron("every day 2:30")
+	next = cron.Next(time.Date(2026, 3, 28, 12, 0, 0, 0, oslo))
+	assert.Equal(t, time.Date(2026, 3, 30, 2, 30, 0, 0, oslo), next)
+}
+
+func TestScheduleMember(t *testing.T) {
+	gid, id := splitScheduleMember(scheduleMember("123", "abc123"))
+	assert.Equal(t, "123", gid)
+	assert.Equal(t, "abc123", id)
+}
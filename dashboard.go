@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a dashboard login lasts. Guild memberships and permissions are taken as they were at
+// login, so this shouldn't be too long.
+const dashboardSessionTTL = 24 * time.Hour
+
+// Cookies used by the dashboard.
+const (
+	dashboardSessionCookie = "hiqty_session"
+	dashboardStateCookie   = "hiqty_oauth_state"
+)
+
+// Discord's MANAGE_GUILD permission; users with it get to control playback from the dashboard.
+const permissionManageGuild = 0x20
+
+// The Dashboard is a small web UI for managing guilds' queues, served by the HTTPServer under
+// /dashboard/. Users log in with Discord, and can pick any guild they share with the bot.
+//
+// It's a client of the HTTP API like any other, authenticated by a session cookie; see
+// Authenticate. Everyone can view and queue tracks; members who can manage the server also get to
+// skip, remove and reorder them, and to start and stop playback.
+type Dashboard struct {
+	Pool         *redis.Pool
+	ClientID     string
+	ClientSecret string
+	URL          string // Public URL of the HTTP server, eg. https://hiqty.example.com
+
+	// Sessions of the bots whose guilds can be picked.
+	Sessions []*discordgo.Session
+
+	// Discord's API; can be overridden for tests.
+	Endpoint string
+	Client   http.Client
+}
+
+// A DashboardGuild is a guild that can be picked in the dashboard.
+type DashboardGuild struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Icon  string `json:"icon"`
+	Scope string `json:"scope"`
+}
+
+func (d *Dashboard) endpoint() string {
+	if d.Endpoint == "" {
+		return "https://discord.com/api"
+	}
+	return strings.TrimSuffix(d.Endpoint, "/")
+}
+
+func (d *Dashboard) redirectURI() string {
+	return strings.TrimSuffix(d.URL, "/") + "/dashboard/callback"
+}
+
+// ServeHTTP serves the dashboard and its login flow.
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch strings.TrimPrefix(req.URL.Path, "/dashboard/") {
+	case "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, dashboardHTML)
+	case "login":
+		d.login(w, req)
+	case "callback":
+		d.callback(w, req)
+	case "logout":
+		d.logout(w, req)
+	case "guilds":
+		d.guilds(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// login sends the user off to Discord to authorize the dashboard.
+func (d *Dashboard) login(w http.ResponseWriter, req *http.Request) {
+	state, err := NewToken()
+	if err != nil {
+		log.WithError(err).Error("Dashboard: Couldn't generate state")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// Lax, as the callback is a navigation from Discord.
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardStateCookie,
+		Value:    state,
+		Path:     "/dashboard/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(d.URL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := neturl.Values{}
+	q.Set("client_id", d.ClientID)
+	q.Set("redirect_uri", d.redirectURI())
+	q.Set("response_type", "code")
+	q.Set("scope", "identify guilds")
+	q.Set("state", state)
+	http.Redirect(w, req, d.endpoint()+"/oauth2/authorize?"+q.Encode(), http.StatusFound)
+}
+
+// callback finishes logging in, recording the guilds the user shares with the bot in a session.
+func (d *Dashboard) callback(w http.ResponseWriter, req *http.Request) {
+	state, err := req.Cookie(dashboardStateCookie)
+	if err != nil || state.Value == "" || req.FormValue("state") != state.Value {
+		http.Error(w, "invalid state; try logging in again", http.StatusBadRequest)
+		return
+	}
+	code := req.FormValue("code")
+	if code == "" {
+		http.Error(w, "authorization denied", http.StatusForbidden)
+		return
+	}
+
+	accessToken, err := d.exchange(code)
+	if err != nil {
+		log.WithError(err).Error("Dashboard: Couldn't exchange authorization code")
+		http.Error(w, "couldn't log in with Discord", http.StatusBadGateway)
+		return
+	}
+	var user discordgo.User
+	if err := d.get(accessToken, "/users/@me", &user); err != nil {
+		log.WithError(err).Error("Dashboard: Couldn't get user")
+		http.Error(w, "couldn't log in with Discord", http.StatusBadGateway)
+		return
+	}
+	var userGuilds []discordUserGuild
+	if err := d.get(accessToken, "/users/@me/guilds", &userGuilds); err != nil {
+		log.WithError(err).Error("Dashboard: Couldn't get user's guilds")
+		http.Error(w, "couldn't log in with Discord", http.StatusBadGateway)
+		return
+	}
+
+	token, err := NewToken()
+	if err != nil {
+		log.WithError(err).Error("Dashboard: Couldn't generate session")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	rconn := d.Pool.Get()
+	defer rconn.Close()
+	if err := d.createSession(rconn, HashToken(token), user.ID, userGuilds); err != nil {
+		log.WithError(err).Error("Dashboard: Couldn't create session")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: dashboardStateCookie, Path: "/dashboard/", MaxAge: -1})
+	// Strict, so other sites can't make requests with it; the API trusts it like a bearer token.
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardSessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(dashboardSessionTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(d.URL, "https://"),
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, req, "/dashboard/", http.StatusFound)
+}
+
+// createSession records a session, with the scope the user gets in each guild shared with the bot.
+func (d *Dashboard) createSession(rconn redis.Conn, hash, uid string, userGuilds []discordUserGuild) error {
+	key := KeyForDashboardSession(hash)
+	args := redis.Args{}.Add(key, "user", uid)
+	for _, g := range userGuilds {
+		if !d.botInGuild(g.ID) {
+			continue
+		}
+		data, err := json.Marshal(DashboardGuild{ID: g.ID, Name: g.Name, Icon: g.Icon, Scope: dashboardScope(g)})
+		if err != nil {
+			return err
+		}
+		args = args.Add("guild:"+g.ID, data)
+	}
+
+	rconn.Send("MULTI")
+	rconn.Send("HMSET", args...)
+	rconn.Send("EXPIRE", key, int(dashboardSessionTTL/time.Second))
+	_, err := rconn.Do("EXEC")
+	return err
+}
+
+// A discordUserGuild is a guild a user is in. Unlike discordgo.UserGuild, it copes with
+// permissions being sent as a string, as newer API versions do.
+type discordUserGuild struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Icon        string      `json:"icon"`
+	Owner       bool        `json:"owner"`
+	Permissions json.Number `json:"permissions"`
+}
+
+// dashboardScope returns the API scope a user gets in a guild.
+func dashboardScope(g discordUserGuild) string {
+	perms, _ := strconv.ParseInt(string(g.Permissions), 10, 64)
+	if g.Owner || perms&permissionManageGuild != 0 {
+		return ScopeAdmin
+	}
+	return ScopeQueue
+}
+
+// botInGuild returns whether any of the bots are in a guild.
+func (d *Dashboard) botInGuild(gid string) bool {
+	for _, s := range d.Sessions {
+		if _, err := s.State.Guild(gid); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// logout ends the user's session.
+func (d *Dashboard) logout(w http.ResponseWriter, req *http.Request) {
+	if c, err := req.Cookie(dashboardSessionCookie); err == nil && c.Value != "" {
+		rconn := d.Pool.Get()
+		defer rconn.Close()
+		if _, err := rconn.Do("DEL", KeyForDashboardSession(HashToken(c.Value))); err != nil {
+			log.WithError(err).Error("Dashboard: Couldn't delete session")
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: dashboardSessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, req, "/dashboard/", http.StatusFound)
+}
+
+// guilds lists the guilds the user can pick; 401 if they aren't logged in.
+func (d *Dashboard) guilds(w http.ResponseWriter, req *http.Request) {
+	c, err := req.Cookie(dashboardSessionCookie)
+	if err != nil || c.Value == "" {
+		writeError(w, http.StatusUnauthorized, "not logged in")
+		return
+	}
+
+	rconn := d.Pool.Get()
+	defer rconn.Close()
+	fields, err := redis.StringMap(rconn.Do("HGETALL", KeyForDashboardSession(HashToken(c.Value))))
+	if err != nil {
+		log.WithError(err).Error("Dashboard: Couldn't get session")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if len(fields) == 0 {
+		writeError(w, http.StatusUnauthorized, "not logged in")
+		return
+	}
+
+	guilds := []DashboardGuild{}
+	for field, data := range fields {
+		if !strings.HasPrefix(field, "guild:") {
+			continue
+		}
+		var g DashboardGuild
+		if err := json.Unmarshal([]byte(data), &g); err != nil {
+			continue
+		}
+		guilds = append(guilds, g)
+	}
+	writeJSON(w, http.StatusOK, guilds)
+}
+
+// Authenticate authenticates API requests made from the dashboard, by their session cookie, with
+// the scope the user has in the guild the request is for.
+func (d *Dashboard) Authenticate(rconn redis.Conn, req *http.Request) (*APIToken, error) {
+	c, err := req.Cookie(dashboardSessionCookie)
+	if err != nil || c.Value == "" {
+		return nil, nil
+	}
+	gid := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/api/guilds/"), "/", 2)[0]
+	data, err := redis.Bytes(rconn.Do("HGET", KeyForDashboardSession(HashToken(c.Value)), "guild:"+gid))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var g DashboardGuild
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, nil
+	}
+	return &APIToken{Scope: g.Scope, GuildID: gid}, nil
+}
+
+// exchange exchanges an authorization code for an access token.
+func (d *Dashboard) exchange(code string) (string, error) {
+	form := neturl.Values{}
+	form.Set("client_id", d.ClientID)
+	form.Set("client_secret", d.ClientSecret)
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", d.redirectURI())
+
+	res, err := d.Client.PostForm(d.endpoint()+"/oauth2/token", form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token exchange: %s", res.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.AccessToken, nil
+}
+
+// get gets something from Discord's API on behalf of the user.
+func (d *Dashboard) get(accessToken, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", d.endpoint()+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
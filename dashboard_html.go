@@ -0,0 +1,157 @@
+package main
+
+// dashboardHTML is the dashboard's single page. It talks to the HTTP API with the session cookie,
+// and refreshes whenever the guild's event stream says something happened.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>hiqty</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; }
+header { display: flex; justify-content: space-between; align-items: center; }
+ol { padding-left: 1.5em; }
+li { margin: 0.25em 0; }
+li.playing { font-weight: bold; }
+li button { margin-left: 0.25em; }
+.hidden { display: none; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<header>
+  <h1>hiqty</h1>
+  <span><select id="guild"></select> <a href="/dashboard/logout">Log out</a></span>
+</header>
+<p id="login" class="hidden"><a href="/dashboard/login">Log in with Discord</a></p>
+<p id="error" class="error"></p>
+<main id="main" class="hidden">
+  <p>
+    <span id="state"></span>
+    <button id="play" class="admin">Play</button>
+    <button id="pause" class="admin">Pause</button>
+    <button id="stop" class="admin">Stop</button>
+    <button id="skip" class="admin">Skip</button>
+  </p>
+  <form id="queue-form">
+    <input id="url" type="url" placeholder="Track or playlist URL" size="40" required>
+    <button>Queue</button>
+  </form>
+  <p><input id="search" type="search" placeholder="Search the queue"></p>
+  <ol id="queue" start="0"></ol>
+</main>
+<script>
+var guilds = {}, gid = null, events = null;
+
+function api(method, endpoint, body) {
+  return fetch("/api/guilds/" + gid + "/" + endpoint, {
+    method: method,
+    credentials: "same-origin",
+    headers: body ? {"Content-Type": "application/json"} : {},
+    body: body ? JSON.stringify(body) : undefined
+  }).then(function (res) {
+    return res.json().then(function (data) {
+      if (!res.ok) { throw new Error(data.error || res.statusText); }
+      return data;
+    });
+  });
+}
+
+function showError(err) { document.getElementById("error").textContent = err ? err.message : ""; }
+
+function isAdmin() { return guilds[gid] && guilds[gid].scope === "admin"; }
+
+function refresh() {
+  Promise.all([api("GET", "state"), api("GET", "queue")]).then(function (r) {
+    document.getElementById("state").textContent = {playing: "Playing", paused: "Paused"}[r[0].state] || "Stopped";
+    render(r[1].playing, r[1].tracks);
+    showError(null);
+  }).catch(showError);
+}
+
+function render(playing, tracks) {
+  var list = document.getElementById("queue");
+  var search = document.getElementById("search").value.toLowerCase();
+  list.innerHTML = "";
+  // Index 0 is the playing track; the queued ones start at 1.
+  var entries = tracks.map(function (t, i) { return {track: t, index: i + 1}; });
+  if (playing) { entries.unshift({track: playing, index: 0}); }
+  entries.forEach(function (e) {
+    var t = e.track, i = e.index;
+    var text = (t.artist ? t.artist + " - " : "") + t.title;
+    var li = document.createElement("li");
+    li.value = i;
+    if (i === 0) { li.className = "playing"; }
+    if (search && text.toLowerCase().indexOf(search) === -1) { li.classList.add("hidden"); }
+    var a = document.createElement("a");
+    a.href = t.url;
+    a.textContent = text;
+    li.appendChild(a);
+    if (i > 0 && isAdmin()) {
+      li.appendChild(button("↑", i > 1, function () { return api("POST", "move", {from: i, to: i - 1}); }));
+      li.appendChild(button("↓", i < tracks.length, function () { return api("POST", "move", {from: i, to: i + 1}); }));
+      li.appendChild(button("Remove", true, function () { return api("DELETE", "queue", {index: i}); }));
+    }
+    list.appendChild(li);
+  });
+}
+
+function button(label, enabled, action) {
+  var b = document.createElement("button");
+  b.textContent = label;
+  b.disabled = !enabled;
+  b.onclick = function () { action().then(refresh).catch(showError); };
+  return b;
+}
+
+function selectGuild(id) {
+  gid = id;
+  localStorage.setItem("hiqty.guild", id);
+  document.querySelectorAll(".admin").forEach(function (el) { el.classList.toggle("hidden", !isAdmin()); });
+  if (events) { events.close(); }
+  var proto = location.protocol === "https:" ? "wss://" : "ws://";
+  events = new WebSocket(proto + location.host + "/api/guilds/" + gid + "/events");
+  events.onmessage = refresh;
+  refresh();
+}
+
+document.getElementById("guild").onchange = function (e) { selectGuild(e.target.value); };
+document.getElementById("search").oninput = refresh;
+document.getElementById("play").onclick = function () { api("PUT", "state", {state: "playing"}).then(refresh).catch(showError); };
+document.getElementById("pause").onclick = function () { api("PUT", "state", {state: "paused"}).then(refresh).catch(showError); };
+document.getElementById("stop").onclick = function () { api("PUT", "state", {state: "stopped"}).then(refresh).catch(showError); };
+document.getElementById("skip").onclick = function () { api("POST", "skip").then(refresh).catch(showError); };
+document.getElementById("queue-form").onsubmit = function (e) {
+  e.preventDefault();
+  var url = document.getElementById("url");
+  api("POST", "queue", {url: url.value, requester: "Dashboard"}).then(function () { url.value = ""; refresh(); }).catch(showError);
+};
+
+fetch("/dashboard/guilds", {credentials: "same-origin"}).then(function (res) {
+  if (res.status === 401) {
+    document.getElementById("login").classList.remove("hidden");
+    document.querySelector("header span").classList.add("hidden");
+    return;
+  }
+  return res.json().then(function (list) {
+    var select = document.getElementById("guild");
+    list.sort(function (a, b) { return a.name.localeCompare(b.name); });
+    list.forEach(function (g) {
+      guilds[g.id] = g;
+      var opt = document.createElement("option");
+      opt.value = g.id;
+      opt.textContent = g.name;
+      select.appendChild(opt);
+    });
+    if (!list.length) { showError(new Error("You don't share any servers with the bot.")); return; }
+    var last = localStorage.getItem("hiqty.guild");
+    select.value = guilds[last] ? last : list[0].id;
+    document.getElementById("main").classList.remove("hidden");
+    selectGuild(select.value);
+  });
+}).catch(showError);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+)
+
+func TestDashboardScope(t *testing.T) {
+	assert.Equal(t, ScopeQueue, dashboardScope(discordUserGuild{Permissions: "104324161"}))
+	assert.Equal(t, ScopeAdmin, dashboardScope(discordUserGuild{Permissions: "32"}))
+	assert.Equal(t, ScopeAdmin, dashboardScope(discordUserGuild{Owner: true}))
+}
+
+func TestDashboardLogin(t *testing.T) {
+	d := &Dashboard{ClientID: "1234", URL: "https://hiqty.example.com/"}
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard/login", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	u, err := neturl.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "discord.com", u.Host)
+	assert.Equal(t, "1234", u.Query().Get("client_id"))
+	assert.Equal(t, "https://hiqty.example.com/dashboard/callback", u.Query().Get("redirect_uri"))
+
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, dashboardStateCookie, cookies[0].Name)
+		assert.Equal(t, cookies[0].Value, u.Query().Get("state"))
+	}
+}
+
+func TestDashboardCallbackState(t *testing.T) {
+	d := &Dashboard{ClientID: "1234", URL: "https://hiqty.example.com"}
+	req := httptest.NewRequest("GET", "/dashboard/callback?state=forged&code=abc", nil)
+	req.AddCookie(&http.Cookie{Name: dashboardStateCookie, Value: "real"})
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// How many dead letters are kept per queue; the oldest ones are dropped past that.
+const MaxDeadLetters = 100
+
+// A DeadLetter is an envelope that couldn't be decoded when its turn came up, eg. because its
+// service was disabled or a plugin was missing. Rather than being dropped, it's set aside along
+// with why, so it can be requeued with `hiqty deadletters --requeue` once that's fixed.
+type DeadLetter struct {
+	Envelope string    `json:"envelope"` // As it was stored, as it may not even be valid JSON
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// NewDeadLetter creates a dead letter for an envelope that failed to decode.
+func NewDeadLetter(data []byte, err error) DeadLetter {
+	return DeadLetter{Envelope: string(data), Error: err.Error(), Time: time.Now().UTC()}
+}
+
+// AddDeadLetter sets an envelope aside in a queue's dead letters.
+func AddDeadLetter(rconn redis.Conn, q Queue, dl DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	rconn.Send("MULTI")
+	rconn.Send("LPUSH", q.DeadLetterKey(), data)
+	rconn.Send("LTRIM", q.DeadLetterKey(), 0, MaxDeadLetters-1)
+	_, err = rconn.Do("EXEC")
+	return err
+}
+
+// DeadLetters returns a queue's dead letters, newest first.
+func DeadLetters(rconn redis.Conn, q Queue) ([]DeadLetter, error) {
+	datas, err := redis.ByteSlices(rconn.Do("LRANGE", q.DeadLetterKey(), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	dls := make([]DeadLetter, 0, len(datas))
+	for _, data := range datas {
+		var dl DeadLetter
+		if err := json.Unmarshal(data, &dl); err != nil {
+			return nil, err
+		}
+		dls = append(dls, dl)
+	}
+	return dls, nil
+}
+
+// RequeueDeadLetters puts a queue's dead letters that can be decoded now back at the end of its
+// active playlist, oldest first, returning how many were requeued. Ones that still can't be decoded
+// are left where they are.
+func RequeueDeadLetters(rconn redis.Conn, q Queue) (int, error) {
+	datas, err := redis.ByteSlices(rconn.Do("LRANGE", q.DeadLetterKey(), 0, -1))
+	if err != nil {
+		return 0, err
+	}
+
+	pq := ActivePlaylistQueue(rconn, q)
+	n := 0
+	for i := len(datas) - 1; i >= 0; i-- {
+		var dl DeadLetter
+		if err := json.Unmarshal(datas[i], &dl); err != nil {
+			continue
+		}
+		var envelope TrackEnvelope
+		if err := json.Unmarshal([]byte(dl.Envelope), &envelope); err != nil {
+			continue
+		}
+
+		// Take it off first, so it can't end up queued twice if two requeues race.
+		removed, err := redis.Int(rconn.Do("LREM", q.DeadLetterKey(), 1, datas[i]))
+		if err != nil {
+			return n, err
+		}
+		if removed == 0 {
+			continue
+		}
+		if err := pushEnvelopes(rconn, pq, envelope); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
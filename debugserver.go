@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// The DebugServer subsystem serves Go's profiling endpoints, for diagnosing eg. goroutine leaks on a
+// live instance. Anyone who can reach it can see a lot about the process, so it should only ever
+// listen on an internal address.
+type DebugServer struct {
+	Addr string
+}
+
+// Run runs the debug server until the context expires.
+func (s *DebugServer) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{Addr: s.Addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.WithError(err).Warn("DebugServer: Couldn't shut down cleanly")
+		}
+	}()
+
+	log.WithField("addr", s.Addr).Info("DebugServer: Listening")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("DebugServer: Couldn't listen")
+	}
+}
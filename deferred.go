@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// How long a request from someone who isn't in a voice channel is held for, with the
+// wait-for-voice setting on.
+const DeferredRequestTimeout = 2 * time.Minute
+
+// A DeferredRequest is a request held until its poster joins a voice channel.
+type DeferredRequest struct {
+	MessageID string    `json:"message"`
+	ChannelID string    `json:"channel"` // The text channel it was posted in
+	NSFW      bool      `json:"nsfw"`
+	URLs      []string  `json:"urls"`
+	Received  time.Time `json:"received"`
+}
+
+// DeferRequest holds a user's request until they join a voice channel, for up to a timeout. It
+// replaces any request they already had held.
+func DeferRequest(rconn redis.Conn, q Queue, uid string, req DeferredRequest, timeout time.Duration) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = rconn.Do("SET", q.DeferredKey(uid), data, "PX", int64(timeout/time.Millisecond))
+	return err
+}
+
+// TakeDeferredRequest returns and forgets a user's held request, or nil if they have none. It's
+// atomic, so a request is only ever taken once, by one instance.
+func TakeDeferredRequest(rconn redis.Conn, q Queue, uid string) (*DeferredRequest, error) {
+	key := q.DeferredKey(uid)
+	rconn.Send("MULTI")
+	rconn.Send("GET", key)
+	rconn.Send("DEL", key)
+	replies, err := redis.Values(rconn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+	data, err := redis.Bytes(replies[0], nil)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var req DeferredRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// How long a DJ lock lasts at most, in case it's never released otherwise.
+const DJLockExpiry = 6 * time.Hour
+
+// DJLock returns the user who holds a queue's DJ lock, or "" if nobody does.
+func DJLock(rconn redis.Conn, q Queue) (string, error) {
+	uid, err := redis.String(rconn.Do("GET", q.DJLockKey()))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return uid, err
+}
+
+// LockDJ gives a user a queue's DJ lock, or renews theirs. Returns who holds it, which is someone
+// else if they already did.
+func LockDJ(rconn redis.Conn, q Queue, uid string) (string, error) {
+	key := q.DJLockKey()
+	expiry := int64(DJLockExpiry / time.Millisecond)
+	if _, err := redis.String(rconn.Do("SET", key, uid, "NX", "PX", expiry)); err != redis.ErrNil {
+		return uid, err
+	}
+
+	holder, err := DJLock(rconn, q)
+	if err != nil || holder != uid {
+		return holder, err
+	}
+	_, err = rconn.Do("PEXPIRE", key, expiry)
+	return uid, err
+}
+
+// UnlockDJ releases a queue's DJ lock if it's held by the given user, or by anyone if uid is "".
+// Returns whether it was released.
+func UnlockDJ(rconn redis.Conn, q Queue, uid string) (bool, error) {
+	key := q.DJLockKey()
+	if _, err := rconn.Do("WATCH", key); err != nil {
+		return false, err
+	}
+	holder, err := DJLock(rconn, q)
+	if err != nil || holder == "" || (uid != "" && holder != uid) {
+		rconn.Do("UNWATCH")
+		return false, err
+	}
+
+	rconn.Send("MULTI")
+	rconn.Send("DEL", key)
+	reply, err := rconn.Do("EXEC")
+	return reply != nil, err
+}
+
+// djLocked returns whether the queue is locked by a DJ other than the given user, and if so, tells
+// them so. If the lock can't be checked, the queue is considered unlocked.
+func (r *Responder) djLocked(rconn redis.Conn, q Queue, cid, uid string) bool {
+	holder, err := DJLock(rconn, q)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't check DJ lock")
+		return false
+	}
+	if holder == "" || holder == uid {
+		return false
+	}
+	r.reply(cid, uid, fmt.Sprintf("<@!%s> has the queue locked; only they can change it until they unlock it or leave voice.", holder))
+	return true
+}
+
+// releaseDJ releases the DJ lock of a user who's left the voice channel the bot is active in.
+func (r *Responder) releaseDJ(rconn redis.Conn, gid, uid, vcid string) {
+	q := r.queue(gid)
+	holder, err := DJLock(rconn, q)
+	if err != nil || holder != uid {
+		return
+	}
+	cid, err := r.Store.Channel(q)
+	if err != nil || vcid != "" && (cid == "" || vcid == cid) {
+		return
+	}
+	if ok, err := UnlockDJ(rconn, q, uid); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't release DJ lock")
+	} else if ok {
+		ResponderLog.WithFields(log.Fields{"gid": gid, "uid": uid}).Info("DJ left voice; released lock")
+	}
+}
+
+// voiceChannel returns the voice channel a user is in, or "" if they're not in one, or it's unknown.
+func (r *Responder) voiceChannel(gid, uid string) string {
+	guild, err := r.Session.State.Guild(gid)
+	if err != nil {
+		return ""
+	}
+	r.Session.State.RLock()
+	defer r.Session.State.RUnlock()
+	for _, vs := range guild.VoiceStates {
+		if vs.UserID == uid {
+			return vs.ChannelID
+		}
+	}
+	return ""
+}
+
+// cmdLock lets someone in the voice channel the bot's playing in claim exclusive control of the
+// queue, eg. for a curated listening session; everyone else can still see what's queued. The lock
+// is released when they leave the channel, or use unlock.
+func cmdLock(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionVoiceMuteMembers) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Mute Members permission to lock the queue.")
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	q := r.queue(channel.GuildID)
+	vcid := r.voiceChannel(channel.GuildID, msg.Author.ID)
+	if vcid == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, "You must be in a voice channel to lock the queue.")
+		return
+	}
+	if cid, err := r.Store.Channel(q); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get active channel")
+		return
+	} else if cid != "" && cid != vcid {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You must be in <#%s> to lock the queue.", cid))
+		return
+	}
+
+	holder, err := LockDJ(rconn, q, msg.Author.ID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't take DJ lock")
+		return
+	}
+	if holder != msg.Author.ID {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("<@!%s> already has the queue locked.", holder))
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, "The queue is yours; nobody else can change it until you unlock it or leave voice.")
+}
+
+// cmdUnlock releases the DJ lock; anyone with the Manage Server permission can release someone
+// else's.
+func cmdUnlock(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	q := r.queue(channel.GuildID)
+	uid := msg.Author.ID
+	if r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		uid = ""
+	}
+	ok, err := UnlockDJ(rconn, q, uid)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't release DJ lock")
+		return
+	}
+	if !ok && uid == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, "Nobody has the queue locked.")
+		return
+	}
+	if !ok {
+		r.reply(msg.ChannelID, msg.Author.ID, "You don't have the queue locked.")
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, "The queue is unlocked.")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default bitrate to encode audio at, in bits per second, if the channel's is unknown.
+const DefaultBitrate = 64000
+
+// Duration of each Opus packet the encoder produces.
+const FrameDuration = 20 * time.Millisecond
+
+// EncodeOptions configures how a track is encoded for a voice channel.
+type EncodeOptions struct {
+	Bitrate   int           // Target bitrate, in bits per second
+	Gain      float64       // Volume adjustment, in dB
+	Seek      time.Duration // How far into the track to start, eg. to resume an interrupted one
+	Normalize bool          // Whether to even out loudness; see NormalizeFilter
+	Effects   string        // Any other ffmpeg filters to apply, eg. from a filter preset
+
+	// Fade the track in at its start, and out at its end, if its length is known. When the encoder
+	// is restarted partway through, Position is how far into the track the new one starts from, so
+	// fades are timed from there.
+	Fade     time.Duration
+	Length   time.Duration
+	Position time.Duration
+}
+
+// Filters returns the ffmpeg audio filter chain for the options, or "" if there's nothing to do.
+func (o EncodeOptions) Filters() string {
+	filters := []string{}
+	if o.Effects != "" {
+		filters = append(filters, o.Effects)
+	}
+	if o.Gain != 0 {
+		filters = append(filters, fmt.Sprintf("volume=%sdB", strconv.FormatFloat(o.Gain, 'f', -1, 64)))
+	}
+	if o.Normalize {
+		filters = append(filters, NormalizeFilter)
+	}
+	if o.Fade > 0 {
+		// Timestamps start over from 0 wherever the input does.
+		start := o.Seek + o.Position
+		if start == 0 {
+			filters = append(filters, "afade=t=in:d="+formatSeconds(o.Fade))
+		}
+		if out := o.Length - o.Fade - start; o.Length > 0 && out >= 0 {
+			filters = append(filters, "afade=t=out:st="+formatSeconds(out)+":d="+formatSeconds(o.Fade))
+		}
+	}
+	return strings.Join(filters, ",")
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// Args returns the arguments to have ffmpeg transcode stdin into an Ogg/Opus stream on stdout, in
+// the format Discord expects: 48kHz stereo, in 20ms frames.
+func (o EncodeOptions) Args() []string {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if o.Seek > 0 {
+		// As an input option, this decodes and discards everything before the offset, which is the
+		// only way to seek in a pipe.
+		args = append(args, "-ss", formatSeconds(o.Seek))
+	}
+	args = append(args, "-i", "pipe:0", "-vn")
+	if filters := o.Filters(); filters != "" {
+		args = append(args, "-af", filters)
+	}
+	return append(args,
+		"-c:a", "libopus", "-b:a", strconv.Itoa(o.Bitrate),
+		"-ar", "48000", "-ac", "2", "-frame_duration", "20", "-application", "audio",
+		"-f", "ogg", "pipe:1",
+	)
+}
+
+// encode is a pipeline stage that transcodes chunks of audio from streamResponse, in any format
+// ffmpeg understands, into Opus packets. Sending new options on reconfigure restarts the encoder
+// with them partway through the stream; this works for formats ffmpeg can pick up mid-stream, eg.
+// MP3 and MPEG-TS.
+func (p *Player) encode(ctx context.Context, indata <-chan []byte, opts EncodeOptions, reconfigure <-chan EncodeOptions) <-chan []byte {
+	ch := make(chan []byte)
+	p.Supervisor.Go(ctx, p.GuildID, "encode", func() {
+		defer close(ch)
+
+		// If we bail out early, keep draining the input so upstream isn't stuck.
+		defer func() {
+			for chunk := range indata {
+				releaseChunk(chunk)
+			}
+		}()
+
+		for {
+			stdin, done, err := p.startEncoder(ctx, opts, ch)
+			if err != nil {
+				log.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't start encoder")
+				return
+			}
+
+		feed:
+			for {
+				select {
+				case chunk, ok := <-indata:
+					if !ok {
+						stdin.Close()
+						<-done
+						return
+					}
+					// ffmpeg has its own copy once it's been written.
+					_, err := stdin.Write(chunk)
+					releaseChunk(chunk)
+					if err != nil {
+						<-done
+						return
+					}
+				case opts = <-reconfigure:
+					// Let the old encoder flush what it has before starting the new one.
+					log.WithFields(log.Fields{"gid": p.GuildID, "bitrate": opts.Bitrate}).Info("Player: Reconfiguring encoder")
+					stdin.Close()
+					<-done
+					break feed
+				case <-ctx.Done():
+					stdin.Close()
+					<-done
+					return
+				}
+			}
+		}
+	})
+	return ch
+}
+
+// startEncoder starts an encoder, or takes a spare from the pool, and demuxes its output into
+// packets on out. Returns its input, and a channel that's closed once it's exited.
+func (p *Player) startEncoder(ctx context.Context, opts EncodeOptions, out chan<- []byte) (io.WriteCloser, <-chan struct{}, error) {
+	var enc *Encoder
+	var err error
+	if p.Encoders != nil {
+		enc, err = p.Encoders.Get(opts)
+	} else {
+		enc, err = StartEncoder(p.FFmpeg, opts)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd, stdin, stdout := enc.Cmd, enc.Stdin, enc.Stdout
+
+	// Pooled encoders are started before the track is, so they can't be tied to its context.
+	done := make(chan struct{})
+	p.Supervisor.Go(ctx, p.GuildID, "encoder-killer", func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-done:
+		}
+	})
+
+	p.Supervisor.Go(ctx, p.GuildID, "encoder-output", func() {
+		defer close(done)
+		defer cmd.Wait()
+
+		r := NewOggReader(stdout)
+		for i := 0; ; i++ {
+			pkt, err := r.ReadPacket()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					log.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't read encoder output")
+					io.Copy(ioutil.Discard, stdout)
+				}
+				return
+			}
+
+			// The first two packets are the OpusHead and OpusTags headers, not audio.
+			if i < 2 {
+				continue
+			}
+
+			select {
+			case out <- pkt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	return stdin, done, nil
+}
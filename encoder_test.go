@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEncodeOptionsArgs(t *testing.T) {
+	args := EncodeOptions{Bitrate: 64000}.Args()
+	assert.Equal(t, []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vn"}, args[:6])
+	assert.NotContains(t, args, "-af")
+	assert.NotContains(t, args, "-ss")
+
+	// Seeking has to come before the input, to apply to it.
+	args = EncodeOptions{Bitrate: 64000, Gain: -3, Seek: 90500 * time.Millisecond}.Args()
+	assert.Equal(t, []string{"-hide_banner", "-loglevel", "error", "-ss", "90.500", "-i", "pipe:0", "-vn", "-af", "volume=-3dB"}, args[:10])
+}
+
+func TestResumeOffset(t *testing.T) {
+	envelope := TrackEnvelope{ServiceID: "soundcloud", Track: &soundcloud.Track{Duration: 180000}, Offset: time.Minute}
+	assert.Equal(t, time.Minute, resumeOffset(envelope))
+
+	// Live streams are joined as they are.
+	envelope.Track = &soundcloud.Track{}
+	assert.Equal(t, time.Duration(0), resumeOffset(envelope))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long spare encoders for a set of options are kept around without being used.
+const EncoderIdleTimeout = 5 * time.Minute
+
+// An Encoder is a running ffmpeg process, transcoding audio written to Stdin into an Ogg/Opus
+// stream on Stdout; see EncodeOptions.Args.
+type Encoder struct {
+	Cmd    *exec.Cmd
+	Stdin  io.WriteCloser
+	Stdout io.ReadCloser
+}
+
+// StartEncoder starts an encoder.
+func StartEncoder(ffmpeg string, opts EncodeOptions) (*Encoder, error) {
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	cmd := exec.Command(ffmpeg, opts.Args()...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &Encoder{Cmd: cmd, Stdin: stdin, Stdout: stdout}, nil
+}
+
+// Stop kills an encoder that's not being used, and waits for it to exit.
+func (e *Encoder) Stop() {
+	e.Cmd.Process.Kill()
+	e.Cmd.Wait()
+}
+
+// An EncoderPool keeps encoders started ahead of time, so a track doesn't have to wait for ffmpeg
+// to start up before it can play. An encoder can only encode the one stream it's fed, so they're
+// not reused as such: rather, whenever one is checked out, a spare with the same options is started
+// in the background, ready for the next track played with them.
+//
+// Only options without filters or seeking are pooled (see EncodeOptions.Poolable), which in
+// practice means a set of spares for each channel bitrate in use, for guilds with the default
+// playback settings. Ones that go unused for a while are stopped.
+type EncoderPool struct {
+	FFmpeg      string
+	Size        int           // Spares kept for each set of options
+	IdleTimeout time.Duration // Defaults to EncoderIdleTimeout
+
+	spares   map[string][]*Encoder
+	lastUsed map[string]time.Time
+	closed   bool
+	mutex    sync.Mutex
+}
+
+// Poolable returns whether encoders for the options can be started ahead of time.
+func (o EncodeOptions) Poolable() bool {
+	return o.Filters() == "" && o.Seek == 0
+}
+
+// Get returns an encoder for the options: a spare if one's ready, otherwise a freshly started one.
+func (pool *EncoderPool) Get(opts EncodeOptions) (*Encoder, error) {
+	if !opts.Poolable() || pool.Size <= 0 {
+		return StartEncoder(pool.FFmpeg, opts)
+	}
+
+	key := strings.Join(opts.Args(), " ")
+	pool.mutex.Lock()
+	if pool.spares == nil {
+		pool.spares = map[string][]*Encoder{}
+		pool.lastUsed = map[string]time.Time{}
+	}
+	var enc *Encoder
+	if spares := pool.spares[key]; len(spares) > 0 {
+		enc = spares[0]
+		pool.spares[key] = spares[1:]
+	}
+	pool.lastUsed[key] = time.Now()
+	pool.mutex.Unlock()
+
+	go pool.replenish(key, opts)
+	if enc != nil {
+		MetricEncoderCheckouts.IncFor("hit")
+		return enc, nil
+	}
+	MetricEncoderCheckouts.IncFor("miss")
+	return StartEncoder(pool.FFmpeg, opts)
+}
+
+// replenish starts spares for a set of options, until there are enough of them.
+func (pool *EncoderPool) replenish(key string, opts EncodeOptions) {
+	for {
+		pool.mutex.Lock()
+		full := pool.closed || len(pool.spares[key]) >= pool.Size
+		pool.mutex.Unlock()
+		if full {
+			return
+		}
+
+		enc, err := StartEncoder(pool.FFmpeg, opts)
+		if err != nil {
+			log.WithError(err).Error("EncoderPool: Couldn't start spare encoder")
+			return
+		}
+
+		// Another replenish may have filled it up in the meantime.
+		pool.mutex.Lock()
+		if pool.closed || len(pool.spares[key]) >= pool.Size {
+			pool.mutex.Unlock()
+			enc.Stop()
+			return
+		}
+		pool.spares[key] = append(pool.spares[key], enc)
+		pool.mutex.Unlock()
+	}
+}
+
+// Run stops spares that have gone unused for too long, until the context expires; then, it stops
+// all of them.
+func (pool *EncoderPool) Run(ctx context.Context) {
+	timeout := pool.IdleTimeout
+	if timeout <= 0 {
+		timeout = EncoderIdleTimeout
+	}
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pool.stopIdle(time.Now().Add(-timeout))
+		case <-ctx.Done():
+			pool.mutex.Lock()
+			pool.closed = true
+			pool.mutex.Unlock()
+			pool.stopIdle(time.Now())
+			return
+		}
+	}
+}
+
+// stopIdle stops the spares for options that haven't been used since the given time.
+func (pool *EncoderPool) stopIdle(since time.Time) {
+	pool.mutex.Lock()
+	stopped := []*Encoder{}
+	for key, used := range pool.lastUsed {
+		if used.After(since) {
+			continue
+		}
+		stopped = append(stopped, pool.spares[key]...)
+		delete(pool.spares, key)
+		delete(pool.lastUsed, key)
+	}
+	pool.mutex.Unlock()
+
+	for _, enc := range stopped {
+		enc.Stop()
+	}
+}
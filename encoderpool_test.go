@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncoderPool(t *testing.T) {
+	// Any program will do, as nothing's actually encoded.
+	bin, err := exec.LookPath("true")
+	if err != nil {
+		t.Skip("no true(1) to stand in for ffmpeg")
+	}
+	pool := &EncoderPool{FFmpeg: bin, Size: 1}
+	opts := EncodeOptions{Bitrate: 64000}
+	key := strings.Join(opts.Args(), " ")
+
+	first, err := pool.Get(opts)
+	assert.NoError(t, err)
+	first.Stop()
+
+	// A spare is started in the background, and handed out next.
+	var spare *Encoder
+	for i := 0; i < 100 && spare == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		pool.mutex.Lock()
+		if len(pool.spares[key]) > 0 {
+			spare = pool.spares[key][0]
+		}
+		pool.mutex.Unlock()
+	}
+	if assert.NotNil(t, spare) {
+		enc, err := pool.Get(opts)
+		assert.NoError(t, err)
+		assert.True(t, enc == spare)
+		enc.Stop()
+	}
+
+	// Tracks with adjustments of their own get an encoder of their own.
+	assert.False(t, EncodeOptions{Bitrate: 64000, Gain: -3}.Poolable())
+}
@@ -4,23 +4,87 @@ import (
 	"encoding/json"
 	"github.com/pkg/errors"
 	"github.com/sencrash/hiqty/media"
+	"time"
 )
 
+// EnvelopeVersion is the version of the envelope encoding this release writes. Fields can be added
+// freely, as older envelopes simply don't have them; bump it whenever one changes in a way older
+// envelopes can't just be decoded into, and add an upgrade for them to envelopeUpgrades.
+const EnvelopeVersion = 1
+
+// envelopeUpgrades convert an encoded envelope of each older version into the next one up, field by
+// field, so queues stored by older releases stay readable.
+var envelopeUpgrades = map[int]func(fields map[string]json.RawMessage) error{
+	// Version 0 predates versioning, and is otherwise the same as 1.
+	0: func(fields map[string]json.RawMessage) error { return nil },
+}
+
 type TrackEnvelope struct {
 	ServiceID string
 	Track     media.Track
+
+	// The message that requested the track, and the URL in it that resolved to it.
+	MessageID string
+	URL       string
+
+	// The user who requested it, if anyone did.
+	RequesterID string
+
+	// Volume adjustment to apply when playing the track, in dB.
+	Gain float64
+
+	// Whether it was requested from an NSFW channel. That's checked when it's queued, except for
+	// stubs (see media.Stub), which are checked once they've been looked up.
+	NSFW bool
+
+	// Roughly how far into the track it had played, if it was interrupted; updated every so often
+	// while it's playing, so another instance can resume it from there.
+	Offset time.Duration
+
+	// When the request passed each stage so far, for latency instrumentation.
+	Timing RequestTiming
 }
 
-func (e *TrackEnvelope) UnmarshalJSON(data []byte) error {
-	var tmp struct {
-		ServiceID string
-		Track     json.RawMessage
+// envelopeFields is the encoding of the current envelope version.
+type envelopeFields struct {
+	Version     int
+	ServiceID   string
+	Track       json.RawMessage
+	MessageID   string
+	URL         string
+	RequesterID string `json:",omitempty"`
+	Gain        float64
+	NSFW        bool
+	Offset      time.Duration
+	Timing      RequestTiming
+}
+
+func (e TrackEnvelope) MarshalJSON() ([]byte, error) {
+	track, err := json.Marshal(e.Track)
+	if err != nil {
+		return nil, err
 	}
-	if err := json.Unmarshal(data, &tmp); err != nil {
+	return json.Marshal(envelopeFields{
+		Version:     EnvelopeVersion,
+		ServiceID:   e.ServiceID,
+		Track:       track,
+		MessageID:   e.MessageID,
+		URL:         e.URL,
+		RequesterID: e.RequesterID,
+		Gain:        e.Gain,
+		NSFW:        e.NSFW,
+		Offset:      e.Offset,
+		Timing:      e.Timing,
+	})
+}
+
+func (e *TrackEnvelope) UnmarshalJSON(data []byte) error {
+	tmp, err := decodeEnvelopeFields(data)
+	if err != nil {
 		return err
 	}
 
-	svc := media.Services[tmp.ServiceID]
+	svc := media.Lookup(tmp.ServiceID)
 	if svc == nil {
 		return errors.New("unknown service: " + tmp.ServiceID)
 	}
@@ -32,6 +96,50 @@ func (e *TrackEnvelope) UnmarshalJSON(data []byte) error {
 
 	e.ServiceID = tmp.ServiceID
 	e.Track = track
+	e.MessageID = tmp.MessageID
+	e.URL = tmp.URL
+	e.RequesterID = tmp.RequesterID
+	e.Gain = tmp.Gain
+	e.NSFW = tmp.NSFW
+	e.Offset = tmp.Offset
+	e.Timing = tmp.Timing
 
 	return nil
 }
+
+// decodeEnvelopeFields decodes an envelope of any version this release knows, upgrading it to the
+// current one as needed. Envelopes written by a newer release are an error, rather than being
+// misread.
+func decodeEnvelopeFields(data []byte) (envelopeFields, error) {
+	var tmp envelopeFields
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return tmp, err
+	}
+	if tmp.Version == EnvelopeVersion {
+		return tmp, nil
+	}
+	if tmp.Version > EnvelopeVersion {
+		return tmp, errors.Errorf("envelope version %d is newer than this release's %d", tmp.Version, EnvelopeVersion)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return tmp, err
+	}
+	for v := tmp.Version; v < EnvelopeVersion; v++ {
+		upgrade := envelopeUpgrades[v]
+		if upgrade == nil {
+			return tmp, errors.Errorf("don't know how to upgrade envelope version %d", v)
+		}
+		if err := upgrade(fields); err != nil {
+			return tmp, errors.Wrapf(err, "upgrading envelope version %d", v)
+		}
+	}
+	upgraded, err := json.Marshal(fields)
+	if err != nil {
+		return tmp, err
+	}
+	tmp = envelopeFields{}
+	err = json.Unmarshal(upgraded, &tmp)
+	return tmp, err
+}
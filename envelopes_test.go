@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/sencrash/hiqty/media"
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEnvelopeVersions(t *testing.T) {
+	data, err := json.Marshal(testEnvelope(1, "a"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"Version":1`)
+
+	// Envelopes from before versioning are read as they are.
+	var envelope TrackEnvelope
+	assert.NoError(t, json.Unmarshal([]byte(`{"ServiceID":"soundcloud","Track":{"id":2},"MessageID":"b","Gain":-3}`), &envelope))
+	assert.True(t, envelope.Track.Equals(&soundcloud.Track{ID: 2}))
+	assert.Equal(t, "b", envelope.MessageID)
+	assert.Equal(t, -3.0, envelope.Gain)
+
+	// Ones from a newer release can't be.
+	err = json.Unmarshal([]byte(`{"Version":99,"ServiceID":"soundcloud","Track":{"id":2}}`), &envelope)
+	assert.EqualError(t, err, "envelope version 99 is newer than this release's 1")
+}
+
+func TestSummarizeStub(t *testing.T) {
+	// Tracks only known by their ID have yet to be looked up.
+	stub := testEnvelope(1, "a")
+	assert.True(t, media.IsStub(stub.Track))
+	assert.Equal(t, "(not looked up yet)", SummarizeTrack(stub).Title)
+
+	stub.Track = &soundcloud.Track{ID: 1, Title: "Title"}
+	assert.False(t, media.IsStub(stub.Track))
+	assert.Equal(t, "Title", SummarizeTrack(stub).Title)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// How often the same playback error is reported to a guild, at most; a voice channel that can't be
+// joined, for one, is retried continuously.
+const ErrorReportInterval = time.Minute
+
+// Maximum length of an error's description when it's reported to a guild.
+const MaxErrorReportLength = 300
+
+// ErrorChannel returns the text channel to report a queue's playback errors in, per the guild's
+// error-channel setting, or "" if they shouldn't be reported.
+func ErrorChannel(rconn redis.Conn, q Queue) (string, error) {
+	v, err := ReadSetting(rconn, q.GuildID, SettingErrorChannel)
+	if err != nil || v == ErrorChannelOff {
+		return "", err
+	}
+	if v != ErrorChannelAuto {
+		return v, nil
+	}
+	cid, err := redis.String(rconn.Do("GET", q.TextChannelKey()))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return cid, err
+}
+
+// ErrorEmbed builds a concise embed about a playback error.
+func ErrorEmbed(title string, err error) *discordgo.MessageEmbed {
+	description := err.Error()
+	if runes := []rune(description); len(runes) > MaxErrorReportLength {
+		description = string(runes[:MaxErrorReportLength-1]) + "…"
+	}
+	return &discordgo.MessageEmbed{
+		Title:       title,
+		Description: description,
+		Color:       0xff3333,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// reportError posts a playback error to the guild's error channel, unless the same one (by key) was
+// reported recently.
+func (p *Player) reportError(key, title string, err error) {
+	if p.reported == nil {
+		p.reported = map[string]time.Time{}
+	}
+	if time.Since(p.reported[key]) < ErrorReportInterval {
+		return
+	}
+	p.reported[key] = time.Now()
+
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	cid, cerr := ErrorChannel(rconn, p.queue())
+	if cerr != nil {
+		PlayerLog.WithError(cerr).WithField("gid", p.GuildID).Warn("Player: Couldn't get error channel")
+		return
+	}
+	if cid == "" {
+		return
+	}
+	if _, err := p.Session.ChannelMessageSendEmbed(cid, ErrorEmbed(title, err)); err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't report error")
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestErrorEmbed(t *testing.T) {
+	embed := ErrorEmbed("Couldn't play Song", errors.New("403 Forbidden"))
+	assert.Equal(t, "Couldn't play Song", embed.Title)
+	assert.Equal(t, "403 Forbidden", embed.Description)
+
+	embed = ErrorEmbed("Couldn't play Song", errors.New(strings.Repeat("ä", 1000)))
+	assert.Equal(t, MaxErrorReportLength, len([]rune(embed.Description)))
+	assert.True(t, strings.HasSuffix(embed.Description, "…"))
+}
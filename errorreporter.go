@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/getsentry/sentry-go"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// The error reporter in use, if any (see --sentry-dsn).
+var errorReporter *SentryHook
+
+// How many reports are queued up to be sent, at most; more than that, eg. from every player logging
+// the same error while Redis is down, are dropped until there's room again.
+const SentryBufferSize = 100
+
+// Log fields that are reported as searchable tags; the rest are reported as extra data.
+var sentryTagFields = map[string]bool{"gid": true, "cid": true, "mid": true, "service": true}
+
+// A SentryHook reports Error-level log entries, and panics (see ReportPanic), to Sentry.
+type SentryHook struct {
+	Client *sentry.Client
+}
+
+// NewSentryHook creates a hook from a DSN, eg. "https://key@sentry.example.com/1".
+func NewSentryHook(dsn string) (*SentryHook, error) {
+	transport := sentry.NewHTTPTransport()
+	transport.BufferSize = SentryBufferSize
+	transport.Timeout = 10 * time.Second
+
+	client, err := sentry.NewClient(sentry.ClientOptions{Dsn: dsn, Transport: transport})
+	if err != nil {
+		return nil, err
+	}
+	return &SentryHook{Client: client}, nil
+}
+
+// Levels returns the levels that are reported.
+func (h *SentryHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+// Fire reports a log entry. Errors are queued up to be sent in the background; fatal ones are sent
+// right away, as the process is about to exit.
+func (h *SentryHook) Fire(e *log.Entry) error {
+	h.Client.CaptureEvent(h.event(e), nil, nil)
+	if e.Level <= log.FatalLevel {
+		h.Flush(5 * time.Second)
+	}
+	return nil
+}
+
+// Flush waits for queued reports to be sent, for up to a timeout.
+func (h *SentryHook) Flush(timeout time.Duration) {
+	h.Client.Flush(timeout)
+}
+
+func (h *SentryHook) event(e *log.Entry) *sentry.Event {
+	event := sentry.NewEvent()
+	event.Timestamp = e.Time
+	event.Level = sentry.LevelError
+	event.Message = e.Message
+	if e.Level <= log.FatalLevel {
+		event.Level = sentry.LevelFatal
+	}
+
+	// Messages are prefixed with the subsystem they're from, eg. "Player: Couldn't start track".
+	if i := strings.Index(e.Message, ": "); i != -1 && !strings.Contains(e.Message[:i], " ") {
+		event.Logger = e.Message[:i]
+	}
+
+	extra := sentry.Context{}
+	for k, v := range e.Data {
+		switch {
+		case k == log.ErrorKey:
+			if err, ok := v.(error); ok {
+				event.Message += ": " + err.Error()
+				continue
+			}
+			extra[k] = fmt.Sprint(v)
+		case sentryTagFields[k]:
+			event.Tags[k] = fmt.Sprint(v)
+		default:
+			extra[k] = fmt.Sprint(v)
+		}
+	}
+	if len(extra) > 0 {
+		event.Contexts["extra"] = extra
+	}
+	return event
+}
+
+// ReportPanic reports a panic, with its stack trace, before letting it crash the process as it
+// would have anyway. Defer it at the top of goroutines:
+//
+//	defer ReportPanic(PlayerLog, "Player", log.Fields{"gid": gid})
+func ReportPanic(logger *log.Logger, subsystem string, fields log.Fields) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if errorReporter != nil {
+		logger.WithFields(fields).WithField("stack", string(debug.Stack())).Error(fmt.Sprintf("%s: Panic: %v", subsystem, r))
+		errorReporter.Flush(5 * time.Second)
+	}
+	panic(r)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/getsentry/sentry-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewSentryHook(t *testing.T) {
+	_, err := NewSentryHook("https://public@sentry.example.com/sub/42")
+	assert.NoError(t, err)
+
+	_, err = NewSentryHook("https://sentry.example.com/42")
+	assert.Error(t, err, "missing public key")
+	_, err = NewSentryHook("https://public@sentry.example.com/")
+	assert.Error(t, err, "missing project ID")
+}
+
+func TestSentryHookEvent(t *testing.T) {
+	h, _ := NewSentryHook("https://public@sentry.example.com/42")
+	e := log.WithFields(log.Fields{
+		"gid":        "123",
+		"url":        "https://example.com/",
+		log.ErrorKey: errors.New("oops"),
+	})
+	e.Message = "Player: Couldn't start track"
+	e.Level = log.ErrorLevel
+	e.Time = time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	event := h.event(e)
+	assert.Equal(t, "Player: Couldn't start track: oops", event.Message)
+	assert.Equal(t, "Player", event.Logger)
+	assert.Equal(t, sentry.LevelError, event.Level)
+	assert.Equal(t, e.Time, event.Timestamp)
+	assert.Equal(t, map[string]string{"gid": "123"}, event.Tags)
+	assert.Equal(t, sentry.Context{"url": "https://example.com/"}, event.Contexts["extra"])
+}
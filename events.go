@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"github.com/sencrash/hiqty/media"
+	"time"
+)
+
+// Playback event types.
+const (
+	EventTrackStarted  = "track_started"  // A track started playing
+	EventTrackFinished = "track_finished" // A track played to the end
+	EventTrackSkipped  = "track_skipped"  // A track was skipped, or removed while playing
+	EventTrackError    = "track_error"    // A track couldn't be played
+	EventQueueChanged  = "queue_changed"  // Tracks were added to, removed from or changed in a playlist
+)
+
+// An Event is published to a guild's event channel (see KeyForEvents) whenever something happens
+// to its playback, for anything that wants to react to it: the WebSocket event stream, etc.
+type Event struct {
+	Type    string        `json:"type"`
+	GuildID string        `json:"guild"`
+	BotID   string        `json:"bot,omitempty"` // The linked bot whose queue it's about, if any
+	Track   *TrackSummary `json:"track,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Time    time.Time     `json:"time"`
+}
+
+// NewEvent creates an event for a queue, optionally about a track.
+func NewEvent(typ string, q Queue, track media.Track) Event {
+	e := Event{Type: typ, GuildID: q.GuildID, BotID: q.BotID, Time: time.Now().UTC()}
+	if track != nil {
+		e.Track = SummarizeTrack(TrackEnvelope{ServiceID: track.GetServiceID(), Track: track})
+	}
+	return e
+}
+
+// PublishEvent publishes an event, and sends it to the guild's outgoing webhooks (see Notify).
+// Nobody may be listening, so it's fire and forget.
+func PublishEvent(rconn redis.Conn, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := rconn.Do("PUBLISH", KeyForEvents(e.GuildID), data); err != nil {
+		return err
+	}
+	return Notify(rconn, e)
+}
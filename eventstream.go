@@ -0,0 +1,107 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/websocket"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// How often event stream clients are pinged, and how long they have to answer.
+const (
+	eventStreamPingInterval = 30 * time.Second
+	eventStreamPongTimeout  = 60 * time.Second
+)
+
+// Clients authenticating with a token may connect from any origin; the dashboard's session cookie
+// is only good for connections from the dashboard itself.
+var eventStreamUpgrader = websocket.Upgrader{
+	CheckOrigin: func(req *http.Request) bool {
+		if _, err := req.Cookie(dashboardSessionCookie); err != nil {
+			return true
+		}
+		origin, err := neturl.Parse(req.Header.Get("Origin"))
+		return err == nil && strings.EqualFold(origin.Host, req.Host)
+	},
+}
+
+// apiEvents handles GET /api/guilds/<gid>/events, which upgrades to a WebSocket that each of the
+// guild's events (see Event) is sent over as a JSON text message, for as long as it's open.
+func (s *HTTPServer) apiEvents(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	psc := redis.PubSubConn{Conn: s.Pool.Get()}
+	defer psc.Close()
+	if err := psc.Subscribe(KeyForEvents(gid)); err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't subscribe to events")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	ws, err := eventStreamUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader has already responded.
+		return
+	}
+	defer ws.Close()
+
+	// Nothing is expected from the client, but reading is how closes and pongs are noticed.
+	ws.SetReadDeadline(time.Now().Add(eventStreamPongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(eventStreamPongTimeout))
+	})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	messages := make(chan []byte)
+	go func() {
+		defer close(messages)
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				messages <- v.Data
+			case redis.Subscription:
+				if v.Count == 0 {
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+
+	// Once the client's gone, unsubscribe and let the receiver run out.
+	defer func() {
+		psc.Unsubscribe()
+		for range messages {
+		}
+	}()
+
+	ticker := time.NewTicker(eventStreamPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data, ok := <-messages:
+			if !ok {
+				return
+			}
+			if err := ws.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"strings"
+)
+
+// Most favorites a user can have.
+const MaxFavorites = 100
+
+// How many favorites are listed at a time.
+const FavoritesPageSize = 15
+
+// AddFavorite adds a track to a user's favorites, returning their new number of favorites.
+func AddFavorite(rconn redis.Conn, uid string, envelope TrackEnvelope) (int, error) {
+	return pushSaved(rconn, KeyForUserFavorites(uid), envelope)
+}
+
+// RemoveFavorite removes the favorite at a position in a user's list, 1 being the first, returning
+// false if there's no such favorite.
+func RemoveFavorite(rconn redis.Conn, uid string, pos int) (bool, error) {
+	return removeSaved(rconn, KeyForUserFavorites(uid), pos)
+}
+
+// Favorites returns a user's favorites, oldest first. Ones that can't be decoded anymore, eg.
+// because their service is gone, are nil, so the rest keep their positions.
+func Favorites(rconn redis.Conn, uid string) ([]*TrackEnvelope, error) {
+	return readSaved(rconn, KeyForUserFavorites(uid))
+}
+
+// savedEnvelope returns an envelope to keep in a user's favorites or playlists: one that requests
+// the track itself, rather than whatever it was queued from, with nothing about the request that
+// queued it. Stubs know nothing but their ID, and are left requesting what they were queued from.
+func savedEnvelope(envelope TrackEnvelope) TrackEnvelope {
+	saved := TrackEnvelope{ServiceID: envelope.ServiceID, Track: envelope.Track, URL: envelope.Track.GetInfo().URL}
+	if saved.URL == "" {
+		saved.URL = envelope.URL
+	}
+	return saved
+}
+
+// pushSaved appends envelopes to a list of saved tracks, returning its new length.
+func pushSaved(rconn redis.Conn, key string, envelopes ...TrackEnvelope) (int, error) {
+	args := redis.Args{}.Add(key)
+	for _, envelope := range envelopes {
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return 0, err
+		}
+		args = args.Add(data)
+	}
+	return redis.Int(rconn.Do("RPUSH", args...))
+}
+
+// removeSaved removes the envelope at a position in a list of saved tracks, 1 being the first,
+// returning false if there's no such envelope.
+func removeSaved(rconn redis.Conn, key string, pos int) (bool, error) {
+	if pos < 1 {
+		return false, nil
+	}
+	data, err := redis.Bytes(rconn.Do("LINDEX", key, pos-1))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return redis.Bool(rconn.Do("LREM", key, 1, data))
+}
+
+// readSaved returns the envelopes in a list of saved tracks; ones that can't be decoded are nil.
+func readSaved(rconn redis.Conn, key string) ([]*TrackEnvelope, error) {
+	items, err := redis.ByteSlices(rconn.Do("LRANGE", key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	saved := make([]*TrackEnvelope, len(items))
+	for i, data := range items {
+		var envelope TrackEnvelope
+		if json.Unmarshal(data, &envelope) == nil {
+			saved[i] = &envelope
+		}
+	}
+	return saved, nil
+}
+
+// nowPlaying returns what the bot's playing in a guild, or nil if nothing is; a guild following a
+// station is playing whatever the station is.
+func (r *Responder) nowPlaying(rconn redis.Conn, gid string) (*TrackEnvelope, error) {
+	q := r.queue(gid)
+	envelope, err := r.Store.NowPlaying(ActivePlaylistQueue(rconn, q))
+	if envelope != nil || err != nil || q.BotID != "" {
+		return envelope, err
+	}
+	track, err := ReadStationTrack(rconn, gid)
+	if track == nil || err != nil {
+		return nil, err
+	}
+	return &track.Envelope, nil
+}
+
+// cmdFav adds the track that's playing to the favorites of whoever asked, which they can play again
+// later, in any server, with favs.
+func cmdFav(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	playing, err := r.nowPlaying(rconn, channel.GuildID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get track")
+		return
+	}
+	if playing == nil {
+		r.reply(msg.ChannelID, msg.Author.ID, "Nothing's playing right now.")
+		return
+	}
+
+	favs, err := Favorites(rconn, msg.Author.ID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get favorites")
+		return
+	}
+	title := playing.Track.GetInfo().Title
+	for i, fav := range favs {
+		if fav != nil && fav.Track.Equals(playing.Track) {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s** is in your favorites already, as #%d.", title, i+1))
+			return
+		}
+	}
+	if len(favs) >= MaxFavorites {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You can only have %d favorites; remove one with `favs remove <number>` first.", MaxFavorites))
+		return
+	}
+
+	n, err := AddFavorite(rconn, msg.Author.ID, savedEnvelope(*playing))
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't add favorite")
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Added **%s** to your favorites; play it again with `favs play %d`.", title, n))
+}
+
+// cmdFavs lists, plays or removes the favorites of whoever asked.
+func cmdFavs(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	usage := "Usage: `favs [list <page>|play <number>|remove <number>]`"
+	sub := "list"
+	if len(args) > 0 {
+		sub = strings.ToLower(args[0])
+	}
+	num := 1
+	if len(args) > 1 {
+		var err error
+		if num, err = strconv.Atoi(args[1]); err != nil || len(args) > 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, usage)
+			return
+		}
+	}
+
+	switch sub {
+	case "list":
+		favs, err := Favorites(rconn, msg.Author.ID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't get favorites")
+			return
+		}
+		if len(favs) == 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, "You have no favorites; add whatever's playing with `fav`.")
+			return
+		}
+		pages := (len(favs) + FavoritesPageSize - 1) / FavoritesPageSize
+		if num < 1 || num > pages {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There are only %d pages of favorites.", pages))
+			return
+		}
+		lines := []string{fmt.Sprintf("Your favorites (page %d of %d):", num, pages)}
+		for i := (num - 1) * FavoritesPageSize; i < len(favs) && i < num*FavoritesPageSize; i++ {
+			if favs[i] == nil {
+				lines = append(lines, fmt.Sprintf("%d. (unavailable)", i+1))
+				continue
+			}
+			info := favs[i].Track.GetInfo()
+			lines = append(lines, fmt.Sprintf("%d. **%s** <%s>", i+1, info.Title, info.URL))
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, strings.Join(lines, "\n"))
+	case "remove":
+		if len(args) != 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, usage)
+			return
+		}
+		ok, err := RemoveFavorite(rconn, msg.Author.ID, num)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't remove favorite")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You have no favorite #%d.", num))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Removed favorite #%d.", num))
+	case "play":
+		if len(args) != 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, usage)
+			return
+		}
+		cmdFavsPlay(r, rconn, msg, channel, num)
+	default:
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+	}
+}
+
+// cmdFavsPlay queues one of a user's favorites in the voice channel they're in.
+func cmdFavsPlay(r *Responder, rconn redis.Conn, msg *discordgo.MessageCreate, channel *discordgo.Channel, num int) {
+	favs, err := Favorites(rconn, msg.Author.ID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get favorites")
+		return
+	}
+	if num < 1 || num > len(favs) {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You have no favorite #%d.", num))
+		return
+	}
+	fav := favs[num-1]
+	if fav == nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Favorite #%d can't be played anymore.", num))
+		return
+	}
+
+	tracks, skipped, ok := r.queueSaved(rconn, msg, channel, []TrackEnvelope{*fav})
+	if !ok {
+		return
+	}
+	if len(skipped) > 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, "Can't play that: "+skipped[0].Reason)
+		return
+	}
+	r.announce(rconn, channel.GuildID, msg.ChannelID, channel.NSFW, msg.Author, tracks)
+}
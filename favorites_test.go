@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSavedEnvelope(t *testing.T) {
+	track := &soundcloud.Track{ID: 1, PermalinkURL: "https://soundcloud.com/artist/track"}
+	envelope := TrackEnvelope{
+		ServiceID: "soundcloud",
+		Track:     track,
+		MessageID: "123",
+		URL:       "https://soundcloud.com/artist/sets/album",
+		Gain:      -3,
+		Offset:    time.Minute,
+	}
+
+	// A favorite is of the track itself, not the playlist it was queued from.
+	assert.Equal(t, TrackEnvelope{ServiceID: "soundcloud", Track: track, URL: "https://soundcloud.com/artist/track"}, savedEnvelope(envelope))
+	assert.Equal(t, "hiqty:user:456:favorites", KeyForUserFavorites("456"))
+	assert.Equal(t, "hiqty:user:456:playlist:chill", KeyForUserPlaylist("456", "chill"))
+
+	// Stubs don't know their own URL, so they're saved as what they were queued from.
+	stub := TrackEnvelope{ServiceID: "soundcloud", Track: &soundcloud.Track{ID: 2}, URL: "https://soundcloud.com/artist/sets/album"}
+	assert.Equal(t, "https://soundcloud.com/artist/sets/album", savedEnvelope(stub).URL)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strings"
+)
+
+// Most custom filter presets a guild can have.
+const MaxFilterPresets = 20
+
+// SaveFilterPreset saves one of a guild's custom filter presets, replacing any with the same name.
+// Players using it pick up the change right away.
+func SaveFilterPreset(rconn redis.Conn, gid, name, filters string) error {
+	if _, err := rconn.Do("HSET", KeyForServerFilters(gid), name, filters); err != nil {
+		return err
+	}
+	NotifyBus(KeyForServerSettings(gid))
+	return nil
+}
+
+// RemoveFilterPreset removes one of a guild's custom filter presets, returning false if there's no
+// such preset. If it's in use, the guild goes back to the flat preset.
+func RemoveFilterPreset(rconn redis.Conn, gid, name string) (bool, error) {
+	ok, err := redis.Bool(rconn.Do("HDEL", KeyForServerFilters(gid), name))
+	if !ok || err != nil {
+		return ok, err
+	}
+	if current, err := ReadSetting(rconn, gid, SettingFilter); err != nil {
+		return true, err
+	} else if current == name {
+		_, err = WriteSetting(rconn, gid, SettingFilter, "flat")
+		return true, err
+	}
+	return true, nil
+}
+
+// FilterPreset returns the ffmpeg filters of one of a guild's custom filter presets, or "" if
+// there's no such preset.
+func FilterPreset(rconn redis.Conn, gid, name string) (string, error) {
+	filters, err := redis.String(rconn.Do("HGET", KeyForServerFilters(gid), name))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return filters, err
+}
+
+// FilterPresetsFor returns a guild's custom filter presets, by name.
+func FilterPresetsFor(rconn redis.Conn, gid string) (map[string]string, error) {
+	return redis.StringMap(rconn.Do("HGETALL", KeyForServerFilters(gid)))
+}
+
+// cmdFilter shows or switches the filter preset tracks play through, or saves or removes the
+// guild's custom presets. Anyone listening can switch presets; saving and removing them takes the
+// Manage Server permission.
+func cmdFilter(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	custom, err := FilterPresetsFor(rconn, channel.GuildID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't list filter presets")
+		return
+	}
+
+	if len(args) == 0 {
+		current, err := ReadSetting(rconn, channel.GuildID, SettingFilter)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't read setting")
+			return
+		}
+		lines := []string{fmt.Sprintf("Tracks play through **%s**. Presets: `%s`", current, strings.Join(FilterPresetNames(), "`, `"))}
+		names := make([]string, 0, len(custom))
+		for name := range custom {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("**%s**: `%s`", name, custom[name]))
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, strings.Join(lines, "\n"))
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "save":
+		cmdFilterSave(r, rconn, msg, channel, custom, args[1:])
+		return
+	case "remove":
+		if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+			r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to remove filter presets.")
+			return
+		}
+		if len(args) != 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, "Usage: `filter remove <name>`")
+			return
+		}
+		name := strings.ToLower(args[1])
+		ok, err := RemoveFilterPreset(rconn, channel.GuildID, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't remove filter preset")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no custom preset called `%s`.", name))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Removed filter preset `%s`.", name))
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	if _, ok := FilterPresets[name]; !ok && custom[name] == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no filter preset called `%s`.", name))
+		return
+	}
+
+	// Whoever's listening can change how it sounds; anyone else has to be able to change settings.
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		q := r.queue(channel.GuildID)
+		cid, err := r.activeChannel(q)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't get active channel")
+			return
+		}
+		if cid == "" || r.voiceChannel(channel.GuildID, msg.Author.ID) != cid {
+			r.reply(msg.ChannelID, msg.Author.ID, "You must be listening, or have the Manage Server permission, to switch filter presets.")
+			return
+		}
+		if r.djLocked(rconn, q, msg.ChannelID, msg.Author.ID) {
+			return
+		}
+	}
+
+	if _, err := WriteSetting(rconn, channel.GuildID, SettingFilter, name); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't write setting")
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Tracks now play through **%s**.", name))
+}
+
+// cmdFilterSave saves a custom filter preset, from a chain of ffmpeg filters.
+func cmdFilterSave(r *Responder, rconn redis.Conn, msg *discordgo.MessageCreate, channel *discordgo.Channel, custom map[string]string, args []string) {
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to save filter presets.")
+		return
+	}
+	if len(args) != 2 {
+		r.reply(msg.ChannelID, msg.Author.ID, "Usage: `filter save <name> <filter>,<filter>...`, eg. `filter save warm bass=g=4,treble=g=-3`")
+		return
+	}
+	name := strings.ToLower(args[0])
+	if _, ok := FilterPresets[name]; ok || !namePattern.MatchString(name) || name == "save" || name == "remove" {
+		r.reply(msg.ChannelID, msg.Author.ID, "Preset names can only have letters, numbers, dashes and underscores, and can't be `save`, `remove`, or a built-in preset's.")
+		return
+	}
+	if _, ok := custom[name]; !ok && len(custom) >= MaxFilterPresets {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There can only be %d custom presets; remove one first.", MaxFilterPresets))
+		return
+	}
+
+	filters, err := normalizeFilterChain(args[1])
+	if err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, "Couldn't save that: "+err.Error())
+		return
+	}
+	if err := SaveFilterPreset(rconn, channel.GuildID, name, filters); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't save filter preset")
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Saved filter preset `%s`; switch to it with `filter %s`.", name, name))
+}
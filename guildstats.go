@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the time a guild's spent listening is added to its statistics, while it's listening.
+const ListeningStatsInterval = time.Minute
+
+// Most tracks a guild's statistics keep count of; once there are this many, only tracks that are
+// counted already are, as ones that aren't by then are unlikely to make the top anyway.
+const MaxGuildStatsTracks = 1000
+
+// How many of the most played tracks and most active requesters are shown by the stats command.
+const GuildStatsTop = 5
+
+// Fields of a guild's statistics; plays by hour of the day are counted as "hour:<0-23>".
+const (
+	guildStatPlays    = "plays"
+	guildStatListened = "listened" // In seconds
+	guildStatHour     = "hour:"
+)
+
+// A GuildStatsTrack is one of a guild's most played tracks, as counted in its statistics.
+type GuildStatsTrack struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+	Plays int64  `json:"-"`
+}
+
+// A GuildStatsRequester is one of the people whose requests a guild has played the most of.
+type GuildStatsRequester struct {
+	UserID string
+	Plays  int64
+}
+
+// GuildStats holds what a guild's listened to, for as long as the bot's been in it.
+type GuildStats struct {
+	Plays      int64
+	Listened   time.Duration
+	Hours      [24]int64 // Plays by hour of the day, in the guild's timezone
+	Tracks     []GuildStatsTrack
+	Requesters []GuildStatsRequester
+}
+
+// BusiestHour returns the hour of the day the most tracks have been played at, or false if none
+// have been.
+func (s GuildStats) BusiestHour() (int, bool) {
+	busiest := 0
+	for hour, plays := range s.Hours {
+		if plays > s.Hours[busiest] {
+			busiest = hour
+		}
+	}
+	return busiest, s.Hours[busiest] > 0
+}
+
+// RecordGuildPlay counts a track starting to play in a guild, at a time, on behalf of whoever
+// requested it, if anyone. Failing to record statistics is never fatal, so errors are merely
+// logged.
+func RecordGuildPlay(rconn redis.Conn, gid string, info GuildStatsTrack, requester string, at time.Time) {
+	if tz, err := ReadSetting(rconn, gid, SettingTimezone); err == nil {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			at = at.In(loc)
+		}
+	}
+	member, err := json.Marshal(info)
+	if err != nil {
+		log.WithError(err).WithField("gid", gid).Warn("Couldn't record guild statistics")
+		return
+	}
+	tracks := KeyForServerStatsTracks(gid)
+	counted, err := redis.Int(rconn.Do("HLEN", tracks))
+	if err != nil {
+		log.WithError(err).WithField("gid", gid).Warn("Couldn't record guild statistics")
+		return
+	}
+	countTrack := counted < MaxGuildStatsTracks
+	if !countTrack {
+		if countTrack, err = redis.Bool(rconn.Do("HEXISTS", tracks, member)); err != nil {
+			log.WithError(err).WithField("gid", gid).Warn("Couldn't record guild statistics")
+			return
+		}
+	}
+
+	rconn.Send("MULTI")
+	rconn.Send("HINCRBY", KeyForServerStats(gid), guildStatPlays, 1)
+	rconn.Send("HINCRBY", KeyForServerStats(gid), guildStatHour+strconv.Itoa(at.Hour()), 1)
+	if countTrack {
+		rconn.Send("HINCRBY", tracks, member, 1)
+	}
+	if requester != "" {
+		rconn.Send("HINCRBY", KeyForServerStatsRequesters(gid), requester, 1)
+	}
+	if _, err := rconn.Do("EXEC"); err != nil {
+		log.WithError(err).WithField("gid", gid).Warn("Couldn't record guild statistics")
+	}
+}
+
+// RecordGuildListening adds time spent listening to a guild's statistics, to the second; it's
+// returned what's left over, to be added next time.
+func RecordGuildListening(rconn redis.Conn, gid string, d time.Duration) time.Duration {
+	secs := int64(d / time.Second)
+	if secs == 0 {
+		return d
+	}
+	if _, err := rconn.Do("HINCRBY", KeyForServerStats(gid), guildStatListened, secs); err != nil {
+		log.WithError(err).WithField("gid", gid).Warn("Couldn't record guild statistics")
+		return d
+	}
+	return d - time.Duration(secs)*time.Second
+}
+
+// ReadGuildStats reads a guild's statistics, with its top few tracks and requesters.
+func ReadGuildStats(rconn redis.Conn, gid string, top int) (GuildStats, error) {
+	var stats GuildStats
+	counters, err := redis.Int64Map(rconn.Do("HGETALL", KeyForServerStats(gid)))
+	if err != nil {
+		return stats, err
+	}
+	stats.Plays = counters[guildStatPlays]
+	stats.Listened = time.Duration(counters[guildStatListened]) * time.Second
+	for hour := range stats.Hours {
+		stats.Hours[hour] = counters[guildStatHour+strconv.Itoa(hour)]
+	}
+
+	tracks, err := redis.Int64Map(rconn.Do("HGETALL", KeyForServerStatsTracks(gid)))
+	if err != nil {
+		return stats, err
+	}
+	for member, plays := range tracks {
+		var track GuildStatsTrack
+		if json.Unmarshal([]byte(member), &track) == nil {
+			track.Plays = plays
+			stats.Tracks = append(stats.Tracks, track)
+		}
+	}
+	sort.Slice(stats.Tracks, func(i, j int) bool {
+		a, b := stats.Tracks[i], stats.Tracks[j]
+		return a.Plays > b.Plays || (a.Plays == b.Plays && a.Title < b.Title)
+	})
+	if len(stats.Tracks) > top {
+		stats.Tracks = stats.Tracks[:top]
+	}
+
+	requesters, err := redis.Int64Map(rconn.Do("HGETALL", KeyForServerStatsRequesters(gid)))
+	if err != nil {
+		return stats, err
+	}
+	for uid, plays := range requesters {
+		stats.Requesters = append(stats.Requesters, GuildStatsRequester{uid, plays})
+	}
+	sort.Slice(stats.Requesters, func(i, j int) bool {
+		a, b := stats.Requesters[i], stats.Requesters[j]
+		return a.Plays > b.Plays || (a.Plays == b.Plays && a.UserID < b.UserID)
+	})
+	if len(stats.Requesters) > top {
+		stats.Requesters = stats.Requesters[:top]
+	}
+	return stats, nil
+}
+
+// guildStatsEmbed formats a guild's statistics.
+func guildStatsEmbed(stats GuildStats) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Color: 0x99ff99,
+		Title: "Listening statistics",
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Tracks played", Value: strconv.FormatInt(stats.Plays, 10), Inline: true},
+			{Name: "Hours listened", Value: strconv.FormatFloat(stats.Listened.Hours(), 'f', 1, 64), Inline: true},
+		},
+	}
+	if hour, ok := stats.BusiestHour(); ok {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Busiest hour", Value: fmt.Sprintf("%02d:00-%02d:00", hour, (hour+1)%24), Inline: true})
+	}
+
+	if len(stats.Tracks) > 0 {
+		lines := []string{}
+		for i, track := range stats.Tracks {
+			lines = append(lines, fmt.Sprintf("`%d.` [%s](%s) (%d plays)", i+1, track.Title, track.URL, track.Plays))
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Top tracks", Value: strings.Join(lines, "\n")})
+	}
+	if len(stats.Requesters) > 0 {
+		lines := []string{}
+		for i, req := range stats.Requesters {
+			lines = append(lines, fmt.Sprintf("`%d.` <@%s> (%d plays)", i+1, req.UserID, req.Plays))
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Top requesters", Value: strings.Join(lines, "\n")})
+	}
+	return embed
+}
+
+// recordPlay counts a track starting to play in the guild's statistics. Followers of a station
+// count it too, as they're listening, but whoever requested it did so elsewhere.
+func (p *Player) recordPlay(envelope TrackEnvelope) {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	info := envelope.Track.GetInfo()
+	requester := envelope.RequesterID
+	if p.following {
+		requester = ""
+	}
+	RecordGuildPlay(rconn, p.GuildID, GuildStatsTrack{Title: info.Title, URL: info.URL}, requester, time.Now())
+}
+
+// recordListening adds time spent listening to the guild's statistics, returning what's left over.
+func (p *Player) recordListening(d time.Duration) time.Duration {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	return RecordGuildListening(rconn, p.GuildID, d)
+}
+
+// cmdStats shows what the guild's listened to.
+func cmdStats(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	stats, err := ReadGuildStats(rconn, channel.GuildID, GuildStatsTop)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't read statistics")
+		return
+	}
+	if stats.Plays == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, "Nothing's been played here yet.")
+		return
+	}
+	r.Session.ChannelMessageSendEmbed(msg.ChannelID, guildStatsEmbed(stats))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGuildStatsBusiestHour(t *testing.T) {
+	var stats GuildStats
+	_, ok := stats.BusiestHour()
+	assert.False(t, ok)
+
+	stats.Hours[3], stats.Hours[21], stats.Hours[22] = 1, 4, 4
+	hour, ok := stats.BusiestHour()
+	assert.True(t, ok)
+	assert.Equal(t, 21, hour)
+}
+
+func TestGuildStatsEmbed(t *testing.T) {
+	stats := GuildStats{
+		Plays:      12,
+		Listened:   90 * time.Minute,
+		Tracks:     []GuildStatsTrack{{Title: "A", URL: "https://example.com/a", Plays: 3}},
+		Requesters: []GuildStatsRequester{{UserID: "1", Plays: 7}},
+	}
+	stats.Hours[23] = 12
+
+	embed := guildStatsEmbed(stats)
+	assert.Equal(t, "12", embed.Fields[0].Value)
+	assert.Equal(t, "1.5", embed.Fields[1].Value)
+	assert.Equal(t, "23:00-00:00", embed.Fields[2].Value)
+	assert.Equal(t, "`1.` [A](https://example.com/a) (3 plays)", embed.Fields[3].Value)
+	assert.Equal(t, "`1.` <@1> (7 plays)", embed.Fields[4].Value)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"github.com/sencrash/hiqty/media"
+	"time"
+)
+
+// Service health statuses. A service is degraded as soon as a health check fails, and down once
+// enough of them fail in a row; URLs for services that are down are refused.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// Number of consecutive failed health checks before a service is considered down.
+const HealthDownAfter = 3
+
+// ServiceHealth is the result of a service's last health check.
+type ServiceHealth struct {
+	Status   string `redis:"status"`
+	Error    string `redis:"error"`
+	Failures int    `redis:"failures"`
+	Checked  int64  `redis:"checked"`
+}
+
+// ReadServiceHealth reads a service's last health check. Services that haven't been checked (or
+// can't be) are reported as OK.
+func ReadServiceHealth(rconn redis.Conn, sid string) (ServiceHealth, error) {
+	health := ServiceHealth{Status: HealthOK}
+	values, err := redis.Values(rconn.Do("HGETALL", KeyForServiceHealth(sid)))
+	if err != nil || len(values) == 0 {
+		return health, err
+	}
+	err = redis.ScanStruct(values, &health)
+	return health, err
+}
+
+// WriteServiceHealth records the outcome of a health check, returning the service's new health.
+func WriteServiceHealth(rconn redis.Conn, sid string, pingErr error, ttl time.Duration) (ServiceHealth, error) {
+	key := KeyForServiceHealth(sid)
+	health := ServiceHealth{Status: HealthOK, Checked: time.Now().Unix()}
+	if pingErr != nil {
+		failures, err := redis.Int(rconn.Do("HINCRBY", key, "failures", 1))
+		if err != nil {
+			return health, err
+		}
+		health.Failures = failures
+		health.Error = pingErr.Error()
+		health.Status = HealthDegraded
+		if failures >= HealthDownAfter {
+			health.Status = HealthDown
+		}
+	}
+
+	rconn.Send("MULTI")
+	rconn.Send("HMSET", redis.Args{}.Add(key).AddFlat(&health)...)
+	rconn.Send("PEXPIRE", key, int64(ttl/time.Millisecond))
+	_, err := rconn.Do("EXEC")
+	return health, err
+}
+
+// A HealthChecker periodically pings all services that support it, and records their health.
+type HealthChecker struct {
+	Pool     *redis.Pool
+	Interval time.Duration
+}
+
+// Run runs the HealthChecker until the context expires.
+func (c *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.checkAll()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *HealthChecker) checkAll() {
+	rconn := c.Pool.Get()
+	defer rconn.Close()
+
+	for sid, svc := range media.Services() {
+		pinger, ok := svc.(media.Pinger)
+		if !ok {
+			continue
+		}
+
+		// Forget about a service if the checker stops running, rather than refusing it forever.
+		health, err := WriteServiceHealth(rconn, sid, pinger.Ping(), 5*c.Interval)
+		if err != nil {
+			log.WithError(err).WithField("service", sid).Error("HealthChecker: Couldn't record health")
+			continue
+		}
+		if health.Status != HealthOK {
+			log.WithFields(log.Fields{
+				"service":  sid,
+				"status":   health.Status,
+				"failures": health.Failures,
+			}).Warn("HealthChecker: " + health.Error)
+		}
+	}
+}
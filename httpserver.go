@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// The HTTPServer subsystem serves endpoints for external integrations. Like the Responder, it has
+// no direct access to the Player; everything goes through Redis.
+type HTTPServer struct {
+	Addr string
+	Pool *redis.Pool
+
+	// Ways to authenticate API requests, tried in order. Defaults to RedisTokenAuth.
+	Auth []AuthProvider
+
+	// Serve the dashboard under /dashboard/, if set. It should be among the Auth providers too.
+	Dashboard *Dashboard
+
+	// Serve over TLS with this certificate and key, if set. With a client CA, clients can also
+	// present certificates signed by it, for ClientCertAuth.
+	TLSCert  string
+	TLSKey   string
+	ClientCA string
+}
+
+// Run runs the HTTP server until the context expires.
+func (s *HTTPServer) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhooks/", s.HandleWebhook)
+	mux.HandleFunc("/api/guilds/", s.HandleAPI)
+	mux.HandleFunc("/status/", s.HandleStatusPage)
+	if s.Dashboard != nil {
+		mux.Handle("/dashboard/", s.Dashboard)
+	}
+
+	srv := &http.Server{Addr: s.Addr, Handler: mux}
+	if s.ClientCA != "" {
+		pem, err := ioutil.ReadFile(s.ClientCA)
+		if err != nil {
+			log.WithError(err).Error("HTTPServer: Couldn't read client CA")
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Error("HTTPServer: No certificates found in client CA")
+			return
+		}
+		srv.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.WithError(err).Warn("HTTPServer: Couldn't shut down cleanly")
+		}
+	}()
+
+	log.WithFields(log.Fields{"addr": s.Addr, "tls": s.TLSCert != ""}).Info("HTTPServer: Listening")
+	var err error
+	if s.TLSCert != "" {
+		err = srv.ListenAndServeTLS(s.TLSCert, s.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("HTTPServer: Couldn't listen")
+	}
+}
+
+func (s *HTTPServer) authProviders() []AuthProvider {
+	if len(s.Auth) == 0 {
+		return []AuthProvider{RedisTokenAuth{}}
+	}
+	return s.Auth
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("HTTPServer: Couldn't write response")
+	}
+}
+
+// writeError writes a JSON error response.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
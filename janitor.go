@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+// GuildMembership holds the guilds each bot is in, by bot ID; the primary bot's is "".
+type GuildMembership map[string]map[string]bool
+
+// FetchGuilds lists the guilds a session's bot is in.
+func FetchGuilds(session *discordgo.Session) (map[string]bool, error) {
+	guilds := map[string]bool{}
+	after := ""
+	for {
+		page, err := session.UserGuilds(100, "", after)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range page {
+			guilds[g.ID] = true
+		}
+		if len(page) < 100 {
+			return guilds, nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// FetchMembership lists the guilds bots are in, from their sessions; the primary bot's first,
+// then linked bots'.
+func FetchMembership(sessions []*discordgo.Session) (GuildMembership, error) {
+	members := GuildMembership{}
+	for i, session := range sessions {
+		bid := ""
+		if i > 0 {
+			user, err := session.User("@me")
+			if err != nil {
+				return nil, err
+			}
+			bid = user.ID
+		}
+		guilds, err := FetchGuilds(session)
+		if err != nil {
+			return nil, err
+		}
+		members[bid] = guilds
+	}
+	return members, nil
+}
+
+// StaleKeys finds keys left behind by guilds that bots have left: all of a guild's keys once the
+// primary bot is gone from it, or a linked bot's queue once that bot is. API tokens limited to
+// those guilds, their status pages and webhooks queueing into them are stale too.
+//
+// Linked bots that aren't in the membership are left alone, as there's no telling where they are.
+func StaleKeys(rconn redis.Conn, members GuildMembership) ([]string, error) {
+	serverKeys, err := scanKeys(rconn, "hiqty:server:*")
+	if err != nil {
+		return nil, err
+	}
+	stale, err := withRelatedKeys(rconn, staleServerKeys(serverKeys, members))
+	if err != nil {
+		return nil, err
+	}
+	webhooks, err := webhookKeys(rconn, func(gid string) bool { return !members[""][gid] })
+	if err != nil {
+		return nil, err
+	}
+	return append(stale, webhooks...), nil
+}
+
+// GuildKeys returns all of a guild's keys, as StaleKeys would once the primary bot has left it.
+func GuildKeys(rconn redis.Conn, gid string) ([]string, error) {
+	serverKeys, err := scanKeys(rconn, KeyForServer(gid, "*"))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := withRelatedKeys(rconn, serverKeys)
+	if err != nil {
+		return nil, err
+	}
+	webhooks, err := webhookKeys(rconn, func(wgid string) bool { return wgid == gid })
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, webhooks...), nil
+}
+
+// withRelatedKeys adds the keys that go with a guild's keys, but live elsewhere: its API tokens and
+// its status page.
+func withRelatedKeys(rconn redis.Conn, keys []string) ([]string, error) {
+	for _, key := range keys {
+		if strings.HasSuffix(key, ":status_page") {
+			slug, err := redis.String(rconn.Do("GET", key))
+			if err != nil && err != redis.ErrNil {
+				return nil, err
+			}
+			if slug != "" {
+				keys = append(keys, KeyForStatusPage(slug))
+			}
+			continue
+		}
+		if !strings.HasSuffix(key, ":apitokens") {
+			continue
+		}
+		hashes, err := redis.Strings(rconn.Do("SMEMBERS", key))
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range hashes {
+			keys = append(keys, KeyForAPIToken(hash))
+		}
+	}
+	return keys, nil
+}
+
+// webhookKeys returns the keys of webhooks queueing into guilds that match a predicate.
+func webhookKeys(rconn redis.Conn, match func(gid string) bool) ([]string, error) {
+	keys, err := scanKeys(rconn, KeyForWebhook("*"))
+	if err != nil {
+		return nil, err
+	}
+	matched := []string{}
+	for _, key := range keys {
+		gid, err := redis.String(rconn.Do("GET", key))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if match(gid) {
+			matched = append(matched, key)
+		}
+	}
+	return matched, nil
+}
+
+// DeleteKeys deletes keys, in batches.
+func DeleteKeys(rconn redis.Conn, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 500 {
+			n = 500
+		}
+		if _, err := rconn.Do("DEL", redis.Args{}.AddFlat(keys[:n])...); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// staleServerKeys picks out the stale ones among hiqty:server:* keys.
+func staleServerKeys(keys []string, members GuildMembership) []string {
+	stale := []string{}
+	for _, key := range keys {
+		gid, bid, ok := parseServerKey(key)
+		if !ok {
+			continue
+		}
+		if !members[""][gid] {
+			stale = append(stale, key)
+		} else if guilds, known := members[bid]; known && !guilds[gid] {
+			stale = append(stale, key)
+		}
+	}
+	return stale
+}
+
+// parseServerKey returns the guild a hiqty:server:* key belongs to, and the linked bot, if any.
+func parseServerKey(key string) (gid, bid string, ok bool) {
+	parts := strings.SplitN(key, ":", 6)
+	if len(parts) < 4 || parts[0] != "hiqty" || parts[1] != "server" {
+		return "", "", false
+	}
+	if len(parts) >= 6 && parts[3] == "bot" {
+		return parts[2], parts[4], true
+	}
+	return parts[2], "", true
+}
+
+func scanKeys(rconn redis.Conn, pattern string) ([]string, error) {
+	keys := []string{}
+	cursor := 0
+	for {
+		values, err := redis.Values(rconn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		if _, err := redis.Scan(values, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// The Janitor periodically deletes keys left behind by guilds that bots have left.
+type Janitor struct {
+	Pool     *redis.Pool
+	Sessions []*discordgo.Session // The primary bot's session first, then linked bots'
+	Interval time.Duration
+}
+
+// Run runs the Janitor until the context expires.
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			j.clean()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (j *Janitor) clean() {
+	// Don't guess: if any bot's guilds can't be listed, try again next time.
+	members, err := FetchMembership(j.Sessions)
+	if err != nil {
+		log.WithError(err).Warn("Janitor: Couldn't list guilds")
+		return
+	}
+
+	rconn := j.Pool.Get()
+	defer rconn.Close()
+
+	keys, err := StaleKeys(rconn, members)
+	if err != nil {
+		log.WithError(err).Error("Janitor: Couldn't find stale keys")
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := DeleteKeys(rconn, keys); err != nil {
+		log.WithError(err).Error("Janitor: Couldn't delete stale keys")
+		return
+	}
+	log.WithField("keys", len(keys)).Info("Janitor: Deleted stale keys")
+}
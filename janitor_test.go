@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseServerKey(t *testing.T) {
+	for key, expected := range map[string][2]string{
+		"hiqty:server:123:playlist":              {"123", ""},
+		"hiqty:server:123:message:456:channel":   {"123", ""},
+		"hiqty:server:123:bot:789:state":         {"123", "789"},
+		"hiqty:server:123:bot:789:vc:1:playlist": {"123", "789"},
+	} {
+		gid, bid, ok := parseServerKey(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, expected, [2]string{gid, bid}, key)
+	}
+
+	_, _, ok := parseServerKey("hiqty:webhook:abc")
+	assert.False(t, ok)
+}
+
+func TestStaleServerKeys(t *testing.T) {
+	members := GuildMembership{
+		"":    {"1": true, "2": true},
+		"bot": {"1": true},
+	}
+	assert.Equal(t, []string{
+		"hiqty:server:2:bot:bot:state",
+		"hiqty:server:3:settings",
+		"hiqty:server:3:bot:bot:state",
+	}, staleServerKeys([]string{
+		"hiqty:server:1:settings",
+		"hiqty:server:1:bot:bot:state",
+		"hiqty:server:2:bot:bot:state",
+		"hiqty:server:2:bot:other:state",
+		"hiqty:server:3:settings",
+		"hiqty:server:3:bot:bot:state",
+	}, members))
+}
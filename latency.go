@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+)
+
+// Latency stage names, in the order a request passes through them.
+const (
+	LatencyResolve = "resolve" // Message received -> URL resolved.
+	LatencyEnqueue = "enqueue" // URL resolved -> track pushed onto the playlist.
+	LatencyWait    = "wait"    // Track queued -> player starts it; includes any tracks ahead of it.
+	LatencyStart   = "start"   // Player starts the track -> first audio frame is sent.
+	LatencyTotal   = "total"   // Message received -> first audio frame is sent.
+)
+
+// RequestTiming records when a request passed each stage on its way to being heard. Timestamps
+// that were never recorded, eg. for tracks queued by webhooks rather than messages, are zero.
+type RequestTiming struct {
+	Trace map[string]string `json:",omitempty"` // Span context of the request's trace (see tracing.go)
+
+	Received   time.Time
+	Resolved   time.Time
+	Enqueued   time.Time
+	Started    time.Time
+	FirstFrame time.Time
+}
+
+// LatencyStage is the time spent in a single stage of a request.
+type LatencyStage struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Stages breaks the timing down into stages. Stages with a missing endpoint are omitted.
+func (t RequestTiming) Stages() []LatencyStage {
+	stages := []LatencyStage{}
+	for _, b := range t.stageBounds() {
+		stages = append(stages, LatencyStage{b.Name, b.To.Sub(b.From)})
+	}
+	return stages
+}
+
+type stageBounds struct {
+	Name     string
+	From, To time.Time
+}
+
+func (t RequestTiming) stageBounds() []stageBounds {
+	bounds := []stageBounds{}
+	add := func(name string, from, to time.Time) {
+		if from.IsZero() || to.IsZero() {
+			return
+		}
+		bounds = append(bounds, stageBounds{name, from, to})
+	}
+	add(LatencyResolve, t.Received, t.Resolved)
+	add(LatencyEnqueue, t.Resolved, t.Enqueued)
+	add(LatencyWait, t.Enqueued, t.Started)
+	add(LatencyStart, t.Started, t.FirstFrame)
+	add(LatencyTotal, t.Received, t.FirstFrame)
+	return bounds
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRequestTimingStages(t *testing.T) {
+	t0 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	timing := RequestTiming{
+		Received:   t0,
+		Resolved:   t0.Add(300 * time.Millisecond),
+		Enqueued:   t0.Add(310 * time.Millisecond),
+		Started:    t0.Add(1 * time.Second),
+		FirstFrame: t0.Add(1500 * time.Millisecond),
+	}
+	assert.Equal(t, []LatencyStage{
+		{LatencyResolve, 300 * time.Millisecond},
+		{LatencyEnqueue, 10 * time.Millisecond},
+		{LatencyWait, 690 * time.Millisecond},
+		{LatencyStart, 500 * time.Millisecond},
+		{LatencyTotal, 1500 * time.Millisecond},
+	}, timing.Stages())
+}
+
+func TestRequestTimingStagesPartial(t *testing.T) {
+	t0 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	timing := RequestTiming{
+		Enqueued:   t0,
+		Started:    t0.Add(1 * time.Second),
+		FirstFrame: t0.Add(1200 * time.Millisecond),
+	}
+	assert.Equal(t, []LatencyStage{
+		{LatencyWait, 1 * time.Second},
+		{LatencyStart, 200 * time.Millisecond},
+	}, timing.Stages())
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A LoadTest simulates a number of guilds playing at once, for `hiqty loadtest`. Each one streams a
+// fixture served over HTTP on localhost through the same pipeline players use, with the packets
+// taken at the pace a voice connection takes them, so changes to the pipeline can be measured
+// without a Discord connection in the way.
+type LoadTest struct {
+	Guilds   int
+	Duration time.Duration
+	Fixture  []byte // Audio in any format ffmpeg understands; restarted until the test is over
+	Bitrate  int
+	FFmpeg   string
+	Stream   StreamConfig
+	Encoders *EncoderPool // Optional
+}
+
+// A LoadTestReport is what a LoadTest measured.
+type LoadTestReport struct {
+	Guilds  int
+	Elapsed time.Duration
+	Tracks  int // Times the fixture was started, across all guilds
+	Packets int
+	Late    int // Packets that weren't ready a whole frame after they were due, ie. audible gaps
+
+	CPUPerStream        float64 // Share of a core used by hiqty itself, per guild
+	EncoderCPUPerStream float64 // Share of a core used by ffmpeg, per guild
+	AllocBytesPerSecond float64
+	AllocsPerSecond     float64
+
+	Startup DurationStats // From requesting the fixture to its first packet
+	Jitter  DurationStats // How long after it was due each packet was ready
+}
+
+// DurationStats summarizes a set of durations.
+type DurationStats struct {
+	Mean, P99, Max time.Duration
+}
+
+// NewDurationStats summarizes a set of durations, which are sorted in the process.
+func NewDurationStats(ds []time.Duration) DurationStats {
+	if len(ds) == 0 {
+		return DurationStats{}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	return DurationStats{
+		Mean: sum / time.Duration(len(ds)),
+		P99:  ds[(len(ds)-1)*99/100],
+		Max:  ds[len(ds)-1],
+	}
+}
+
+// loadTestGuild is what's measured for a single simulated guild.
+type loadTestGuild struct {
+	tracks, packets, late int
+	startups, jitter      []time.Duration
+	err                   error
+}
+
+// GenerateFixture has ffmpeg generate an MP3 of a tone to load test with.
+func GenerateFixture(ffmpeg string, length time.Duration) ([]byte, error) {
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(ffmpeg, "-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "sine=frequency=440:duration="+strconv.FormatFloat(length.Seconds(), 'f', 3, 64),
+		"-c:a", "libmp3lame", "-b:a", "128k", "-f", "mp3", "pipe:1",
+	)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrap(err, "couldn't generate fixture")
+	}
+	return out.Bytes(), nil
+}
+
+// Run runs the load test, until its duration is up or the context is cancelled.
+func (lt *LoadTest) Run(ctx context.Context) (LoadTestReport, error) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "fixture", time.Time{}, bytes.NewReader(lt.Fixture))
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, lt.Duration)
+	defer cancel()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	allocBytes, allocs := mem.TotalAlloc, mem.Mallocs
+	selfCPU, encoderCPU := cpuTime()
+	start := time.Now()
+
+	guilds := make([]loadTestGuild, lt.Guilds)
+	var wg sync.WaitGroup
+	for i := range guilds {
+		wg.Add(1)
+		go func(g *loadTestGuild, gid string) {
+			defer wg.Done()
+			p := &Player{GuildID: gid, FFmpeg: lt.FFmpeg, Stream: lt.Stream, Encoders: lt.Encoders}
+			for ctx.Err() == nil && g.err == nil {
+				g.err = lt.play(ctx, p, g, server.URL)
+			}
+		}(&guilds[i], fmt.Sprintf("loadtest-%d", i))
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&mem)
+	selfCPU2, encoderCPU2 := cpuTime()
+
+	report := LoadTestReport{Guilds: lt.Guilds, Elapsed: elapsed}
+	streams := float64(lt.Guilds) * elapsed.Seconds()
+	if streams > 0 {
+		report.CPUPerStream = (selfCPU2 - selfCPU).Seconds() / streams
+		report.EncoderCPUPerStream = (encoderCPU2 - encoderCPU).Seconds() / streams
+	}
+	report.AllocBytesPerSecond = float64(mem.TotalAlloc-allocBytes) / elapsed.Seconds()
+	report.AllocsPerSecond = float64(mem.Mallocs-allocs) / elapsed.Seconds()
+
+	var startups, jitter []time.Duration
+	for _, g := range guilds {
+		if g.err != nil {
+			return report, g.err
+		}
+		report.Tracks += g.tracks
+		report.Packets += g.packets
+		report.Late += g.late
+		startups = append(startups, g.startups...)
+		jitter = append(jitter, g.jitter...)
+	}
+	report.Startup = NewDurationStats(startups)
+	report.Jitter = NewDurationStats(jitter)
+	return report, nil
+}
+
+// play streams the fixture once, taking a packet every frame, like a voice connection would.
+func (lt *LoadTest) play(ctx context.Context, p *Player, g *loadTestGuild, url string) error {
+	requested := time.Now()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	g.tracks++
+
+	encoded := p.encode(ctx, p.streamResponse(ctx, res.Body), EncodeOptions{Bitrate: lt.Bitrate}, nil)
+	packets := p.streamPackets(ctx, encoded)
+
+	// Wait for the encoder to exit before returning, so its CPU time is counted.
+	defer func() {
+		for range encoded {
+		}
+	}()
+
+	if _, ok := <-packets; !ok {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errors.New("the encoder didn't produce any audio")
+	}
+	g.packets++
+	g.startups = append(g.startups, time.Since(requested))
+
+	ticker := time.NewTicker(FrameDuration)
+	defer ticker.Stop()
+	for {
+		var due time.Time
+		select {
+		case due = <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+		if _, ok := <-packets; !ok {
+			return nil
+		}
+		g.packets++
+		late := time.Since(due)
+		g.jitter = append(g.jitter, late)
+		if late > FrameDuration {
+			g.late++
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewDurationStats(t *testing.T) {
+	assert.Equal(t, DurationStats{}, NewDurationStats(nil))
+
+	ds := []time.Duration{}
+	for i := 100; i > 0; i-- {
+		ds = append(ds, time.Duration(i)*time.Millisecond)
+	}
+	stats := NewDurationStats(ds)
+	assert.Equal(t, 50500*time.Microsecond, stats.Mean)
+	assert.Equal(t, 99*time.Millisecond, stats.P99)
+	assert.Equal(t, 100*time.Millisecond, stats.Max)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Loggers for subsystems whose level can be set separately from the rest (see --log-level).
+// Everything else logs through the standard logger.
+var (
+	ResponderLog = log.New()
+	PlayerLog    = log.New()
+	WatcherLog   = log.New()
+)
+
+// Subsystem loggers by the names they're configured with.
+var subsystemLoggers = map[string]*log.Logger{
+	"responder": ResponderLog,
+	"player":    PlayerLog,
+	"watcher":   WatcherLog,
+}
+
+// LogConfig describes where and how to log.
+type LogConfig struct {
+	Format     string   // "text" (default) or "json"
+	File       string   // Log to this file instead of stderr, if set
+	MaxSize    int64    // Rotate the file when it grows past this many bytes; 0 to never rotate
+	MaxBackups int      // Rotated files to keep around
+	Levels     []string // "level" for everything, or "subsystem=level" for a single subsystem
+}
+
+// ConfigureLogging applies a logging configuration to the standard logger and all subsystems.
+func ConfigureLogging(cfg LogConfig) error {
+	std := log.StandardLogger()
+
+	switch cfg.Format {
+	case "", "text":
+	case "json":
+		std.Formatter = &log.JSONFormatter{}
+	default:
+		return errors.New("unknown log format: " + cfg.Format)
+	}
+
+	if cfg.File != "" {
+		f, err := OpenRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+		std.Out = f
+	}
+
+	levels := map[string]log.Level{}
+	for _, spec := range cfg.Levels {
+		name, lvl := "", spec
+		if i := strings.IndexRune(spec, '='); i != -1 {
+			name, lvl = spec[:i], spec[i+1:]
+		}
+		level, err := log.ParseLevel(lvl)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			std.SetLevel(level)
+			continue
+		}
+		if subsystemLoggers[name] == nil {
+			return errors.New("unknown log subsystem: " + name)
+		}
+		levels[name] = level
+	}
+
+	for name, logger := range subsystemLoggers {
+		logger.Out = std.Out
+		logger.Formatter = std.Formatter
+		logger.Hooks = std.Hooks
+		if level, ok := levels[name]; ok {
+			logger.SetLevel(level)
+		} else {
+			logger.SetLevel(std.Level)
+		}
+	}
+	return nil
+}
+
+// A RotatingFile is a log file that's rotated when it grows too large; "hiqty.log" is renamed to
+// "hiqty.log.1", which is renamed to "hiqty.log.2", and so on, up to a number of backups.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+// OpenRotatingFile opens a log file for appending, creating it if it doesn't exist.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.file.Close()
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", f.Path, i) }
+	if f.MaxBackups > 0 {
+		os.Remove(backup(f.MaxBackups))
+		for i := f.MaxBackups - 1; i > 0; i-- {
+			os.Rename(backup(i), backup(i+1))
+		}
+		if err := os.Rename(f.Path, backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.Path); err != nil {
+		return err
+	}
+	return f.open()
+}
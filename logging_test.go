@@ -0,0 +1,50 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiqty")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hiqty.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+
+	for file, data := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		b, err := ioutil.ReadFile(file)
+		assert.NoError(t, err, file)
+		assert.Equal(t, data, string(b), file)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestConfigureLoggingLevels(t *testing.T) {
+	defer ConfigureLogging(LogConfig{Levels: []string{"info"}})
+
+	assert.NoError(t, ConfigureLogging(LogConfig{Levels: []string{"warn", "player=debug"}}))
+	assert.Equal(t, log.WarnLevel, log.GetLevel())
+	assert.Equal(t, log.DebugLevel, PlayerLog.Level)
+	assert.Equal(t, log.WarnLevel, ResponderLog.Level)
+
+	assert.Error(t, ConfigureLogging(LogConfig{Levels: []string{"mixer=debug"}}))
+	assert.Error(t, ConfigureLogging(LogConfig{Format: "xml"}))
+}
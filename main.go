@@ -7,33 +7,131 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/gomodule/redigo/redis"
 	"github.com/joho/godotenv"
+	"github.com/pkg/errors"
 	"github.com/sencrash/hiqty/media"
-	"github.com/sencrash/hiqty/media/soundcloud"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"gopkg.in/urfave/cli.v2"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 func populateServices(cc *cli.Context) error {
-	// SoundCloud
-	{
-		clientID := cc.String("soundcloud-client-id")
-		if clientID != "" {
-			media.Register(soundcloud.New(
-				cc.String("soundcloud-client-id"),
-			))
-			log.Info("Service Registered: soundcloud")
-		} else {
-			log.Warn("Service Unavailable: soundcloud")
+	// Shared HTTP settings; these have to be in place before services are created.
+	if ua := cc.String("user-agent"); ua != "" {
+		media.DefaultTransport.UserAgent = ua
+	}
+	media.DefaultTransport.Retries = cc.Int("http-retries")
+	for _, header := range cc.StringSlice("http-header") {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return cli.Exit("Invalid --http-header, expected \"Name: value\": "+header, 1)
+		}
+		if media.DefaultTransport.Headers == nil {
+			media.DefaultTransport.Headers = http.Header{}
+		}
+		media.DefaultTransport.Headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	if dir := cc.String("template-dir"); dir != "" {
+		if err := LoadTemplates(dir); err != nil {
+			return cli.Exit("Couldn't load templates: "+err.Error(), 1)
 		}
 	}
 
+	RegisterServices(ServiceConfigFromContext(cc))
+
 	return nil
 }
 
+func newPool(cc *cli.Context) *redis.Pool {
+	// The address is validated up front, in app.Before.
+	cfg, _ := ParseRedisConfig(cc.String("redis"))
+	return &redis.Pool{
+		IdleTimeout: 2 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial(cfg.Network, cfg.Addr, cfg.DialOptions()...)
+			if err != nil {
+				MetricRedisErrors.Inc()
+				return nil, err
+			}
+			return metricsConn{conn}, nil
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// newBus creates the bus selected with --bus; each PlayerController needs one of its own.
+func newBus(cc *cli.Context, pool *redis.Pool) (Bus, error) {
+	redisCfg, _ := ParseRedisConfig(cc.String("redis"))
+	return NewBus(cc.String("bus"), pool, redisCfg.DB, cc.Duration("state-poll-interval"), cc.String("nats-url"))
+}
+
+// streamConfig reads how tracks are streamed from flags.
+func streamConfig(cc *cli.Context) StreamConfig {
+	return StreamConfig{ChunkSize: cc.Int("stream-chunk-size"), Buffer: cc.Int("stream-buffer")}
+}
+
+// newAuthProviders sets up ways to authenticate to the HTTP API. Tokens stored in Redis are always
+// accepted; anything else has to be configured.
+func newAuthProviders(cc *cli.Context) ([]AuthProvider, error) {
+	auth := []AuthProvider{RedisTokenAuth{}}
+
+	if grants := cc.StringSlice("api-static-token"); len(grants) > 0 {
+		static := StaticTokenAuth{Tokens: map[string]APIToken{}}
+		for _, grant := range grants {
+			token, t, err := ParseAuthGrant(grant)
+			if err != nil {
+				return nil, errors.Wrap(err, "--api-static-token")
+			}
+			static.Tokens[token] = t
+		}
+		auth = append(auth, static)
+	}
+
+	if grants := cc.StringSlice("api-client-cert"); len(grants) > 0 {
+		if cc.String("http-client-ca") == "" {
+			return nil, errors.New("--api-client-cert requires --http-client-ca")
+		}
+		certs := ClientCertAuth{Names: map[string]APIToken{}}
+		for _, grant := range grants {
+			name, t, err := ParseAuthGrant(grant)
+			if err != nil {
+				return nil, errors.Wrap(err, "--api-client-cert")
+			}
+			certs.Names[name] = t
+		}
+		auth = append(auth, certs)
+	}
+
+	if issuer := cc.String("oidc-issuer"); issuer != "" {
+		if cc.String("oidc-audience") == "" {
+			return nil, errors.New("--oidc-issuer requires --oidc-audience")
+		}
+		oidcAuth, err := NewOIDCAuth(&http.Client{Timeout: 10 * time.Second}, issuer, cc.String("oidc-audience"))
+		if err != nil {
+			return nil, errors.Wrap(err, "--oidc-issuer")
+		}
+		oidcAuth.ScopeClaim = cc.String("oidc-scope-claim")
+		oidcAuth.GuildClaim = cc.String("oidc-guild-claim")
+		oidcAuth.AllowGlobal = cc.Bool("oidc-allow-global")
+		auth = append(auth, oidcAuth)
+	}
+
+	return auth, nil
+}
+
 func actionRun(cc *cli.Context) error {
 	token := cc.String("token")
 	if token == "" {
@@ -45,19 +143,21 @@ func actionRun(cc *cli.Context) error {
 		return cli.Exit(err.Error(), 1)
 	}
 
-	redisAddr := cc.String("redis")
-	pool := &redis.Pool{
-		IdleTimeout: 2 * time.Minute,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", redisAddr)
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			if time.Since(t) < time.Minute {
-				return nil
-			}
-			_, err := c.Do("PING")
-			return err
-		},
+	pool := newPool(cc)
+	if err := checkSchema(pool); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	bus, err := newBus(cc, pool)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	store := &RedisStore{Pool: pool, Bus: bus}
+
+	var tts TTS
+	if spec := cc.String("tts"); spec != "" {
+		if tts, err = NewTTS(spec); err != nil {
+			return cli.Exit("Invalid --tts: "+err.Error(), 1)
+		}
 	}
 
 	// Log connection state changes.
@@ -77,6 +177,16 @@ func actionRun(cc *cli.Context) error {
 		}).Info("Ready!")
 	})
 
+	var tracerProvider *sdktrace.TracerProvider
+	if endpoint := cc.String("otlp-endpoint"); endpoint != "" {
+		tp, err := NewTracerProvider(context.Background(), endpoint, cc.String("otel-service-name"))
+		if err != nil {
+			return cli.Exit("Invalid --otlp-endpoint: "+err.Error(), 1)
+		}
+		otel.SetTracerProvider(tp)
+		tracerProvider = tp
+	}
+
 	// Run the Responder and the Player in goroutines.
 	wg := sync.WaitGroup{}
 	ctx, cancel := context.WithCancel(context.Background())
@@ -84,6 +194,10 @@ func actionRun(cc *cli.Context) error {
 	responder := Responder{
 		Session: session,
 		Pool:    pool,
+		Store:   store,
+		Owners:  cc.StringSlice("owner"),
+		URL:     cc.String("dashboard-url"),
+		TTS:     tts != nil,
 	}
 	wg.Add(1)
 	go func() {
@@ -93,9 +207,32 @@ func actionRun(cc *cli.Context) error {
 		wg.Done()
 	}()
 
+	// Players of all bots share spare encoders, and a supervisor for their goroutines; it keeps
+	// running until they've all stopped.
+	supervisor := &Supervisor{}
+	supervisorCtx, stopSupervisor := context.WithCancel(context.Background())
+	defer stopSupervisor()
+	go supervisor.Run(supervisorCtx)
+
+	var encoders *EncoderPool
+	if spares := cc.Int("encoder-spares"); spares > 0 {
+		encoders = &EncoderPool{FFmpeg: cc.String("ffmpeg"), Size: spares}
+		wg.Add(1)
+		go func() {
+			encoders.Run(ctx)
+			wg.Done()
+		}()
+	}
+
 	playerController := PlayerController{
-		Session: session,
-		Pool:    pool,
+		Session:    session,
+		Pool:       pool,
+		Store:      store,
+		FFmpeg:     cc.String("ffmpeg"),
+		Encoders:   encoders,
+		Supervisor: supervisor,
+		TTS:        tts,
+		Stream:     streamConfig(cc),
 	}
 	wg.Add(1)
 	go func() {
@@ -105,22 +242,232 @@ func actionRun(cc *cli.Context) error {
 		wg.Done()
 	}()
 
+	// Linked bots get a Responder and a PlayerController of their own, playing from separate queues.
+	sessions := []*discordgo.Session{session}
+	for _, linkedToken := range cc.StringSlice("linked-token") {
+		linked, err := discordgo.New("Bot " + linkedToken)
+		if err != nil {
+			cancel()
+			return cli.Exit(err.Error(), 1)
+		}
+		linked.AddHandler(func(_ *discordgo.Session, e *discordgo.Ready) {
+			log.WithFields(log.Fields{
+				"protocol": e.Version,
+				"username": fmt.Sprintf("%s#%s", e.User.Username, e.User.Discriminator),
+			}).Info("Ready! (linked)")
+		})
+		sessions = append(sessions, linked)
+
+		// Each bot watches the states of its own queues.
+		linkedBus, err := newBus(cc, pool)
+		if err != nil {
+			cancel()
+			return cli.Exit(err.Error(), 1)
+		}
+		linkedStore := &RedisStore{Pool: pool, Bus: linkedBus}
+		linkedResponder := Responder{
+			Session: linked,
+			Pool:    pool,
+			Store:   linkedStore,
+			Linked:  true,
+			Owners:  cc.StringSlice("owner"),
+			URL:     cc.String("dashboard-url"),
+			TTS:     tts != nil,
+		}
+		linkedController := PlayerController{
+			Session:    linked,
+			Pool:       pool,
+			Store:      linkedStore,
+			FFmpeg:     cc.String("ffmpeg"),
+			Encoders:   encoders,
+			Supervisor: supervisor,
+			TTS:        tts,
+			Stream:     streamConfig(cc),
+			Linked:     true,
+		}
+		wg.Add(2)
+		go func() {
+			log.Info("Responder (linked): Initializing")
+			linkedResponder.Run(ctx)
+			log.Info("Responder (linked): Terminated")
+			wg.Done()
+		}()
+		go func() {
+			log.Info("PlayerController (linked): Initializing")
+			linkedController.Run(ctx)
+			log.Info("PlayerController (linked): Terminated")
+			wg.Done()
+		}()
+	}
+
+	if interval := cc.Duration("cleanup-interval"); interval > 0 {
+		janitor := Janitor{
+			Pool:     pool,
+			Sessions: sessions,
+			Interval: interval,
+		}
+		wg.Add(1)
+		go func() {
+			log.Info("Janitor: Initializing")
+			janitor.Run(ctx)
+			log.Info("Janitor: Terminated")
+			wg.Done()
+		}()
+	}
+
+	healthChecker := HealthChecker{
+		Pool:     pool,
+		Interval: cc.Duration("health-interval"),
+	}
+	wg.Add(1)
+	go func() {
+		log.Info("HealthChecker: Initializing")
+		healthChecker.Run(ctx)
+		log.Info("HealthChecker: Terminated")
+		wg.Done()
+	}()
+
+	if addr := cc.String("http"); addr != "" {
+		auth, err := newAuthProviders(cc)
+		if err != nil {
+			cancel()
+			return cli.Exit(err.Error(), 1)
+		}
+		httpServer := HTTPServer{
+			Addr:     addr,
+			Pool:     pool,
+			Auth:     auth,
+			TLSCert:  cc.String("http-tls-cert"),
+			TLSKey:   cc.String("http-tls-key"),
+			ClientCA: cc.String("http-client-ca"),
+		}
+		if clientID := cc.String("dashboard-client-id"); clientID != "" {
+			if cc.String("dashboard-client-secret") == "" || cc.String("dashboard-url") == "" {
+				cancel()
+				return cli.Exit("--dashboard-client-id requires --dashboard-client-secret and --dashboard-url", 1)
+			}
+			httpServer.Dashboard = &Dashboard{
+				Pool:         pool,
+				ClientID:     clientID,
+				ClientSecret: cc.String("dashboard-client-secret"),
+				URL:          cc.String("dashboard-url"),
+				Sessions:     sessions,
+				Client:       http.Client{Timeout: 10 * time.Second},
+			}
+			httpServer.Auth = append(httpServer.Auth, httpServer.Dashboard)
+		}
+		wg.Add(1)
+		go func() {
+			log.Info("HTTPServer: Initializing")
+			httpServer.Run(ctx)
+			log.Info("HTTPServer: Terminated")
+			wg.Done()
+		}()
+	}
+
+	if addr := cc.String("metrics"); addr != "" {
+		metricsServer := MetricsServer{Addr: addr, Store: store}
+		wg.Add(1)
+		go func() {
+			log.Info("MetricsServer: Initializing")
+			metricsServer.Run(ctx)
+			log.Info("MetricsServer: Terminated")
+			wg.Done()
+		}()
+	}
+
+	if cc.Bool("pprof") {
+		debugServer := DebugServer{Addr: cc.String("pprof-addr")}
+		wg.Add(1)
+		go func() {
+			log.Info("DebugServer: Initializing")
+			debugServer.Run(ctx)
+			log.Info("DebugServer: Terminated")
+			wg.Done()
+		}()
+	}
+
+	if channel := cc.String("twitch-channel"); channel != "" {
+		twitchBridge := TwitchBridge{
+			Pool:        pool,
+			Nick:        cc.String("twitch-nick"),
+			Token:       cc.String("twitch-token"),
+			Channel:     channel,
+			GuildID:     cc.String("twitch-guild"),
+			Quota:       cc.Int("twitch-quota"),
+			QuotaWindow: cc.Duration("twitch-quota-window"),
+		}
+		if twitchBridge.Nick == "" || twitchBridge.Token == "" || twitchBridge.GuildID == "" {
+			cancel()
+			return cli.Exit("--twitch-channel requires --twitch-nick, --twitch-token and --twitch-guild", 1)
+		}
+		wg.Add(1)
+		go func() {
+			log.Info("TwitchBridge: Initializing")
+			twitchBridge.Run(ctx)
+			log.Info("TwitchBridge: Terminated")
+			wg.Done()
+		}()
+	}
+
+	if gid := cc.String("mpris-guild"); gid != "" {
+		mprisBridge := MPRISBridge{
+			Pool:    pool,
+			GuildID: gid,
+		}
+		wg.Add(1)
+		go func() {
+			log.Info("MPRISBridge: Initializing")
+			mprisBridge.Run(ctx)
+			log.Info("MPRISBridge: Terminated")
+			wg.Done()
+		}()
+	}
+
 	// Connect to Discord.
-	if err := session.Open(); err != nil {
-		log.WithError(err).Error("Couldn't connect to Discord!")
-		return err
+	for _, s := range sessions {
+		if err := s.Open(); err != nil {
+			log.WithError(err).Error("Couldn't connect to Discord!")
+			cancel()
+			return err
+		}
 	}
 
-	// Wait for a signal before exiting.
-	quit := make(chan os.Signal)
+	// Wait for a signal before exiting; SIGHUP reloads service credentials instead.
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-	sig := <-quit
-	log.WithField("sig", sig).Info("Signal")
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for waiting := true; waiting; {
+		select {
+		case sig := <-reload:
+			log.WithField("sig", sig).Info("Signal: Reloading services")
+			cfg, err := ReloadServiceConfig(cc)
+			if err != nil {
+				log.WithError(err).Error("Couldn't reload services")
+				continue
+			}
+			RegisterServices(cfg)
+		case sig := <-quit:
+			log.WithField("sig", sig).Info("Signal")
+			waiting = false
+		}
+	}
 	signal.Reset()
 
 	// Shut down subsystems, wait for them to finish.
 	cancel()
 	wg.Wait()
+	if tracerProvider != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+			log.WithError(err).Error("Couldn't export remaining traces")
+		}
+		cancelShutdown()
+	}
+	if errorReporter != nil {
+		errorReporter.Flush(5 * time.Second)
+	}
 
 	return nil
 }
@@ -155,6 +502,22 @@ func actionInfo(cc *cli.Context) error {
 	return nil
 }
 
+// Settings from --config, if any, for commands to pick up their flags from.
+var configFile ConfigFile
+
+// setCommandConfig makes commands apply the config file to their own flags before running.
+func setCommandConfig(cmds []*cli.Command) {
+	for _, cmd := range cmds {
+		cmd.Before = func(cc *cli.Context) error {
+			if err := configFile.Apply(cc, cc.Command.Flags); err != nil {
+				return cli.Exit("Invalid config: "+err.Error(), 1)
+			}
+			return nil
+		}
+		setCommandConfig(cmd.Subcommands)
+	}
+}
+
 func main() {
 	if err := godotenv.Load(); err != nil {
 		log.WithError(err).Error("Couldn't load .env")
@@ -165,24 +528,100 @@ func main() {
 	app.Usage = "A high quality Discord music bot"
 	app.HideVersion = true
 	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Aliases: []string{"c"},
+			Usage:   "YAML file to read settings from; flags and environment variables take precedence",
+			EnvVars: []string{"HIQTY_CONFIG"},
+		},
 		&cli.BoolFlag{
 			Name:    "verbose",
 			Aliases: []string{"v"},
 			EnvVars: []string{"HIQTY_VERBOSE"},
 			Usage:   "Log debug messages",
 		},
+		&cli.StringSliceFlag{
+			Name:    "log-level",
+			Usage:   "Log level, or subsystem=level for the responder, player or watcher (may be repeated)",
+			EnvVars: []string{"HIQTY_LOG_LEVEL"},
+		},
+		&cli.StringFlag{
+			Name:    "log-format",
+			Usage:   "Log format: text or json",
+			Value:   "text",
+			EnvVars: []string{"HIQTY_LOG_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:    "log-file",
+			Usage:   "Log to a file instead of stderr",
+			EnvVars: []string{"HIQTY_LOG_FILE"},
+		},
+		&cli.Int64Flag{
+			Name:    "log-max-size",
+			Usage:   "Rotate the log file when it grows past this many megabytes; 0 to never rotate",
+			Value:   100,
+			EnvVars: []string{"HIQTY_LOG_MAX_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:    "log-max-backups",
+			Usage:   "Rotated log files to keep",
+			Value:   3,
+			EnvVars: []string{"HIQTY_LOG_MAX_BACKUPS"},
+		},
+		&cli.StringFlag{
+			Name:    "sentry-dsn",
+			Usage:   "Report errors and crashes to Sentry",
+			EnvVars: []string{"SENTRY_DSN"},
+		},
 		&cli.StringFlag{
 			Name:    "redis",
 			Aliases: []string{"r"},
-			Usage:   "Redis address",
+			Usage:   "Redis address, as host:port, redis[s]://[:password@]host[:port][/db], or a Unix socket path (unix:///path?db=N)",
 			EnvVars: []string{"HIQTY_REDIS"},
 			Value:   "127.0.0.1:6379",
 		},
+		&cli.StringFlag{
+			Name:    "bus",
+			Usage:   "How player state changes reach the player: keyspace (Redis keyspace events, or polling if they can't be enabled), poll, streams (a Redis stream) or nats",
+			EnvVars: []string{"HIQTY_BUS"},
+			Value:   BusKeyspace,
+		},
+		&cli.StringFlag{
+			Name:    "nats-url",
+			Usage:   "NATS server for the nats bus, as nats://[user:password@]host[:port]",
+			EnvVars: []string{"HIQTY_NATS_URL"},
+		},
 		&cli.StringFlag{
 			Name:    "soundcloud-client-id",
 			Usage:   "Soundcloud Client ID",
 			EnvVars: []string{"SOUNDCLOUD_CLIENT_ID"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "plugin",
+			Usage:   "Base URL of a plugin service (may be repeated)",
+			EnvVars: []string{"HIQTY_PLUGINS"},
+		},
+		&cli.StringFlag{
+			Name:    "template-dir",
+			Usage:   "Directory of message templates (eg. announce.tmpl) to use instead of the built-in ones",
+			EnvVars: []string{"HIQTY_TEMPLATE_DIR"},
+		},
+		&cli.StringFlag{
+			Name:    "user-agent",
+			Usage:   "User-Agent to send to services and media servers",
+			EnvVars: []string{"HIQTY_USER_AGENT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "http-header",
+			Usage:   "Extra header to send to services and media servers, eg. \"Referer: https://example.com/\" (may be repeated)",
+			EnvVars: []string{"HIQTY_HTTP_HEADERS"},
+		},
+		&cli.IntFlag{
+			Name:    "http-retries",
+			Usage:   "Number of times to retry failed requests to services and media servers",
+			EnvVars: []string{"HIQTY_HTTP_RETRIES"},
+			Value:   2,
+		},
 	}
 	app.Commands = []*cli.Command{
 		&cli.Command{
@@ -196,6 +635,493 @@ func main() {
 					Usage:   "Discord token",
 					EnvVars: []string{"HIQTY_BOT_TOKEN"},
 				},
+				&cli.StringSliceFlag{
+					Name:    "linked-token",
+					Usage:   "Discord token for an additional bot, with its own queues, so guilds can have music in several voice channels at once",
+					EnvVars: []string{"HIQTY_LINKED_TOKENS"},
+				},
+				&cli.StringFlag{
+					Name:    "ffmpeg",
+					Usage:   "Path to ffmpeg, used to encode audio",
+					Value:   "ffmpeg",
+					EnvVars: []string{"HIQTY_FFMPEG"},
+				},
+				&cli.IntFlag{
+					Name:    "encoder-spares",
+					Usage:   "How many encoders to keep started ahead of time for each channel bitrate in use, so tracks start sooner; 0 to start them as needed",
+					Value:   1,
+					EnvVars: []string{"HIQTY_ENCODER_SPARES"},
+				},
+				&cli.IntFlag{
+					Name:    "stream-chunk-size",
+					Usage:   "How much of a track to download at a time, in bytes",
+					Value:   DefaultStreamChunkSize,
+					EnvVars: []string{"HIQTY_STREAM_CHUNK_SIZE"},
+				},
+				&cli.IntFlag{
+					Name:    "stream-buffer",
+					Usage:   "How many chunks of a track to download ahead of the encoder",
+					Value:   DefaultStreamBuffer,
+					EnvVars: []string{"HIQTY_STREAM_BUFFER"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "owner",
+					Usage:   "Discord user ID of a bot owner, who can use owner commands in any guild (may be repeated)",
+					EnvVars: []string{"HIQTY_OWNERS"},
+				},
+				&cli.StringFlag{
+					Name:    "tts",
+					Usage:   "Text-to-speech backend for spoken announcements: the URL of an HTTP service that takes a text parameter and responds with audio, or a command that reads text on stdin and writes audio to stdout, eg. \"espeak-ng --stdin --stdout\"",
+					EnvVars: []string{"HIQTY_TTS"},
+				},
+				&cli.DurationFlag{
+					Name:    "state-poll-interval",
+					Usage:   "How often to poll player states if Redis doesn't allow enabling keyspace events",
+					Value:   2 * time.Second,
+					EnvVars: []string{"HIQTY_STATE_POLL_INTERVAL"},
+				},
+				&cli.DurationFlag{
+					Name:    "cleanup-interval",
+					Usage:   "How often to delete data of guilds the bots have left; 0 to never do it",
+					Value:   24 * time.Hour,
+					EnvVars: []string{"HIQTY_CLEANUP_INTERVAL"},
+				},
+				&cli.DurationFlag{
+					Name:    "health-interval",
+					Usage:   "How often to check that services are working",
+					Value:   1 * time.Minute,
+					EnvVars: []string{"HIQTY_HEALTH_INTERVAL"},
+				},
+				&cli.StringFlag{
+					Name:    "metrics",
+					Usage:   "Address to serve Prometheus metrics on, eg. 127.0.0.1:9090",
+					EnvVars: []string{"HIQTY_METRICS"},
+				},
+				&cli.StringFlag{
+					Name:    "otlp-endpoint",
+					Usage:   "OpenTelemetry collector to export request traces to over OTLP/HTTP, eg. http://localhost:4318",
+					EnvVars: []string{"OTEL_EXPORTER_OTLP_ENDPOINT"},
+				},
+				&cli.StringFlag{
+					Name:    "otel-service-name",
+					Usage:   "Service name to export traces under",
+					Value:   "hiqty",
+					EnvVars: []string{"OTEL_SERVICE_NAME"},
+				},
+				&cli.BoolFlag{
+					Name:    "pprof",
+					Usage:   "Serve profiling endpoints (/debug/pprof/) on --pprof-addr",
+					EnvVars: []string{"HIQTY_PPROF"},
+				},
+				&cli.StringFlag{
+					Name:    "pprof-addr",
+					Usage:   "Address to serve profiling endpoints on; keep this internal",
+					Value:   "127.0.0.1:6060",
+					EnvVars: []string{"HIQTY_PPROF_ADDR"},
+				},
+				&cli.StringFlag{
+					Name:    "http",
+					Usage:   "Address to serve HTTP endpoints (eg. webhooks) on, eg. 127.0.0.1:8080",
+					EnvVars: []string{"HIQTY_HTTP"},
+				},
+				&cli.StringFlag{
+					Name:    "http-tls-cert",
+					Usage:   "TLS certificate to serve HTTP endpoints with",
+					EnvVars: []string{"HIQTY_HTTP_TLS_CERT"},
+				},
+				&cli.StringFlag{
+					Name:    "http-tls-key",
+					Usage:   "TLS key to serve HTTP endpoints with",
+					EnvVars: []string{"HIQTY_HTTP_TLS_KEY"},
+				},
+				&cli.StringFlag{
+					Name:    "http-client-ca",
+					Usage:   "CA to verify TLS client certificates against, for --api-client-cert",
+					EnvVars: []string{"HIQTY_HTTP_CLIENT_CA"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "api-static-token",
+					Usage:   "Static API token, as scope[/guild]=token (may be repeated)",
+					EnvVars: []string{"HIQTY_API_STATIC_TOKENS"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "api-client-cert",
+					Usage:   "Grant API access to a TLS client certificate, as scope[/guild]=common-name (may be repeated)",
+					EnvVars: []string{"HIQTY_API_CLIENT_CERTS"},
+				},
+				&cli.StringFlag{
+					Name:    "oidc-issuer",
+					Usage:   "Accept ID tokens from this OpenID Connect issuer for the API",
+					EnvVars: []string{"HIQTY_OIDC_ISSUER"},
+				},
+				&cli.StringFlag{
+					Name:    "oidc-audience",
+					Usage:   "Audience (client ID) ID tokens must be issued for",
+					EnvVars: []string{"HIQTY_OIDC_AUDIENCE"},
+				},
+				&cli.StringFlag{
+					Name:    "oidc-scope-claim",
+					Usage:   "ID token claim holding the API scope",
+					Value:   "hiqty_scope",
+					EnvVars: []string{"HIQTY_OIDC_SCOPE_CLAIM"},
+				},
+				&cli.StringFlag{
+					Name:    "oidc-guild-claim",
+					Usage:   "ID token claim holding the guild ID the token is limited to; tokens without it are refused, unless --oidc-allow-global is set",
+					Value:   "hiqty_guild",
+					EnvVars: []string{"HIQTY_OIDC_GUILD_CLAIM"},
+				},
+				&cli.BoolFlag{
+					Name:    "oidc-allow-global",
+					Usage:   "Accept ID tokens without a guild claim, for every guild",
+					EnvVars: []string{"HIQTY_OIDC_ALLOW_GLOBAL"},
+				},
+				&cli.StringFlag{
+					Name:    "dashboard-client-id",
+					Usage:   "Discord OAuth2 client ID to log into the dashboard with; enables the dashboard",
+					EnvVars: []string{"HIQTY_DASHBOARD_CLIENT_ID"},
+				},
+				&cli.StringFlag{
+					Name:    "dashboard-client-secret",
+					Usage:   "Discord OAuth2 client secret",
+					EnvVars: []string{"HIQTY_DASHBOARD_CLIENT_SECRET"},
+				},
+				&cli.StringFlag{
+					Name:    "dashboard-url",
+					Usage:   "Public URL of the HTTP server, eg. https://hiqty.example.com, for links to status pages; with the dashboard, add <url>/dashboard/callback as a redirect URI",
+					EnvVars: []string{"HIQTY_DASHBOARD_URL"},
+				},
+				&cli.StringFlag{
+					Name:    "mpris-guild",
+					Usage:   "Guild ID to expose playback control for over MPRIS (Linux only)",
+					EnvVars: []string{"HIQTY_MPRIS_GUILD"},
+				},
+				&cli.StringFlag{
+					Name:    "twitch-channel",
+					Usage:   "Twitch channel to take song requests (!sr <url>) from",
+					EnvVars: []string{"HIQTY_TWITCH_CHANNEL"},
+				},
+				&cli.StringFlag{
+					Name:    "twitch-nick",
+					Usage:   "Twitch username to log into chat as",
+					EnvVars: []string{"HIQTY_TWITCH_NICK"},
+				},
+				&cli.StringFlag{
+					Name:    "twitch-token",
+					Usage:   "Twitch chat OAuth token",
+					EnvVars: []string{"HIQTY_TWITCH_TOKEN"},
+				},
+				&cli.StringFlag{
+					Name:    "twitch-guild",
+					Usage:   "Discord guild ID to queue Twitch song requests in",
+					EnvVars: []string{"HIQTY_TWITCH_GUILD"},
+				},
+				&cli.IntFlag{
+					Name:    "twitch-quota",
+					Usage:   "Maximum song requests per viewer per quota window (0 = unlimited)",
+					EnvVars: []string{"HIQTY_TWITCH_QUOTA"},
+					Value:   3,
+				},
+				&cli.DurationFlag{
+					Name:    "twitch-quota-window",
+					Usage:   "Window for per-viewer song request quotas",
+					EnvVars: []string{"HIQTY_TWITCH_QUOTA_WINDOW"},
+					Value:   time.Hour,
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "migrate",
+			Usage:  "Upgrades data in Redis for this release; run it with all instances stopped",
+			Action: actionMigrate,
+		},
+		&cli.Command{
+			Name:      "backup",
+			Usage:     "Backs up all data in Redis to a file (- for stdout)",
+			ArgsUsage: "<file>",
+			Action:    actionBackup,
+		},
+		&cli.Command{
+			Name:      "restore",
+			Usage:     "Restores data from a backup file (- for stdin)",
+			ArgsUsage: "<file>",
+			Action:    actionRestore,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "overwrite",
+					Usage: "Replace keys that already exist, rather than skipping them",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "doctor",
+			Usage:  "Checks the configuration, before running the bot with it",
+			Action: actionDoctor,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "token",
+					Aliases: []string{"t"},
+					Usage:   "Discord token",
+					EnvVars: []string{"HIQTY_BOT_TOKEN"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "linked-token",
+					Usage:   "Discord token for a linked bot, to check too (may be repeated)",
+					EnvVars: []string{"HIQTY_LINKED_TOKENS"},
+				},
+				&cli.StringFlag{
+					Name:    "ffmpeg",
+					Usage:   "Path to ffmpeg, used to encode audio",
+					Value:   "ffmpeg",
+					EnvVars: []string{"HIQTY_FFMPEG"},
+				},
+				&cli.StringSliceFlag{
+					Name:  "test-url",
+					Usage: "URL to try resolving, eg. a track on a service you use (may be repeated)",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "cleanup",
+			Usage:  "Deletes data of guilds the bots have left",
+			Action: actionCleanup,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "token",
+					Aliases: []string{"t"},
+					Usage:   "Discord token",
+					EnvVars: []string{"HIQTY_BOT_TOKEN"},
+				},
+				&cli.StringSliceFlag{
+					Name:    "linked-token",
+					Usage:   "Discord token for a linked bot, whose queues are cleaned up too (may be repeated)",
+					EnvVars: []string{"HIQTY_LINKED_TOKENS"},
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Show what would be deleted, without deleting it",
+				},
+			},
+		},
+		&cli.Command{
+			Name:  "token",
+			Usage: "Manages HTTP API tokens",
+			Subcommands: []*cli.Command{
+				&cli.Command{
+					Name:   "create",
+					Usage:  "Creates an API token",
+					Action: actionTokenCreate,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "scope",
+							Usage: "What the token may do: read, queue or admin",
+							Value: ScopeRead,
+						},
+						&cli.StringFlag{
+							Name:  "guild",
+							Usage: "Guild ID to limit the token to (default: any guild)",
+						},
+					},
+				},
+				&cli.Command{
+					Name:   "list",
+					Usage:  "Lists API tokens, by ID",
+					Action: actionTokenList,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "guild",
+							Usage: "Only list tokens limited to this guild ID",
+						},
+					},
+				},
+				&cli.Command{
+					Name:      "revoke",
+					Usage:     "Revokes an API token",
+					ArgsUsage: "<token>",
+					Action:    actionTokenRevoke,
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "id",
+							Usage: "Take the token's ID (see token list) instead of the token itself",
+						},
+						&cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Show what would be deleted, without deleting it",
+						},
+					},
+				},
+			},
+		},
+		&cli.Command{
+			Name:  "webhook",
+			Usage: "Manages inbound webhooks",
+			Subcommands: []*cli.Command{
+				&cli.Command{
+					Name:      "create",
+					Usage:     "Creates a webhook that queues tracks in a guild",
+					ArgsUsage: "<guild-id>",
+					Action:    actionWebhookCreate,
+				},
+				&cli.Command{
+					Name:      "revoke",
+					Usage:     "Revokes a webhook",
+					ArgsUsage: "<token>",
+					Action:    actionWebhookRevoke,
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Show what would be deleted, without deleting it",
+						},
+					},
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "ctl",
+			Usage:     "Controls playback in a guild",
+			ArgsUsage: "<guild-id> play|pause|stop|skip",
+			Action:    actionCtl,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "bot",
+					Usage: "Control a linked bot's queue, by its user ID",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "ps",
+			Usage:  "Lists guilds with a player state, and which instance is playing in each",
+			Action: actionPs,
+		},
+		&cli.Command{
+			Name:      "purge",
+			Usage:     "Deletes a guild's playlists, player state, active channel and player lock",
+			ArgsUsage: "<guild-id>",
+			Action:    actionPurge,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "all-stale",
+					Usage: "Purge every guild that isn't being played in and has nothing playable queued",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Show what would be deleted, without deleting it",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "resolve",
+			Usage:     "Resolves a URL like a request in chat would, and prints the tracks as JSON",
+			ArgsUsage: "<url>",
+			Action:    actionResolve,
+		},
+		&cli.Command{
+			Name:      "queue",
+			Usage:     "Shows a guild's player state and queued tracks",
+			ArgsUsage: "<guild-id>",
+			Action:    actionQueue,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "bot",
+					Usage: "Show a linked bot's queue, by its user ID",
+				},
+			},
+		},
+		&cli.Command{
+			Name:      "deadletters",
+			Usage:     "Shows queued tracks that couldn't be decoded, and requeues them once they can be",
+			ArgsUsage: "<guild-id>",
+			Action:    actionDeadLetters,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "bot",
+					Usage: "Show a linked bot's dead letters, by its user ID",
+				},
+				&cli.BoolFlag{
+					Name:  "requeue",
+					Usage: "Requeue the ones that can be decoded now, at the end of the active playlist",
+				},
+			},
+		},
+		&cli.Command{
+			Name:   "loadtest",
+			Usage:  "Simulates guilds playing at once from a local fixture, and measures the audio pipeline",
+			Action: actionLoadTest,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "guilds",
+					Usage: "How many guilds to simulate",
+					Value: 10,
+				},
+				&cli.DurationFlag{
+					Name:  "duration",
+					Usage: "How long to run for",
+					Value: 30 * time.Second,
+				},
+				&cli.StringFlag{
+					Name:  "fixture",
+					Usage: "Audio file to stream, in any format ffmpeg understands; a tone is generated if not given",
+				},
+				&cli.IntFlag{
+					Name:  "bitrate",
+					Usage: "Bitrate to encode at, in bits per second",
+					Value: DefaultBitrate,
+				},
+				&cli.StringFlag{
+					Name:    "ffmpeg",
+					Usage:   "Path to ffmpeg, used to encode audio",
+					Value:   "ffmpeg",
+					EnvVars: []string{"HIQTY_FFMPEG"},
+				},
+				&cli.IntFlag{
+					Name:  "encoder-spares",
+					Usage: "How many encoders to keep started ahead of time; 0 to start them as needed",
+					Value: 1,
+				},
+				&cli.IntFlag{
+					Name:  "stream-chunk-size",
+					Usage: "How much of a track to download at a time, in bytes",
+					Value: DefaultStreamChunkSize,
+				},
+				&cli.IntFlag{
+					Name:  "stream-buffer",
+					Usage: "How many chunks of a track to download ahead of the encoder",
+					Value: DefaultStreamBuffer,
+				},
+				&cli.StringFlag{
+					Name:  "cpu-profile",
+					Usage: "Write a CPU profile of the run to a file, for go tool pprof",
+				},
+				&cli.StringFlag{
+					Name:  "mem-profile",
+					Usage: "Write an allocation profile of the run to a file, for go tool pprof",
+				},
+			},
+		},
+		&cli.Command{
+			Name:  "stats",
+			Usage: "Usage statistics",
+			Subcommands: []*cli.Command{
+				&cli.Command{
+					Name:   "export",
+					Usage:  "Exports aggregate usage statistics",
+					Action: actionStatsExport,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "from",
+							Usage: "First day to export (YYYY-MM-DD, default: 30 days ago)",
+						},
+						&cli.StringFlag{
+							Name:  "to",
+							Usage: "Last day to export (YYYY-MM-DD, default: today)",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "Output format: csv or json",
+							Value: "csv",
+						},
+					},
+				},
 			},
 		},
 		&cli.Command{
@@ -213,16 +1139,63 @@ func main() {
 		},
 	}
 	app.Before = func(cc *cli.Context) error {
+		for _, name := range cc.LocalFlagNames() {
+			commandLineFlags[name] = true
+		}
+		if path := cc.String("config"); path != "" {
+			cfg, err := LoadConfigFile(path)
+			if err == nil {
+				err = cfg.Check(cc.App)
+			}
+			if err != nil {
+				return cli.Exit("Couldn't load config: "+err.Error(), 1)
+			}
+			if err := cfg.Apply(cc, cc.App.Flags); err != nil {
+				return cli.Exit("Invalid config: "+err.Error(), 1)
+			}
+			configFile = cfg
+		}
+
 		if cc.Bool("verbose") {
 			log.SetLevel(log.DebugLevel)
 		}
+		if err := ConfigureLogging(LogConfig{
+			Format:     cc.String("log-format"),
+			File:       cc.String("log-file"),
+			MaxSize:    cc.Int64("log-max-size") * 1024 * 1024,
+			MaxBackups: cc.Int("log-max-backups"),
+			Levels:     cc.StringSlice("log-level"),
+		}); err != nil {
+			return cli.Exit("Couldn't configure logging: "+err.Error(), 1)
+		}
+		if dsn := cc.String("sentry-dsn"); dsn != "" {
+			hook, err := NewSentryHook(dsn)
+			if err != nil {
+				return cli.Exit("Invalid --sentry-dsn: "+err.Error(), 1)
+			}
+			log.AddHook(hook)
+			errorReporter = hook
+		}
+
+		if _, err := ParseRedisConfig(cc.String("redis")); err != nil {
+			return cli.Exit("Invalid --redis: "+err.Error(), 1)
+		}
 
 		if err := populateServices(cc); err != nil {
 			return err
 		}
 
+		// State changes made by any command are announced on the bus.
+		bus, err := newBus(cc, newPool(cc))
+		if err != nil {
+			return cli.Exit("Invalid --bus: "+err.Error(), 1)
+		}
+		stateBus = bus
+
 		return nil
 	}
+	setCommandConfig(app.Commands)
+
 	if app.Run(os.Args) != nil {
 		os.Exit(1)
 	}
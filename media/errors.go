@@ -0,0 +1,54 @@
+package media
+
+import (
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// Errors services return (possibly wrapped) from Resolve and BuildMediaRequest, so callers can
+// tell users what went wrong, and decide whether trying again is worthwhile.
+var (
+	ErrNotFound    = errors.New("media: not found")
+	ErrPrivate     = errors.New("media: private")
+	ErrGeoBlocked  = errors.New("media: not available in this region")
+	ErrRateLimited = errors.New("media: rate limited")
+	ErrUnavailable = errors.New("media: service unavailable")
+
+	// The track is stale, eg. its stream URL or authorization has expired; see Refresher.
+	ErrExpired = errors.New("media: track expired")
+)
+
+// IsPermanent returns whether an error means that a track will never be playable.
+func IsPermanent(err error) bool {
+	switch errors.Cause(err) {
+	case ErrNotFound, ErrPrivate, ErrGeoBlocked:
+		return true
+	}
+	return false
+}
+
+// ErrorForStatus returns the error corresponding to an HTTP status code from a service's API, or
+// nil if there's no specific error for it.
+func ErrorForStatus(code int) error {
+	switch code {
+	case http.StatusNotFound, http.StatusGone:
+		return ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrPrivate
+	case http.StatusUnavailableForLegalReasons:
+		return ErrGeoBlocked
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// IsExpiredStatus returns whether an HTTP status code from a media server suggests that the URL or
+// authorization used has expired.
+func IsExpiredStatus(code int) bool {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
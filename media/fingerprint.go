@@ -0,0 +1,87 @@
+package media
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// How far apart two tracks' durations can be, and still be considered the same recording. Uploads
+// of the same song often differ by a second or two of silence.
+const FingerprintDurationTolerance = 3 * time.Second
+
+var (
+	// Bracketed asides, eg. "(Official Video)", "[HD]" or "(feat. Someone)".
+	fingerprintAsideRe = regexp.MustCompile(`\([^)]*\)|\[[^\]]*\]`)
+
+	// Featured artists outside of brackets, eg. "Song ft. Someone".
+	fingerprintFeatRe = regexp.MustCompile(`\s(feat\.?|ft\.?|featuring)\s.*$`)
+)
+
+// Fingerprint returns a key identifying the song a track is a recording of, regardless of which
+// service it's from. Tracks with an ISRC are identified by it; otherwise the artist and title are
+// normalized, eg. "Artist - Song (Official Video)" uploaded by "ArtistVEVO" becomes "artist|song".
+// Returns "" if there isn't enough information to go on.
+func Fingerprint(info TrackInfo) string {
+	if isrc := normalizeISRC(info.ISRC); isrc != "" {
+		return "isrc:" + isrc
+	}
+
+	artist, title := info.User.Name, info.Title
+	if parts := strings.SplitN(title, " - ", 2); len(parts) == 2 {
+		artist, title = parts[0], parts[1]
+	}
+	artist, title = normalizeFingerprintText(artist), normalizeFingerprintText(title)
+	if title == "" {
+		return ""
+	}
+	return artist + "|" + title
+}
+
+// SameSong returns whether two tracks, possibly from different services, are recordings of the same
+// song: either their ISRCs match, or their fingerprints match and their durations are close enough.
+func SameSong(a, b TrackInfo) bool {
+	isrcA, isrcB := normalizeISRC(a.ISRC), normalizeISRC(b.ISRC)
+	if isrcA != "" && isrcB != "" {
+		return isrcA == isrcB
+	}
+
+	fpA, fpB := Fingerprint(TrackInfo{Title: a.Title, User: a.User}), Fingerprint(TrackInfo{Title: b.Title, User: b.User})
+	if fpA == "" || fpA != fpB {
+		return false
+	}
+
+	// Unknown durations (eg. live streams) can't rule anything out.
+	if a.Duration == 0 || b.Duration == 0 {
+		return true
+	}
+	diff := a.Duration - b.Duration
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= FingerprintDurationTolerance
+}
+
+func normalizeISRC(isrc string) string {
+	return strings.ToUpper(strings.Replace(strings.TrimSpace(isrc), "-", "", -1))
+}
+
+// normalizeFingerprintText lowercases a string and strips anything that commonly differs between
+// uploads of the same song: bracketed asides, featured artists, punctuation and extra whitespace.
+// Channel suffixes like "VEVO" and " - Topic" are stripped from artist names as well.
+func normalizeFingerprintText(s string) string {
+	s = strings.ToLower(s)
+	s = fingerprintAsideRe.ReplaceAllString(s, " ")
+	s = fingerprintFeatRe.ReplaceAllString(s, "")
+	s = strings.TrimSuffix(strings.TrimSpace(s), " - topic")
+	s = strings.TrimSuffix(s, "vevo")
+
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return ' '
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
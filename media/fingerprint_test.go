@@ -0,0 +1,40 @@
+package media
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	assert.Equal(t, "isrc:USRC17607839", Fingerprint(TrackInfo{Title: "Whatever", ISRC: "US-RC1-76-07839"}))
+	assert.Equal(t, "artist|song", Fingerprint(TrackInfo{Title: "Song", User: TrackUserInfo{Name: "Artist"}}))
+	assert.Equal(t, "artist|song", Fingerprint(TrackInfo{Title: "Artist - Song (Official Video)", User: TrackUserInfo{Name: "ArtistVEVO"}}))
+	assert.Equal(t, "artist|song", Fingerprint(TrackInfo{Title: "Song [HD] feat. Someone Else", User: TrackUserInfo{Name: "Artist - Topic"}}))
+	assert.Equal(t, "the artist|don t stop", Fingerprint(TrackInfo{Title: "The Artist - Don't Stop!!"}))
+	assert.Equal(t, "", Fingerprint(TrackInfo{Title: "(Official Video)"}))
+}
+
+func TestSameSong(t *testing.T) {
+	sc := TrackInfo{Title: "Song", User: TrackUserInfo{Name: "Artist"}, Duration: 200 * time.Second}
+	yt := TrackInfo{Title: "Artist - Song (Official Audio)", User: TrackUserInfo{Name: "ArtistVEVO"}, Duration: 202 * time.Second}
+	assert.True(t, SameSong(sc, yt))
+
+	// Too far apart in length; probably a remix or an extended version.
+	ext := yt
+	ext.Duration = 320 * time.Second
+	assert.False(t, SameSong(sc, ext))
+
+	// Unknown durations don't rule anything out.
+	live := yt
+	live.Duration = 0
+	assert.True(t, SameSong(sc, live))
+
+	// ISRCs trump everything else, if both tracks have one.
+	a := TrackInfo{Title: "Song", ISRC: "USRC17607839"}
+	b := TrackInfo{Title: "Completely Different", ISRC: "us-rc1-76-07839"}
+	assert.True(t, SameSong(a, b))
+	b.ISRC = "GBAYE0601498"
+	b.Title = "Song"
+	assert.False(t, SameSong(a, b))
+}
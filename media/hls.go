@@ -0,0 +1,124 @@
+package media
+
+import (
+	"bufio"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// IsHLS returns true if the response is an HLS playlist.
+func IsHLS(res *http.Response) bool {
+	ct := strings.ToLower(res.Header.Get("Content-Type"))
+	return strings.Contains(ct, "mpegurl") || strings.HasSuffix(res.Request.URL.Path, ".m3u8")
+}
+
+// ParseHLSPlaylist parses an HLS media playlist, returning the URLs of its segments in order.
+// Relative segment URLs are resolved against base.
+func ParseHLSPlaylist(r io.Reader, base *url.URL) ([]*url.URL, error) {
+	segments := []*url.URL{}
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			if line != "#EXTM3U" {
+				return nil, errors.New("hls: not a playlist")
+			}
+			first = false
+			continue
+		}
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			return nil, errors.New("hls: master playlists are not supported")
+		case strings.HasPrefix(line, "#EXT-X-KEY") && !strings.Contains(line, "METHOD=NONE"):
+			return nil, errors.New("hls: encrypted playlists are not supported")
+		case strings.HasPrefix(line, "#"):
+		default:
+			u, err := base.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, u)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if first {
+		return nil, errors.New("hls: empty playlist")
+	}
+	return segments, nil
+}
+
+// An HLSReader reads the segments of an HLS playlist in sequence, as one continuous stream.
+type HLSReader struct {
+	Client *http.Client
+
+	ctx      context.Context // Segments are fetched with this, to stop when it's cancelled
+	segments []*url.URL
+	current  io.ReadCloser
+}
+
+// NewHLSReader creates an HLSReader from a response containing a playlist, consuming its body.
+// Segments are fetched until the context is cancelled.
+func NewHLSReader(ctx context.Context, client *http.Client, res *http.Response) (*HLSReader, error) {
+	defer res.Body.Close()
+	segments, err := ParseHLSPlaylist(res.Body, res.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &HLSReader{Client: client, ctx: ctx, segments: segments}, nil
+}
+
+// Read reads from the current segment, moving on to the next one when it's exhausted.
+func (r *HLSReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.segments) == 0 {
+				return 0, io.EOF
+			}
+
+			req, err := http.NewRequestWithContext(r.ctx, "GET", r.segments[0].String(), nil)
+			if err != nil {
+				return 0, err
+			}
+			res, err := r.Client.Do(req)
+			if err != nil {
+				return 0, err
+			}
+			if res.StatusCode != http.StatusOK {
+				res.Body.Close()
+				return 0, errors.Errorf("hls: couldn't get segment: %s", res.Status)
+			}
+			r.segments = r.segments[1:]
+			r.current = res.Body
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the segment currently being read, if any.
+func (r *HLSReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
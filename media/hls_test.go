@@ -0,0 +1,73 @@
+package media
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHLSPlaylist(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/media/playlist.m3u8?sig=abc")
+	playlist := "#EXTM3U\n#EXT-X-VERSION:6\n#EXTINF:1.985,\nseg0.mp3\n#EXTINF:9.952,\nhttps://other.example.com/seg1.mp3\n#EXT-X-ENDLIST\n"
+
+	segments, err := ParseHLSPlaylist(strings.NewReader(playlist), base)
+	assert.NoError(t, err)
+	if assert.Len(t, segments, 2) {
+		assert.Equal(t, "https://cdn.example.com/media/seg0.mp3", segments[0].String())
+		assert.Equal(t, "https://other.example.com/seg1.mp3", segments[1].String())
+	}
+}
+
+func TestParseHLSPlaylistInvalid(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/playlist.m3u8")
+	_, err := ParseHLSPlaylist(strings.NewReader("not a playlist\n"), base)
+	assert.Error(t, err)
+}
+
+func TestParseHLSPlaylistEncrypted(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/playlist.m3u8")
+	_, err := ParseHLSPlaylist(strings.NewReader("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\"\nseg0.ts\n"), base)
+	assert.Error(t, err)
+}
+
+func TestHLSReaderCancel(t *testing.T) {
+	// The segment never arrives, like a stalled download.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, ".m3u8") {
+			w.Write([]byte("#EXTM3U\n#EXTINF:10,\nseg0.mp3\n"))
+			return
+		}
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/playlist.m3u8")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := NewHLSReader(ctx, srv.Client(), res)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 16))
+		done <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("segment fetch didn't stop")
+	}
+}
@@ -3,6 +3,7 @@ package media
 import (
 	"encoding/json"
 	"github.com/pkg/errors"
+	"time"
 )
 
 // A ServiceRef is a wrapper around a Service, that (un)marshals services as IDs.
@@ -15,14 +16,14 @@ func (s ServiceRef) MarshalJSON() ([]byte, error) {
 	return json.Marshal(s.Service.ID())
 }
 
-// UnmarshalJSON decodes the service from JSON, by looking up the ID in Services.
+// UnmarshalJSON decodes the service from JSON, by looking up the ID in the registry.
 func (s *ServiceRef) UnmarshalJSON(data []byte) error {
 	var id string
 	if err := json.Unmarshal(data, &id); err != nil {
 		return err
 	}
-	svc, ok := Services[id]
-	if !ok {
+	svc := Lookup(id)
+	if svc == nil {
 		return errors.New("unknown service: " + id)
 	}
 	s.Service = svc
@@ -44,12 +45,34 @@ type TrackUserInfo struct {
 	AvatarURL string
 }
 
+// Describes the license a track is published under. A blank Name means it's unknown.
+type TrackLicense struct {
+	Name string
+	URL  string
+
+	// Whether it's a Creative Commons license.
+	CreativeCommons bool
+
+	// Whether it permits commercial use, eg. playing it on a monetized stream.
+	Commercial bool
+}
+
 type TrackInfo struct {
 	Title       string
 	Description string
 	URL         string
 	CoverURL    string
 	User        TrackUserInfo
+	License     TrackLicense
+
+	Duration time.Duration // 0 if unknown, eg. for live streams
+	Genre    string
+	Explicit bool
+	ISRC     string // International Standard Recording Code, if known
+
+	// Whether the service restricts the track to adults, eg. because the uploader or a rating board
+	// said so. This is separate from Explicit, which is about lyrics.
+	AgeRestricted bool
 }
 
 // Describes how to properly attribute the media provider.
@@ -57,3 +80,32 @@ type ServiceAttribution struct {
 	Text    string
 	LogoURL string
 }
+
+// Describes what a service supports, beyond resolving URLs into tracks.
+type Capabilities struct {
+	Search    bool // Searching for tracks by text
+	Playlists bool // Resolving playlists and albums into multiple tracks
+	Related   bool // Finding tracks related to a given one
+	Live      bool // Live streams, which have no fixed duration
+	Seeking   bool // Starting playback from an offset into a track
+}
+
+// List returns the names of all supported capabilities.
+func (c Capabilities) List() []string {
+	names := []string{}
+	for _, cap := range []struct {
+		Name      string
+		Supported bool
+	}{
+		{"search", c.Search},
+		{"playlists", c.Playlists},
+		{"related", c.Related},
+		{"live", c.Live},
+		{"seeking", c.Seeking},
+	} {
+		if cap.Supported {
+			names = append(names, cap.Name)
+		}
+	}
+	return names
+}
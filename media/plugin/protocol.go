@@ -0,0 +1,108 @@
+// Package plugin implements services that live in a separate process, and are spoken to over a
+// small JSON-over-HTTP protocol. This lets third parties add sources without recompiling hiqty.
+//
+// A plugin is an HTTP server exposing the following endpoints, which all take and return JSON:
+//
+//	GET  /info     -> Info (also polled as a health check)
+//	POST /sniff    SniffRequest -> SniffResponse
+//	POST /resolve  ResolveRequest -> ResolveResponse
+//	POST /media    MediaRequest -> MediaResponse
+//	POST /search   SearchRequest -> SearchResponse (only if the plugin's capabilities include search)
+//	POST /related  RelatedRequest -> RelatedResponse (only if they include related)
+//
+// Errors are reported with a non-2xx status code, and optionally an ErrorResponse body. The status
+// codes 404, 401/403, 451 and 429 map to media.ErrNotFound, ErrPrivate, ErrGeoBlocked and
+// ErrRateLimited respectively.
+package plugin
+
+import (
+	"encoding/json"
+	"github.com/sencrash/hiqty/media"
+)
+
+// Info describes the plugin's service.
+type Info struct {
+	ID           string                   `json:"id"`
+	Attribution  media.ServiceAttribution `json:"attribution"`
+	Capabilities media.Capabilities       `json:"capabilities"`
+}
+
+type SniffRequest struct {
+	URL string `json:"url"`
+}
+
+type SniffResponse struct {
+	OK bool `json:"ok"`
+}
+
+type ResolveRequest struct {
+	URL string `json:"url"`
+}
+
+type ResolveResponse struct {
+	Tracks []Track `json:"tracks"`
+}
+
+type SearchRequest struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+}
+
+type SearchResponse struct {
+	Tracks []Track `json:"tracks"`
+}
+
+type RelatedRequest struct {
+	Track Track `json:"track"`
+	Limit int   `json:"limit"`
+}
+
+type RelatedResponse struct {
+	Tracks []Track `json:"tracks"`
+}
+
+type MediaRequest struct {
+	Track Track `json:"track"`
+}
+
+// MediaResponse tells the Player where to fetch a track's media from.
+type MediaResponse struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// A Track is a track from a plugin. Data is opaque to hiqty, and is handed back to the plugin
+// as-is when the track's media is requested.
+type Track struct {
+	ID       string          `json:"id"`
+	Info     media.TrackInfo `json:"info"`
+	Playable bool            `json:"playable"`
+	Reason   string          `json:"reason,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+
+	serviceID string
+}
+
+func (t *Track) GetServiceID() string {
+	return t.serviceID
+}
+
+func (t Track) GetInfo() media.TrackInfo {
+	return t.Info
+}
+
+func (t Track) GetPlayable() (bool, string) {
+	return t.Playable, t.Reason
+}
+
+func (t Track) Equals(other media.Track) bool {
+	if other == nil {
+		return false
+	}
+	t2, ok := other.(*Track)
+	return ok && t.serviceID == t2.serviceID && t.ID == t2.ID
+}
@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sencrash/hiqty/media"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Service struct {
+	Client  http.Client
+	BaseURL string
+
+	info Info
+}
+
+// New connects to a plugin, and asks it to describe itself.
+func New(baseURL string) (*Service, error) {
+	s := &Service{
+		Client:  media.NewClient(10 * time.Second),
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+
+	res, err := s.Client.Get(s.BaseURL + "/info")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := decodeResponse(res, &s.info); err != nil {
+		return nil, err
+	}
+	if s.info.ID == "" {
+		return nil, errors.New("plugin: missing service ID")
+	}
+	return s, nil
+}
+
+func (s *Service) ID() string {
+	return s.info.ID
+}
+
+func (s *Service) Attribution() media.ServiceAttribution {
+	return s.info.Attribution
+}
+
+func (s *Service) Capabilities() media.Capabilities {
+	return s.info.Capabilities
+}
+
+func (s *Service) Sniff(u *url.URL) bool {
+	var res SniffResponse
+	if err := s.call("/sniff", SniffRequest{URL: u.String()}, &res); err != nil {
+		return false
+	}
+	return res.OK
+}
+
+func (s *Service) Resolve(u *url.URL) ([]media.Track, error) {
+	var res ResolveResponse
+	if err := s.call("/resolve", ResolveRequest{URL: u.String()}, &res); err != nil {
+		return nil, err
+	}
+
+	tracks := make([]media.Track, len(res.Tracks))
+	for i := range res.Tracks {
+		res.Tracks[i].serviceID = s.info.ID
+		tracks[i] = media.Track(&res.Tracks[i])
+	}
+	return tracks, nil
+}
+
+// Search searches for tracks by text, if the plugin says it can.
+func (s *Service) Search(query string, limit int) ([]media.Track, error) {
+	if !s.info.Capabilities.Search {
+		return nil, errors.New("plugin: " + s.info.ID + " can't search")
+	}
+
+	var res SearchResponse
+	if err := s.call("/search", SearchRequest{Query: query, Limit: limit}, &res); err != nil {
+		return nil, err
+	}
+
+	tracks := make([]media.Track, len(res.Tracks))
+	for i := range res.Tracks {
+		res.Tracks[i].serviceID = s.info.ID
+		tracks[i] = media.Track(&res.Tracks[i])
+	}
+	return tracks, nil
+}
+
+// Related finds tracks related to a track, if the plugin says it can.
+func (s *Service) Related(t_ media.Track, limit int) ([]media.Track, error) {
+	if !s.info.Capabilities.Related {
+		return nil, errors.New("plugin: " + s.info.ID + " can't find related tracks")
+	}
+
+	var res RelatedResponse
+	if err := s.call("/related", RelatedRequest{Track: *t_.(*Track), Limit: limit}, &res); err != nil {
+		return nil, err
+	}
+
+	tracks := make([]media.Track, len(res.Tracks))
+	for i := range res.Tracks {
+		res.Tracks[i].serviceID = s.info.ID
+		tracks[i] = media.Track(&res.Tracks[i])
+	}
+	return tracks, nil
+}
+
+func (s *Service) NewTrack() media.Track {
+	return &Track{serviceID: s.info.ID}
+}
+
+func (s *Service) BuildMediaRequest(t_ media.Track) (*http.Request, error) {
+	t := t_.(*Track)
+
+	var res MediaResponse
+	if err := s.call("/media", MediaRequest{Track: *t}, &res); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", res.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range res.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// Ping checks that the plugin is still up, and still describing the same service.
+func (s *Service) Ping() error {
+	res, err := s.Client.Get(s.BaseURL + "/info")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var info Info
+	if err := decodeResponse(res, &info); err != nil {
+		return err
+	}
+	if info.ID != s.info.ID {
+		return errors.Errorf("plugin: service ID changed from %s to %s", s.info.ID, info.ID)
+	}
+	return nil
+}
+
+// call POSTs a request to one of the plugin's endpoints, and decodes the response into v.
+func (s *Service) call(path string, req, v interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := s.Client.Post(s.BaseURL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return decodeResponse(res, v)
+}
+
+// decodeResponse decodes a response from the plugin, turning error statuses into errors.
+func decodeResponse(res *http.Response, v interface{}) error {
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var e ErrorResponse
+		msg := res.Status
+		if err := json.NewDecoder(res.Body).Decode(&e); err == nil && e.Error != "" {
+			msg = e.Error
+		}
+		if err := media.ErrorForStatus(res.StatusCode); err != nil {
+			return errors.Wrap(err, msg)
+		}
+		return errors.New("plugin: " + msg)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
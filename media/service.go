@@ -3,14 +3,49 @@ package media
 import (
 	"net/http"
 	"net/url"
+	"sync"
 )
 
-// Global registry of available services.
-var Services = make(map[string]Service)
+// Global registry of available services. It may be replaced at runtime (see SetServices), so it's
+// only accessed through functions.
+var services = make(map[string]Service)
+var servicesMutex sync.RWMutex
 
 // Registers a service with the registry.
 func Register(svc Service) {
-	Services[svc.ID()] = svc
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+	services[svc.ID()] = svc
+}
+
+// SetServices replaces all registered services, eg. when their credentials are reloaded.
+func SetServices(svcs ...Service) {
+	m := make(map[string]Service, len(svcs))
+	for _, svc := range svcs {
+		m[svc.ID()] = svc
+	}
+
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+	services = m
+}
+
+// Lookup returns the registered service with an ID, or nil.
+func Lookup(id string) Service {
+	servicesMutex.RLock()
+	defer servicesMutex.RUnlock()
+	return services[id]
+}
+
+// Services returns a snapshot of all registered services, by ID.
+func Services() map[string]Service {
+	servicesMutex.RLock()
+	defer servicesMutex.RUnlock()
+	m := make(map[string]Service, len(services))
+	for id, svc := range services {
+		m[id] = svc
+	}
+	return m
 }
 
 // A Service facilitates communication with a streaming service of some kind.
@@ -21,6 +56,9 @@ type Service interface {
 	// Attribution info for the service.
 	Attribution() ServiceAttribution
 
+	// Describes what the service supports.
+	Capabilities() Capabilities
+
 	// Return true if the URL looks interesting.
 	Sniff(u *url.URL) bool
 
@@ -33,3 +71,48 @@ type Service interface {
 	// Builds a request for the track's media file.
 	BuildMediaRequest(t Track) (*http.Request, error)
 }
+
+// A Pinger is a Service that can check its own health, eg. that it can reach its API and that its
+// credentials haven't been revoked.
+type Pinger interface {
+	// Ping returns an error if the service isn't usable right now.
+	Ping() error
+}
+
+// A Searcher is a Service that can search for tracks by text. It must also say so in its
+// Capabilities, as some, such as plugins, implement it whether they can or not.
+type Searcher interface {
+	// Search returns up to limit tracks matching a query, best match first.
+	Search(query string, limit int) ([]Track, error)
+}
+
+// A Recommender is a Service that can find tracks related to one of its own, eg. ones similar
+// listeners also liked. Like a Searcher, it must also say so in its Capabilities.
+type Recommender interface {
+	// Related returns up to limit tracks related to a track, most related first.
+	Related(t Track, limit int) ([]Track, error)
+}
+
+// A Refresher is a Service that can refresh stale tracks. Tracks may sit in a queue for hours, by
+// which point any time-limited URLs or tokens they hold have expired.
+type Refresher interface {
+	// Refresh returns an up-to-date copy of a track.
+	Refresh(t Track) (Track, error)
+}
+
+// A Stub is a Track that may only identify a track, without anything else about it, eg. one of the
+// tracks of a large playlist, which a service may leave for later rather than look them all up at
+// once. Stubs are refreshed (see Refresher) once their turn to play comes up, so services that
+// return them must be Refreshers.
+type Stub interface {
+	Track
+
+	// IsStub returns whether the track has yet to be looked up.
+	IsStub() bool
+}
+
+// IsStub returns whether a track has yet to be looked up; see Stub.
+func IsStub(t Track) bool {
+	s, ok := t.(Stub)
+	return ok && s.IsStub()
+}
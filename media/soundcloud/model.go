@@ -2,6 +2,7 @@ package soundcloud
 
 import (
 	"github.com/sencrash/hiqty/media"
+	"time"
 )
 
 const (
@@ -10,29 +11,76 @@ const (
 	PlaylistKind = "playlist"
 )
 
+const (
+	ProgressiveProtocol = "progressive"
+	HLSProtocol         = "hls"
+)
+
+const (
+	PolicyAllow = "ALLOW"
+	PolicySnip  = "SNIP"
+	PolicyBlock = "BLOCK"
+)
+
+// Licenses tracks can be published under, by the identifiers the API uses for them.
+var licenses = map[string]media.TrackLicense{
+	"all-rights-reserved": {Name: "All Rights Reserved"},
+	"no-rights-reserved":  {Name: "CC0 1.0", URL: "https://creativecommons.org/publicdomain/zero/1.0/", CreativeCommons: true, Commercial: true},
+	"cc-by":               {Name: "CC BY 4.0", URL: "https://creativecommons.org/licenses/by/4.0/", CreativeCommons: true, Commercial: true},
+	"cc-by-sa":            {Name: "CC BY-SA 4.0", URL: "https://creativecommons.org/licenses/by-sa/4.0/", CreativeCommons: true, Commercial: true},
+	"cc-by-nd":            {Name: "CC BY-ND 4.0", URL: "https://creativecommons.org/licenses/by-nd/4.0/", CreativeCommons: true, Commercial: true},
+	"cc-by-nc":            {Name: "CC BY-NC 4.0", URL: "https://creativecommons.org/licenses/by-nc/4.0/", CreativeCommons: true},
+	"cc-by-nc-sa":         {Name: "CC BY-NC-SA 4.0", URL: "https://creativecommons.org/licenses/by-nc-sa/4.0/", CreativeCommons: true},
+	"cc-by-nc-nd":         {Name: "CC BY-NC-ND 4.0", URL: "https://creativecommons.org/licenses/by-nc-nd/4.0/", CreativeCommons: true},
+}
+
 type BlankEnvelope struct {
 	Kind string `json:"kind"`
 }
 
 type User struct {
-	ID       int64  `json:"user"`
+	ID       int64  `json:"id"`
 	Username string `json:"username"`
 
 	PermalinkURL string `json:"permalink_url"`
 	AvatarURL    string `json:"avatar_url"`
 }
 
+// A Transcoding is one of the formats a track's audio is available in.
+type Transcoding struct {
+	URL     string `json:"url"`
+	Preset  string `json:"preset"`
+	Snipped bool   `json:"snipped"`
+	Format  struct {
+		Protocol string `json:"protocol"`
+		MimeType string `json:"mime_type"`
+	} `json:"format"`
+}
+
 type Track struct {
 	ID          int64  `json:"id"`
 	Title       string `json:"title"`
 	Description string `json:"description"`
 	User        User   `json:"user"`
 
-	Streamable bool `json:"streamable"`
+	Streamable bool   `json:"streamable"`
+	Policy     string `json:"policy"`
+	License    string `json:"license"`
 
 	PermalinkURL string `json:"permalink_url"`
 	ArtworkURL   string `json:"artwork_url"`
-	StreamURL    string `json:"stream_url"`
+
+	Duration          int64  `json:"duration"` // Milliseconds
+	Genre             string `json:"genre"`
+	PublisherMetadata struct {
+		Explicit bool   `json:"explicit"`
+		ISRC     string `json:"isrc"`
+	} `json:"publisher_metadata"`
+
+	Media struct {
+		Transcodings []Transcoding `json:"transcodings"`
+	} `json:"media"`
+	TrackAuthorization string `json:"track_authorization"`
 }
 
 func (t *Track) GetServiceID() string {
@@ -56,16 +104,30 @@ func (t Track) GetInfo() media.TrackInfo {
 			URL:       t.User.PermalinkURL,
 			AvatarURL: t.User.AvatarURL,
 		},
+		License:  licenses[t.License],
+		Duration: time.Duration(t.Duration) * time.Millisecond,
+		Genre:    t.Genre,
+		Explicit: t.PublisherMetadata.Explicit,
+		ISRC:     t.PublisherMetadata.ISRC,
 	}
 }
 
 func (t Track) GetPlayable() (bool, string) {
-	if !t.Streamable {
+	if !t.Streamable || t.Policy == PolicyBlock {
 		return false, "The artist has disabled streaming for this track."
 	}
+	if t.Transcoding() == nil {
+		return false, "Only a preview of this track is available."
+	}
 	return true, ""
 }
 
+// IsStub returns whether only the track's ID is known, as is the case for all but the first few
+// tracks of a playlist, until they're looked up.
+func (t Track) IsStub() bool {
+	return t.Title == ""
+}
+
 func (t Track) Equals(other media.Track) bool {
 	if other == nil {
 		return false
@@ -74,6 +136,26 @@ func (t Track) Equals(other media.Track) bool {
 	return ok && t.ID == t2.ID
 }
 
+// Transcoding picks the best playable transcoding for the track, or nil if there are none. Full
+// length progressive streams are preferred over HLS, as they're a single request to fetch.
+func (t Track) Transcoding() *Transcoding {
+	var best *Transcoding
+	for i, tc := range t.Media.Transcodings {
+		if tc.Snipped {
+			continue
+		}
+		switch tc.Format.Protocol {
+		case ProgressiveProtocol:
+			return &t.Media.Transcodings[i]
+		case HLSProtocol:
+			if best == nil {
+				best = &t.Media.Transcodings[i]
+			}
+		}
+	}
+	return best
+}
+
 type Playlist struct {
 	ID          int64   `json:"id"`
 	Title       string  `json:"title"`
@@ -5,11 +5,22 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sencrash/hiqty/media"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
+// Base URL for SoundCloud's v2 API.
+const APIBase = "https://api-v2.soundcloud.com"
+
+// Maximum number of IDs the API accepts in a single track lookup.
+const maxTrackIDs = 50
+
+// How many of a playlist's tracks are looked up when it's resolved; the rest are left as stubs (see
+// media.Stub), and looked up as they come up, so even huge playlists resolve in a single lookup.
+const maxHydratedTracks = maxTrackIDs
+
 type Service struct {
 	Client   http.Client
 	ClientID string
@@ -17,6 +28,7 @@ type Service struct {
 
 func New(clientID string) *Service {
 	return &Service{
+		Client:   media.NewClient(0),
 		ClientID: clientID,
 	}
 }
@@ -35,18 +47,24 @@ func (s *Service) Attribution() media.ServiceAttribution {
 	}
 }
 
+func (s *Service) Capabilities() media.Capabilities {
+	return media.Capabilities{
+		Search:    true,
+		Playlists: true,
+		Related:   true,
+		Seeking:   true,
+	}
+}
+
 func (s *Service) Sniff(u *url.URL) bool {
 	return (u.Host == "soundcloud.com")
 }
 
 func (s *Service) Resolve(u *url.URL) ([]media.Track, error) {
-	apiURL := fmt.Sprintf("https://api.soundcloud.com/resolve?client_id=%s&url=%s", s.ClientID, url.QueryEscape(u.String()))
-	res, err := s.Client.Get(apiURL)
-	if err != nil {
+	var data json.RawMessage
+	if err := s.get("/resolve", url.Values{"url": {u.String()}}, &data); err != nil {
 		return nil, err
 	}
-	data, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
 
 	var env BlankEnvelope
 	if err := json.Unmarshal(data, &env); err != nil {
@@ -65,10 +83,17 @@ func (s *Service) Resolve(u *url.URL) ([]media.Track, error) {
 		if err := json.Unmarshal(data, &list); err != nil {
 			return nil, err
 		}
+		hydrated := list.Tracks
+		if len(hydrated) > maxHydratedTracks {
+			hydrated = hydrated[:maxHydratedTracks]
+		}
+		if err := s.hydrate(hydrated); err != nil {
+			return nil, err
+		}
 
 		tracks := make([]media.Track, len(list.Tracks))
-		for i, track := range list.Tracks {
-			tracks[i] = media.Track(&track)
+		for i := range list.Tracks {
+			tracks[i] = media.Track(&list.Tracks[i])
 		}
 		return tracks, nil
 	default:
@@ -82,5 +107,135 @@ func (s *Service) NewTrack() media.Track {
 
 func (s *Service) BuildMediaRequest(t_ media.Track) (*http.Request, error) {
 	t := t_.(*Track)
-	return http.NewRequest("GET", t.StreamURL+"?client_id="+s.ClientID, nil)
+	tc := t.Transcoding()
+	if tc == nil {
+		return nil, errors.New("no playable transcodings")
+	}
+
+	// Transcoding URLs don't point at the media itself, but at an endpoint that hands out a
+	// short-lived URL for it; for HLS transcodings, this is the URL of the playlist.
+	q := url.Values{"client_id": {s.ClientID}}
+	if t.TrackAuthorization != "" {
+		q.Set("track_authorization", t.TrackAuthorization)
+	}
+	res, err := s.Client.Get(tc.URL + "?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if media.IsExpiredStatus(res.StatusCode) {
+		return nil, errors.Wrap(media.ErrExpired, "couldn't get stream URL: "+res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		if err := media.ErrorForStatus(res.StatusCode); err != nil {
+			return nil, errors.Wrap(err, "couldn't get stream URL")
+		}
+		return nil, errors.Errorf("couldn't get stream URL: %s", res.Status)
+	}
+
+	var stream struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stream); err != nil {
+		return nil, err
+	}
+	return http.NewRequest("GET", stream.URL, nil)
+}
+
+// Search searches for tracks by text.
+func (s *Service) Search(query string, limit int) ([]media.Track, error) {
+	var res struct {
+		Collection []Track `json:"collection"`
+	}
+	if err := s.get("/search/tracks", url.Values{"q": {query}, "limit": {strconv.Itoa(limit)}}, &res); err != nil {
+		return nil, err
+	}
+
+	tracks := make([]media.Track, len(res.Collection))
+	for i := range res.Collection {
+		tracks[i] = media.Track(&res.Collection[i])
+	}
+	return tracks, nil
+}
+
+// Related finds tracks related to a track, per SoundCloud's recommendations.
+func (s *Service) Related(t_ media.Track, limit int) ([]media.Track, error) {
+	t := t_.(*Track)
+	var res struct {
+		Collection []Track `json:"collection"`
+	}
+	if err := s.get(fmt.Sprintf("/tracks/%d/related", t.ID), url.Values{"limit": {strconv.Itoa(limit)}}, &res); err != nil {
+		return nil, err
+	}
+
+	tracks := make([]media.Track, len(res.Collection))
+	for i := range res.Collection {
+		tracks[i] = media.Track(&res.Collection[i])
+	}
+	return tracks, nil
+}
+
+// Refresh re-fetches a track, renewing its transcoding URLs and authorization.
+func (s *Service) Refresh(t_ media.Track) (media.Track, error) {
+	t := t_.(*Track)
+	var fresh Track
+	if err := s.get(fmt.Sprintf("/tracks/%d", t.ID), url.Values{}, &fresh); err != nil {
+		return nil, err
+	}
+	return &fresh, nil
+}
+
+// get performs a GET request against the API, and decodes the response into v.
+// Ping checks that the API is reachable, and that the client ID is still accepted.
+func (s *Service) Ping() error {
+	var data json.RawMessage
+	return s.get("/search/tracks", url.Values{"q": {"hiqty"}, "limit": {"1"}}, &data)
+}
+
+func (s *Service) get(path string, q url.Values, v interface{}) error {
+	q.Set("client_id", s.ClientID)
+	res, err := s.Client.Get(APIBase + path + "?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		if err := media.ErrorForStatus(res.StatusCode); err != nil {
+			return errors.Wrap(err, "soundcloud")
+		}
+		return errors.Errorf("soundcloud: %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// hydrate fills in incomplete tracks. Playlists only include full representations of their first
+// few tracks; the rest are just IDs, which have to be looked up separately.
+func (s *Service) hydrate(tracks []Track) error {
+	missing := map[int64]*Track{}
+	ids := []string{}
+	for i, t := range tracks {
+		if t.Title == "" {
+			missing[t.ID] = &tracks[i]
+			ids = append(ids, fmt.Sprint(t.ID))
+		}
+	}
+
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxTrackIDs {
+			n = maxTrackIDs
+		}
+
+		var full []Track
+		if err := s.get("/tracks", url.Values{"ids": {strings.Join(ids[:n], ",")}}, &full); err != nil {
+			return err
+		}
+		for _, t := range full {
+			if dst := missing[t.ID]; dst != nil {
+				*dst = t
+			}
+		}
+		ids = ids[n:]
+	}
+	return nil
 }
@@ -0,0 +1,94 @@
+package media
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// DefaultTransport is shared by services and the Player for API calls and media downloads, so
+// tweaks to it apply consistently everywhere. Configure it before creating services.
+var DefaultTransport = &Transport{
+	UserAgent: "hiqty (+https://github.com/sencrash/hiqty)",
+	Retries:   2,
+	Backoff:   500 * time.Millisecond,
+}
+
+// NewClient returns an HTTP client using DefaultTransport, with the given timeout (or none if 0).
+func NewClient(timeout time.Duration) http.Client {
+	return http.Client{Transport: DefaultTransport, Timeout: timeout}
+}
+
+// A Transport is an http.RoundTripper that sets a User-Agent and any extra headers some CDNs
+// require, and retries idempotent requests that fail in ways that may be temporary.
+type Transport struct {
+	Base      http.RoundTripper // Underlying transport; http.DefaultTransport if nil
+	UserAgent string
+	Headers   http.Header
+
+	Retries int           // Number of times to retry a failed request
+	Backoff time.Duration // Delay before the first retry, doubling for each one after it
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// RoundTrippers mustn't modify the caller's request.
+	req = cloneRequest(req)
+	if t.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.UserAgent)
+	}
+	for k, vs := range t.Headers {
+		if req.Header.Get(k) == "" {
+			req.Header[k] = vs
+		}
+	}
+
+	// Requests with bodies can't be replayed, and non-idempotent ones shouldn't be.
+	retries := t.Retries
+	if req.Body != nil || (req.Method != "" && req.Method != "GET" && req.Method != "HEAD") {
+		retries = 0
+	}
+
+	backoff := t.Backoff
+	for attempt := 0; ; attempt++ {
+		res, err := base.RoundTrip(req)
+		if attempt >= retries || !shouldRetry(res, err) {
+			return res, err
+		}
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+// shouldRetry returns whether a failed request may succeed if it's retried.
+func shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, vs := range req.Header {
+		r.Header[k] = append([]string(nil), vs...)
+	}
+	return r
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sencrash/hiqty/media"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MemoryStore keeps playback state in memory, for tests that don't need it shared.
+// Envelopes are kept encoded, so they round-trip the same way as through Redis.
+type MemoryStore struct {
+	playlists   map[string][][]byte
+	nowPlaying  map[string][]byte
+	deadLetters map[string][]DeadLetter
+	values      map[string]string
+	requests    map[string]memoryRequest
+
+	subscribed map[string]bool
+	watchers   []memoryWatcher
+	mutex      sync.Mutex
+}
+
+type memoryWatcher struct {
+	ctx context.Context
+	ch  chan string
+}
+
+type memoryRequest struct {
+	StoredRequest
+	Expires time.Time
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		playlists:   map[string][][]byte{},
+		nowPlaying:  map[string][]byte{},
+		deadLetters: map[string][]DeadLetter{},
+		values:      map[string]string{},
+		requests:    map[string]memoryRequest{},
+		subscribed:  map[string]bool{},
+	}
+}
+
+func (s *MemoryStore) Push(q Queue, envelopes ...TrackEnvelope) error {
+	datas := make([][]byte, 0, len(envelopes))
+	for _, envelope := range envelopes {
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return err
+		}
+		datas = append(datas, data)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.PlaylistKey()
+	s.playlists[key] = append(s.playlists[key], datas...)
+	s.changed(key)
+	return nil
+}
+
+func (s *MemoryStore) NowPlaying(q Queue) (*TrackEnvelope, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.NowPlayingKey()
+	data, ok := s.nowPlaying[key]
+	if !ok {
+		return nil, nil
+	}
+
+	var envelope TrackEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		s.addDeadLetter(q, NewDeadLetter(data, err))
+		delete(s.nowPlaying, key)
+		return nil, nil
+	}
+	return &envelope, nil
+}
+
+func (s *MemoryStore) Advance(q Queue) (*TrackEnvelope, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, nowPlayingKey := q.PlaylistKey(), q.NowPlayingKey()
+	for len(s.playlists[key]) > 0 {
+		data := s.playlists[key][0]
+		s.playlists[key] = s.playlists[key][1:]
+
+		var envelope TrackEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			s.addDeadLetter(q, NewDeadLetter(data, err))
+			continue
+		}
+		s.nowPlaying[nowPlayingKey] = data
+		s.changed(key)
+		return &envelope, nil
+	}
+	delete(s.nowPlaying, nowPlayingKey)
+	s.changed(nowPlayingKey)
+	return nil, nil
+}
+
+// addDeadLetter sets an envelope aside, like AddDeadLetter. The store must be locked.
+func (s *MemoryStore) addDeadLetter(q Queue, dl DeadLetter) {
+	key := q.DeadLetterKey()
+	s.deadLetters[key] = append([]DeadLetter{dl}, s.deadLetters[key]...)
+	if len(s.deadLetters[key]) > MaxDeadLetters {
+		s.deadLetters[key] = s.deadLetters[key][:MaxDeadLetters]
+	}
+}
+
+func (s *MemoryStore) ReplaceNowPlaying(q Queue, track media.Track, envelope TrackEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.NowPlayingKey()
+	if s.isNowPlaying(key, track) {
+		s.nowPlaying[key] = data
+		s.changed(key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Finish(q Queue, track media.Track) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.NowPlayingKey()
+	if s.isNowPlaying(key, track) {
+		delete(s.nowPlaying, key)
+		s.changed(key)
+	}
+	return nil
+}
+
+// isNowPlaying returns whether the envelope at a now playing key is for the given track. Must be
+// called with the store locked.
+func (s *MemoryStore) isNowPlaying(key string, track media.Track) bool {
+	data, ok := s.nowPlaying[key]
+	if !ok {
+		return false
+	}
+	var current TrackEnvelope
+	return json.Unmarshal(data, &current) == nil && current.Track.Equals(track)
+}
+
+func (s *MemoryStore) Len(q Queue) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.playlists[q.PlaylistKey()]), nil
+}
+
+func (s *MemoryStore) Skip(q Queue) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.NowPlayingKey()
+	if _, ok := s.nowPlaying[key]; !ok {
+		return false, nil
+	}
+	delete(s.nowPlaying, key)
+	s.changed(key)
+	return true, nil
+}
+
+func (s *MemoryStore) Remove(q Queue, match func(TrackEnvelope) bool) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.PlaylistKey()
+	playlist := s.playlists[key]
+	kept := [][]byte{}
+	for _, data := range playlist {
+		var envelope TrackEnvelope
+		if err := json.Unmarshal(data, &envelope); err == nil && match(envelope) {
+			continue
+		}
+		kept = append(kept, data)
+	}
+	s.playlists[key] = kept
+	if len(kept) != len(playlist) {
+		s.changed(key)
+	}
+	return len(playlist) - len(kept), nil
+}
+
+func (s *MemoryStore) Migrate(from, to Queue) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fromKey, toKey := from.PlaylistKey(), to.PlaylistKey()
+	if fromKey == toKey {
+		return nil
+	}
+	if playlist := s.playlists[fromKey]; len(playlist) > 0 && len(s.playlists[toKey]) == 0 {
+		s.playlists[toKey] = playlist
+		delete(s.playlists, fromKey)
+	}
+	fromKey, toKey = from.NowPlayingKey(), to.NowPlayingKey()
+	if _, ok := s.nowPlaying[toKey]; !ok {
+		if data, ok := s.nowPlaying[fromKey]; ok {
+			s.nowPlaying[toKey] = data
+			delete(s.nowPlaying, fromKey)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Clear(q Queue) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Everything is kept by its Redis key, so it's picked out the same way.
+	prefix := q.Key("")
+	owned := func(key string) bool {
+		_, bid, ok := parseServerKey(key)
+		return ok && bid == q.BotID && strings.HasPrefix(key, prefix)
+	}
+	for key := range s.playlists {
+		if owned(key) {
+			delete(s.playlists, key)
+		}
+	}
+	for key := range s.nowPlaying {
+		if owned(key) {
+			delete(s.nowPlaying, key)
+		}
+	}
+	for key := range s.deadLetters {
+		if owned(key) {
+			delete(s.deadLetters, key)
+		}
+	}
+	for key := range s.values {
+		if owned(key) {
+			delete(s.values, key)
+		}
+	}
+	for key := range s.requests {
+		if owned(key) {
+			delete(s.requests, key)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) State(q Queue) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.values[q.StateKey()], nil
+}
+
+func (s *MemoryStore) SetState(q Queue, state string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.StateKey()
+	s.values[key] = state
+	s.changed(key)
+	return nil
+}
+
+func (s *MemoryStore) Channel(q Queue) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.values[q.ChannelKey()], nil
+}
+
+func (s *MemoryStore) SetChannel(q Queue, cid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.values[q.ChannelKey()] = cid
+	s.changed(q.ChannelKey())
+	return nil
+}
+
+func (s *MemoryStore) Request(q Queue, mid string) (StoredRequest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.MessageKey(mid)
+	req, ok := s.requests[key]
+	if !ok {
+		return StoredRequest{}, nil
+	}
+	ttl := time.Until(req.Expires)
+	if ttl <= 0 {
+		delete(s.requests, key)
+		return StoredRequest{}, nil
+	}
+	req.TTL = ttl
+	return req.StoredRequest, nil
+}
+
+func (s *MemoryStore) SetRequest(q Queue, mid string, req StoredRequest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := q.MessageKey(mid)
+	if len(req.URLs) == 0 || req.TTL <= 0 {
+		delete(s.requests, key)
+		return nil
+	}
+	s.requests[key] = memoryRequest{req, time.Now().Add(req.TTL)}
+	return nil
+}
+
+func (s *MemoryStore) DeleteRequest(q Queue, mid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.requests, q.MessageKey(mid))
+	return nil
+}
+
+func (s *MemoryStore) Subscribe(q Queue) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Like Redis, confirm the subscription with an event, so the current state is picked up.
+	s.subscribed[q.StateKey()] = true
+	s.subscribed[q.ChannelKey()] = true
+	s.subscribed[KeyForServerSettings(q.GuildID)] = true
+	s.notify(q.GuildID)
+}
+
+func (s *MemoryStore) Unsubscribe(q Queue) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.subscribed, q.StateKey())
+	delete(s.subscribed, q.ChannelKey())
+	delete(s.subscribed, KeyForServerSettings(q.GuildID))
+}
+
+func (s *MemoryStore) SubscribePlaylist(q Queue) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.subscribed[q.PlaylistKey()] = true
+	s.subscribed[q.NowPlayingKey()] = true
+	s.notify(q.GuildID)
+}
+
+func (s *MemoryStore) UnsubscribePlaylist(q Queue) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.subscribed, q.PlaylistKey())
+	delete(s.subscribed, q.NowPlayingKey())
+}
+
+func (s *MemoryStore) Watch(ctx context.Context) (<-chan string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w := memoryWatcher{ctx, make(chan string)}
+	s.watchers = append(s.watchers, w)
+	for key := range s.subscribed {
+		w.send(GIDFromKey(key))
+	}
+	return w.ch, nil
+}
+
+// changed sends an event for a key, if it's subscribed to. Must be called with the store locked.
+func (s *MemoryStore) changed(key string) {
+	if s.subscribed[key] {
+		s.notify(GIDFromKey(key))
+	}
+}
+
+// notify sends an event to all watchers that are still running. Must be called with the store
+// locked.
+func (s *MemoryStore) notify(gid string) {
+	watchers := s.watchers[:0]
+	for _, w := range s.watchers {
+		if w.ctx.Err() != nil {
+			continue
+		}
+		w.send(gid)
+		watchers = append(watchers, w)
+	}
+	s.watchers = watchers
+}
+
+// send sends an event without blocking the store; the channel is never closed, so a send can't
+// race with that, but the order of events isn't guaranteed.
+func (w memoryWatcher) send(gid string) {
+	go func() {
+		select {
+		case w.ch <- gid:
+		case <-w.ctx.Done():
+		}
+	}()
+}
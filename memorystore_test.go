@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"github.com/sencrash/hiqty/media"
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Envelopes can only be decoded for registered services.
+func init() {
+	media.Register(soundcloud.New(""))
+}
+
+func testEnvelope(id int64, mid string) TrackEnvelope {
+	return TrackEnvelope{ServiceID: "soundcloud", Track: &soundcloud.Track{ID: id}, MessageID: mid}
+}
+
+func TestMemoryStorePlaylist(t *testing.T) {
+	s := NewMemoryStore()
+	q := GuildQueue("123")
+
+	playing, err := s.Advance(q)
+	assert.NoError(t, err)
+	assert.Nil(t, playing)
+
+	assert.NoError(t, s.Push(q, testEnvelope(1, "a"), testEnvelope(2, "a"), testEnvelope(3, "b")))
+	n, err := s.Len(q)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	playing, err = s.NowPlaying(q)
+	assert.NoError(t, err)
+	assert.Nil(t, playing)
+
+	// Advancing takes the track off the playlist.
+	playing, err = s.Advance(q)
+	assert.NoError(t, err)
+	assert.True(t, playing.Track.Equals(&soundcloud.Track{ID: 1}))
+	playing, err = s.NowPlaying(q)
+	assert.NoError(t, err)
+	assert.True(t, playing.Track.Equals(&soundcloud.Track{ID: 1}))
+	n, _ = s.Len(q)
+	assert.Equal(t, 2, n)
+
+	// The playing track is never removed, even if it matches.
+	n, err = s.Remove(q, func(e TrackEnvelope) bool { return e.MessageID == "a" })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	playing, _ = s.NowPlaying(q)
+	assert.NotNil(t, playing)
+
+	ok, err := s.Skip(q)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	playing, _ = s.NowPlaying(q)
+	assert.Nil(t, playing)
+	playing, _ = s.Advance(q)
+	assert.True(t, playing.Track.Equals(&soundcloud.Track{ID: 3}))
+
+	// Replacing or finishing the playing track only works if it's still the same track.
+	fresh := testEnvelope(3, "b")
+	fresh.Gain = -3
+	assert.NoError(t, s.ReplaceNowPlaying(q, &soundcloud.Track{ID: 1}, fresh))
+	playing, _ = s.NowPlaying(q)
+	assert.Equal(t, 0.0, playing.Gain)
+	assert.NoError(t, s.ReplaceNowPlaying(q, &soundcloud.Track{ID: 3}, fresh))
+	playing, _ = s.NowPlaying(q)
+	assert.Equal(t, -3.0, playing.Gain)
+
+	assert.NoError(t, s.Finish(q, &soundcloud.Track{ID: 1}))
+	playing, _ = s.NowPlaying(q)
+	assert.NotNil(t, playing)
+	assert.NoError(t, s.Finish(q, &soundcloud.Track{ID: 3}))
+	playing, _ = s.NowPlaying(q)
+	assert.Nil(t, playing)
+
+	ok, _ = s.Skip(q)
+	assert.False(t, ok)
+}
+
+func TestMemoryStoreDeadLetters(t *testing.T) {
+	s := NewMemoryStore()
+	q := GuildQueue("123").ForChannel("789")
+
+	// Envelopes for unknown services are set aside, rather than played or lost.
+	broken := []byte(`{"ServiceID":"nope","Track":{}}`)
+	s.playlists[q.PlaylistKey()] = [][]byte{broken}
+	assert.NoError(t, s.Push(q, testEnvelope(1, "")))
+	playing, err := s.Advance(q)
+	assert.NoError(t, err)
+	assert.True(t, playing.Track.Equals(&soundcloud.Track{ID: 1}))
+
+	dls := s.deadLetters[GuildQueue("123").DeadLetterKey()]
+	if assert.Len(t, dls, 1) {
+		assert.Equal(t, string(broken), dls[0].Envelope)
+		assert.Equal(t, "unknown service: nope", dls[0].Error)
+	}
+}
+
+func TestMemoryStoreMigrate(t *testing.T) {
+	s := NewMemoryStore()
+	from, to := GuildQueue("123"), GuildQueue("123").ForChannel("456")
+
+	assert.NoError(t, s.Push(from, testEnvelope(1, ""), testEnvelope(2, "")))
+	s.Advance(from)
+	assert.NoError(t, s.Migrate(from, to))
+	n, _ := s.Len(from)
+	assert.Equal(t, 0, n)
+	playing, _ := s.NowPlaying(from)
+	assert.Nil(t, playing)
+	n, _ = s.Len(to)
+	assert.Equal(t, 1, n)
+	playing, _ = s.NowPlaying(to)
+	assert.NotNil(t, playing)
+
+	// Playlists are never merged.
+	assert.NoError(t, s.Push(from, testEnvelope(3, "")))
+	assert.NoError(t, s.Migrate(from, to))
+	n, _ = s.Len(from)
+	assert.Equal(t, 1, n)
+}
+
+func TestMemoryStoreClear(t *testing.T) {
+	s := NewMemoryStore()
+	q, linked := GuildQueue("123"), Queue{GuildID: "123", BotID: "456"}
+	for _, q := range []Queue{q, linked} {
+		s.Push(q, testEnvelope(1, ""), testEnvelope(2, ""))
+		s.Push(q.ForChannel("789"), testEnvelope(3, ""))
+		s.Advance(q)
+		s.SetState(q, StatePlaying)
+	}
+
+	// Linked bots' queues are their own.
+	assert.NoError(t, s.Clear(q))
+	n, _ := s.Len(q)
+	assert.Equal(t, 0, n)
+	n, _ = s.Len(q.ForChannel("789"))
+	assert.Equal(t, 0, n)
+	playing, _ := s.NowPlaying(q)
+	assert.Nil(t, playing)
+	state, _ := s.State(q)
+	assert.Equal(t, "", state)
+
+	n, _ = s.Len(linked)
+	assert.Equal(t, 1, n)
+	state, _ = s.State(linked)
+	assert.Equal(t, StatePlaying, state)
+}
+
+func TestMemoryStoreRequest(t *testing.T) {
+	s := NewMemoryStore()
+	q := GuildQueue("123")
+
+	req, err := s.Request(q, "m")
+	assert.NoError(t, err)
+	assert.Empty(t, req.URLs)
+
+	assert.NoError(t, s.SetRequest(q, "m", StoredRequest{URLs: []string{"u"}, ChannelID: "c", TTL: time.Minute}))
+	req, err = s.Request(q, "m")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u"}, req.URLs)
+	assert.Equal(t, "c", req.ChannelID)
+	assert.True(t, req.TTL > 0 && req.TTL <= time.Minute)
+
+	assert.NoError(t, s.DeleteRequest(q, "m"))
+	req, _ = s.Request(q, "m")
+	assert.Empty(t, req.URLs)
+}
+
+func TestMemoryStoreWatch(t *testing.T) {
+	s := NewMemoryStore()
+	q := GuildQueue("123")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gids, err := s.Watch(ctx)
+	assert.NoError(t, err)
+
+	s.Subscribe(q)
+	assert.Equal(t, "123", <-gids)
+
+	assert.NoError(t, s.SetState(q, StatePlaying))
+	assert.Equal(t, "123", <-gids)
+	state, err := s.State(q)
+	assert.NoError(t, err)
+	assert.Equal(t, StatePlaying, state)
+
+	// Playlists are only watched once subscribed to, eg. by their player.
+	assert.NoError(t, s.Push(q, testEnvelope(1, "")))
+	s.SubscribePlaylist(q)
+	assert.Equal(t, "123", <-gids)
+	assert.NoError(t, s.Push(q, testEnvelope(2, "")))
+	assert.Equal(t, "123", <-gids)
+
+	// Other queues' states aren't watched.
+	s.SetState(GuildQueue("456"), StatePlaying)
+	select {
+	case gid := <-gids:
+		t.Errorf("unexpected event for %s", gid)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
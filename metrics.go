@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics exported by the MetricsServer, in the Prometheus text format. They're per instance;
+// usage statistics across all instances are kept in Redis (see RecordStats).
+var (
+	MetricActivePlayers     = NewGauge("hiqty_active_players", "Players running on this instance.", "")
+	MetricTracksPlayed      = NewCounter("hiqty_tracks_played_total", "Tracks started, by service.", "service")
+	MetricResolveDuration   = NewHistogram("hiqty_resolve_duration_seconds", "Time taken to resolve URLs, by service.", "service", ResolveBuckets)
+	MetricResolveErrors     = NewCounter("hiqty_resolve_errors_total", "URLs that failed to resolve, by service.", "service")
+	MetricRefreshDuration   = NewHistogram("hiqty_refresh_duration_seconds", "Time taken to look up stale and stub tracks again, by service.", "service", ResolveBuckets)
+	MetricRefreshErrors     = NewCounter("hiqty_refresh_errors_total", "Tracks that failed to be looked up again, by service.", "service")
+	MetricMediaDuration     = NewHistogram("hiqty_media_request_duration_seconds", "Time taken for media requests to start streaming, by service.", "service", ResolveBuckets)
+	MetricMediaErrors       = NewCounter("hiqty_media_request_errors_total", "Media requests that couldn't be built or failed, by service.", "service")
+	MetricVoiceReconnects   = NewCounter("hiqty_voice_reconnects_total", "Voice connections that dropped and had to reconnect.", "")
+	MetricRedisErrors       = NewCounter("hiqty_redis_errors_total", "Failed Redis connections, and commands that failed to go through.", "")
+	MetricGoroutines        = NewGauge("hiqty_player_goroutines", "Goroutines running on behalf of players, by what they do.", "stage")
+	MetricOverdueGoroutines = NewCounter("hiqty_player_goroutines_overdue_total", "Player goroutines still running well after they were told to stop, by what they do.", "stage")
+	MetricEncoderCheckouts  = NewCounter("hiqty_encoder_checkouts_total", "Encoders taken from the pool, by whether a spare was ready (hit) or one had to be started (miss).", "result")
+)
+
+// Histogram buckets for resolve durations, in seconds.
+var ResolveBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// All registered metrics, in the order they're written.
+var metrics = []metric{}
+var metricsMutex sync.Mutex
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	metrics = append(metrics, m)
+}
+
+// WriteMetrics writes all registered metrics to w, in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	metricsMutex.Lock()
+	ms := append([]metric{}, metrics...)
+	metricsMutex.Unlock()
+
+	for _, m := range ms {
+		m.write(w)
+	}
+}
+
+// A Counter is a number that only goes up, optionally split by the value of a label.
+type Counter struct {
+	name, help, label string
+	values            map[string]float64
+	mutex             sync.Mutex
+}
+
+// NewCounter creates and registers a counter; label may be empty.
+func NewCounter(name, help, label string) *Counter {
+	c := &Counter{name: name, help: help, label: label, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc increments the counter.
+func (c *Counter) Inc() { c.IncFor("") }
+
+// IncFor increments the counter for the given label value.
+func (c *Counter) IncFor(value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[value]++
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writeValues(w, c.name, c.help, "counter", c.label, c.values)
+}
+
+// A Gauge is a number that can go up and down, optionally split by the value of a label.
+type Gauge struct {
+	name, help, label string
+	values            map[string]float64
+	mutex             sync.Mutex
+}
+
+// NewGauge creates and registers a gauge; label may be empty.
+func NewGauge(name, help, label string) *Gauge {
+	g := &Gauge{name: name, help: help, label: label, values: map[string]float64{}}
+	register(g)
+	return g
+}
+
+// Add adds to the gauge, which may be negative.
+func (g *Gauge) Add(delta float64) { g.AddFor("", delta) }
+
+// AddFor adds to the gauge for the given label value.
+func (g *Gauge) AddFor(value string, delta float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[value] += delta
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	writeValues(w, g.name, g.help, "gauge", g.label, g.values)
+}
+
+// A GaugeFunc is a gauge that's computed when metrics are written, split by the value of a label.
+type GaugeFunc struct {
+	name, help, label string
+	fn                func() map[string]float64
+}
+
+// NewGaugeFunc creates and registers a computed gauge.
+func NewGaugeFunc(name, help, label string, fn func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name, help, label, fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeValues(w, g.name, g.help, "gauge", g.label, g.fn())
+}
+
+// A Histogram counts observations into buckets, optionally split by the value of a label.
+type Histogram struct {
+	name, help, label string
+	buckets           []float64
+	values            map[string]*histogramValues
+	mutex             sync.Mutex
+}
+
+type histogramValues struct {
+	Counts []uint64 // Per bucket, not cumulative
+	Count  uint64
+	Sum    float64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket upper bounds, ascending.
+func NewHistogram(name, help, label string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, label: label, buckets: buckets, values: map[string]*histogramValues{}}
+	register(h)
+	return h
+}
+
+// ObserveDuration records a duration, in seconds, for the given label value.
+func (h *Histogram) ObserveDuration(value string, d time.Duration) {
+	h.Observe(value, d.Seconds())
+}
+
+// Observe records an observation for the given label value.
+func (h *Histogram) Observe(value string, v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hv := h.values[value]
+	if hv == nil {
+		hv = &histogramValues{Counts: make([]uint64, len(h.buckets))}
+		h.values[value] = hv
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hv.Counts[i]++
+			break
+		}
+	}
+	hv.Count++
+	hv.Sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, value := range sortedKeys(h.values) {
+		hv := h.values[value]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hv.Counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.label, value, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.label, value, "le", "+Inf"), hv.Count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.label, value), formatFloat(hv.Sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.label, value), hv.Count)
+	}
+}
+
+func writeValues(w io.Writer, name, help, typ, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	if label == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(values[""]))
+		return
+	}
+	for _, value := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(label, value), formatFloat(values[value]))
+	}
+}
+
+// formatLabels formats label name/value pairs, skipping ones without a name.
+func formatLabels(pairs ...string) string {
+	parts := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i] == "" {
+			continue
+		}
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch m := m.(type) {
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramValues:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCounterWrite(t *testing.T) {
+	c := &Counter{name: "plays_total", help: "Plays.", label: "service", values: map[string]float64{}}
+	c.IncFor("soundcloud")
+	c.IncFor("soundcloud")
+	c.IncFor(`we"ird`)
+
+	buf := bytes.Buffer{}
+	c.write(&buf)
+	assert.Equal(t, "# HELP plays_total Plays.\n# TYPE plays_total counter\n"+
+		"plays_total{service=\"soundcloud\"} 2\n"+
+		"plays_total{service=\"we\\\"ird\"} 1\n", buf.String())
+}
+
+func TestGaugeWriteUnlabelled(t *testing.T) {
+	g := &Gauge{name: "players", help: "Players.", values: map[string]float64{}}
+
+	buf := bytes.Buffer{}
+	g.write(&buf)
+	assert.Equal(t, "# HELP players Players.\n# TYPE players gauge\nplayers 0\n", buf.String())
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := &Histogram{name: "resolve_seconds", help: "Resolves.", label: "service", buckets: []float64{0.1, 1}, values: map[string]*histogramValues{}}
+	h.Observe("sc", 0.05)
+	h.Observe("sc", 0.5)
+	h.Observe("sc", 2)
+
+	buf := bytes.Buffer{}
+	h.write(&buf)
+	assert.Equal(t, "# HELP resolve_seconds Resolves.\n# TYPE resolve_seconds histogram\n"+
+		"resolve_seconds_bucket{service=\"sc\",le=\"0.1\"} 1\n"+
+		"resolve_seconds_bucket{service=\"sc\",le=\"1\"} 2\n"+
+		"resolve_seconds_bucket{service=\"sc\",le=\"+Inf\"} 3\n"+
+		"resolve_seconds_sum{service=\"sc\"} 2.55\n"+
+		"resolve_seconds_count{service=\"sc\"} 3\n", buf.String())
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The MetricsServer subsystem serves metrics for Prometheus to scrape. It's separate from the
+// HTTPServer, so it can listen on an internal address while that one's public.
+type MetricsServer struct {
+	Addr  string
+	Store Store
+}
+
+// Playlists of the players running on this instance, by guild (and bot, if linked), for reporting
+// their lengths.
+var playingQueues = map[string]Queue{}
+var playingQueuesMutex sync.Mutex
+
+// setPlayingQueue records the playlist a player is playing from; an empty one removes it.
+func setPlayingQueue(q Queue, playlist Queue) {
+	name := q.GuildID
+	if q.BotID != "" {
+		name += "/" + q.BotID
+	}
+
+	playingQueuesMutex.Lock()
+	defer playingQueuesMutex.Unlock()
+	if playlist.GuildID == "" {
+		delete(playingQueues, name)
+	} else {
+		playingQueues[name] = playlist
+	}
+}
+
+// Run runs the metrics server until the context expires.
+func (s *MetricsServer) Run(ctx context.Context) {
+	NewGaugeFunc("hiqty_queue_length", "Tracks in the playlists of players running on this instance.", "guild", s.queueLengths)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.HandleMetrics)
+
+	srv := &http.Server{Addr: s.Addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			log.WithError(err).Warn("MetricsServer: Couldn't shut down cleanly")
+		}
+	}()
+
+	log.WithField("addr", s.Addr).Info("MetricsServer: Listening")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("MetricsServer: Couldn't listen")
+	}
+}
+
+// HandleMetrics serves all metrics.
+func (s *MetricsServer) HandleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteMetrics(w)
+}
+
+func (s *MetricsServer) queueLengths() map[string]float64 {
+	playingQueuesMutex.Lock()
+	queues := make(map[string]Queue, len(playingQueues))
+	for name, q := range playingQueues {
+		queues[name] = q
+	}
+	playingQueuesMutex.Unlock()
+
+	lengths := map[string]float64{}
+	for name, q := range queues {
+		n, err := s.Store.Len(q)
+		if err != nil {
+			log.WithError(err).WithField("gid", q.GuildID).Warn("MetricsServer: Couldn't get queue length")
+			continue
+		}
+		lengths[name] = float64(n)
+	}
+	return lengths
+}
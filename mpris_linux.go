@@ -0,0 +1,199 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/gomodule/redigo/redis"
+	"reflect"
+	"time"
+)
+
+const (
+	mprisBusName     = "org.mpris.MediaPlayer2.hiqty"
+	mprisPath        = dbus.ObjectPath("/org/mpris/MediaPlayer2")
+	mprisRootIface   = "org.mpris.MediaPlayer2"
+	mprisPlayerIface = "org.mpris.MediaPlayer2.Player"
+)
+
+// The MPRISBridge subsystem exposes a guild's playback over MPRIS on the D-Bus session bus, so a
+// self-hoster's desktop media keys and widgets can control the bot. Since there's only one set of
+// media keys, it only makes sense for a single guild.
+type MPRISBridge struct {
+	Pool    *redis.Pool
+	GuildID string
+
+	props *prop.Properties
+}
+
+// Run runs the bridge until the context expires.
+func (b *MPRISBridge) Run(ctx context.Context) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		log.WithError(err).Error("MPRISBridge: Couldn't connect to the session bus")
+		return
+	}
+	defer conn.Close()
+
+	reply, err := conn.RequestName(mprisBusName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		log.WithError(err).Error("MPRISBridge: Couldn't claim bus name")
+		return
+	}
+
+	if err := conn.Export(mprisRoot{}, mprisPath, mprisRootIface); err != nil {
+		log.WithError(err).Error("MPRISBridge: Couldn't export interface")
+		return
+	}
+	// Seek is exported under another name, to not be mistaken for io.Seeker.Seek.
+	if err := conn.ExportWithMap(mprisPlayer{b}, map[string]string{"SeekOffset": "Seek"}, mprisPath, mprisPlayerIface); err != nil {
+		log.WithError(err).Error("MPRISBridge: Couldn't export interface")
+		return
+	}
+
+	b.props, err = prop.Export(conn, mprisPath, prop.Map{
+		mprisRootIface: {
+			"CanQuit":             {Value: false},
+			"CanRaise":            {Value: false},
+			"HasTrackList":        {Value: false},
+			"Identity":            {Value: "hiqty"},
+			"SupportedUriSchemes": {Value: []string{}},
+			"SupportedMimeTypes":  {Value: []string{}},
+		},
+		mprisPlayerIface: {
+			"PlaybackStatus": {Value: "Stopped", Emit: prop.EmitTrue},
+			"Metadata":       {Value: map[string]dbus.Variant{}, Emit: prop.EmitTrue},
+			"Rate":           {Value: 1.0},
+			"MinimumRate":    {Value: 1.0},
+			"MaximumRate":    {Value: 1.0},
+			"Volume":         {Value: 1.0},
+			"Position":       {Value: int64(0), Emit: prop.EmitFalse},
+			"CanGoNext":      {Value: true},
+			"CanGoPrevious":  {Value: false},
+			"CanPlay":        {Value: true},
+			"CanPause":       {Value: true},
+			"CanSeek":        {Value: false},
+			"CanControl":     {Value: true},
+		},
+	})
+	if err != nil {
+		log.WithError(err).Error("MPRISBridge: Couldn't export properties")
+		return
+	}
+
+	// Redis is the source of truth, so just poll it for changes to emit.
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		b.refresh()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh updates the exported properties from Redis.
+func (b *MPRISBridge) refresh() {
+	rconn := b.Pool.Get()
+	defer rconn.Close()
+
+	state, err := redis.String(rconn.Do("GET", KeyForServerState(b.GuildID)))
+	if err != nil && err != redis.ErrNil {
+		log.WithError(err).Warn("MPRISBridge: Couldn't get state")
+		return
+	}
+	envelope, err := ReadNowPlaying(rconn, ActivePlaylistQueue(rconn, GuildQueue(b.GuildID)))
+	if err != nil {
+		log.WithError(err).Warn("MPRISBridge: Couldn't get current track")
+		return
+	}
+
+	status := "Stopped"
+	metadata := map[string]dbus.Variant{}
+	if envelope != nil {
+		info := envelope.Track.GetInfo()
+		metadata["mpris:trackid"] = dbus.MakeVariant(dbus.ObjectPath("/org/hiqty/track/current"))
+		metadata["xesam:title"] = dbus.MakeVariant(info.Title)
+		metadata["xesam:artist"] = dbus.MakeVariant([]string{info.User.Name})
+		metadata["xesam:url"] = dbus.MakeVariant(info.URL)
+		if info.CoverURL != "" {
+			metadata["mpris:artUrl"] = dbus.MakeVariant(info.CoverURL)
+		}
+		if state == StatePlaying {
+			status = "Playing"
+		} else {
+			status = "Paused"
+		}
+	}
+
+	b.setIfChanged("PlaybackStatus", status)
+	b.setIfChanged("Metadata", metadata)
+}
+
+// setIfChanged sets a player property, if it changed; setting it always emits a signal.
+func (b *MPRISBridge) setIfChanged(name string, v interface{}) {
+	if old, err := b.props.Get(mprisPlayerIface, name); err == nil && reflect.DeepEqual(old.Value(), v) {
+		return
+	}
+	b.props.SetMust(mprisPlayerIface, name, v)
+}
+
+// setState sets the guild's playback state.
+func (b *MPRISBridge) setState(state string) *dbus.Error {
+	rconn := b.Pool.Get()
+	defer rconn.Close()
+
+	if err := SetQueueState(rconn, GuildQueue(b.GuildID), state); err != nil {
+		log.WithError(err).Error("MPRISBridge: Couldn't set state")
+		return dbus.MakeFailedError(err)
+	}
+	b.refresh()
+	return nil
+}
+
+// mprisRoot implements org.mpris.MediaPlayer2.
+type mprisRoot struct{}
+
+func (mprisRoot) Raise() *dbus.Error { return nil }
+func (mprisRoot) Quit() *dbus.Error  { return nil }
+
+// mprisPlayer implements org.mpris.MediaPlayer2.Player. There's no separate notion of pausing, so
+// pausing stops the player, and playing starts it again.
+type mprisPlayer struct {
+	b *MPRISBridge
+}
+
+func (p mprisPlayer) Play() *dbus.Error  { return p.b.setState(StatePlaying) }
+func (p mprisPlayer) Pause() *dbus.Error { return p.b.setState(StatePaused) }
+func (p mprisPlayer) Stop() *dbus.Error  { return p.b.setState(StateStopped) }
+
+func (p mprisPlayer) PlayPause() *dbus.Error {
+	status, err := p.b.props.Get(mprisPlayerIface, "PlaybackStatus")
+	if err == nil && status.Value() == "Playing" {
+		return p.Pause()
+	}
+	return p.Play()
+}
+
+func (p mprisPlayer) Next() *dbus.Error {
+	rconn := p.b.Pool.Get()
+	defer rconn.Close()
+
+	if _, err := Skip(rconn, ActivePlaylistQueue(rconn, GuildQueue(p.b.GuildID))); err != nil {
+		log.WithError(err).Error("MPRISBridge: Couldn't skip")
+		return dbus.MakeFailedError(err)
+	}
+	p.b.refresh()
+	return nil
+}
+
+func (p mprisPlayer) Previous() *dbus.Error                                 { return nil }
+func (p mprisPlayer) SeekOffset(offset int64) *dbus.Error                   { return nil }
+func (p mprisPlayer) SetPosition(id dbus.ObjectPath, pos int64) *dbus.Error { return nil }
+func (p mprisPlayer) OpenUri(uri string) *dbus.Error                        { return nil }
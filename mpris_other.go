@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+)
+
+// MPRIS is a D-Bus protocol, and is only supported on Linux.
+type MPRISBridge struct {
+	Pool    *redis.Pool
+	GuildID string
+}
+
+func (b *MPRISBridge) Run(ctx context.Context) {
+	log.Error("MPRISBridge: MPRIS is only supported on Linux")
+}
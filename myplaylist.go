@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mvdan/xurls"
+	"github.com/sencrash/hiqty/media"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most personal playlists a user can have.
+const MaxPersonalPlaylists = 25
+
+// Most tracks a personal playlist can have.
+const MaxPersonalPlaylistLength = 200
+
+// How many tracks in a personal playlist are listed with myplaylist show.
+const PersonalPlaylistPreview = 15
+
+// AddToPersonalPlaylist appends envelopes to one of a user's playlists, creating it if need be, and
+// returns its new length.
+func AddToPersonalPlaylist(rconn redis.Conn, uid, name string, envelopes ...TrackEnvelope) (int, error) {
+	if _, err := rconn.Do("SADD", KeyForUserPlaylists(uid), name); err != nil {
+		return 0, err
+	}
+	return pushSaved(rconn, KeyForUserPlaylist(uid, name), envelopes...)
+}
+
+// RemoveFromPersonalPlaylist removes the track at a position in one of a user's playlists, 1 being
+// the first, returning false if there's no such track. A playlist left empty is deleted.
+func RemoveFromPersonalPlaylist(rconn redis.Conn, uid, name string, pos int) (bool, error) {
+	ok, err := removeSaved(rconn, KeyForUserPlaylist(uid, name), pos)
+	if err != nil || !ok {
+		return ok, err
+	}
+	n, err := redis.Int(rconn.Do("LLEN", KeyForUserPlaylist(uid, name)))
+	if err == nil && n == 0 {
+		_, err = DeletePersonalPlaylist(rconn, uid, name)
+	}
+	return true, err
+}
+
+// DeletePersonalPlaylist deletes one of a user's playlists, returning false if there's no such
+// playlist.
+func DeletePersonalPlaylist(rconn redis.Conn, uid, name string) (bool, error) {
+	rconn.Send("MULTI")
+	rconn.Send("SREM", KeyForUserPlaylists(uid), name)
+	rconn.Send("DEL", KeyForUserPlaylist(uid, name))
+	replies, err := redis.Ints(rconn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	return replies[0] > 0, nil
+}
+
+// PersonalPlaylists returns the names of a user's playlists, in alphabetical order, and how many
+// tracks are in each.
+func PersonalPlaylists(rconn redis.Conn, uid string) ([]string, map[string]int, error) {
+	names, err := redis.Strings(rconn.Do("SMEMBERS", KeyForUserPlaylists(uid)))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rconn.Send("LLEN", KeyForUserPlaylist(uid, name))
+	}
+	rconn.Flush()
+	lengths := map[string]int{}
+	for _, name := range names {
+		if lengths[name], err = redis.Int(rconn.Receive()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return names, lengths, nil
+}
+
+// PersonalPlaylist returns the tracks in one of a user's playlists; ones that can't be decoded
+// anymore, eg. because their service is gone, are nil.
+func PersonalPlaylist(rconn redis.Conn, uid, name string) ([]*TrackEnvelope, error) {
+	return readSaved(rconn, KeyForUserPlaylist(uid, name))
+}
+
+// queueSaved queues tracks for a user in the voice channel they're in, eg. ones they saved, as if
+// they'd requested them there and then: the guild's settings and the channel's NSFW-ness apply. Returns the tracks
+// that were queued and the ones that were skipped, or false if the user can't queue anything right
+// now, having been told why.
+func (r *Responder) queueSaved(rconn redis.Conn, msg *discordgo.MessageCreate, channel *discordgo.Channel, saved []TrackEnvelope) ([]media.Track, []SkippedTrack, bool) {
+	vcid := r.voiceChannel(channel.GuildID, msg.Author.ID)
+	if vcid == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, "You must be in a voice channel to play anything.")
+		return nil, nil, false
+	}
+	q := r.queue(channel.GuildID)
+	if r.djLocked(rconn, q, msg.ChannelID, msg.Author.ID) {
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	envelopes := []TrackEnvelope{}
+	skipped := []SkippedTrack{}
+	for _, s := range saved {
+		res := resolvedURL{URL: s.URL, Tracks: []media.Track{s.Track}, Timing: RequestTiming{Received: now, Resolved: now}, Requester: msg.Author.ID}
+		playable, unplayable := PlayableEnvelopes(rconn, channel.GuildID, msg.ID, channel.NSFW, res)
+		envelopes = append(envelopes, playable...)
+		skipped = append(skipped, unplayable...)
+	}
+	if len(envelopes) == 0 {
+		return nil, skipped, true
+	}
+	if err := r.Store.Push(PlaylistQueue(rconn, q, vcid), envelopes...); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't push to playlist")
+		return nil, nil, false
+	}
+	r.activate(rconn, q, msg.ChannelID, vcid)
+
+	tracks := make([]media.Track, len(envelopes))
+	for i, envelope := range envelopes {
+		tracks[i] = envelope.Track
+	}
+	return tracks, skipped, true
+}
+
+// cmdMyPlaylist manages the named playlists of whoever asked, which follow them to any server.
+func cmdMyPlaylist(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	usage := "Usage: `myplaylist [add <name> [<url>...]|play <name>|show <name>|remove <name> <number>|delete <name>]`"
+	if len(args) == 0 {
+		names, lengths, err := PersonalPlaylists(rconn, msg.Author.ID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't list personal playlists")
+			return
+		}
+		if len(names) == 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, "You have no playlists; start one with `myplaylist add <name> <url>`, or leave out the URL to add whatever's playing.")
+			return
+		}
+		lines := []string{"Your playlists:"}
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("`%s` (%d tracks)", name, lengths[name]))
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, strings.Join(lines, "\n"))
+		return
+	}
+	if len(args) < 2 {
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+		return
+	}
+	sub, name := strings.ToLower(args[0]), strings.ToLower(args[1])
+	if !namePattern.MatchString(name) {
+		r.reply(msg.ChannelID, msg.Author.ID, "Playlist names can only have letters, numbers, dashes and underscores.")
+		return
+	}
+
+	switch sub {
+	case "add":
+		cmdMyPlaylistAdd(r, rconn, msg, channel, name, args[2:])
+	case "play":
+		saved, err := PersonalPlaylist(rconn, msg.Author.ID, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't get personal playlist")
+			return
+		}
+		envelopes := []TrackEnvelope{}
+		for _, envelope := range saved {
+			if envelope != nil {
+				envelopes = append(envelopes, *envelope)
+			}
+		}
+		if len(envelopes) == 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You have no playlist called `%s`, or nothing in it can be played anymore.", name))
+			return
+		}
+		tracks, skipped, ok := r.queueSaved(rconn, msg, channel, envelopes)
+		if !ok {
+			return
+		}
+		if len(skipped) > 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Queued %d of %d tracks from `%s`; skipped %d that can't be played here.", len(tracks), len(envelopes), name, len(skipped)))
+		}
+		r.announce(rconn, channel.GuildID, msg.ChannelID, channel.NSFW, msg.Author, tracks)
+	case "show":
+		saved, err := PersonalPlaylist(rconn, msg.Author.ID, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't get personal playlist")
+			return
+		}
+		if len(saved) == 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You have no playlist called `%s`.", name))
+			return
+		}
+		lines := []string{fmt.Sprintf("`%s`:", name)}
+		for i, envelope := range saved {
+			if i == PersonalPlaylistPreview {
+				lines = append(lines, fmt.Sprintf("...and %d more", len(saved)-i))
+				break
+			}
+			if envelope == nil {
+				lines = append(lines, fmt.Sprintf("%d. (unavailable)", i+1))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%d. **%s** <%s>", i+1, envelope.Track.GetInfo().Title, envelope.URL))
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, strings.Join(lines, "\n"))
+	case "remove":
+		pos, err := strconv.Atoi(strings.Join(args[2:], " "))
+		if err != nil {
+			r.reply(msg.ChannelID, msg.Author.ID, usage)
+			return
+		}
+		ok, err := RemoveFromPersonalPlaylist(rconn, msg.Author.ID, name, pos)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't remove from personal playlist")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no track #%d in `%s`.", pos, name))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Removed track #%d from `%s`.", pos, name))
+	case "delete":
+		ok, err := DeletePersonalPlaylist(rconn, msg.Author.ID, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't delete personal playlist")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You have no playlist called `%s`.", name))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Deleted `%s`.", name))
+	default:
+		r.reply(msg.ChannelID, msg.Author.ID, usage)
+	}
+}
+
+// cmdMyPlaylistAdd adds the tracks links resolve to, or whatever's playing if there are none, to one
+// of a user's playlists. Whether they can be played is checked when they're played, wherever that is.
+func cmdMyPlaylistAdd(r *Responder, rconn redis.Conn, msg *discordgo.MessageCreate, channel *discordgo.Channel, name string, args []string) {
+	names, lengths, err := PersonalPlaylists(rconn, msg.Author.ID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't list personal playlists")
+		return
+	}
+	if len(names) >= MaxPersonalPlaylists && !containsString(names, name) {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("You can only have %d playlists; delete one first.", MaxPersonalPlaylists))
+		return
+	}
+
+	envelopes := []TrackEnvelope{}
+	urls := xurls.Strict().FindAllString(strings.Join(args, " "), -1)
+	if len(urls) == 0 {
+		playing, err := r.nowPlaying(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't get track")
+			return
+		}
+		if playing == nil {
+			r.reply(msg.ChannelID, msg.Author.ID, "Nothing's playing right now; give me a link to add instead.")
+			return
+		}
+		envelopes = append(envelopes, savedEnvelope(*playing))
+	}
+	for _, url := range urls {
+		tracks, err := ResolveURL(rconn, url)
+		if err != nil {
+			r.reply(msg.ChannelID, msg.Author.ID, friendlyError(err))
+			return
+		}
+		for _, track := range tracks {
+			envelopes = append(envelopes, savedEnvelope(TrackEnvelope{ServiceID: track.GetServiceID(), Track: track, URL: url}))
+		}
+	}
+	if len(envelopes) == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, "There's nothing there to add.")
+		return
+	}
+	if lengths[name]+len(envelopes) > MaxPersonalPlaylistLength {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Playlists can have %d tracks at most; `%s` has %d.", MaxPersonalPlaylistLength, name, lengths[name]))
+		return
+	}
+
+	n, err := AddToPersonalPlaylist(rconn, msg.Author.ID, name, envelopes...)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't add to personal playlist")
+		return
+	}
+	added := fmt.Sprintf("%d tracks", len(envelopes))
+	if len(envelopes) == 1 {
+		added = fmt.Sprintf("**%s**", envelopes[0].Track.GetInfo().Title)
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Added %s to `%s`, which now has %d; play it anywhere with `myplaylist play %s`.", added, name, n, name))
+}
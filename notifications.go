@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Most outgoing webhooks a guild can have.
+const MaxNotifications = 10
+
+// Most notifications being delivered at once, across all guilds; events that come in while this
+// many are still being delivered aren't sent to receivers that are that slow.
+const MaxNotificationsInFlight = 100
+
+// Client for delivering notifications; receivers that take longer than this are given up on. It
+// won't connect to private addresses, whatever a receiver's name resolves to, so webhooks can't be
+// used to reach anything on the bot's own network; nor does it go through a proxy, which would
+// bypass that.
+var notificationClient = http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+					return errors.New("refusing to connect to private address: " + host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// Slots for notifications being delivered; see MaxNotificationsInFlight.
+var notificationSlots = make(chan struct{}, MaxNotificationsInFlight)
+
+// Carrier-grade NAT addresses, which net.IP doesn't count as private.
+var sharedAddressSpace = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// isPrivateIP returns whether an IP address is one that isn't reachable over the internet, eg. a
+// loopback, private network or link-local one (like cloud metadata services).
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// A Notification is an outgoing webhook, which is sent a guild's playback events (see Event) as
+// they happen, eg. to log plays elsewhere. Discord webhook URLs are sent a chat message instead.
+type Notification struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"` // Event types to send; all of them if empty
+
+	// Payloads are signed with this, in an X-Hiqty-Signature header: "sha256=<hex HMAC>".
+	Secret string `json:"secret"`
+}
+
+// NotificationID returns a short identifier for a notification, from its URL.
+func NotificationID(url string) string {
+	return HashToken(url)[:8]
+}
+
+// Wants returns whether a notification should be sent an event.
+func (n Notification) Wants(typ string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	for _, e := range n.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// AddNotification adds an outgoing webhook to a guild, or replaces the one with the same URL.
+// Only http(s) URLs that aren't obviously private, and known event types, are accepted; a guild can
+// have up to MaxNotifications.
+func AddNotification(rconn redis.Conn, gid string, n Notification) error {
+	if err := validateNotificationURL(n.URL); err != nil {
+		return err
+	}
+	for _, typ := range n.Events {
+		if !isEventType(typ) {
+			return errors.New("unknown event: " + typ)
+		}
+	}
+
+	key, id := KeyForServerNotifications(gid), NotificationID(n.URL)
+	exists, err := redis.Bool(rconn.Do("HEXISTS", key, id))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		count, err := redis.Int(rconn.Do("HLEN", key))
+		if err != nil {
+			return err
+		}
+		if count >= MaxNotifications {
+			return errors.Errorf("there can only be %d webhooks; remove one first", MaxNotifications)
+		}
+	}
+
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	_, err = rconn.Do("HSET", key, id, data)
+	return err
+}
+
+// validateNotificationURL checks that a URL is an http(s) one, that isn't for a private address or
+// localhost. Names that resolve to private addresses are only caught when it's sent to, as what
+// they resolve to can change.
+func validateNotificationURL(url string) error {
+	u, err := neturl.Parse(url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("not an http(s) URL: " + url)
+	}
+	host := strings.ToLower(u.Hostname())
+	if ip := net.ParseIP(host); (ip != nil && isPrivateIP(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("not a public address: " + host)
+	}
+	return nil
+}
+
+// ListNotifications lists a guild's outgoing webhooks, by ID.
+func ListNotifications(rconn redis.Conn, gid string) (map[string]Notification, error) {
+	fields, err := redis.StringMap(rconn.Do("HGETALL", KeyForServerNotifications(gid)))
+	if err != nil {
+		return nil, err
+	}
+	notifications := map[string]Notification{}
+	for id, data := range fields {
+		var n Notification
+		if err := json.Unmarshal([]byte(data), &n); err != nil {
+			continue
+		}
+		notifications[id] = n
+	}
+	return notifications, nil
+}
+
+// RemoveNotification removes an outgoing webhook by ID, returning false if there was no such one.
+func RemoveNotification(rconn redis.Conn, gid, id string) (bool, error) {
+	n, err := redis.Int(rconn.Do("HDEL", KeyForServerNotifications(gid), id))
+	return n > 0, err
+}
+
+// Notify sends an event to the guild's outgoing webhooks, in the background.
+func Notify(rconn redis.Conn, e Event) error {
+	notifications, err := ListNotifications(rconn, e.GuildID)
+	if err != nil {
+		return err
+	}
+	for _, n := range notifications {
+		if !n.Wants(e.Type) {
+			continue
+		}
+		select {
+		case notificationSlots <- struct{}{}:
+		default:
+			log.WithFields(log.Fields{"gid": e.GuildID, "url": n.URL}).Warn("Too many notifications in flight, dropping one")
+			continue
+		}
+		go func(n Notification) {
+			defer func() { <-notificationSlots }()
+			if err := n.Send(e); err != nil {
+				log.WithError(err).WithFields(log.Fields{"gid": e.GuildID, "url": n.URL}).Warn("Couldn't send notification")
+			}
+		}(n)
+	}
+	return nil
+}
+
+// Send sends an event to a notification's URL.
+func (n Notification) Send(e Event) error {
+	var payload interface{} = e
+	if isDiscordWebhook(n.URL) {
+		text := DescribeEvent(e)
+		if text == "" {
+			return nil
+		}
+		payload = map[string]string{"content": text}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hiqty")
+	if n.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.Secret))
+		mac.Write(data)
+		req.Header.Set("X-Hiqty-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := notificationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New("unexpected status: " + res.Status)
+	}
+	return nil
+}
+
+// DescribeEvent describes an event for a chat message, or returns "" if it's not worth one.
+func DescribeEvent(e Event) string {
+	if e.Track == nil {
+		return ""
+	}
+	title := e.Track.Title
+	if e.Track.Artist != "" {
+		title = e.Track.Artist + " - " + title
+	}
+	switch e.Type {
+	case EventTrackStarted:
+		return fmt.Sprintf("Now playing: **%s** <%s>", title, e.Track.URL)
+	case EventTrackError:
+		return fmt.Sprintf("Couldn't play **%s**: %s", title, e.Error)
+	}
+	return ""
+}
+
+// isDiscordWebhook returns whether a URL is a Discord webhook, which takes chat messages.
+func isDiscordWebhook(url string) bool {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Host) {
+	case "discord.com", "discordapp.com", "canary.discord.com", "ptb.discord.com":
+		return strings.HasPrefix(u.Path, "/api/webhooks/")
+	}
+	return false
+}
+
+// EventTypes lists all event types, sorted.
+func EventTypes() []string {
+	types := []string{EventTrackStarted, EventTrackFinished, EventTrackSkipped, EventTrackError, EventQueueChanged}
+	sort.Strings(types)
+	return types
+}
+
+func isEventType(typ string) bool {
+	for _, t := range EventTypes() {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
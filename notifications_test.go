@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotificationWants(t *testing.T) {
+	assert.True(t, Notification{}.Wants(EventTrackStarted))
+	n := Notification{Events: []string{EventTrackStarted}}
+	assert.True(t, n.Wants(EventTrackStarted))
+	assert.False(t, n.Wants(EventQueueChanged))
+}
+
+func TestIsDiscordWebhook(t *testing.T) {
+	assert.True(t, isDiscordWebhook("https://discord.com/api/webhooks/1/abc"))
+	assert.True(t, isDiscordWebhook("https://discordapp.com/api/webhooks/1/abc"))
+	assert.False(t, isDiscordWebhook("https://discord.com/channels/1/2"))
+	assert.False(t, isDiscordWebhook("https://example.com/api/webhooks/1/abc"))
+}
+
+func TestNotificationSend(t *testing.T) {
+	var body []byte
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+		signature = req.Header.Get("X-Hiqty-Signature")
+	}))
+	defer srv.Close()
+
+	e := Event{Type: EventTrackStarted, GuildID: "1234", Track: &TrackSummary{Title: "Title"}}
+	assert.Error(t, Notification{URL: srv.URL}.Send(e), "test servers are on loopback")
+
+	// Let it reach the test server, which is private.
+	defer func(c http.Client) { notificationClient = c }(notificationClient)
+	notificationClient = http.Client{}
+	assert.NoError(t, Notification{URL: srv.URL, Secret: "s3cret"}.Send(e))
+
+	var sent Event
+	assert.NoError(t, json.Unmarshal(body, &sent))
+	assert.Equal(t, e.Type, sent.Type)
+	assert.Equal(t, "Title", sent.Track.Title)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature)
+}
+
+func TestDescribeEvent(t *testing.T) {
+	track := &TrackSummary{Title: "Title", Artist: "Artist", URL: "https://example.com/track"}
+	assert.Equal(t, "Now playing: **Artist - Title** <https://example.com/track>", DescribeEvent(Event{Type: EventTrackStarted, Track: track}))
+	assert.Equal(t, "", DescribeEvent(Event{Type: EventTrackFinished, Track: track}))
+	assert.Equal(t, "", DescribeEvent(Event{Type: EventQueueChanged}))
+}
+
+func TestValidateNotificationURL(t *testing.T) {
+	assert.NoError(t, validateNotificationURL("https://example.com/hook"))
+	assert.NoError(t, validateNotificationURL("http://93.184.216.34:8080/hook"))
+
+	for _, url := range []string{
+		"ftp://example.com/hook",
+		"https:///hook",
+		"http://localhost/hook",
+		"http://127.0.0.1:6379/",
+		"http://[::1]/hook",
+		"http://10.0.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://100.64.0.1/hook",
+		"http://0.0.0.0/hook",
+	} {
+		assert.Error(t, validateNotificationURL(url), url)
+	}
+}
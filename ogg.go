@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// An OggReader reads packets from an Ogg stream. Only a single logical bitstream is supported,
+// which is all ffmpeg ever writes for a single audio stream.
+type OggReader struct {
+	r *bufio.Reader
+
+	segments []byte // Remaining lacing values of the current page
+	partial  []byte // Incomplete packet, continued from a previous segment
+
+	segmentTable [255]byte // Backs segments, so it's not allocated for every page
+}
+
+// NewOggReader creates an OggReader.
+func NewOggReader(r io.Reader) *OggReader {
+	return &OggReader{r: bufio.NewReader(r)}
+}
+
+// ReadPacket returns the next packet in the stream.
+func (o *OggReader) ReadPacket() ([]byte, error) {
+	for {
+		if len(o.segments) == 0 {
+			if err := o.readPageHeader(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Packets are handed off to whoever reads them, so each needs a buffer of its own; size it
+		// for the whole packet, as far as this page goes, so it's read straight into it.
+		if o.partial == nil {
+			o.partial = make([]byte, 0, packetSize(o.segments))
+		}
+		size := int(o.segments[0])
+		o.segments = o.segments[1:]
+		start := len(o.partial)
+		if cap(o.partial)-start < size {
+			o.partial = append(o.partial, make([]byte, size)...)
+		} else {
+			o.partial = o.partial[:start+size]
+		}
+		if _, err := io.ReadFull(o.r, o.partial[start:]); err != nil {
+			return nil, errors.Wrap(err, "ogg: truncated page")
+		}
+
+		// A lacing value of 255 means the packet continues in the next segment.
+		if size < 255 {
+			pkt := o.partial
+			o.partial = nil
+			return pkt, nil
+		}
+	}
+}
+
+// packetSize returns the size of the packet starting at the first of the given lacing values, or
+// the part of it that's in them, if it continues past them.
+func packetSize(segments []byte) int {
+	size := 0
+	for _, l := range segments {
+		size += int(l)
+		if l < 255 {
+			break
+		}
+	}
+	return size
+}
+
+// readPageHeader reads the header of the next page, including its segment table.
+func (o *OggReader) readPageHeader() error {
+	var header [27]byte
+	if _, err := io.ReadFull(o.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errors.Wrap(err, "ogg: truncated page header")
+		}
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return errors.New("ogg: invalid capture pattern")
+	}
+	if header[4] != 0 {
+		return errors.Errorf("ogg: unsupported version: %d", header[4])
+	}
+
+	// Bytes 5-25 hold flags, the granule position, serial, sequence number and checksum; none of
+	// which matter for simply extracting packets.
+
+	o.segments = o.segmentTable[:header[26]]
+	if _, err := io.ReadFull(o.r, o.segments); err != nil {
+		return errors.Wrap(err, "ogg: truncated segment table")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+// oggPage builds an Ogg page containing the given lacing values and data.
+func oggPage(lacing []byte, data []byte) []byte {
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	header[26] = byte(len(lacing))
+	return append(append(header, lacing...), data...)
+}
+
+func TestOggReader(t *testing.T) {
+	long := bytes.Repeat([]byte{'b'}, 300)
+	stream := append(
+		oggPage([]byte{3, 255}, append([]byte("aaa"), long[:255]...)),
+		oggPage([]byte{45, 1}, append(long[255:], 'c'))...,
+	)
+
+	r := NewOggReader(bytes.NewReader(stream))
+
+	pkt, err := r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("aaa"), pkt)
+
+	pkt, err = r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, long, pkt)
+
+	pkt, err = r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c"), pkt)
+
+	_, err = r.ReadPacket()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestOggReaderInvalid(t *testing.T) {
+	r := NewOggReader(bytes.NewReader(bytes.Repeat([]byte{'x'}, 27)))
+	_, err := r.ReadPacket()
+	assert.Error(t, err)
+}
+
+func TestPacketSize(t *testing.T) {
+	assert.Equal(t, 3, packetSize([]byte{3, 255}))
+	assert.Equal(t, 300, packetSize([]byte{255, 45, 1}))
+	assert.Equal(t, 510, packetSize([]byte{255, 255}))
+	assert.Equal(t, 0, packetSize(nil))
+}
+
+func BenchmarkOggReader(b *testing.B) {
+	// A second of 64kbps audio: 50 packets of 160 bytes, a page each.
+	var stream []byte
+	for i := 0; i < 50; i++ {
+		stream = append(stream, oggPage([]byte{160}, bytes.Repeat([]byte{byte(i)}, 160))...)
+	}
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		r := NewOggReader(bytes.NewReader(stream))
+		for {
+			if _, err := r.ReadPacket(); err != nil {
+				break
+			}
+		}
+	}
+}
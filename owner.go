@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"github.com/sencrash/hiqty/media"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Usage of the owner command.
+const ownerUsage = "Usage: `owner stats`, `owner guilds`, `owner leave <guild id>`, `owner broadcast <message>`, `owner service enable|disable <id>`"
+
+// DisabledServices returns the IDs of services the bot's owners have disabled.
+func DisabledServices(rconn redis.Conn) (map[string]bool, error) {
+	sids, err := redis.Strings(rconn.Do("SMEMBERS", KeyDisabledServices))
+	if err != nil {
+		return nil, err
+	}
+	disabled := make(map[string]bool, len(sids))
+	for _, sid := range sids {
+		disabled[sid] = true
+	}
+	return disabled, nil
+}
+
+// IsServiceDisabled returns whether a service has been disabled by the bot's owners.
+func IsServiceDisabled(rconn redis.Conn, sid string) (bool, error) {
+	return redis.Bool(rconn.Do("SISMEMBER", KeyDisabledServices, sid))
+}
+
+// SetServiceDisabled disables or re-enables a service, for every instance at once. Links to a
+// disabled service are refused, as if it was down; tracks that are already queued still play.
+func SetServiceDisabled(rconn redis.Conn, sid string, disabled bool) error {
+	cmd := "SREM"
+	if disabled {
+		cmd = "SADD"
+	}
+	_, err := rconn.Do(cmd, KeyDisabledServices, sid)
+	return err
+}
+
+// isOwner returns whether a user is one of the bot's owners.
+func (r *Responder) isOwner(uid string) bool {
+	for _, id := range r.Owners {
+		if id == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdOwner lets the bot's owners (see --owner) manage the bot as a whole, regardless of what
+// permissions they have in the guild they're using it from.
+func cmdOwner(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	if !r.isOwner(msg.Author.ID) {
+		r.reply(msg.ChannelID, msg.Author.ID, "Only the bot's owners can do that.")
+		return
+	}
+	if len(args) == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, ownerUsage)
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	switch strings.ToLower(args[0]) {
+	case "stats":
+		r.reply(msg.ChannelID, msg.Author.ID, r.ownerStats(rconn))
+	case "guilds":
+		r.reply(msg.ChannelID, msg.Author.ID, r.ownerGuilds())
+	case "leave":
+		if len(args) != 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, ownerUsage)
+			return
+		}
+		if err := r.Session.GuildLeave(args[1]); err != nil {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Couldn't leave `%s`: %s", args[1], err.Error()))
+			return
+		}
+		ResponderLog.WithField("gid", args[1]).Info("Left guild at an owner's request")
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Left `%s`.", args[1]))
+	case "broadcast":
+		if len(args) < 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, ownerUsage)
+			return
+		}
+		// Take the message as it was written, rather than as split up into arguments.
+		i := strings.Index(strings.ToLower(msg.Content), "broadcast") + len("broadcast")
+		text := strings.TrimSpace(msg.Content[i:])
+		sent, failed := r.broadcast(text)
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Sent to %d guilds; %d couldn't be reached.", sent, failed))
+	case "service":
+		if len(args) != 3 {
+			r.reply(msg.ChannelID, msg.Author.ID, ownerUsage)
+			return
+		}
+		action, sid := strings.ToLower(args[1]), strings.ToLower(args[2])
+		if action != "enable" && action != "disable" {
+			r.reply(msg.ChannelID, msg.Author.ID, ownerUsage)
+			return
+		}
+		if media.Lookup(sid) == nil {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no service called `%s`.", sid))
+			return
+		}
+		if err := SetServiceDisabled(rconn, sid, action == "disable"); err != nil {
+			ResponderLog.WithError(err).Error("Couldn't toggle service")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s** is now %sd.", sid, action))
+	default:
+		r.reply(msg.ChannelID, msg.Author.ID, ownerUsage)
+	}
+}
+
+// ownerStats summarizes the bot's guilds, what's playing across all instances, and today's usage.
+func (r *Responder) ownerStats(rconn redis.Conn) string {
+	guilds, members := 0, 0
+	r.Session.State.RLock()
+	for _, g := range r.Session.State.Guilds {
+		guilds++
+		members += g.MemberCount
+	}
+	r.Session.State.RUnlock()
+
+	playing := 0
+	keys, err := scanKeys(rconn, "hiqty:server:*:state")
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't list player states")
+	}
+	for _, key := range keys {
+		if state, _ := redis.String(rconn.Do("GET", key)); state == StatePlaying {
+			playing++
+		}
+	}
+
+	lines := []string{
+		fmt.Sprintf("**Guilds**: %d (%d members)", guilds, members),
+		fmt.Sprintf("**Playing**: %d", playing),
+	}
+	now := time.Now()
+	if report, err := ReadStatsReport(rconn, now, now); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't read statistics")
+	} else {
+		lines = append(lines, fmt.Sprintf("**Today**: %d requests, %d plays, %d resolve errors, %d playback errors",
+			report.Totals[StatRequests], report.Totals[StatPlays],
+			report.Totals[StatResolveError], report.Totals[StatPlayError]))
+	}
+	if disabled, err := DisabledServices(rconn); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't read disabled services")
+	} else if len(disabled) > 0 {
+		sids := []string{}
+		for sid := range disabled {
+			sids = append(sids, sid)
+		}
+		sort.Strings(sids)
+		lines = append(lines, "**Disabled services**: "+strings.Join(sids, ", "))
+	}
+	return "Stats:\n" + strings.Join(lines, "\n")
+}
+
+// ownerGuilds lists the guilds the bot is in, largest first.
+func (r *Responder) ownerGuilds() string {
+	r.Session.State.RLock()
+	guilds := append([]*discordgo.Guild{}, r.Session.State.Guilds...)
+	r.Session.State.RUnlock()
+	sort.Slice(guilds, func(i, j int) bool { return guilds[i].MemberCount > guilds[j].MemberCount })
+
+	lines := []string{}
+	for _, g := range guilds {
+		lines = append(lines, fmt.Sprintf("`%s` **%s** (%d members)", g.ID, g.Name, g.MemberCount))
+	}
+	if len(lines) == 0 {
+		return "I'm not in any guilds."
+	}
+	return fmt.Sprintf("Guilds (%d):\n%s", len(lines), strings.Join(lines, "\n"))
+}
+
+// broadcast sends a notice to every guild the bot is in, in the first text channel it can post
+// in. Returns how many guilds it was sent to, and how many it couldn't be.
+func (r *Responder) broadcast(text string) (sent, failed int) {
+	r.Session.State.RLock()
+	guilds := append([]*discordgo.Guild{}, r.Session.State.Guilds...)
+	r.Session.State.RUnlock()
+
+	for _, g := range guilds {
+		cid := r.noticeChannel(g)
+		if cid == "" {
+			failed++
+			continue
+		}
+		if _, err := r.Session.ChannelMessageSend(cid, text); err != nil {
+			ResponderLog.WithError(err).WithField("gid", g.ID).Warn("Couldn't send broadcast")
+			failed++
+			continue
+		}
+		sent++
+	}
+	return sent, failed
+}
+
+// noticeChannel returns the topmost text channel in a guild the bot can post in, or "".
+func (r *Responder) noticeChannel(g *discordgo.Guild) string {
+	r.Session.State.RLock()
+	channels := append([]*discordgo.Channel{}, g.Channels...)
+	r.Session.State.RUnlock()
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Position < channels[j].Position })
+
+	uid := r.Session.State.User.ID
+	for _, c := range channels {
+		if c.Type != discordgo.ChannelTypeGuildText {
+			continue
+		}
+		if r.hasPermission(uid, c.ID, discordgo.PermissionSendMessages) {
+			return c.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Longest fade the fade setting allows.
+const MaxFade = 10 * time.Second
+
+// The ffmpeg filter used to even out loudness between tracks, with the normalize setting on. It
+// targets -16 LUFS, which is about what streaming services play at.
+const NormalizeFilter = "loudnorm=I=-16:TP=-1.5:LRA=11"
+
+// The ffmpeg filter used to remove vocals, with the karaoke setting on. Vocals are usually mixed
+// dead center, so subtracting each channel from the other cancels them out, along with anything
+// else that's centered, eg. bass and kick drums; what's left is instrumental-ish. Mono tracks are
+// all center, and cancel out entirely.
+const KaraokeFilter = "aformat=channel_layouts=stereo,pan=stereo|c0=c0-c1|c1=c1-c0"
+
+// FilterPresets are the built-in ffmpeg filter chains the filter setting can pick from, by name;
+// guilds can save their own as well (see SaveFilterPreset).
+var FilterPresets = map[string]string{
+	"flat":      "",
+	"bassboost": "bass=g=8:f=110:w=0.6",
+	"treble":    "treble=g=6:f=3000:w=0.6",
+
+	// Speech: rumble and hiss cut, presence brought up, and levels evened out, so quiet and loud
+	// speakers are about as easy to make out.
+	"podcast": "highpass=f=80,lowpass=f=12000,equalizer=f=3000:t=q:w=1:g=4,acompressor=threshold=-20dB:ratio=4:attack=10:release=200",
+}
+
+// Most filters a custom filter preset can chain together.
+const MaxCustomFilters = 8
+
+// customFilters are the ffmpeg filters custom filter presets can be made of. Anything that can read
+// files, run for longer than the track, or change its timing is left out.
+var customFilters = map[string]bool{
+	"acompressor": true,
+	"aecho":       true,
+	"bandpass":    true,
+	"bandreject":  true,
+	"bass":        true,
+	"chorus":      true,
+	"crystalizer": true,
+	"equalizer":   true,
+	"extrastereo": true,
+	"flanger":     true,
+	"highpass":    true,
+	"lowpass":     true,
+	"treble":      true,
+	"tremolo":     true,
+	"vibrato":     true,
+	"volume":      true,
+}
+
+// What the options of a filter in a custom filter preset can look like: key=value pairs, separated
+// by colons, with nothing that ffmpeg would read as more than that.
+var customFilterOptionsPattern = regexp.MustCompile(`^[a-z_]+=[a-zA-Z0-9.+-]+(:[a-z_]+=[a-zA-Z0-9.+-]+)*$`)
+
+// FilterPresetNames returns the names of all filter presets, in alphabetical order.
+func FilterPresetNames() []string {
+	names := make([]string, 0, len(FilterPresets))
+	for name := range FilterPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PlaybackSettings are a guild's settings for how tracks sound; they apply to every track its
+// players play, and are read whenever a player starts one.
+type PlaybackSettings struct {
+	Volume    float64       // In dB, on top of each track's own gain
+	Normalize bool          // Whether to even out loudness between tracks
+	Fade      time.Duration // How long to fade tracks in and out over, if at all
+	Filter    string        // Name of a filter preset; see FilterPresets
+	Custom    string        // The ffmpeg filters of the preset, if it's one of the guild's own
+	Karaoke   bool          // Whether to remove vocals; see KaraokeFilter
+}
+
+// ReadPlaybackSettings reads a guild's playback settings.
+func ReadPlaybackSettings(rconn redis.Conn, gid string) (PlaybackSettings, error) {
+	var s PlaybackSettings
+	volume, err := ReadSetting(rconn, gid, SettingVolume)
+	if err != nil {
+		return s, err
+	}
+	if s.Volume, err = parseGain(volume); err != nil {
+		return s, err
+	}
+	if s.Normalize, err = ReadBoolSetting(rconn, gid, SettingNormalize); err != nil {
+		return s, err
+	}
+	fade, err := ReadSetting(rconn, gid, SettingFade)
+	if err != nil {
+		return s, err
+	}
+	seconds, err := strconv.ParseFloat(fade, 64)
+	if err != nil {
+		return s, err
+	}
+	s.Fade = time.Duration(seconds * float64(time.Second))
+	if s.Filter, err = ReadSetting(rconn, gid, SettingFilter); err != nil {
+		return s, err
+	}
+	if _, ok := FilterPresets[s.Filter]; !ok {
+		if s.Custom, err = FilterPreset(rconn, gid, s.Filter); err != nil {
+			return s, err
+		}
+	}
+	s.Karaoke, err = ReadBoolSetting(rconn, gid, SettingKaraoke)
+	return s, err
+}
+
+// Effects returns the ffmpeg filters to play tracks through, other than for volume and fades: vocal
+// removal first, as it needs the mix as it was, then the filter preset. Presets that don't exist,
+// eg. custom ones that have been removed, leave tracks alone.
+func (s PlaybackSettings) Effects() string {
+	effects := []string{}
+	if s.Karaoke {
+		effects = append(effects, KaraokeFilter)
+	}
+	preset, ok := FilterPresets[s.Filter]
+	if !ok {
+		preset = s.Custom
+	}
+	if preset != "" {
+		effects = append(effects, preset)
+	}
+	return strings.Join(effects, ",")
+}
+
+// EncodeOptions returns the options to encode a track with at a bitrate, starting at an offset.
+func (s PlaybackSettings) EncodeOptions(bitrate int, envelope TrackEnvelope, seek time.Duration) EncodeOptions {
+	return EncodeOptions{
+		Bitrate:   bitrate,
+		Gain:      envelope.Gain + s.Volume,
+		Seek:      seek,
+		Normalize: s.Normalize,
+		Fade:      s.Fade,
+		Length:    envelope.Track.GetInfo().Duration,
+		Effects:   s.Effects(),
+	}
+}
+
+// normalizeFilter accepts the name of a built-in filter preset, or of a custom one, which isn't
+// checked, as it may be any guild's.
+func normalizeFilter(v string) (string, error) {
+	v = strings.ToLower(v)
+	if _, ok := FilterPresets[v]; !ok && !namePattern.MatchString(v) {
+		return "", errors.New("expected one of: " + strings.Join(FilterPresetNames(), ", ") + ", or the name of a custom preset")
+	}
+	return v, nil
+}
+
+// normalizeFilterChain accepts a chain of ffmpeg filters for a custom preset, separated by commas,
+// eg. "bass=g=5,treble=g=-2"; only filters in customFilters are allowed.
+func normalizeFilterChain(v string) (string, error) {
+	filters := strings.Split(strings.Trim(v, "`"), ",")
+	if len(filters) > MaxCustomFilters {
+		return "", errors.Errorf("a preset can have up to %d filters", MaxCustomFilters)
+	}
+	for i, f := range filters {
+		f = strings.TrimSpace(f)
+		name, opts := f, ""
+		if idx := strings.Index(f, "="); idx >= 0 {
+			name, opts = f[:idx], f[idx+1:]
+		}
+		if !customFilters[name] {
+			return "", errors.Errorf("`%s` isn't a filter presets can use", name)
+		}
+		if opts != "" && !customFilterOptionsPattern.MatchString(opts) {
+			return "", errors.Errorf("can't make out the options of `%s`; they should look like `g=5:f=100`", name)
+		}
+		filters[i] = f
+	}
+	return strings.Join(filters, ","), nil
+}
+
+// normalizeVolume accepts a gain adjustment (see parseGain), eg. "-3dB" or "+2".
+func normalizeVolume(v string) (string, error) {
+	gain, err := parseGain(v)
+	if err != nil {
+		return "", errors.Errorf("expected an adjustment between %gdB and %+gdB, eg. -3dB", MinGain, MaxGain)
+	}
+	return strconv.FormatFloat(gain, 'f', -1, 64) + "dB", nil
+}
+
+// normalizeFade accepts a number of seconds, up to MaxFade.
+func normalizeFade(v string) (string, error) {
+	seconds, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(v), "s"), 64)
+	if err != nil || seconds < 0 || seconds > MaxFade.Seconds() {
+		return "", errors.Errorf("expected a number of seconds, from 0 to %g", MaxFade.Seconds())
+	}
+	return strconv.FormatFloat(seconds, 'f', -1, 64), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeVolume(t *testing.T) {
+	for in, out := range map[string]string{"0": "0dB", "-3dB": "-3dB", "+2.5db": "2.5dB"} {
+		v, err := normalizeVolume(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, out, v, in)
+	}
+	for _, in := range []string{"loud", "-31", "21dB"} {
+		_, err := normalizeVolume(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestNormalizeFade(t *testing.T) {
+	v, err := normalizeFade("2.5s")
+	assert.NoError(t, err)
+	assert.Equal(t, "2.5", v)
+
+	for _, in := range []string{"-1", "11", "long"} {
+		_, err := normalizeFade(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestPlaybackEncodeOptions(t *testing.T) {
+	s := PlaybackSettings{Volume: -3, Normalize: true, Fade: 2 * time.Second, Filter: "bassboost"}
+	envelope := TrackEnvelope{ServiceID: "soundcloud", Track: &soundcloud.Track{Duration: 60000}, Gain: 1}
+	opts := s.EncodeOptions(64000, envelope, 0)
+	assert.Equal(t, "bass=g=8:f=110:w=0.6,volume=-2dB,"+NormalizeFilter+",afade=t=in:d=2.000,afade=t=out:st=58.000:d=2.000", opts.Filters())
+	assert.False(t, opts.Poolable())
+
+	// Tracks resumed partway through aren't faded in again.
+	opts = s.EncodeOptions(64000, envelope, 30*time.Second)
+	assert.Equal(t, "bass=g=8:f=110:w=0.6,volume=-2dB,"+NormalizeFilter+",afade=t=out:st=28.000:d=2.000", opts.Filters())
+
+	// The defaults leave tracks alone.
+	opts = PlaybackSettings{Filter: "flat"}.EncodeOptions(64000, TrackEnvelope{Track: &soundcloud.Track{}}, 0)
+	assert.Equal(t, "", opts.Filters())
+	assert.True(t, opts.Poolable())
+}
+
+func TestPlaybackEffects(t *testing.T) {
+	assert.Equal(t, "", PlaybackSettings{Filter: "flat"}.Effects())
+	assert.Equal(t, KaraokeFilter, PlaybackSettings{Filter: "flat", Karaoke: true}.Effects())
+
+	// Vocals are removed before anything else touches the mix.
+	opts := PlaybackSettings{Filter: "bassboost", Karaoke: true}.EncodeOptions(64000, TrackEnvelope{Track: &soundcloud.Track{}}, 0)
+	assert.Equal(t, KaraokeFilter+",bass=g=8:f=110:w=0.6", opts.Filters())
+	assert.False(t, opts.Poolable())
+}
+
+func TestPlaybackEffectsCustom(t *testing.T) {
+	assert.Equal(t, "bass=g=2", PlaybackSettings{Filter: "warm", Custom: "bass=g=2"}.Effects())
+
+	// Built-in presets win over custom ones.
+	assert.Equal(t, "", PlaybackSettings{Filter: "flat", Custom: "bass=g=2"}.Effects())
+}
+
+func TestNormalizeFilter(t *testing.T) {
+	v, err := normalizeFilter("Podcast")
+	assert.NoError(t, err)
+	assert.Equal(t, "podcast", v)
+
+	v, err = normalizeFilter("my-preset")
+	assert.NoError(t, err)
+	assert.Equal(t, "my-preset", v)
+
+	_, err = normalizeFilter("no way")
+	assert.Error(t, err)
+}
+
+func TestNormalizeFilterChain(t *testing.T) {
+	v, err := normalizeFilterChain("`bass=g=4, treble=g=-3:f=4000`")
+	assert.NoError(t, err)
+	assert.Equal(t, "bass=g=4,treble=g=-3:f=4000", v)
+
+	v, err = normalizeFilterChain("aecho=in_gain=0.8")
+	assert.NoError(t, err)
+	assert.Equal(t, "aecho=in_gain=0.8", v)
+
+	for _, in := range []string{
+		"amovie=/etc/passwd",
+		"bass=g=4;[a]volume=2",
+		"volume=2[out]",
+		"bass=g='4'",
+		"",
+		strings.Repeat("bass=g=1,", MaxCustomFilters) + "bass=g=1",
+	} {
+		_, err := normalizeFilterChain(in)
+		assert.Error(t, err, in)
+	}
+}
@@ -2,79 +2,333 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
 	"github.com/sencrash/hiqty/media"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
 	"time"
 )
 
+// Why a track's trace ends without it being heard, when it was skipped while it was starting.
+var errSkippedBeforeHeard = errors.New("skipped before it was heard")
+
 // A Player plays music in a server. It watches the playlist and adjusts to changes on its own, but
 // watching server state and launching/terminating players is the PlayerController's job.
 type Player struct {
-	Session *discordgo.Session
-	Pool    *redis.Pool
-	Client  http.Client
+	Session    *discordgo.Session
+	Pool       *redis.Pool
+	Store      Store
+	Client     http.Client
+	FFmpeg     string       // Path to ffmpeg; defaults to looking it up in $PATH
+	Encoders   *EncoderPool // Spare encoders to use, if any
+	Supervisor *Supervisor  // Keeps track of the player's goroutines, if set
+	TTS        TTS          // Speaks announcements, if set
+	Stream     StreamConfig
 
 	GuildID string
+	BotID   string // Set if the player belongs to a linked bot; see Queue
+
+	// Signalled when something the player follows may have changed: its playlist, what's playing,
+	// its state, voice channel or settings. It rereads them every so often regardless.
+	Wake <-chan struct{}
+
+	playlist Queue                // Queue for the channel the player's in
+	reported map[string]time.Time // When errors were last reported to the guild; see reportError
+
+	// The station the player's guild is in, if any, and whether it's following it rather than its
+	// own queue; see cmdStation. Station tracks aren't the follower's to finish or skip, so the last
+	// one that was is kept, to not play it again.
+	station     string
+	following   bool
+	stationDone media.Track
 }
 
 // Run runs the Player. The context expiring will not immediately terminate the player - rather, it
 // will terminate after the current song finishes playing.
 func (p *Player) Run(ctx context.Context, stop <-chan interface{}) {
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(PlayerRecheckInterval)
+	defer ticker.Stop()
 
 	var cid string
 	var voiceState *discordgo.VoiceConnection
+	deaf := p.readSelfDeafen(true)
 
 	var track media.Track
+	var opts EncodeOptions
 	var packets <-chan []byte
+	var reconfigure chan EncodeOptions
 	var cancel context.CancelFunc
+	var recheck bool
+	var retryAt time.Time
+	var retry <-chan time.Time
+	paused := p.readPaused(false)
+	playback := p.readPlaybackSettings(PlaybackSettings{})
+
+	// How far into the current track playback is, and how far it was when that was last recorded.
+	var offset, checkpointed time.Duration
+
+	// Whether the current track hasn't produced any audio yet.
+	var silent bool
+
+	// Timing of the current track's request, and the span of it being started, until its first
+	// frame has been sent.
+	var timing *RequestTiming
+	var startSpan trace.Span
+
+	// A track that's dropped before it's heard has its span marked as failed.
+	dropTiming := func(err error) {
+		if startSpan != nil {
+			endSpan(startSpan, err)
+			startSpan = nil
+		}
+		timing = nil
+	}
+	defer func() {
+		if startSpan != nil {
+			dropTiming(errors.New("the player stopped"))
+		}
+	}()
+
+	// The soundboard clip or announcement that's playing, if any, which holds the track until it's
+	// over, and whether there may be more waiting to be played. Announcements of tracks starting are
+	// made by the player itself, rather than queued in Redis.
+	var clip <-chan []byte
+	var cancelClip context.CancelFunc
+	var announcements []string
+	clipsWaiting := true
+
+	// Whether the station the player leads, if any, has been told about the current track.
+	var broadcasting bool
+
+	// Time spent playing that hasn't been added to the guild's statistics yet.
+	var listened time.Duration
+	defer func() { p.recordListening(listened) }()
+
+	// Keep an eye on the channel's bitrate, which may change mid-track, eg. because an admin changed
+	// it, or the guild's boost tier (and with it, the highest allowed bitrate) changed.
+	channelChanged := make(chan struct{}, 1)
+	notifyChannelChanged := func() {
+		select {
+		case channelChanged <- struct{}{}:
+		default:
+		}
+	}
+	defer p.Session.AddHandler(func(s *discordgo.Session, e *discordgo.ChannelUpdate) {
+		if e.GuildID == p.GuildID {
+			notifyChannelChanged()
+		}
+	})()
+	defer p.Session.AddHandler(func(s *discordgo.Session, e *discordgo.GuildUpdate) {
+		if e.ID == p.GuildID {
+			notifyChannelChanged()
+		}
+	})()
+
+	// Discord moves voice connections to other servers every so often, eg. when a channel's region
+	// is changed. discordgo reconnects to the new one on its own; the track is held until it has.
+	voiceServerChanged := make(chan string, 1)
+	defer p.Session.AddHandler(func(s *discordgo.Session, e *discordgo.VoiceServerUpdate) {
+		if e.GuildID == p.GuildID {
+			select {
+			case voiceServerChanged <- e.Endpoint:
+			default:
+			}
+		}
+	})()
 
 	defer func() {
 		if cancel != nil {
 			cancel()
 		}
+		if cancelClip != nil {
+			cancelClip()
+		}
 		if voiceState != nil {
 			if err := voiceState.Disconnect(); err != nil {
-				log.WithField("gid", p.GuildID).WithError(err).Error("Player: Couldn't disconnect from voice")
+				PlayerLog.WithField("gid", p.GuildID).WithError(err).Error("Player: Couldn't disconnect from voice")
 			}
 		}
 	}()
 
+	p.readStation()
+	defer func() {
+		if broadcasting && !p.following {
+			p.broadcastStation(nil, 0)
+		}
+	}()
+
+	p.playlist = p.queue()
+	p.Store.SubscribePlaylist(p.playlist)
+	defer func() { p.Store.UnsubscribePlaylist(p.playlist) }()
+	defer setPlayingQueue(p.queue(), Queue{})
+
+	// Restart the encoder with new options from where playback is, eg. when the channel's bitrate
+	// changes; an older change that hasn't been picked up yet is superseded.
+	reencode := func() {
+		opts.Position = offset
+		select {
+		case <-reconfigure:
+		default:
+		}
+		reconfigure <- opts
+	}
+
+	// Reread everything that isn't read on every pass, when it may have changed.
+	refresh := func() {
+		recheck = true
+		clipsWaiting = true
+
+		if newPaused := p.readPaused(paused); newPaused != paused {
+			paused = newPaused
+			if voiceState != nil && track != nil {
+				voiceState.Speaking(!paused)
+			}
+
+			// A station's followers stop along with its leader, and pick up where it resumes.
+			if broadcasting && paused {
+				p.broadcastStation(nil, 0)
+				broadcasting = false
+			}
+		}
+		p.readStation()
+
+		// Changing the deafen setting takes effect immediately, not on the next join.
+		if newDeaf := p.readSelfDeafen(deaf); newDeaf != deaf {
+			deaf = newDeaf
+			if voiceState != nil {
+				if err := voiceState.ChangeChannel(voiceState.ChannelID, false, deaf); err != nil {
+					PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't change deafen state")
+				} else if track != nil {
+					voiceState.Speaking(true)
+				}
+			}
+		}
+
+		// So do changes to playback settings, rather than on the next track.
+		if newPlayback := p.readPlaybackSettings(playback); newPlayback != playback {
+			opts.Gain += newPlayback.Volume - playback.Volume
+			opts.Normalize, opts.Fade, opts.Effects = newPlayback.Normalize, newPlayback.Fade, newPlayback.Effects()
+			playback = newPlayback
+			if track != nil {
+				reencode()
+			}
+		}
+	}
+
+	// Whether the voice connection was ready, to notice it dropping, and since when it hasn't been.
+	var ready bool
+	var notReadySince time.Time
+
 loop:
 	for {
-		if cid == "" {
-			cid = p.readChannelID()
+		// Follow the bot being moved to another channel, which may have a queue of its own.
+		if cid == "" || recheck {
+			if newCID := p.readChannelID(); newCID != "" {
+				cid = newCID
+			}
+			p.updatePlaylist(cid)
+			setPlayingQueue(p.queue(), p.playlist)
 		}
 		if cid != "" && voiceState == nil {
-			vs, err := p.Session.ChannelVoiceJoin(p.GuildID, cid, false, false)
+			vs, err := p.Session.ChannelVoiceJoin(p.GuildID, cid, false, deaf)
 			if err != nil {
-				log.WithError(err).WithFields(log.Fields{
+				PlayerLog.WithError(err).WithFields(log.Fields{
 					"gid": p.GuildID,
 					"cid": cid,
 				}).Warn("Player: Couldn't join channel")
+				p.reportError("join", "Couldn't join the voice channel", err)
 				continue
 			}
 			voiceState = vs
 		}
 		if cid != "" && voiceState != nil && voiceState.ChannelID != cid {
-			if err := voiceState.ChangeChannel(cid, false, false); err != nil {
-				log.WithError(err).WithFields(log.Fields{
+			if err := voiceState.ChangeChannel(cid, false, deaf); err != nil {
+				PlayerLog.WithError(err).WithFields(log.Fields{
 					"gid": p.GuildID,
 					"cid": cid,
 				}).Warn("Player: Couldn't change channel")
 			}
+			notifyChannelChanged()
+		}
+
+		if voiceState != nil {
+			if ready && !voiceState.Ready {
+				MetricVoiceReconnects.Inc()
+			}
+			if !ready && voiceState.Ready && track != nil {
+				voiceState.Speaking(!paused)
+			}
+			ready = voiceState.Ready
+
+			// If the connection doesn't come back on its own, start over with a fresh one; the
+			// track carries on from where it was held once it's up.
+			switch {
+			case ready:
+				notReadySince = time.Time{}
+			case notReadySince.IsZero():
+				notReadySince = time.Now()
+			case time.Since(notReadySince) > VoiceReconnectTimeout:
+				PlayerLog.WithField("gid", p.GuildID).Warn("Player: Voice connection didn't recover, reconnecting")
+				if err := voiceState.Disconnect(); err != nil {
+					PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't disconnect from voice")
+				}
+				voiceState, ready, notReadySince = nil, false, time.Time{}
+				continue
+			}
 		}
 
 		if voiceState != nil && voiceState.Ready {
-			if track == nil {
-				newTrack := p.readFirstTrack()
+			// Keep an eye on what's supposed to be playing, in case it's skipped. If nothing is, the
+			// next track is taken off the playlist; if something was left playing, eg. because the
+			// bot restarted, that's picked back up instead.
+			if track == nil || recheck {
+				recheck = false
+				var envelope *TrackEnvelope
+				if p.following {
+					envelope = p.readStationTrack()
+				} else {
+					envelope = p.readNowPlaying()
+					if envelope == nil && !paused {
+						envelope = p.advance()
+					}
+				}
+				var newTrack media.Track
+				if envelope != nil {
+					newTrack = envelope.Track
+				}
+
+				// Followers that have fallen behind or gotten ahead of the station, eg. from playing a
+				// clip or from a slow start, start the track over from where the leader is.
+				if p.following && newTrack != nil && newTrack.Equals(track) && !paused {
+					if drift := envelope.Offset - offset; drift > StationMaxDrift || drift < -StationMaxDrift {
+						PlayerLog.WithFields(log.Fields{"gid": p.GuildID, "drift": drift}).Info("Player: Resyncing with station")
+						cancel()
+						cancel = nil
+						packets = nil
+						track = nil
+					}
+				}
+
+				switch {
+				case p.following || p.station == "":
+					broadcasting = false
+				case broadcasting && newTrack == nil:
+					p.broadcastStation(nil, 0)
+					broadcasting = false
+				case !broadcasting && newTrack != nil && newTrack.Equals(track) && !paused:
+					p.broadcastStation(envelope, offset)
+					broadcasting = true
+				}
 
 				if newTrack == nil {
+					if track != nil {
+						p.publish(EventTrackSkipped, track, nil)
+						dropTiming(errSkippedBeforeHeard)
+					}
 					track = nil
 					if cancel != nil {
 						cancel()
@@ -87,133 +341,600 @@ loop:
 						cancel = nil
 						packets = nil
 					}
+					if track != nil {
+						p.publish(EventTrackSkipped, track, nil)
+						dropTiming(errSkippedBeforeHeard)
+						track = nil
+					}
 
-					// Note: You can't unmarshal a track with a missing service, so we can safely count
-					// on the indicated service's existence at this point.
-					svc := media.Services[newTrack.GetServiceID()]
-
-					req, err := svc.BuildMediaRequest(newTrack)
-					if err != nil {
-						log.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't build request")
-						continue
+					// Tracks queued without being looked up, eg. from a large playlist, are looked
+					// up once their turn comes; until then, there's nothing to go by.
+					stub := media.IsStub(newTrack)
+					nsfw := true
+					if stub && time.Now().After(retryAt) {
+						full, err := p.resolveStub(newTrack)
+						if err != nil {
+							retryAt = p.trackFailed(newTrack, envelope.URL, err)
+							retry = time.After(time.Until(retryAt))
+						} else {
+							newTrack, envelope.Track, stub, nsfw = full, full, false, envelope.NSFW
+						}
 					}
 
-					res, err := p.Client.Do(req)
-					if err != nil {
-						log.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't get media source")
-						continue
+					// Settings may have changed since the track was queued; whether it was requested
+					// from an NSFW channel was checked back then, though, unless it was a stub.
+					if stub {
+						// Wait to retry looking it up.
+					} else if ok, reason := p.playable(newTrack, nsfw); !ok {
+						PlayerLog.WithFields(log.Fields{"gid": p.GuildID, "reason": reason}).Info("Player: Skipping unplayable track")
+						p.publish(EventTrackSkipped, newTrack, errors.New(reason))
+						p.skipTrack(newTrack)
+						endSpan(startPlaySpan(p.GuildID, *envelope, time.Now()), errors.New(reason))
+					} else if !paused && time.Now().After(retryAt) {
+						var err error
+						timing = &envelope.Timing
+						timing.Started = time.Now()
+						seek := resumeOffset(*envelope)
+						if seek == 0 {
+							startSpan = startPlaySpan(p.GuildID, *envelope, timing.Started)
+						}
+						opts = playback.EncodeOptions(p.channelBitrate(cid), *envelope, seek)
+						reconfigure = make(chan EncodeOptions, 1)
+						packets, cancel, err = p.startTrack(newTrack, opts, reconfigure)
+
+						// Restarting the encoder partway through, eg. for a new bitrate, mustn't seek.
+						opts.Seek = 0
+						if err != nil {
+							dropTiming(err)
+							retryAt = p.trackFailed(newTrack, envelope.URL, err)
+							retry = time.After(time.Until(retryAt))
+						} else {
+							track = newTrack
+							offset, checkpointed = seek, seek
+							silent = true
+							voiceState.Speaking(true)
+							if seek > 0 {
+								// It's been counted already, and its latency means nothing now.
+								PlayerLog.WithFields(log.Fields{"gid": p.GuildID, "offset": seek}).Info("Player: Resuming interrupted track")
+								timing = nil
+							} else {
+								MetricTracksPlayed.IncFor(newTrack.GetServiceID())
+								p.recordStats(StatPlays + ":" + newTrack.GetServiceID())
+								p.recordPlay(*envelope)
+								if text := p.trackAnnouncement(newTrack); text != "" {
+									announcements = append(announcements, text)
+									clipsWaiting = true
+								}
+								if !p.following {
+									// It's a couple of REST calls, which mustn't hold up playback.
+									go p.notifyRequester(*envelope)
+								}
+							}
+							p.publish(EventTrackStarted, newTrack, nil)
+							if p.station != "" && !p.following {
+								p.broadcastStation(envelope, seek)
+								broadcasting = true
+							}
+						}
 					}
+				}
+			}
+		}
 
-					subctx, c := context.WithCancel(context.Background())
-					cancel = c
-					packets = p.streamPackets(subctx, p.streamResponse(subctx, res))
-					track = newTrack
+		// Clips and announcements play over whatever's going on, paused or not; announcements go
+		// first, as they're usually about what's going on.
+		if clipsWaiting && clip == nil && voiceState != nil && voiceState.Ready {
+			clipsWaiting = false
+			if p.TTS != nil && len(announcements) == 0 {
+				if text := p.takeAnnouncement(); text != "" {
+					announcements = append(announcements, text)
+				}
+			}
+			if len(announcements) > 0 {
+				text := announcements[0]
+				announcements = announcements[1:]
+				var err error
+				if clip, cancelClip, err = p.speak(text, EncodeOptions{Bitrate: p.channelBitrate(cid), Gain: playback.Volume}); err != nil {
+					PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't speak announcement")
+					clipsWaiting = true
+				}
+			} else if envelope := p.takeClip(); envelope != nil {
+				clipOpts := playback.EncodeOptions(p.channelBitrate(cid), *envelope, 0)
+				clipOpts.Fade = 0
+				var err error
+				if clip, cancelClip, err = p.startTrack(envelope.Track, clipOpts, nil); err != nil {
+					PlayerLog.WithError(err).WithFields(log.Fields{"gid": p.GuildID, "url": envelope.URL}).Warn("Player: Couldn't play clip")
+					clipsWaiting = true
 				}
 			}
+			if clip != nil {
+				voiceState.Speaking(true)
+			}
+		}
+
+		// While paused, or while the voice connection is down, the current track is left to wait
+		// where it is; so it is while a clip plays.
+		playing, clipping := packets, clip
+		if paused || clip != nil {
+			playing = nil
+		}
+		if voiceState == nil || !voiceState.Ready {
+			playing, clipping = nil, nil
+		}
+
+		// Nothing announces a voice connection becoming ready, so it has to be checked on.
+		var voicePoll <-chan time.Time
+		if voiceState != nil && !voiceState.Ready {
+			voicePoll = time.After(VoiceReadyPollInterval)
 		}
 
 		select {
-		case pkt, ok := <-packets:
+		case pkt, ok := <-playing:
 			if !ok {
 				if cancel != nil {
 					cancel()
 				}
+				if track != nil {
+					// A stream that ends before anything could be made out of it couldn't be decoded.
+					if silent {
+						err := errors.New("the stream ended before any audio could be decoded")
+						PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Track produced no audio")
+						dropTiming(err)
+						p.recordStats(StatPlayError + ":" + track.GetServiceID())
+						p.reportError("decode:"+track.GetInfo().URL, "Couldn't play "+track.GetInfo().Title, err)
+					}
+					p.finishTrack(track)
+					p.publish(EventTrackFinished, track, nil)
+				}
 				track = nil
+				packets = nil
+				voiceState.Speaking(false)
 				continue
 			}
-			log.WithField("len", len(pkt)).Info("got response packet")
+			if !p.sendOpus(ctx, stop, voiceState, pkt) {
+				continue
+			}
+			offset += FrameDuration
+			silent = false
+			if listened += FrameDuration; listened >= ListeningStatsInterval {
+				listened = p.recordListening(listened)
+			}
+			if offset-checkpointed >= ResumeCheckpointInterval {
+				p.checkpoint(track, offset)
+				checkpointed = offset
+			}
+			if timing != nil {
+				timing.FirstFrame = time.Now()
+				if startSpan != nil {
+					endSpan(startSpan, nil, trace.WithTimestamp(timing.FirstFrame))
+					startSpan = nil
+				}
+				p.recordLatency(*timing)
+				timing = nil
+			}
+		case pkt, ok := <-clipping:
+			if !ok {
+				cancelClip()
+				clip, cancelClip = nil, nil
+				clipsWaiting = true
+				voiceState.Speaking(track != nil && !paused)
+				continue
+			}
+			p.sendOpus(ctx, stop, voiceState, pkt)
+		case <-channelChanged:
+			if track == nil {
+				continue
+			}
+			if bitrate := p.channelBitrate(cid); bitrate != opts.Bitrate {
+				opts.Bitrate = bitrate
+				reencode()
+			}
+		case endpoint := <-voiceServerChanged:
+			if voiceState == nil || !ready {
+				continue // Joining, rather than moving
+			}
+			PlayerLog.WithFields(log.Fields{"gid": p.GuildID, "endpoint": endpoint}).Info("Player: Voice server changed, reconnecting")
+			notReadySince = time.Now()
 		case <-stop:
-			log.WithField("gid", p.GuildID).Info("Stopped")
+			PlayerLog.WithField("gid", p.GuildID).Info("Stopped")
 			break loop
 		case <-ctx.Done():
+			// Let whichever instance takes over pick up right where this one left off.
+			if track != nil {
+				p.checkpoint(track, offset)
+			}
 			break loop
+		case <-p.Wake:
+			refresh()
 		case <-ticker.C:
+			refresh()
+		case <-retry:
+			recheck = true
+		case <-voicePoll:
 		}
 	}
 }
 
-func (p *Player) readFirstTrack() media.Track {
+// sendOpus sends an Opus packet to the voice connection, returning false if it wasn't sent. If the
+// connection's stopped taking packets, it's marked as not ready, to be reconnected if it doesn't
+// recover; if the player's stopping, that's left for the main loop to notice.
+func (p *Player) sendOpus(ctx context.Context, stop <-chan interface{}, voiceState *discordgo.VoiceConnection, pkt []byte) bool {
+	err := sendOpus(ctx, stop, voiceState.OpusSend, pkt)
+	if err == errOpusSendTimeout {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Voice connection stalled")
+		voiceState.Lock()
+		voiceState.Ready = false
+		voiceState.Unlock()
+	}
+	return err == nil
+}
+
+// startTrack starts streaming a track, returning a channel of Opus packets and a function to stop
+// it.
+func (p *Player) startTrack(track media.Track, opts EncodeOptions, reconfigure <-chan EncodeOptions) (<-chan []byte, context.CancelFunc, error) {
+	// You can't unmarshal a track with a missing service, but it may have been unregistered since,
+	// if services were reloaded.
+	svc := media.Lookup(track.GetServiceID())
+	if svc == nil {
+		return nil, nil, errors.New("unknown service: " + track.GetServiceID())
+	}
+
+	res, err := p.openMedia(svc, track)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// HLS streams are playlists of segments, which need to be fetched in turn.
+	ctx, cancel := context.WithCancel(context.Background())
+	var body io.ReadCloser = res.Body
+	if media.IsHLS(res) {
+		hls, err := media.NewHLSReader(ctx, &p.Client, res)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		body = hls
+	}
+
+	return p.streamPackets(ctx, p.encode(ctx, p.streamResponse(ctx, body), opts, reconfigure)), cancel, nil
+}
+
+// trackFailed handles a track that couldn't be started: tracks that will never play are skipped,
+// anything else is retried after a while. Returns when to retry it.
+func (p *Player) trackFailed(track media.Track, url string, err error) time.Time {
+	PlayerLog.WithError(err).WithFields(log.Fields{
+		"gid":     p.GuildID,
+		"service": track.GetServiceID(),
+		"url":     url,
+	}).Error("Player: Couldn't start track")
+	p.recordStats(StatPlayError + ":" + track.GetServiceID())
+	p.publish(EventTrackError, track, err)
+	title := track.GetInfo().Title
+	if title == "" {
+		title = "a track"
+	}
+	p.reportError("start:"+url, "Couldn't play "+title, err)
+
+	switch {
+	case media.IsPermanent(err):
+		p.skipTrack(track)
+		return time.Time{}
+	case errors.Cause(err) == media.ErrRateLimited:
+		return time.Now().Add(30 * time.Second)
+	}
+	return time.Now().Add(5 * time.Second)
+}
+
+// skipTrack discards a track that's playing, if it's still the one that is.
+func (p *Player) skipTrack(track media.Track) {
+	if p.following {
+		p.stationDone = track
+		return
+	}
+	if err := p.Store.Finish(p.playlist, track); err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't skip track")
+	}
+}
+
+// finishTrack discards a track that's played to the end, if it's still the one that's playing.
+func (p *Player) finishTrack(track media.Track) {
+	if p.following {
+		p.stationDone = track
+		return
+	}
+	if err := p.Store.Finish(p.playlist, track); err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't finish track")
+	}
+}
+
+// checkpoint records how far into a track playback is, if it's still the one that's playing, so it
+// can be resumed from there if the player is interrupted.
+func (p *Player) checkpoint(track media.Track, offset time.Duration) {
+	if p.following {
+		return
+	}
+	envelope := p.readNowPlaying()
+	if envelope == nil || !envelope.Track.Equals(track) {
+		return
+	}
+
+	envelope.Offset = offset
+	if err := p.Store.ReplaceNowPlaying(p.playlist, track, *envelope); err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't record playback offset")
+	}
+}
+
+// resumeOffset returns where to start playing a track from: where it was interrupted, if it was.
+// Live streams have nothing to go back to, and are always joined as they are.
+func resumeOffset(envelope TrackEnvelope) time.Duration {
+	if envelope.Track.GetInfo().Duration == 0 {
+		return 0
+	}
+	return envelope.Offset
+}
+
+// publish publishes a playback event about a track, with the error that caused it, if any.
+func (p *Player) publish(typ string, track media.Track, err error) {
+	e := NewEvent(typ, p.queue(), track)
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	if err := PublishEvent(rconn, e); err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't publish event")
+	}
+}
+
+// queue returns the queue the player plays from.
+func (p *Player) queue() Queue {
+	return Queue{GuildID: p.GuildID, BotID: p.BotID}
+}
+
+// updatePlaylist switches to the playlist for a channel. If the guild switched between having per-
+// channel queues and a single one, the old playlist is migrated over.
+func (p *Player) updatePlaylist(cid string) {
 	rconn := p.Pool.Get()
 	defer rconn.Close()
 
-	envdatas, err := redis.ByteSlices(rconn.Do("LRANGE", KeyForServerPlaylist(p.GuildID), 0, 1))
+	playlist := PlaylistQueue(rconn, p.queue(), cid)
+	if playlist == p.playlist {
+		return
+	}
+	if (playlist.ChannelID == "") != (p.playlist.ChannelID == "") {
+		if err := p.Store.Migrate(p.playlist, playlist); err != nil {
+			PlayerLog.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't migrate playlist")
+		}
+	}
+	p.Store.UnsubscribePlaylist(p.playlist)
+	p.Store.SubscribePlaylist(playlist)
+	p.playlist = playlist
+}
+
+func (p *Player) readNowPlaying() *TrackEnvelope {
+	envelope, err := p.Store.NowPlaying(p.playlist)
 	if err != nil {
-		log.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't get track")
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't get track")
 		return nil
 	}
-	if len(envdatas) == 0 {
+	return envelope
+}
+
+// advance takes the next track off the playlist, returning nil if there isn't one.
+func (p *Player) advance() *TrackEnvelope {
+	envelope, err := p.Store.Advance(p.playlist)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't advance playlist")
 		return nil
 	}
+	return envelope
+}
 
-	var envelope TrackEnvelope
-	if err := json.Unmarshal(envdatas[0], &envelope); err != nil {
-		log.WithError(err).WithField("gid", p.GuildID).Error("Player: Invalid envelope encountered!!")
-		_, err := rconn.Do("LPOP", KeyForServerPlaylist(p.GuildID))
-		if err != nil {
-			log.WithField("gid", p.GuildID).WithError(err).Error("Player: Couldn't remove invalid envelope")
+// openMedia requests a track's media. If the request is refused because the track is stale, eg. it
+// was queued long enough ago for its stream URL to have expired, it's refreshed and retried.
+func (p *Player) openMedia(svc media.Service, track media.Track) (*http.Response, error) {
+	res, err := p.requestMedia(svc, track)
+	if err == nil || errors.Cause(err) != media.ErrExpired {
+		return res, err
+	}
+
+	refresher, ok := svc.(media.Refresher)
+	if !ok {
+		return nil, err
+	}
+
+	PlayerLog.WithField("gid", p.GuildID).Info("Player: Refreshing stale track")
+	fresh, err := refresh(refresher, track)
+	if err != nil {
+		return nil, err
+	}
+	p.replaceNowPlaying(track, fresh)
+	return p.requestMedia(svc, fresh)
+}
+
+// requestMedia builds and performs a request for a track's media.
+func (p *Player) requestMedia(svc media.Service, track media.Track) (*http.Response, error) {
+	sid := track.GetServiceID()
+	start := time.Now()
+	res, err := p.doMediaRequest(svc, track)
+	MetricMediaDuration.ObserveDuration(sid, time.Since(start))
+	if err != nil {
+		MetricMediaErrors.IncFor(sid)
+	}
+	return res, err
+}
+
+func (p *Player) doMediaRequest(svc media.Service, track media.Track) (*http.Response, error) {
+	req, err := svc.BuildMediaRequest(track)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		if media.IsExpiredStatus(res.StatusCode) {
+			return nil, errors.Wrap(media.ErrExpired, res.Status)
 		}
-		return nil
+		return nil, errors.New(res.Status)
 	}
+	return res, nil
+}
 
-	return envelope.Track
+// refresh looks a track up again, timing it per service.
+func refresh(refresher media.Refresher, track media.Track) (media.Track, error) {
+	sid := track.GetServiceID()
+	start := time.Now()
+	fresh, err := refresher.Refresh(track)
+	MetricRefreshDuration.ObserveDuration(sid, time.Since(start))
+	if err != nil {
+		MetricRefreshErrors.IncFor(sid)
+	}
+	return fresh, err
 }
 
-func (p *Player) readChannelID() string {
+// resolveStub looks up a track that was queued as a stub, and stores the result in its place, so it
+// doesn't have to be looked up again if it's restarted.
+func (p *Player) resolveStub(track media.Track) (media.Track, error) {
+	refresher, ok := media.Lookup(track.GetServiceID()).(media.Refresher)
+	if !ok {
+		// It'll never be playable, so don't hold up the queue over it.
+		return nil, errors.Wrap(media.ErrNotFound, track.GetServiceID()+" can't look up tracks")
+	}
+	full, err := refresh(refresher, track)
+	if err != nil {
+		return nil, err
+	}
+	p.replaceNowPlaying(track, full)
+	return full, nil
+}
+
+// replaceNowPlaying replaces the track that's playing with a refreshed version of it, so it doesn't
+// have to be refreshed again if it's restarted.
+func (p *Player) replaceNowPlaying(old, fresh media.Track) {
+	if p.following {
+		return
+	}
+	envelope := p.readNowPlaying()
+	if envelope == nil || !envelope.Track.Equals(old) {
+		return
+	}
+
+	envelope.Track = fresh
+	if err := p.Store.ReplaceNowPlaying(p.playlist, old, *envelope); err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't store refreshed track")
+	}
+}
+
+// takeAnnouncement takes the next announcement waiting to be spoken, if any.
+func (p *Player) takeAnnouncement() string {
 	rconn := p.Pool.Get()
 	defer rconn.Close()
 
-	cid, err := redis.String(rconn.Do("GET", KeyForServerChannel(p.GuildID)))
+	text, err := TakeAnnouncement(rconn, p.queue())
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't take announcement")
+	}
+	return text
+}
+
+// takeClip takes the next soundboard clip waiting to be played, if any.
+func (p *Player) takeClip() *TrackEnvelope {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	envelope, err := TakeClip(rconn, p.queue())
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't take clip")
+	}
+	return envelope
+}
+
+func (p *Player) readChannelID() string {
+	cid, err := p.Store.Channel(p.queue())
 	if err != nil {
-		log.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't get channel")
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't get channel")
 	}
 	return cid
 }
 
-func (p *Player) streamResponse(ctx context.Context, res *http.Response) <-chan []byte {
-	ch := make(chan []byte)
-	go func() {
-		defer res.Body.Close()
-		defer close(ch)
+// channelBitrate returns the bitrate of a voice channel, falling back to DefaultBitrate if it's
+// unknown.
+func (p *Player) channelBitrate(cid string) int {
+	channel, err := p.Session.State.Channel(cid)
+	if err != nil || channel.Bitrate == 0 {
+		return DefaultBitrate
+	}
+	return channel.Bitrate
+}
 
-		for {
-			buf := make([]byte, 1024)
-			l, err := res.Body.Read(buf)
-			log.WithField("gid", p.GuildID).WithField("l", l).Info("read bytes")
-			if err != nil {
-				if err != io.EOF {
-					log.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't read HTTP response")
-				}
-				return
-			}
-			ch <- buf[:l]
+func (p *Player) playable(track media.Track, nsfw bool) (bool, string) {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
 
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-		}
-	}()
+	return Playable(rconn, p.GuildID, nsfw, track)
+}
 
-	return ch
+// readPaused returns whether the player's queue is paused, or the fallback if that can't be read.
+func (p *Player) readPaused(fallback bool) bool {
+	state, err := p.Store.State(p.queue())
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't read state")
+		return fallback
+	}
+	return state == StatePaused
 }
 
-func (p *Player) streamPackets(ctx context.Context, indata <-chan []byte) <-chan []byte {
-	ch := make(chan []byte)
-	go func() {
-		defer close(ch)
+// readPlaybackSettings returns the guild's playback settings, or fallback if they can't be read.
+func (p *Player) readPlaybackSettings(fallback PlaybackSettings) PlaybackSettings {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
 
-		for {
-			select {
-			case pkt, ok := <-indata:
-				if !ok {
-					return
-				}
-				ch <- pkt
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-	return ch
+	s, err := ReadPlaybackSettings(rconn, p.GuildID)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't read playback settings")
+		return fallback
+	}
+	return s
+}
+
+// readSelfDeafen returns whether the player should deafen itself; on by default, for privacy.
+// Returns fallback if the setting can't be read.
+func (p *Player) readSelfDeafen(fallback bool) bool {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	deaf, err := ReadBoolSetting(rconn, p.GuildID, SettingSelfDeafen)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't read deafen setting")
+		return fallback
+	}
+	return deaf
+}
+
+// recordLatency logs and records how long a track took to go from being requested to being heard.
+func (p *Player) recordLatency(timing RequestTiming) {
+	stages := timing.Stages()
+	fields := log.Fields{"gid": p.GuildID}
+	for _, stage := range stages {
+		fields[stage.Name] = stage.Duration
+	}
+	PlayerLog.WithFields(fields).Info("Player: First frame sent")
+
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	RecordLatency(rconn, stages)
+}
+
+func (p *Player) recordStats(counters ...string) {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	RecordStats(rconn, counters...)
 }
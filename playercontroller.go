@@ -2,27 +2,68 @@ package main
 
 import (
 	"context"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/gomodule/redigo/redis"
+	"github.com/sencrash/hiqty/media"
 	"gopkg.in/redsync.v1"
+	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 // The PlayerController subsystem watches Redis for key changes, and manages Player instances based
 // on these. Uses a distributed lock to ensure that no more than one player exists for a server at
 // any given time, while crashed instances smoothly fall over on a new one.
 type PlayerController struct {
-	Session *discordgo.Session
-	Pool    *redis.Pool
+	Session    *discordgo.Session
+	Pool       *redis.Pool
+	Store      Store
+	FFmpeg     string
+	Encoders   *EncoderPool
+	Supervisor *Supervisor
+	TTS        TTS
+	Stream     StreamConfig
+	Linked     bool // Whether the session belongs to a linked bot, with its own queues
 
-	redsync *redsync.Redsync
-	stop    map[string]chan interface{}
-	mutex   sync.Mutex
-	wg      sync.WaitGroup
+	redsync   *redsync.Redsync
+	stop      map[string]chan interface{}
+	wake      map[string]chan struct{} // See Player.Wake
+	contended map[string]bool          // Guilds whose players are locked by another instance
+	mutex     sync.Mutex
+	wg        sync.WaitGroup
+}
+
+// InstanceName identifies this process in the player locks it holds, eg. for `hiqty ps`.
+var InstanceName = instanceName()
+
+func instanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// playerLockValue generates the value of a player lock: the instance name, and a random token
+// that makes it unique, as redsync requires.
+func playerLockValue() (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	return InstanceName + " " + token, nil
+}
 
-	stateWatch      Watcher
-	stateWatchMutex sync.Mutex
+// PlayerLockHolder returns the name of the instance that holds a player lock, from its value; ""
+// if it was taken by an instance that doesn't record it.
+func PlayerLockHolder(value string) string {
+	if i := strings.LastIndex(value, " "); i != -1 {
+		return value[:i]
+	}
+	return ""
 }
 
 // Run runs the player controller. When the context expires, no more players will spawn, and
@@ -30,96 +71,328 @@ type PlayerController struct {
 func (c *PlayerController) Run(ctx context.Context) {
 	c.redsync = redsync.New([]redsync.Pool{c.Pool})
 	c.stop = make(map[string]chan interface{})
+	c.wake = make(map[string]chan struct{})
+	c.contended = make(map[string]bool)
 
 	// Add event handlers.
 	defer c.Session.AddHandler(c.HandleGuildCreate)()
+	defer c.Session.AddHandler(c.HandleGuildDelete)()
 
-	// Watch for keyspace notifications.
-	stateWatchConn := c.Pool.Get()
-	_, err := stateWatchConn.Do("CONFIG", "SET", "notify-keyspace-events", "AKE")
+	// Players that were running before a restart are resumed once the session is ready, rather than
+	// staying silent until something touches their state.
+	ready := make(chan map[string]bool, 1)
+	defer c.Session.AddHandler(func(_ *discordgo.Session, e *discordgo.Ready) {
+		gids := make(map[string]bool, len(e.Guilds))
+		for _, g := range e.Guilds {
+			gids[g.ID] = true
+		}
+		select {
+		case ready <- gids:
+		default:
+		}
+	})()
+
+	// Watch for state changes, and changes to what running players are following.
+	gids, err := c.Store.Watch(ctx)
 	if err != nil {
-		log.WithError(err).Error("Player: Couldn't enable keyspace events; state watching will not work!")
+		PlayerLog.WithError(err).Error("Player: Couldn't watch states; state watching will not work!")
 		return
 	}
-	c.stateWatch = Watcher{redis.PubSubConn{stateWatchConn}}
 
-	keys := c.stateWatch.Run(ctx)
+	// Schedules queue into the primary bot's queues, so only its controllers run them.
+	if !c.Linked {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.runScheduler(ctx)
+		}()
+	}
+
+	// Players locked by another instance are taken over if it crashes, and its locks expire.
+	retry := time.NewTicker(PlayerLockRetryInterval)
+	defer retry.Stop()
+
 loop:
 	for {
 		select {
-		case key := <-keys:
-			gid := GIDFromKey(key)
-			log.WithField("gid", gid).Info("State event")
+		case gid := <-gids:
+			PlayerLog.WithField("gid", gid).Debug("State event")
 			c.Fulfill(ctx, gid)
+			c.wakePlayer(gid)
+		case guilds := <-ready:
+			c.resume(ctx, guilds)
+		case <-retry.C:
+			c.mutex.Lock()
+			contended := make([]string, 0, len(c.contended))
+			for gid := range c.contended {
+				contended = append(contended, gid)
+			}
+			c.mutex.Unlock()
+			for _, gid := range contended {
+				c.Fulfill(ctx, gid)
+			}
 		case <-ctx.Done():
 			break loop
 		}
 	}
 
-	log.Info("PlayerController: Waiting for players to finish...")
+	PlayerLog.Info("PlayerController: Waiting for players to finish...")
 	c.wg.Wait()
 }
 
+// resume fulfills the states of guilds that were being played in, out of the given ones, eg. after
+// a restart.
+func (c *PlayerController) resume(ctx context.Context, guilds map[string]bool) {
+	rconn := c.Pool.Get()
+	gids, err := ResumableGuilds(rconn, c.queue("").BotID)
+	rconn.Close()
+	if err != nil {
+		PlayerLog.WithError(err).Error("PlayerController: Couldn't find players to resume")
+		return
+	}
+
+	n := 0
+	for _, gid := range gids {
+		if guilds[gid] {
+			c.Fulfill(ctx, gid)
+			n++
+		}
+	}
+	PlayerLog.WithField("guilds", n).Info("PlayerController: Resumed players")
+}
+
+// ResumableGuilds returns the guilds a bot ("" for the primary one) is playing or paused in,
+// according to their states.
+func ResumableGuilds(rconn redis.Conn, bid string) ([]string, error) {
+	keys, err := scanKeys(rconn, "hiqty:server:*:state")
+	if err != nil {
+		return nil, err
+	}
+	gids := botStateGuilds(keys, bid)
+	for _, gid := range gids {
+		rconn.Send("GET", Queue{GuildID: gid, BotID: bid}.StateKey())
+	}
+	if err := rconn.Flush(); err != nil {
+		return nil, err
+	}
+
+	resumable := []string{}
+	for _, gid := range gids {
+		state, err := redis.String(rconn.Receive())
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if state == StatePlaying || state == StatePaused {
+			resumable = append(resumable, gid)
+		}
+	}
+	return resumable, nil
+}
+
+// botStateGuilds returns the guilds that state keys belong to, out of the ones for a bot's queues.
+func botStateGuilds(keys []string, bid string) []string {
+	gids := []string{}
+	for _, key := range keys {
+		gid, kbid, ok := parseServerKey(key)
+		if ok && kbid == bid && key == (Queue{GuildID: gid, BotID: bid}).StateKey() {
+			gids = append(gids, gid)
+		}
+	}
+	return gids
+}
+
 // HandleGuildCreate subscribes to state changes when the bot joins a guild.
 func (c *PlayerController) HandleGuildCreate(_ *discordgo.Session, g *discordgo.GuildCreate) {
-	c.stateWatchMutex.Lock()
-	c.stateWatch.Subscribe(0, KeyForServerState(g.ID))
-	c.stateWatchMutex.Unlock()
+	c.Store.Subscribe(c.queue(g.ID))
 }
 
-// HandleGuildDelete unsubscribes from state changes when the bot is kicked from a guild.
+// HandleGuildDelete stops playing in a guild the bot's been kicked from, and deletes everything kept
+// about it: a linked bot's queue, or all of the guild's keys (see GuildKeys) for the primary bot.
+// Guilds that are merely unavailable, eg. during an outage, are left alone.
 func (c *PlayerController) HandleGuildDelete(_ *discordgo.Session, g *discordgo.GuildDelete) {
-	c.stateWatchMutex.Lock()
-	c.stateWatch.Unsubscribe(0, KeyForServerState(g.ID))
-	c.stateWatchMutex.Unlock()
-}
+	if g.Unavailable {
+		return
+	}
+
+	q := c.queue(g.ID)
+	c.Store.Unsubscribe(q)
+	c.stopGuild(g.ID)
+	if err := c.Store.Clear(q); err != nil {
+		PlayerLog.WithError(err).WithField("gid", g.ID).Error("PlayerController: Couldn't clear queue")
+	}
 
-// Fulfill ensures that the current state of the given guild matches the desired state.
-func (c *PlayerController) Fulfill(ctx context.Context, gid string) {
 	rconn := c.Pool.Get()
 	defer rconn.Close()
 
-	state, err := redis.String(rconn.Do("GET", KeyForServerState(gid)))
-	if err != nil && err != redis.ErrNil {
-		log.WithError(err).WithField("gid", gid).Error("PlayerController: Couldn't get guild state")
+	// A station led by the guild can't go on without it.
+	if q.BotID == "" {
+		if _, err := LeaveStation(rconn, g.ID); err != nil {
+			PlayerLog.WithError(err).WithField("gid", g.ID).Error("PlayerController: Couldn't leave station")
+		}
+	}
+
+	var keys []string
+	var err error
+	if q.BotID == "" {
+		keys, err = GuildKeys(rconn, g.ID)
+	} else {
+		keys, err = scanKeys(rconn, q.Key("*"))
+	}
+	if err == nil {
+		err = DeleteKeys(rconn, keys)
+	}
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", g.ID).Error("PlayerController: Couldn't delete guild's keys")
+		return
+	}
+	PlayerLog.WithFields(log.Fields{"gid": g.ID, "keys": len(keys)}).Info("PlayerController: Removed from guild")
+}
+
+// stopGuild stops the guild's player, if it's running here, and stops trying to take it over if
+// it's running elsewhere.
+func (c *PlayerController) stopGuild(gid string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.contended, gid)
+	if stop := c.stop[gid]; stop != nil {
+		close(stop)
+		delete(c.stop, gid)
+		delete(c.wake, gid)
+	}
+}
+
+// wakePlayer lets the guild's player know something it follows may have changed, if it's running
+// here.
+func (c *PlayerController) wakePlayer(gid string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case c.wake[gid] <- struct{}{}:
+	default:
+	}
+}
+
+// Fulfill ensures that the current state of the given guild matches the desired state.
+func (c *PlayerController) Fulfill(ctx context.Context, gid string) {
+	q := c.queue(gid)
+	state, err := c.Store.State(q)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", gid).Error("PlayerController: Couldn't get guild state")
 		return
 	}
 
 	switch state {
 	case StateStopped, "":
-		log.WithField("gid", gid).Info("PlayerController: State is stopped")
-
-		c.mutex.Lock()
-		if stop := c.stop[gid]; stop != nil {
-			close(stop)
-			delete(c.stop, gid)
-		}
-		c.mutex.Unlock()
-	case StatePlaying:
-		log.WithField("gid", gid).Info("PlayerController: State is playing")
+		PlayerLog.WithField("gid", gid).Debug("PlayerController: State is stopped")
+		c.stopGuild(gid)
+	case StatePlaying, StatePaused:
+		PlayerLog.WithFields(log.Fields{"gid": gid, "state": state}).Debug("PlayerController: State is playing")
 
 		select {
 		case <-ctx.Done():
-			log.WithField("gid", gid).Info("PlayerController: Not spawning player off expired context")
+			PlayerLog.WithField("gid", gid).Info("PlayerController: Not spawning player off expired context")
+			return
 		default:
 		}
 
-		player := Player{Session: c.Session, Pool: c.Pool, GuildID: gid}
+		c.mutex.Lock()
+		running := c.stop[gid] != nil
+		c.mutex.Unlock()
+		if running {
+			return
+		}
+
+		// Only one instance may play in a guild at a time; whoever gets the lock first gets to.
+		lock := c.redsync.NewMutex(q.PlayerLockKey(), redsync.SetExpiry(PlayerLockExpiry), redsync.SetTries(1), redsync.SetGenValueFunc(playerLockValue))
+		if err := lock.Lock(); err != nil {
+			PlayerLog.WithField("gid", gid).Info("PlayerController: Player is locked by another instance")
+			c.mutex.Lock()
+			c.contended[gid] = true
+			c.mutex.Unlock()
+			return
+		}
+
+		wake := make(chan struct{}, 1)
+		player := Player{Session: c.Session, Pool: c.Pool, Store: c.Store, Client: media.NewClient(0), FFmpeg: c.FFmpeg, Encoders: c.Encoders, Supervisor: c.Supervisor, TTS: c.TTS, Stream: c.Stream, GuildID: gid, BotID: q.BotID, Wake: wake}
 		stop := make(chan interface{})
 
 		c.mutex.Lock()
+		delete(c.contended, gid)
 		c.stop[gid] = stop
+		c.wake[gid] = wake
 		c.mutex.Unlock()
 
 		c.wg.Add(1)
+		MetricActivePlayers.Add(1)
 		go func() {
+			defer ReportPanic(PlayerLog, "Player", log.Fields{"gid": gid})
+			defer MetricActivePlayers.Add(-1)
+
+			done := make(chan struct{})
+			go c.holdLock(gid, lock, stop, done)
 			player.Run(ctx, stop)
+			close(done)
 
-			c.mutex.Lock()
-			delete(c.stop, gid)
-			c.mutex.Unlock()
+			// Hold on to the lock until the last track's pipeline has wound down, so it's not
+			// still running when another instance takes over.
+			if stages := c.Supervisor.Wait(gid, GoroutineShutdownDeadline); len(stages) > 0 {
+				PlayerLog.WithFields(log.Fields{"gid": gid, "stages": stages}).Warn("PlayerController: Player's goroutines didn't stop in time")
+			}
+
+			if ok, err := lock.Unlock(); !ok {
+				PlayerLog.WithError(err).WithField("gid", gid).Warn("PlayerController: Couldn't release player lock")
+			}
 
+			c.stopPlayer(gid, stop)
 			c.wg.Done()
 		}()
 	}
 }
+
+// holdLock keeps extending a player's lock until it's done. If the lock is lost, eg. because Redis
+// was unreachable for long enough for it to expire, the player is stopped, as another instance may
+// have taken over by now.
+func (c *PlayerController) holdLock(gid string, lock *redsync.Mutex, stop chan interface{}, done <-chan struct{}) {
+	ticker := time.NewTicker(PlayerLockExpiry / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if ok, err := lock.Extend(); !ok {
+				PlayerLog.WithError(err).WithField("gid", gid).Error("PlayerController: Lost player lock; stopping player")
+				c.stopPlayer(gid, stop)
+
+				// Try to get it back, in case nobody else did.
+				c.mutex.Lock()
+				c.contended[gid] = true
+				c.mutex.Unlock()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// stopPlayer stops a guild's player, unless it's already been stopped or replaced.
+func (c *PlayerController) stopPlayer(gid string, stop chan interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stop[gid] == stop {
+		close(stop)
+		delete(c.stop, gid)
+		delete(c.wake, gid)
+	}
+}
+
+// queue returns the queue the controller's bot plays from in a guild.
+func (c *PlayerController) queue(gid string) Queue {
+	return SessionQueue(c.Session, gid, c.Linked)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPlayerLockHolder(t *testing.T) {
+	value, err := playerLockValue()
+	assert.NoError(t, err)
+	assert.Equal(t, InstanceName, PlayerLockHolder(value))
+
+	// Locks taken by older instances are just random base64.
+	assert.Equal(t, "", PlayerLockHolder("q83vEjRWeJA/q83vEjRWeA=="))
+}
+
+func TestBotStateGuilds(t *testing.T) {
+	keys := []string{
+		"hiqty:server:1:state",
+		"hiqty:server:2:state",
+		"hiqty:server:2:bot:789:state",
+		"hiqty:server:3:bot:789:state",
+		"hiqty:server:4:message:5:state",
+	}
+	assert.Equal(t, []string{"1", "2"}, botStateGuilds(keys, ""))
+	assert.Equal(t, []string{"2", "3"}, botStateGuilds(keys, "789"))
+	assert.Equal(t, []string{}, botStateGuilds(keys, "000"))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sencrash/hiqty/media"
+	"sort"
+	"strings"
+)
+
+const (
+	PreferenceAnnouncements = "announcements"
+	PreferenceDMOnStart     = "dm-on-start"
+	PreferenceSearchService = "search-service"
+)
+
+const (
+	AnnouncementsFull  = "full"
+	AnnouncementsBrief = "brief"
+	AnnouncementsOff   = "off"
+)
+
+const SearchServiceAuto = "auto"
+
+// Preferences lists all available per-user preferences, which can be changed with the prefs command.
+// Unlike settings, they follow users across guilds.
+var Preferences = []Setting{
+	{
+		Name:        PreferenceAnnouncements,
+		Description: "How tracks you queue are announced: `full` (an embed for each), `brief` (a line for each), or `off` (only ones that couldn't be queued).",
+		Default:     AnnouncementsFull,
+		Normalize:   normalizeChoice(AnnouncementsFull, AnnouncementsBrief, AnnouncementsOff),
+	},
+	{
+		Name:        PreferenceDMOnStart,
+		Description: "DM you when a track you queued starts playing.",
+		Default:     "off",
+		Normalize:   normalizeBool,
+	},
+	{
+		Name:        PreferenceSearchService,
+		Description: "Service the `search` command searches first: `auto`, or one of the services that can search (see `services`).",
+		Default:     SearchServiceAuto,
+		Normalize:   normalizeSearchService,
+	},
+}
+
+// FindPreference looks up a preference by name, returning nil if there's no such preference.
+func FindPreference(name string) *Setting {
+	for i, p := range Preferences {
+		if p.Name == name {
+			return &Preferences[i]
+		}
+	}
+	return nil
+}
+
+// ReadPreference reads a user's preference, falling back to the default if it's not set.
+func ReadPreference(rconn redis.Conn, uid, name string) (string, error) {
+	pref := FindPreference(name)
+	if pref == nil {
+		return "", errors.New("unknown preference: " + name)
+	}
+
+	v, err := redis.String(rconn.Do("HGET", KeyForUserPreferences(uid), name))
+	if err == redis.ErrNil {
+		return pref.Default, nil
+	}
+	return v, err
+}
+
+// ReadBoolPreference reads a boolean preference.
+func ReadBoolPreference(rconn redis.Conn, uid, name string) (bool, error) {
+	v, err := ReadPreference(rconn, uid, name)
+	return v == "on", err
+}
+
+// WritePreference validates and stores a user's preference, returning the normalized value.
+func WritePreference(rconn redis.Conn, uid, name, value string) (string, error) {
+	pref := FindPreference(name)
+	if pref == nil {
+		return "", errors.New("unknown preference: " + name)
+	}
+
+	v, err := pref.Normalize(value)
+	if err != nil {
+		return "", err
+	}
+	_, err = rconn.Do("HSET", KeyForUserPreferences(uid), name, v)
+	return v, err
+}
+
+// normalizeSearchService accepts auto, or the ID of a service that can search.
+func normalizeSearchService(v string) (string, error) {
+	v = strings.ToLower(v)
+	choices := []string{}
+	for sid, svc := range media.Services() {
+		if searcher(svc) != nil {
+			choices = append(choices, sid)
+		}
+	}
+	if v == SearchServiceAuto || containsString(choices, v) {
+		return v, nil
+	}
+	sort.Strings(choices)
+	return "", errors.New("expected one of: " + strings.Join(append([]string{SearchServiceAuto}, choices...), ", "))
+}
+
+// preference reads a user's preference, falling back to the default if there's no user, or if it
+// can't be read.
+func (r *Responder) preference(rconn redis.Conn, user *discordgo.User, name string) string {
+	if user != nil {
+		v, err := ReadPreference(rconn, user.ID, name)
+		if err == nil {
+			return v
+		}
+		ResponderLog.WithError(err).Error("Couldn't read preference")
+	}
+	return FindPreference(name).Default
+}
+
+// notifyRequester DMs whoever requested a track that it's started playing, if they want to know.
+func (p *Player) notifyRequester(envelope TrackEnvelope) {
+	if envelope.RequesterID == "" {
+		return
+	}
+
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	notify, err := ReadBoolPreference(rconn, envelope.RequesterID, PreferenceDMOnStart)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't read preference")
+	}
+	if !notify {
+		return
+	}
+
+	where := "now"
+	if guild, err := p.Session.State.Guild(p.GuildID); err == nil {
+		where = "in **" + guild.Name + "**"
+	}
+	info := envelope.Track.GetInfo()
+	dm, err := p.Session.UserChannelCreate(envelope.RequesterID)
+	if err == nil {
+		_, err = p.Session.ChannelMessageSend(dm.ID, fmt.Sprintf("Playing your request %s: **%s** <%s>", where, info.Title, info.URL))
+	}
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't DM requester")
+	}
+}
+
+// cmdPrefs lists, shows or changes the preferences of whoever asked.
+func cmdPrefs(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	// With no arguments, list all preferences and their current values.
+	if len(args) == 0 {
+		lines := []string{}
+		for _, p := range Preferences {
+			v, err := ReadPreference(rconn, msg.Author.ID, p.Name)
+			if err != nil {
+				ResponderLog.WithError(err).Error("Couldn't read preference")
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("**%s**: `%s` - %s", p.Name, v, p.Description))
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "Your preferences:\n"+strings.Join(lines, "\n"))
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	if FindPreference(name) == nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no preference called `%s`.", name))
+		return
+	}
+
+	if len(args) == 1 {
+		v, err := ReadPreference(rconn, msg.Author.ID, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't read preference")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s**: `%s`", name, v))
+		return
+	}
+
+	v, err := WritePreference(rconn, msg.Author.ID, name, strings.Join(args[1:], " "))
+	if err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Couldn't change `%s`: %s", name, err.Error()))
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("**%s** is now `%s`.", name, v))
+}
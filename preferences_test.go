@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalizeSearchService(t *testing.T) {
+	v, err := normalizeSearchService("SoundCloud")
+	assert.NoError(t, err)
+	assert.Equal(t, "soundcloud", v)
+
+	v, err = normalizeSearchService("auto")
+	assert.NoError(t, err)
+	assert.Equal(t, SearchServiceAuto, v)
+
+	_, err = normalizeSearchService("nope")
+	assert.EqualError(t, err, "expected one of: auto, soundcloud")
+}
+
+func TestFindPreference(t *testing.T) {
+	assert.Equal(t, AnnouncementsFull, FindPreference(PreferenceAnnouncements).Default)
+	assert.Nil(t, FindPreference(SettingVolume))
+}
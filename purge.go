@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strings"
+)
+
+// isPlaybackKey returns whether a queue's subkey holds playback state: a playlist, the track playing
+// from it, the player state, the active channel or the player lock. Settings and the like are left
+// alone by purges.
+func isPlaybackKey(sub string) bool {
+	switch sub {
+	case "playlist", "now_playing", "state", "channel", "player_lock":
+		return true
+	}
+	return strings.HasPrefix(sub, "vc:") && (strings.HasSuffix(sub, ":playlist") || strings.HasSuffix(sub, ":now_playing"))
+}
+
+// playbackKeysByQueue picks out the playback keys from a list of keys, grouped by queue.
+func playbackKeysByQueue(keys []string) map[Queue][]string {
+	queues := map[Queue][]string{}
+	for _, key := range keys {
+		gid, bid, ok := parseServerKey(key)
+		if !ok {
+			continue
+		}
+		q := Queue{GuildID: gid, BotID: bid}
+		if isPlaybackKey(strings.TrimPrefix(key, q.Key(""))) {
+			queues[q] = append(queues[q], key)
+		}
+	}
+	return queues
+}
+
+// PlaybackKeys returns a guild's playback keys, for all of its queues, including linked bots'.
+func PlaybackKeys(rconn redis.Conn, gid string) ([]string, error) {
+	keys, err := scanKeys(rconn, KeyForServer(gid, "*"))
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, qkeys := range playbackKeysByQueue(keys) {
+		result = append(result, qkeys...)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// StalePlaybackKeys returns the playback keys of all queues that are stale: no instance is
+// playing them, and there's nothing in them that could be played, as their playlists are empty or
+// start with an envelope that can't be decoded, and neither is left playing.
+func StalePlaybackKeys(rconn redis.Conn) ([]string, error) {
+	keys, err := scanKeys(rconn, "hiqty:server:*")
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for q, qkeys := range playbackKeysByQueue(keys) {
+		stale, err := isStaleQueue(rconn, q, qkeys)
+		if err != nil {
+			return nil, err
+		}
+		if stale {
+			result = append(result, qkeys...)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func isStaleQueue(rconn redis.Conn, q Queue, keys []string) (bool, error) {
+	locked, err := redis.Bool(rconn.Do("EXISTS", q.PlayerLockKey()))
+	if err != nil || locked {
+		return false, err
+	}
+	for _, key := range keys {
+		var data []byte
+		var err error
+		switch {
+		case strings.HasSuffix(key, "playlist"):
+			data, err = redis.Bytes(rconn.Do("LINDEX", key, 0))
+		case strings.HasSuffix(key, "now_playing"):
+			data, err = redis.Bytes(rconn.Do("GET", key))
+		default:
+			continue
+		}
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		var envelope TrackEnvelope
+		if json.Unmarshal(data, &envelope) == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
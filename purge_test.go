@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPlaybackKeysByQueue(t *testing.T) {
+	queues := playbackKeysByQueue([]string{
+		"hiqty:server:1:playlist",
+		"hiqty:server:1:vc:2:playlist",
+		"hiqty:server:1:vc:2:now_playing",
+		"hiqty:server:1:state",
+		"hiqty:server:1:settings",
+		"hiqty:server:1:message:3",
+		"hiqty:server:1:bot:4:player_lock",
+		"hiqty:server:1:bot:4:templates",
+		"hiqty:webhook:abc",
+	})
+	assert.Equal(t, map[Queue][]string{
+		{GuildID: "1"}:             {"hiqty:server:1:playlist", "hiqty:server:1:vc:2:playlist", "hiqty:server:1:vc:2:now_playing", "hiqty:server:1:state"},
+		{GuildID: "1", BotID: "4"}: {"hiqty:server:1:bot:4:player_lock"},
+	}, queues)
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sencrash/hiqty/media"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Queue identifies a playlist, along with the state and voice channel that go with it. Guilds
+// have one for the primary bot, and one for each linked bot (see --linked-token) that's in them,
+// so they can have music in several voice channels at once.
+//
+// Guilds with per-channel queues have a separate playlist for each voice channel, so moving the bot
+// around doesn't mix up what was queued where. The state and active channel are still per-bot, as
+// a bot can only be in one voice channel at a time.
+type Queue struct {
+	GuildID   string
+	BotID     string // The linked bot the queue belongs to, or "" for the primary bot
+	ChannelID string // The voice channel the playlist belongs to, if it has per-channel queues
+}
+
+// GuildQueue returns the primary bot's queue in a guild.
+func GuildQueue(gid string) Queue { return Queue{GuildID: gid} }
+
+// SessionQueue returns the queue a session's bot plays from in a guild.
+func SessionQueue(session *discordgo.Session, gid string, linked bool) Queue {
+	if !linked || session.State.User == nil {
+		return GuildQueue(gid)
+	}
+	return Queue{GuildID: gid, BotID: session.State.User.ID}
+}
+
+// Key returns the redis key for the given subkey of the queue.
+func (q Queue) Key(key string) string {
+	if q.BotID == "" {
+		return KeyForServer(q.GuildID, key)
+	}
+	return KeyForServerBot(q.GuildID, q.BotID, key)
+}
+
+// PlaylistKey returns the redis key for the queue's playlist.
+func (q Queue) PlaylistKey() string {
+	if q.ChannelID == "" {
+		return q.Key("playlist")
+	}
+	return q.Key("vc:" + q.ChannelID + ":playlist")
+}
+
+// NowPlayingKey returns the redis key for the envelope that's playing from the queue's playlist.
+// It's taken off the playlist when it starts, and kept here until it's done.
+func (q Queue) NowPlayingKey() string {
+	if q.ChannelID == "" {
+		return q.Key("now_playing")
+	}
+	return q.Key("vc:" + q.ChannelID + ":now_playing")
+}
+
+// StateKey returns the redis key for the queue's player state.
+func (q Queue) StateKey() string { return q.Key("state") }
+
+// ChannelKey returns the redis key for the voice channel the queue plays in.
+func (q Queue) ChannelKey() string { return q.Key("channel") }
+
+// TextChannelKey returns the redis key for the text channel music was last requested from.
+func (q Queue) TextChannelKey() string { return q.Key("text_channel") }
+
+// PlayerLockKey returns the redis key for the lock held by the instance playing the queue.
+func (q Queue) PlayerLockKey() string { return q.Key("player_lock") }
+
+// MessageKey returns the redis key for the URLs a message requested into the queue.
+func (q Queue) MessageKey(mid string) string { return q.Key("message:" + mid) }
+
+// MessageChannelKey returns the redis key for the voice channel a message was requested from.
+func (q Queue) MessageChannelKey(mid string) string { return q.Key("message:" + mid + ":channel") }
+
+// DJLockKey returns the redis key for the user who has the queue locked, if anyone; see LockDJ.
+func (q Queue) DJLockKey() string { return q.Key("dj_lock") }
+
+// ClipQueueKey returns the redis key for the soundboard clips waiting to be played; see QueueClip.
+func (q Queue) ClipQueueKey() string { return q.Key("clip_queue") }
+
+// AnnouncementQueueKey returns the redis key for the announcements waiting to be spoken; see
+// QueueAnnouncement.
+func (q Queue) AnnouncementQueueKey() string { return q.Key("announcement_queue") }
+
+// VotesKey returns the redis key for the votes on a request's tracks; see OpenVote.
+func (q Queue) VotesKey(mid string) string { return q.Key("votes:" + mid) }
+
+// DeadLetterKey returns the redis key for envelopes from the queue's playlists that couldn't be
+// decoded; see DeadLetter.
+func (q Queue) DeadLetterKey() string { return q.Key("dead_letters") }
+
+// ProcessedKey returns the redis key marking an event about a message as handled.
+func (q Queue) ProcessedKey(id string) string { return q.Key("processed:" + id) }
+
+// DeferredKey returns the redis key for a user's request that's waiting for them to join a voice
+// channel.
+func (q Queue) DeferredKey(uid string) string { return q.Key("deferred:" + uid) }
+
+// ClaimMessage marks an event about a message (see ProcessedKey) as handled, returning false if it
+// already was, eg. by another instance sharing the bot's token, or because the gateway delivered it
+// twice. Events are remembered for as long as the message can be edited.
+func ClaimMessage(rconn redis.Conn, q Queue, id string) (bool, error) {
+	reply, err := rconn.Do("SET", q.ProcessedKey(id), 1, "NX", "PX", int64(MessageEditWindow/time.Millisecond))
+	return reply != nil, err
+}
+
+// ForChannel returns the queue with its playlist scoped to a voice channel.
+func (q Queue) ForChannel(cid string) Queue {
+	q.ChannelID = cid
+	return q
+}
+
+// PlaylistQueue returns the queue requests from a voice channel go into: the channel's own, if the
+// guild has per-channel queues, otherwise the bot's one and only.
+func PlaylistQueue(rconn redis.Conn, q Queue, cid string) Queue {
+	perChannel, err := ReadBoolSetting(rconn, q.GuildID, SettingQueuePerChannel)
+	if err != nil {
+		log.WithError(err).Error("Couldn't read setting")
+	}
+	if !perChannel || cid == "" {
+		return q.ForChannel("")
+	}
+	return q.ForChannel(cid)
+}
+
+// ActivePlaylistQueue returns the queue for the voice channel the bot is currently in.
+func ActivePlaylistQueue(rconn redis.Conn, q Queue) Queue {
+	cid, err := redis.String(rconn.Do("GET", q.ChannelKey()))
+	if err != nil && err != redis.ErrNil {
+		log.WithError(err).Error("Couldn't get active channel")
+	}
+	return PlaylistQueue(rconn, q, cid)
+}
+
+// MigratePlaylist moves a playlist, and the track playing from it, to another queue if that one's
+// empty, so nothing queued is lost when a guild switches between per-channel queues and a single one.
+func MigratePlaylist(rconn redis.Conn, from, to Queue) error {
+	if from.PlaylistKey() == to.PlaylistKey() {
+		return nil
+	}
+	if _, err := renameNX(rconn, from.NowPlayingKey(), to.NowPlayingKey()); err != nil {
+		return err
+	}
+	moved, err := renameNX(rconn, from.PlaylistKey(), to.PlaylistKey())
+	if moved {
+		queueChanged(rconn, to)
+	}
+	return err
+}
+
+// renameNX renames a key if there's nothing by the new name yet; a missing key isn't an error.
+func renameNX(rconn redis.Conn, from, to string) (bool, error) {
+	moved, err := redis.Bool(rconn.Do("RENAMENX", from, to))
+	if err != nil && strings.Contains(err.Error(), "no such key") {
+		return false, nil
+	}
+	return moved, err
+}
+
+// A resolvedURL holds the tracks a single URL in a request resolved to.
+type resolvedURL struct {
+	URL       string
+	Tracks    []media.Track
+	Timing    RequestTiming
+	Requester string // The user who requested it, if anyone
+}
+
+// ResolveURL resolves a URL into tracks, using the first service that's interested in it, after
+// following it if it's from a URL shortener. Returns no tracks and no error if no service is.
+func ResolveURL(rconn redis.Conn, url string) ([]media.Track, error) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		log.WithError(err).WithField("url", url).Error("Couldn't parse URL?")
+		return nil, nil
+	}
+	u = UnshortenURL(u)
+
+	for sid, svc := range media.Services() {
+		if !svc.Sniff(u) {
+			continue
+		}
+
+		log.WithFields(log.Fields{"service": sid, "url": url}).Debug("Smell test passed")
+		if err := serviceUnavailable(rconn, sid); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		ts, err := svc.Resolve(u)
+		MetricResolveDuration.ObserveDuration(sid, time.Since(start))
+		if err != nil {
+			log.WithError(err).Error("Couldn't resolve track")
+			MetricResolveErrors.IncFor(sid)
+			RecordStats(rconn, StatResolveError+":"+sid)
+			return nil, err
+		}
+		RecordStats(rconn, StatRequests+":"+sid)
+		return ts, nil
+	}
+	return nil, nil
+}
+
+// SearchTracks searches for tracks by text, on the preferred service if it can search and is
+// available, or else the first one that is, alphabetically. Returns no tracks and no error if none
+// is.
+func SearchTracks(rconn redis.Conn, query, preferred string, limit int) ([]media.Track, error) {
+	svcs := media.Services()
+	sids := []string{}
+	for sid, svc := range svcs {
+		if searcher(svc) != nil {
+			sids = append(sids, sid)
+		}
+	}
+	sort.Slice(sids, func(i, j int) bool {
+		if (sids[i] == preferred) != (sids[j] == preferred) {
+			return sids[i] == preferred
+		}
+		return sids[i] < sids[j]
+	})
+
+	for _, sid := range sids {
+		if serviceUnavailable(rconn, sid) != nil {
+			continue
+		}
+		ts, err := searcher(svcs[sid]).Search(query, limit)
+		if err != nil {
+			log.WithError(err).WithField("service", sid).Error("Couldn't search")
+			return nil, err
+		}
+		RecordStats(rconn, StatRequests+":"+sid)
+		return ts, nil
+	}
+	return nil, nil
+}
+
+// RelatedTracks finds tracks related to a track, on its own service. Returns no tracks and no error
+// if that service can't.
+func RelatedTracks(rconn redis.Conn, track media.Track, limit int) ([]media.Track, error) {
+	sid := track.GetServiceID()
+	rec := recommender(media.Lookup(sid))
+	if rec == nil {
+		return nil, nil
+	}
+	if err := serviceUnavailable(rconn, sid); err != nil {
+		return nil, err
+	}
+	ts, err := rec.Related(track, limit)
+	if err != nil {
+		log.WithError(err).WithField("service", sid).Error("Couldn't find related tracks")
+		return nil, err
+	}
+	RecordStats(rconn, StatRequests+":"+sid)
+	return ts, nil
+}
+
+// recommender returns a service as a media.Recommender, or nil if it can't find related tracks.
+func recommender(svc media.Service) media.Recommender {
+	if r, ok := svc.(media.Recommender); ok && svc.Capabilities().Related {
+		return r
+	}
+	return nil
+}
+
+// searcher returns a service as a media.Searcher, or nil if it can't search.
+func searcher(svc media.Service) media.Searcher {
+	if s, ok := svc.(media.Searcher); ok && svc.Capabilities().Search {
+		return s
+	}
+	return nil
+}
+
+// serviceUnavailable returns an error if a service has been disabled, or is known to be down. If
+// that can't be checked, it's assumed to be fine.
+func serviceUnavailable(rconn redis.Conn, sid string) error {
+	if disabled, err := IsServiceDisabled(rconn, sid); err != nil {
+		log.WithError(err).WithField("service", sid).Warn("Couldn't check if service is disabled")
+	} else if disabled {
+		return errors.Wrap(media.ErrUnavailable, sid+" is disabled")
+	}
+	if health, err := ReadServiceHealth(rconn, sid); err != nil {
+		log.WithError(err).WithField("service", sid).Warn("Couldn't read service health")
+	} else if health.Status == HealthDown {
+		return errors.Wrap(media.ErrUnavailable, sid)
+	}
+	return nil
+}
+
+// A SkippedTrack is a track a URL resolved to that wasn't queued, as it can't be played.
+type SkippedTrack struct {
+	Track  media.Track
+	Reason string
+}
+
+// Enqueue pushes the playable tracks a URL resolved to onto a playlist, on behalf of the given
+// message (if any), which was posted in an NSFW channel or not. Returns the number of tracks
+// queued, and the ones that were skipped.
+func Enqueue(rconn redis.Conn, q Queue, mid string, nsfw bool, res resolvedURL) (int, []SkippedTrack) {
+	envelopes, skipped := PlayableEnvelopes(rconn, q.GuildID, mid, nsfw, res)
+	if err := pushEnvelopes(rconn, q, envelopes...); err != nil {
+		log.WithError(err).Error("Couldn't push to playlist")
+		return 0, skipped
+	}
+	return len(envelopes), skipped
+}
+
+// PlayableEnvelopes wraps the playable tracks a URL resolved to in envelopes designating which
+// service they belong to, on behalf of the given message (if any), which was posted in an NSFW
+// channel or not. Tracks that can't be played are returned separately, with the reason why.
+func PlayableEnvelopes(rconn redis.Conn, gid, mid string, nsfw bool, res resolvedURL) ([]TrackEnvelope, []SkippedTrack) {
+	timing := res.Timing
+	timing.Enqueued = time.Now()
+
+	envelopes := []TrackEnvelope{}
+	skipped := []SkippedTrack{}
+	for _, track := range res.Tracks {
+		// Stubs are checked once they're looked up, when it's their turn to play.
+		if !media.IsStub(track) {
+			if ok, reason := Playable(rconn, gid, nsfw, track); !ok {
+				skipped = append(skipped, SkippedTrack{track, reason})
+				continue
+			}
+		}
+		envelopes = append(envelopes, TrackEnvelope{
+			ServiceID:   track.GetServiceID(),
+			Track:       track,
+			MessageID:   mid,
+			URL:         res.URL,
+			NSFW:        nsfw,
+			Timing:      timing,
+			RequesterID: res.Requester,
+		})
+	}
+	return envelopes, skipped
+}
+
+// queueChanged announces that a queue's playlist, or what's playing from it, has changed: to
+// anything listening for events, and to its Player, over the bus.
+func queueChanged(rconn redis.Conn, q Queue) {
+	PublishEvent(rconn, NewEvent(EventQueueChanged, q, nil))
+	NotifyBus(q.PlaylistKey())
+}
+
+// pushEnvelopes pushes envelopes onto a playlist in one go.
+func pushEnvelopes(rconn redis.Conn, q Queue, envelopes ...TrackEnvelope) error {
+	if len(envelopes) == 0 {
+		return nil
+	}
+	args := redis.Args{}.Add(q.PlaylistKey())
+	for _, envelope := range envelopes {
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return errors.Wrap(err, "couldn't marshal envelope")
+		}
+		args = args.Add(data)
+	}
+	if _, err := rconn.Do("RPUSH", args...); err != nil {
+		return err
+	}
+	queueChanged(rconn, q)
+	return nil
+}
+
+// Dequeue removes tracks that haven't started playing yet and match a predicate from a playlist.
+// Returns the number of tracks removed.
+func Dequeue(rconn redis.Conn, q Queue, match func(TrackEnvelope) bool) int {
+	playlistKey := q.PlaylistKey()
+	envdatas, err := redis.ByteSlices(rconn.Do("LRANGE", playlistKey, 0, -1))
+	if err != nil {
+		log.WithError(err).Error("Couldn't get playlist")
+		return 0
+	}
+
+	count := 0
+	for _, data := range envdatas {
+		var envelope TrackEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			continue
+		}
+		if !match(envelope) {
+			continue
+		}
+
+		// Remove from the tail, in case an identical envelope was queued earlier, and isn't a match.
+		n, err := redis.Int(rconn.Do("LREM", playlistKey, -1, data))
+		if err != nil {
+			log.WithError(err).Error("Couldn't remove from playlist")
+			continue
+		}
+		count += n
+	}
+	if count > 0 {
+		queueChanged(rconn, q)
+	}
+	return count
+}
+
+// ReadNowPlaying returns the envelope that's playing from a queue's playlist, or nil if nothing is,
+// or it can't be decoded.
+func ReadNowPlaying(rconn redis.Conn, q Queue) (*TrackEnvelope, error) {
+	data, err := redis.Bytes(rconn.Do("GET", q.NowPlayingKey()))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var envelope TrackEnvelope
+	if json.Unmarshal(data, &envelope) != nil {
+		return nil, nil
+	}
+	return &envelope, nil
+}
+
+// Advance takes the next envelope off a playlist and makes it the one that's playing, in one go,
+// returning it; if the playlist is empty, nothing is playing anymore, and it returns nil.
+func Advance(rconn redis.Conn, q Queue) ([]byte, error) {
+	playlistKey, nowPlayingKey := q.PlaylistKey(), q.NowPlayingKey()
+	for {
+		// Watch the playlist, so the envelope can't be taken by somebody else in the meantime.
+		if _, err := rconn.Do("WATCH", playlistKey); err != nil {
+			return nil, err
+		}
+		data, err := redis.Bytes(rconn.Do("LINDEX", playlistKey, 0))
+		if err != nil && err != redis.ErrNil {
+			rconn.Do("UNWATCH")
+			return nil, err
+		}
+
+		rconn.Send("MULTI")
+		if data == nil {
+			rconn.Send("DEL", nowPlayingKey)
+		} else {
+			rconn.Send("LPOP", playlistKey)
+			rconn.Send("SET", nowPlayingKey, data)
+		}
+		res, err := rconn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if res != nil {
+			if data != nil {
+				queueChanged(rconn, q)
+			}
+			return data, nil
+		}
+	}
+}
+
+// Skip skips the currently playing track in a queue, returning false if nothing was playing. The
+// player notices, and moves on to the next one.
+func Skip(rconn redis.Conn, q Queue) (bool, error) {
+	n, err := redis.Int(rconn.Do("DEL", q.NowPlayingKey()))
+	if n > 0 {
+		queueChanged(rconn, q)
+	}
+	return n > 0, err
+}
+
+// SetTrackGain sets the gain adjustment, in dB, for the track at a position in a queue, 1 being the
+// next one up. Returns false if there's no such track.
+func SetTrackGain(rconn redis.Conn, q Queue, pos int, gain float64) (bool, error) {
+	if pos < 1 {
+		return false, nil
+	}
+	idx := pos - 1
+	playlistKey := q.PlaylistKey()
+	for {
+		// Watch the playlist, so the track can't move out from under us between reading and writing.
+		if _, err := rconn.Do("WATCH", playlistKey); err != nil {
+			return false, err
+		}
+		data, err := redis.Bytes(rconn.Do("LINDEX", playlistKey, idx))
+		if err == redis.ErrNil {
+			rconn.Do("UNWATCH")
+			return false, nil
+		}
+		if err != nil {
+			rconn.Do("UNWATCH")
+			return false, err
+		}
+
+		var envelope TrackEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			rconn.Do("UNWATCH")
+			return false, err
+		}
+		envelope.Gain = gain
+		if data, err = json.Marshal(envelope); err != nil {
+			rconn.Do("UNWATCH")
+			return false, err
+		}
+
+		rconn.Send("MULTI")
+		rconn.Send("LSET", playlistKey, idx, data)
+		res, err := rconn.Do("EXEC")
+		if err != nil {
+			return false, err
+		}
+		if res != nil {
+			queueChanged(rconn, q)
+			return true, nil
+		}
+	}
+}
+
+// MoveTrack moves the track at a position in a queue to another, 1 being the next one up; the
+// playing track (position 0) isn't in the playlist, and can't be moved. Returns false if there's no
+// track at either position.
+func MoveTrack(rconn redis.Conn, q Queue, from, to int) (bool, error) {
+	return rewritePlaylist(rconn, q, func(items [][]byte) ([][]byte, bool) {
+		from, to := from-1, to-1
+		if from < 0 || to < 0 || from >= len(items) || to >= len(items) {
+			return nil, false
+		}
+		item := items[from]
+		items = append(items[:from], items[from+1:]...)
+		items = append(items[:to], append([][]byte{item}, items[to:]...)...)
+		return items, true
+	})
+}
+
+// RemoveTrack removes the track at a position in a queue, 1 being the next one up; the playing
+// track (position 0) has to be skipped instead. Returns false if there's no such track.
+func RemoveTrack(rconn redis.Conn, q Queue, pos int) (bool, error) {
+	return rewritePlaylist(rconn, q, func(items [][]byte) ([][]byte, bool) {
+		idx := pos - 1
+		if idx < 0 || idx >= len(items) {
+			return nil, false
+		}
+		return append(items[:idx], items[idx+1:]...), true
+	})
+}
+
+// rewritePlaylist replaces a playlist with what edit makes of it, unless it returns false.
+func rewritePlaylist(rconn redis.Conn, q Queue, edit func(items [][]byte) ([][]byte, bool)) (bool, error) {
+	playlistKey := q.PlaylistKey()
+	for {
+		// Watch the playlist, so it can't change out from under us between reading and writing.
+		if _, err := rconn.Do("WATCH", playlistKey); err != nil {
+			return false, err
+		}
+		items, err := redis.ByteSlices(rconn.Do("LRANGE", playlistKey, 0, -1))
+		if err != nil {
+			rconn.Do("UNWATCH")
+			return false, err
+		}
+		items, ok := edit(items)
+		if !ok {
+			rconn.Do("UNWATCH")
+			return false, nil
+		}
+
+		rconn.Send("MULTI")
+		rconn.Send("DEL", playlistKey)
+		if len(items) > 0 {
+			rconn.Send("RPUSH", redis.Args{}.Add(playlistKey).AddFlat(items)...)
+		}
+		res, err := rconn.Do("EXEC")
+		if err != nil {
+			return false, err
+		}
+		if res != nil {
+			queueChanged(rconn, q)
+			return true, nil
+		}
+	}
+}
+
+// Playable returns whether a track can be played in a guild, and if not, why not. On top of the
+// track's own playability, this takes the guild's settings into account, as well as whether it was
+// requested from an NSFW channel.
+func Playable(rconn redis.Conn, gid string, nsfw bool, track media.Track) (bool, string) {
+	if ok, reason := track.GetPlayable(); !ok {
+		return ok, reason
+	}
+
+	filter, err := ReadSetting(rconn, gid, SettingLicenseFilter)
+	if err != nil {
+		log.WithError(err).Error("Couldn't read setting")
+	}
+	info := track.GetInfo()
+	license := info.License
+	switch {
+	case filter == LicenseFilterCC && !license.CreativeCommons:
+		return false, "This server only allows Creative Commons licensed tracks."
+	case filter == LicenseFilterCommercial && !license.Commercial:
+		return false, "This server only allows tracks licensed for commercial use."
+	}
+
+	if info.Explicit || info.AgeRestricted {
+		filter, err := ReadSetting(rconn, gid, SettingExplicitFilter)
+		if err != nil {
+			log.WithError(err).Error("Couldn't read setting")
+		}
+		switch {
+		case filter == ExplicitFilterBlock:
+			return false, "This server doesn't allow explicit or age-restricted tracks."
+		case filter == ExplicitFilterNSFW && !nsfw:
+			return false, "Explicit and age-restricted tracks can only be requested from NSFW channels."
+		}
+	}
+
+	return true, ""
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestQueueKeys(t *testing.T) {
+	q := GuildQueue("123")
+	assert.Equal(t, "hiqty:server:123:playlist", q.PlaylistKey())
+	assert.Equal(t, "hiqty:server:123:state", q.StateKey())
+	assert.Equal(t, KeyForServerPlayerLock("123"), q.PlayerLockKey())
+
+	linked := Queue{GuildID: "123", BotID: "456"}
+	assert.Equal(t, "hiqty:server:123:bot:456:playlist", linked.PlaylistKey())
+	assert.Equal(t, "hiqty:server:123:bot:456:channel", linked.ChannelKey())
+	assert.Equal(t, "hiqty:server:123:bot:456:processed:789", linked.ProcessedKey("789"))
+
+	// Only the playlist and what's playing from it are per-channel; a bot can only be in one channel at a time.
+	vc := linked.ForChannel("789")
+	assert.Equal(t, "hiqty:server:123:bot:456:vc:789:playlist", vc.PlaylistKey())
+	assert.Equal(t, "hiqty:server:123:bot:456:vc:789:now_playing", vc.NowPlayingKey())
+	assert.Equal(t, linked.StateKey(), vc.StateKey())
+	assert.Equal(t, "hiqty:server:123:bot:456:dead_letters", vc.DeadLetterKey())
+	assert.Equal(t, "hiqty:server:123:bot:456:dj_lock", vc.DJLockKey())
+	assert.Equal(t, "hiqty:server:123:bot:456:clip_queue", vc.ClipQueueKey())
+	assert.Equal(t, "hiqty:server:123:bot:456:announcement_queue", vc.AnnouncementQueueKey())
+	assert.Equal(t, "hiqty:server:123:bot:456:votes:789", vc.VotesKey("789"))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"net"
+	neturl "net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultRedisPort is used for Redis URLs that don't specify a port.
+const DefaultRedisPort = "6379"
+
+// RedisConfig describes how to connect to Redis.
+type RedisConfig struct {
+	Network  string // "tcp" or "unix"
+	Addr     string // host:port, or the path of a Unix socket
+	Password string
+	DB       int
+	TLS      bool
+}
+
+// ParseRedisConfig parses a Redis address; either a plain "host:port", or a URL of the form
+// "redis://[:password@]host[:port][/db]", with "rediss://" for TLS. Unix sockets are given as a
+// plain path, or as "unix:///path/to/redis.sock[?db=N][&password=...]".
+func ParseRedisConfig(s string) (RedisConfig, error) {
+	if strings.HasPrefix(s, "/") {
+		return RedisConfig{Network: "unix", Addr: s}, nil
+	}
+	if !strings.Contains(s, "://") {
+		return RedisConfig{Network: "tcp", Addr: s}, nil
+	}
+
+	u, err := neturl.Parse(s)
+	if err != nil {
+		return RedisConfig{}, errors.Wrap(err, "invalid redis URL")
+	}
+
+	cfg := RedisConfig{Network: "tcp"}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		cfg.TLS = true
+	case "unix":
+		return parseRedisSocketURL(u)
+	default:
+		return cfg, errors.New("invalid redis URL scheme: " + u.Scheme)
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if port == "" {
+		port = DefaultRedisPort
+	}
+	cfg.Addr = net.JoinHostPort(host, port)
+
+	// Redis has no usernames (pre-ACL), so the password may be given in either position.
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			cfg.Password = password
+		} else {
+			cfg.Password = u.User.Username()
+		}
+	}
+
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if cfg.DB, err = parseRedisDB(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
+
+func parseRedisSocketURL(u *neturl.URL) (RedisConfig, error) {
+	cfg := RedisConfig{Network: "unix", Addr: u.Path}
+	if cfg.Addr == "" {
+		return cfg, errors.New("missing redis socket path")
+	}
+
+	query := u.Query()
+	cfg.Password = query.Get("password")
+	if u.User != nil && cfg.Password == "" {
+		cfg.Password, _ = u.User.Password()
+	}
+	if db := query.Get("db"); db != "" {
+		var err error
+		if cfg.DB, err = parseRedisDB(db); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+func parseRedisDB(s string) (int, error) {
+	db, err := strconv.Atoi(s)
+	if err != nil || db < 0 {
+		return 0, errors.New("invalid redis database: " + s)
+	}
+	return db, nil
+}
+
+// DialOptions returns options for dialing Redis with the configuration.
+func (cfg RedisConfig) DialOptions() []redis.DialOption {
+	opts := []redis.DialOption{redis.DialDatabase(cfg.DB)}
+	if cfg.Password != "" {
+		opts = append(opts, redis.DialPassword(cfg.Password))
+	}
+	if cfg.TLS {
+		opts = append(opts, redis.DialUseTLS(true))
+	}
+	return opts
+}
+
+// metricsConn counts connection errors for metrics. Error replies, eg. from commands expected to
+// fail, aren't counted.
+type metricsConn struct {
+	redis.Conn
+}
+
+func (c metricsConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	return reply, c.count(err)
+}
+
+func (c metricsConn) Send(cmd string, args ...interface{}) error {
+	return c.count(c.Conn.Send(cmd, args...))
+}
+
+func (c metricsConn) Flush() error {
+	return c.count(c.Conn.Flush())
+}
+
+func (c metricsConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	return reply, c.count(err)
+}
+
+func (c metricsConn) count(err error) error {
+	if _, ok := err.(redis.Error); err != nil && !ok {
+		MetricRedisErrors.Inc()
+	}
+	return err
+}
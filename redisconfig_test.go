@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRedisConfig(t *testing.T) {
+	for s, cfg := range map[string]RedisConfig{
+		"127.0.0.1:6379":                      {Network: "tcp", Addr: "127.0.0.1:6379"},
+		"redis://localhost":                   {Network: "tcp", Addr: "localhost:6379"},
+		"redis://:hunter2@redis.local:6380/2": {Network: "tcp", Addr: "redis.local:6380", Password: "hunter2", DB: 2},
+		"redis://hunter2@redis.local/":        {Network: "tcp", Addr: "redis.local:6379", Password: "hunter2"},
+		"rediss://redis.local:6380/1":         {Network: "tcp", Addr: "redis.local:6380", DB: 1, TLS: true},
+		"/run/redis/redis.sock":               {Network: "unix", Addr: "/run/redis/redis.sock"},
+		"unix:///run/redis.sock?db=3":         {Network: "unix", Addr: "/run/redis.sock", DB: 3},
+		"unix://:hunter2@/run/redis.sock":     {Network: "unix", Addr: "/run/redis.sock", Password: "hunter2"},
+	} {
+		parsed, err := ParseRedisConfig(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, cfg, parsed, s)
+	}
+
+	for _, s := range []string{"http://redis.local", "redis://redis.local/db", "redis://redis.local/-1", "unix://", "unix:///run/redis.sock?db=x"} {
+		_, err := ParseRedisConfig(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sencrash/hiqty/media"
+	"strings"
+	"time"
+)
+
+// A RedisStore keeps playback state in Redis, where any number of instances can share it. Player
+// states are watched over a Bus.
+type RedisStore struct {
+	Pool *redis.Pool
+	Bus  Bus
+}
+
+func (s *RedisStore) Push(q Queue, envelopes ...TrackEnvelope) error {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	return pushEnvelopes(rconn, q, envelopes...)
+}
+
+func (s *RedisStore) NowPlaying(q Queue) (*TrackEnvelope, error) {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	data, err := redis.Bytes(rconn.Do("GET", q.NowPlayingKey()))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope TrackEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		log.WithError(err).WithField("gid", q.GuildID).Error("Invalid envelope encountered!!")
+		if err := AddDeadLetter(rconn, q, NewDeadLetter(data, err)); err != nil {
+			return nil, errors.Wrap(err, "couldn't set aside invalid envelope")
+		}
+		if _, err := rconn.Do("DEL", q.NowPlayingKey()); err != nil {
+			return nil, errors.Wrap(err, "couldn't remove invalid envelope")
+		}
+		return nil, nil
+	}
+	return &envelope, nil
+}
+
+func (s *RedisStore) Advance(q Queue) (*TrackEnvelope, error) {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	for {
+		data, err := Advance(rconn, q)
+		if data == nil || err != nil {
+			return nil, err
+		}
+
+		// An invalid envelope is set aside, and replaced by the next one.
+		var envelope TrackEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			log.WithError(err).WithField("gid", q.GuildID).Error("Invalid envelope encountered!!")
+			if err := AddDeadLetter(rconn, q, NewDeadLetter(data, err)); err != nil {
+				return nil, errors.Wrap(err, "couldn't set aside invalid envelope")
+			}
+			continue
+		}
+		return &envelope, nil
+	}
+}
+
+func (s *RedisStore) ReplaceNowPlaying(q Queue, track media.Track, envelope TrackEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return s.updateNowPlaying(q, track, data)
+}
+
+func (s *RedisStore) Finish(q Queue, track media.Track) error {
+	return s.updateNowPlaying(q, track, nil)
+}
+
+// updateNowPlaying replaces the envelope that's playing with data, or discards it if that's nil, if
+// it's still for the given track. If it changes in the meantime, it's left alone.
+func (s *RedisStore) updateNowPlaying(q Queue, track media.Track, data []byte) error {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	key := q.NowPlayingKey()
+	if _, err := rconn.Do("WATCH", key); err != nil {
+		return err
+	}
+	currentData, err := redis.Bytes(rconn.Do("GET", key))
+	if err != nil {
+		rconn.Do("UNWATCH")
+		if err == redis.ErrNil {
+			return nil
+		}
+		return err
+	}
+	var current TrackEnvelope
+	if err := json.Unmarshal(currentData, &current); err != nil || !current.Track.Equals(track) {
+		rconn.Do("UNWATCH")
+		return nil
+	}
+
+	rconn.Send("MULTI")
+	if data == nil {
+		rconn.Send("DEL", key)
+	} else {
+		rconn.Send("SET", key, data)
+	}
+	_, err = rconn.Do("EXEC")
+	return err
+}
+
+func (s *RedisStore) Len(q Queue) (int, error) {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	return redis.Int(rconn.Do("LLEN", q.PlaylistKey()))
+}
+
+func (s *RedisStore) Skip(q Queue) (bool, error) {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	return Skip(rconn, q)
+}
+
+func (s *RedisStore) Remove(q Queue, match func(TrackEnvelope) bool) (int, error) {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	return Dequeue(rconn, q, match), nil
+}
+
+func (s *RedisStore) Migrate(from, to Queue) error {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	return MigratePlaylist(rconn, from, to)
+}
+
+func (s *RedisStore) Clear(q Queue) error {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	keys, err := scanKeys(rconn, q.Key("*"))
+	if err != nil {
+		return err
+	}
+	cleared := []string{}
+	for _, key := range keys {
+		if _, bid, ok := parseServerKey(key); !ok || bid != q.BotID {
+			continue
+		}
+		if sub := strings.TrimPrefix(key, q.Key("")); isPlaybackKey(sub) || sub == "dead_letters" || sub == "dj_lock" || sub == "clip_queue" || sub == "announcement_queue" || strings.HasPrefix(sub, "message:") || strings.HasPrefix(sub, "votes:") {
+			cleared = append(cleared, key)
+		}
+	}
+	return DeleteKeys(rconn, cleared)
+}
+
+func (s *RedisStore) State(q Queue) (string, error) {
+	return s.get(q.StateKey())
+}
+
+func (s *RedisStore) SetState(q Queue, state string) error {
+	if err := s.set(q.StateKey(), state); err != nil {
+		return err
+	}
+	return s.Bus.Notify(q.StateKey())
+}
+
+func (s *RedisStore) Channel(q Queue) (string, error) {
+	return s.get(q.ChannelKey())
+}
+
+func (s *RedisStore) SetChannel(q Queue, cid string) error {
+	if err := s.set(q.ChannelKey(), cid); err != nil {
+		return err
+	}
+	return s.Bus.Notify(q.ChannelKey())
+}
+
+func (s *RedisStore) Request(q Queue, mid string) (StoredRequest, error) {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	messageKey := q.MessageKey(mid)
+	urls, err := redis.Strings(rconn.Do("LRANGE", messageKey, 0, -1))
+	if err != nil || len(urls) == 0 {
+		return StoredRequest{}, err
+	}
+	ttl, err := redis.Int64(rconn.Do("PTTL", messageKey))
+	if err != nil || ttl <= 0 {
+		return StoredRequest{}, err
+	}
+	cid, err := redis.String(rconn.Do("GET", q.MessageChannelKey(mid)))
+	if err != nil && err != redis.ErrNil {
+		return StoredRequest{}, err
+	}
+	return StoredRequest{URLs: urls, ChannelID: cid, TTL: time.Duration(ttl) * time.Millisecond}, nil
+}
+
+func (s *RedisStore) SetRequest(q Queue, mid string, req StoredRequest) error {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	messageKey := q.MessageKey(mid)
+	channelKey := q.MessageChannelKey(mid)
+	ttl := int64(req.TTL / time.Millisecond)
+	rconn.Send("MULTI")
+	rconn.Send("DEL", messageKey, channelKey)
+	if len(req.URLs) > 0 && ttl > 0 {
+		rconn.Send("RPUSH", redis.Args{}.Add(messageKey).AddFlat(req.URLs)...)
+		rconn.Send("PEXPIRE", messageKey, ttl)
+		if req.ChannelID != "" {
+			rconn.Send("SET", channelKey, req.ChannelID, "PX", ttl)
+		}
+	}
+	_, err := rconn.Do("EXEC")
+	return err
+}
+
+func (s *RedisStore) DeleteRequest(q Queue, mid string) error {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	_, err := rconn.Do("DEL", q.MessageKey(mid), q.MessageChannelKey(mid))
+	return err
+}
+
+func (s *RedisStore) Subscribe(q Queue) {
+	s.Bus.Subscribe(q.StateKey())
+	s.Bus.Subscribe(q.ChannelKey())
+	s.Bus.Subscribe(KeyForServerSettings(q.GuildID))
+	s.Bus.Subscribe(q.ClipQueueKey())
+	s.Bus.Subscribe(q.AnnouncementQueueKey())
+	if q.BotID == "" {
+		s.Bus.Subscribe(KeyForServerStation(q.GuildID))
+		s.Bus.Subscribe(KeyForServerStationTrack(q.GuildID))
+	}
+}
+
+func (s *RedisStore) Unsubscribe(q Queue) {
+	s.Bus.Unsubscribe(q.StateKey())
+	s.Bus.Unsubscribe(q.ChannelKey())
+	s.Bus.Unsubscribe(KeyForServerSettings(q.GuildID))
+	s.Bus.Unsubscribe(q.ClipQueueKey())
+	s.Bus.Unsubscribe(q.AnnouncementQueueKey())
+	if q.BotID == "" {
+		s.Bus.Unsubscribe(KeyForServerStation(q.GuildID))
+		s.Bus.Unsubscribe(KeyForServerStationTrack(q.GuildID))
+	}
+}
+
+func (s *RedisStore) SubscribePlaylist(q Queue) {
+	s.Bus.Subscribe(q.PlaylistKey())
+	s.Bus.Subscribe(q.NowPlayingKey())
+}
+
+func (s *RedisStore) UnsubscribePlaylist(q Queue) {
+	s.Bus.Unsubscribe(q.PlaylistKey())
+	s.Bus.Unsubscribe(q.NowPlayingKey())
+}
+
+// Watch starts watching the keys subscribed to so far, over the bus.
+func (s *RedisStore) Watch(ctx context.Context) (<-chan string, error) {
+	keys, err := s.Bus.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	gids := make(chan string)
+	go func() {
+		defer close(gids)
+
+		for {
+			select {
+			case key, ok := <-keys:
+				if !ok {
+					return
+				}
+				select {
+				case gids <- GIDFromKey(key):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return gids, nil
+}
+
+func (s *RedisStore) get(key string) (string, error) {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	v, err := redis.String(rconn.Do("GET", key))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return v, err
+}
+
+func (s *RedisStore) set(key, value string) error {
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	_, err := rconn.Do("SET", key, value)
+	return err
+}
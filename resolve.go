@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/sencrash/hiqty/media"
+	neturl "net/url"
+	"sort"
+)
+
+// A ResolveReport describes what became of a URL, for `hiqty resolve`.
+type ResolveReport struct {
+	URL         string          `json:"url"`
+	Unshortened string          `json:"unshortened,omitempty"` // Where a shortened URL led, if anywhere else
+	SniffedBy   []string        `json:"sniffed_by"`            // Services interested in it; the first one resolves it
+	Error       string          `json:"error,omitempty"`
+	Tracks      []ResolvedTrack `json:"tracks"`
+}
+
+// A ResolvedTrack is a track a URL resolved to.
+type ResolvedTrack struct {
+	Service   string          `json:"service"`
+	Info      media.TrackInfo `json:"info"`
+	Playable  bool            `json:"playable"`
+	Reason    string          `json:"reason,omitempty"` // Why it's not playable
+	StreamURL string          `json:"stream_url,omitempty"`
+}
+
+// ResolveForReport resolves a URL like ResolveURL, but without touching Redis, and reporting on
+// every step along the way.
+func ResolveForReport(url string) ResolveReport {
+	report := ResolveReport{URL: url, SniffedBy: []string{}, Tracks: []ResolvedTrack{}}
+	u, err := neturl.Parse(url)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	if uu := UnshortenURL(u); uu.String() != u.String() {
+		report.Unshortened = uu.String()
+		u = uu
+	}
+
+	svcs := media.Services()
+	sids := []string{}
+	for sid, svc := range svcs {
+		if svc.Sniff(u) {
+			sids = append(sids, sid)
+		}
+	}
+	sort.Strings(sids)
+	report.SniffedBy = sids
+	if len(sids) == 0 {
+		return report
+	}
+
+	svc := svcs[sids[0]]
+	tracks, err := svc.Resolve(u)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	for _, track := range tracks {
+		rt := ResolvedTrack{Service: sids[0], Info: track.GetInfo()}
+		rt.Playable, rt.Reason = track.GetPlayable()
+		if req, err := svc.BuildMediaRequest(track); err == nil {
+			rt.StreamURL = req.URL.String()
+		} else if rt.Reason == "" {
+			rt.Reason = "couldn't build media request: " + err.Error()
+		}
+		report.Tracks = append(report.Tracks, rt)
+	}
+	return report
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestResolveForReportUnrecognized(t *testing.T) {
+	report := ResolveForReport("https://example.com/not-a-track")
+	assert.Equal(t, "https://example.com/not-a-track", report.URL)
+	assert.Equal(t, "", report.Unshortened)
+	assert.Empty(t, report.SniffedBy)
+	assert.Empty(t, report.Tracks)
+	assert.Equal(t, "", report.Error)
+}
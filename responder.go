@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/gomodule/redigo/redis"
 	"github.com/mvdan/xurls"
+	"github.com/pkg/errors"
 	"github.com/sencrash/hiqty/media"
-	neturl "net/url"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"strings"
+	"sync"
+	"time"
 )
 
 // The Responder subsystem responds to user commands in chat rooms, and dispatches commands. It's
@@ -19,9 +23,16 @@ import (
 type Responder struct {
 	Session *discordgo.Session
 	Pool    *redis.Pool
+	Store   Store
+	Linked  bool     // Whether the session belongs to a linked bot, with its own queues
+	Owners  []string // User IDs of the bot's owners, who can use owner commands
+	URL     string   // Public URL of the HTTP server, if any, to link to status pages on
+	TTS     bool     // Whether players can speak announcements; see --tts
 
 	mentionByUsername string // <@USER_SNOWFLAKE_ID>
 	mentionByNickname string // <@!USER_SNOWFLAKE_ID>
+
+	cache RESTCache // Whatever had to be fetched over REST
 }
 
 // Run runs the responder. When the context is terminated, cleanly detach from the session to allow
@@ -29,7 +40,16 @@ type Responder struct {
 func (r *Responder) Run(ctx context.Context) {
 	// Registering a handler returns a function that unregisters it.
 	defer r.Session.AddHandler(r.HandleReady)()
+	defer r.Session.AddHandler(r.HandleGuildCreate)()
 	defer r.Session.AddHandler(r.HandleMessageCreate)()
+	defer r.Session.AddHandler(r.HandleMessageUpdate)()
+	defer r.Session.AddHandler(r.HandleMessageDelete)()
+	defer r.Session.AddHandler(r.HandleVoiceStateUpdate)()
+	defer r.Session.AddHandler(r.HandleMessageReactionAdd)()
+	defer r.Session.AddHandler(r.HandleMessageReactionRemove)()
+	for _, h := range r.cache.Handlers() {
+		defer r.Session.AddHandler(h)()
+	}
 
 	// Wait for the context to terminate.
 	<-ctx.Done()
@@ -42,17 +62,23 @@ func (r *Responder) HandleReady(_ *discordgo.Session, e *discordgo.Ready) {
 	r.mentionByNickname = fmt.Sprintf("<@!%s>", e.User.ID)
 }
 
+// HandleGuildCreate records the sizes of guilds the bot is in, for usage statistics.
+func (r *Responder) HandleGuildCreate(_ *discordgo.Session, g *discordgo.GuildCreate) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	RecordGuildSize(rconn, g.ID, g.MemberCount)
+}
+
 // HandleMessageCreate handles incoming messages.
 func (r *Responder) HandleMessageCreate(_ *discordgo.Session, msg *discordgo.MessageCreate) {
-	// Having to make a REST call for the channel info should be an exceedingly rare case, but it
-	// is technically possible to receive messages before guild info is sent out.
-	channel, err := r.Session.State.Channel(msg.ChannelID)
+	defer ReportPanic(ResponderLog, "Responder", log.Fields{"cid": msg.ChannelID, "mid": msg.ID})
+	received := time.Now()
+
+	channel, err := r.channel(msg.ChannelID)
 	if err != nil {
-		channel, err = r.Session.Channel(msg.ChannelID)
-		if err != nil {
-			log.WithError(err).Error("Couldn't get channel info")
-			return
-		}
+		ResponderLog.WithError(err).Error("Couldn't get channel info")
+		return
 	}
 
 	// Private calls can't have bots in them (yet?), as they're closely tied to the friend system,
@@ -63,16 +89,43 @@ func (r *Responder) HandleMessageCreate(_ *discordgo.Session, msg *discordgo.Mes
 	}
 
 	// If it's public, we only care about mentions!
-	if !strings.HasPrefix(msg.Content, r.mentionByUsername) && !strings.HasPrefix(msg.Content, r.mentionByNickname) {
+	var content string
+	switch {
+	case strings.HasPrefix(msg.Content, r.mentionByUsername):
+		content = strings.TrimPrefix(msg.Content, r.mentionByUsername)
+	case strings.HasPrefix(msg.Content, r.mentionByNickname):
+		content = strings.TrimPrefix(msg.Content, r.mentionByNickname)
+	default:
+		return
+	}
+
+	// Instances sharing the bot's token all see the message, and only one should handle it.
+	if !r.claim(r.queue(channel.GuildID), msg.ID) {
+		return
+	}
+
+	// Mentions starting with a command name are commands; anything else is a track request.
+	if fields := strings.Fields(content); len(fields) > 0 {
+		if cmd := Commands[strings.ToLower(fields[0])]; cmd != nil {
+			cmd(r, msg, channel, fields[1:])
+			return
+		}
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	// While a DJ has the queue locked, nobody else can request anything.
+	if r.djLocked(rconn, r.queue(channel.GuildID), msg.ChannelID, msg.Author.ID) {
 		return
 	}
 
 	// Get extended info on the guild.
 	guild, err := r.Session.State.Guild(channel.GuildID)
 	if err != nil {
-		guild, err = r.Session.Guild(channel.GuildID)
+		guild, err = r.cache.Guild(channel.GuildID, r.Session.Guild)
 		if err != nil {
-			log.WithError(err).Error("Couldn't get guild info")
+			ResponderLog.WithError(err).Error("Couldn't get guild info")
 			return
 		}
 	}
@@ -85,86 +138,474 @@ func (r *Responder) HandleMessageCreate(_ *discordgo.Session, msg *discordgo.Mes
 		}
 		voiceState = vs
 	}
+	urls := xurls.Strict().FindAllString(msg.Content, -1)
 	if voiceState == nil {
-		r.Session.ChannelMessageSend(msg.ChannelID, fmt.Sprintf("<@!%s> You must be in a voice channel to request tracks.", msg.Author.ID))
+		r.deferRequest(rconn, channel, msg, urls, received)
 		return
 	}
 
-	// Find all URLs in the message.
-	urls := xurls.Strict().FindAllString(msg.Content, -1)
-	tracks := []media.Track{}
-	for _, url := range urls {
-		u, err := neturl.Parse(url)
-		if err != nil {
-			log.WithError(err).WithField("url", url).Error("Couldn't parse URL?")
-			continue
-		}
+	tracks := r.request(rconn, channel, msg.Message, voiceState.ChannelID, urls, received)
 
-		for sid, svc := range media.Services {
-			if !svc.Sniff(u) {
-				continue
-			}
+	// Visually report queued tracks.
+	r.announce(rconn, channel.GuildID, msg.ChannelID, channel.NSFW, msg.Author, tracks)
+}
 
-			log.WithFields(log.Fields{"service": sid, "url": url}).Debug("Smell test passed")
-			ts, err := svc.Resolve(u)
-			if err != nil {
-				log.WithError(err).Error("Couldn't resolve track")
-				r.Session.ChannelMessageSend(msg.ChannelID, fmt.Sprintf("<@!%s> Error: %s", msg.Author.ID, err.Error()))
-				continue
-			}
+// request resolves the URLs in a message, and queues them in a voice channel, returning the tracks
+// that were queued.
+func (r *Responder) request(rconn redis.Conn, channel *discordgo.Channel, msg *discordgo.Message, vcid string, urls []string, received time.Time) []media.Track {
+	ctx, span := startRequestSpan(channel.GuildID, received)
+	defer span.End()
+
+	// Figure out what the URLs point to.
+	resolved := r.resolveURLs(ctx, channel.ID, msg.Author.ID, urls, received)
+	if len(resolved) == 0 {
+		span.SetStatus(codes.Error, "nothing could be resolved")
+		return nil
+	}
 
-			for _, track := range ts {
+	q := r.queue(channel.GuildID)
+
+	// Push tracks onto the playlist.
+	_, enqueueSpan := tracer().Start(ctx, LatencyEnqueue)
+	playlist := PlaylistQueue(rconn, q, vcid)
+	tracks := []media.Track{}
+	for _, res := range resolved {
+		skipped := r.enqueue(rconn, playlist, msg.ID, channel.NSFW, res)
+		enqueueSpan.AddEvent("enqueued", trace.WithAttributes(
+			attribute.String("url", res.URL),
+			attribute.Int("tracks", len(res.Tracks)-len(skipped)),
+			attribute.Int("skipped", len(skipped)),
+		))
+
+		// Single tracks that can't be played are announced with the reason; playlists would bury
+		// the tracks that were queued in them, so their skipped tracks are summed up instead.
+		if len(res.Tracks) == 1 || len(skipped) == 0 {
+			tracks = append(tracks, res.Tracks...)
+			continue
+		}
+		r.reply(channel.ID, msg.Author.ID, skippedSummary(res.URL, len(res.Tracks), skipped))
+		for _, track := range res.Tracks {
+			if !isSkipped(skipped, track) {
 				tracks = append(tracks, track)
 			}
-			break
 		}
 	}
+	enqueueSpan.End()
+
+	// Remember which URLs were requested, so edits to the message can be diffed against them.
+	req := StoredRequest{URLs: urls, ChannelID: vcid, TTL: MessageEditWindow - time.Since(received)}
+	if err := r.Store.SetRequest(q, msg.ID, req); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't record requested URLs")
+	}
+
+	r.activate(rconn, q, channel.ID, vcid)
+	if len(tracks) > 0 {
+		r.openVote(rconn, channel.GuildID, channel.ID, msg.ID, vcid)
+	}
+	return tracks
+}
+
+// activate has a queue's bot play in a voice channel, and remembers which text channel to report
+// playback errors in.
+func (r *Responder) activate(rconn redis.Conn, q Queue, cid, vcid string) {
+	if err := r.Store.SetChannel(q, vcid); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't set active channel")
+	}
+	if _, err := rconn.Do("SET", q.TextChannelKey(), cid); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't set text channel")
+	}
+	if err := r.Store.SetState(q, StatePlaying); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't set player state")
+	}
+}
+
+// deferRequest handles a request from someone who isn't in a voice channel: if the guild has
+// wait-for-voice on, it's held until they join one (see HandleVoiceStateUpdate); otherwise, or if
+// there's nothing to request, they're told to join one first.
+func (r *Responder) deferRequest(rconn redis.Conn, channel *discordgo.Channel, msg *discordgo.MessageCreate, urls []string, received time.Time) {
+	data := r.templateData(channel.GuildID, msg.Author)
+	wait, err := ReadBoolSetting(rconn, channel.GuildID, SettingWaitForVoice)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't read setting")
+	}
+	if !wait || len(urls) == 0 {
+		r.replyTemplate(rconn, msg.ChannelID, "not-in-voice", data)
+		return
+	}
+
+	req := DeferredRequest{MessageID: msg.ID, ChannelID: msg.ChannelID, NSFW: channel.NSFW, URLs: urls, Received: received}
+	if err := DeferRequest(rconn, r.queue(channel.GuildID), msg.Author.ID, req, DeferredRequestTimeout); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't hold request")
+		return
+	}
+	r.replyTemplate(rconn, msg.ChannelID, "waiting-for-voice", data)
+}
+
+// HandleVoiceStateUpdate queues requests that were held for people to join a voice channel (see
+// the wait-for-voice setting), once they do.
+func (r *Responder) HandleVoiceStateUpdate(_ *discordgo.Session, vs *discordgo.VoiceStateUpdate) {
+	defer ReportPanic(ResponderLog, "Responder", log.Fields{"gid": vs.GuildID, "cid": vs.ChannelID})
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	r.releaseDJ(rconn, vs.GuildID, vs.UserID, vs.ChannelID)
+	if vs.ChannelID == "" {
+		return
+	}
+
+	q := r.queue(vs.GuildID)
+	req, err := TakeDeferredRequest(rconn, q, vs.UserID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't take held request")
+		return
+	}
+	if req == nil {
+		return
+	}
+
+	channel, err := r.channel(req.ChannelID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get channel info")
+		return
+	}
+	user, err := r.Session.User(vs.UserID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get user info")
+		return
+	}
+	if r.djLocked(rconn, q, req.ChannelID, vs.UserID) {
+		return
+	}
+
+	msg := &discordgo.Message{ID: req.MessageID, ChannelID: req.ChannelID, Author: user}
+	tracks := r.request(rconn, channel, msg, vs.ChannelID, req.URLs, req.Received)
 	if len(tracks) == 0 {
 		return
 	}
 
-	// Update Redis state.
+	data := r.templateData(vs.GuildID, user)
+	data.Added = len(tracks)
+	r.replyTemplate(rconn, req.ChannelID, "deferred-queued", data)
+	r.announce(rconn, vs.GuildID, req.ChannelID, channel.NSFW, user, tracks)
+}
+
+// HandleMessageUpdate handles edited messages. If the links in a recent request were changed, the
+// tracks that haven't played yet are adjusted to match.
+func (r *Responder) HandleMessageUpdate(_ *discordgo.Session, msg *discordgo.MessageUpdate) {
+	defer ReportPanic(ResponderLog, "Responder", log.Fields{"cid": msg.ChannelID, "mid": msg.ID})
+	received := time.Now()
+
+	// Updates that only attach link previews carry neither content nor an author.
+	if msg.Author == nil || msg.Content == "" {
+		return
+	}
+
+	channel, err := r.channel(msg.ChannelID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get channel info")
+		return
+	}
+
 	rconn := r.Pool.Get()
 	defer rconn.Close()
 
-	stateKey := KeyForServerState(channel.GuildID)
-	channelKey := KeyForServerChannel(channel.GuildID)
-	playlistKey := KeyForServerPlaylist(channel.GuildID)
+	// Linked bots see each other's requests being edited; only the one that queued it should care.
+	q := r.queue(channel.GuildID)
 
-	// Push tracks onto the playlist.
-	for _, track := range tracks {
-		// Skip unplayable tracks.
-		if ok, _ := track.GetPlayable(); !ok {
-			continue
+	// If there are no requested URLs on record, it either wasn't a request, or it's too late.
+	req, err := r.Store.Request(q, msg.ID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get requested URLs")
+		return
+	}
+	if len(req.URLs) == 0 {
+		return
+	}
+	if !r.claim(q, msg.ID+":"+string(msg.EditedTimestamp)) {
+		return
+	}
+	if r.djLocked(rconn, q, msg.ChannelID, msg.Author.ID) {
+		return
+	}
+
+	newURLs := xurls.Strict().FindAllString(msg.Content, -1)
+	added, removed := diffURLs(req.URLs, newURLs)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	playlist := r.requestPlaylist(rconn, q, req)
+	numRemoved, err := r.Store.Remove(playlist, func(envelope TrackEnvelope) bool {
+		return envelope.MessageID == msg.ID && containsString(removed, envelope.URL)
+	})
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't remove from playlist")
+	}
+	ctx, span := startRequestSpan(channel.GuildID, received)
+	defer span.End()
+	resolved := r.resolveURLs(ctx, msg.ChannelID, msg.Author.ID, added, received)
+	_, enqueueSpan := tracer().Start(ctx, LatencyEnqueue)
+	tracks := []media.Track{}
+	for _, res := range resolved {
+		r.enqueue(rconn, playlist, msg.ID, channel.NSFW, res)
+		tracks = append(tracks, res.Tracks...)
+	}
+	enqueueSpan.End()
+
+	// Replace the record of requested URLs, keeping the original expiry.
+	req.URLs = newURLs
+	if err := r.Store.SetRequest(q, msg.ID, req); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't update requested URLs")
+	}
+
+	if len(tracks) > 0 {
+		if err := r.Store.SetState(q, StatePlaying); err != nil {
+			ResponderLog.WithError(err).Error("Couldn't set player state")
 		}
+	}
+
+	data := r.templateData(channel.GuildID, msg.Author)
+	data.Added, data.Removed = len(tracks), numRemoved
+	r.replyTemplate(rconn, msg.ChannelID, "request-updated", data)
+	r.announce(rconn, channel.GuildID, msg.ChannelID, channel.NSFW, msg.Author, tracks)
+}
+
+// HandleMessageDelete handles deleted messages. If the guild has opted into it, deleting a request
+// revokes the tracks it queued that haven't played yet.
+func (r *Responder) HandleMessageDelete(_ *discordgo.Session, msg *discordgo.MessageDelete) {
+	defer ReportPanic(ResponderLog, "Responder", log.Fields{"cid": msg.ChannelID, "mid": msg.ID})
+	channel, err := r.channel(msg.ChannelID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get channel info")
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	revoke, err := ReadBoolSetting(rconn, channel.GuildID, SettingRevokeOnDelete)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't read setting")
+		return
+	}
+	if !revoke {
+		return
+	}
+
+	// Who posted a deleted message isn't known, so while a DJ has the queue locked, it's left as it is.
+	q := r.queue(channel.GuildID)
+	if holder, err := DJLock(rconn, q); err != nil || holder != "" {
+		return
+	}
 
-		// Wrap tracks in envelopes designating which service they belong to.
-		data, err := json.Marshal(TrackEnvelope{track.GetServiceID(), track})
+	req, err := r.Store.Request(q, msg.ID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get requested URLs")
+	}
+	playlist := r.requestPlaylist(rconn, q, req)
+	if err := r.Store.DeleteRequest(q, msg.ID); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't delete requested URLs")
+	}
+
+	n, err := r.Store.Remove(playlist, func(envelope TrackEnvelope) bool {
+		return envelope.MessageID == msg.ID
+	})
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't remove from playlist")
+	}
+	if n > 0 {
+		data := r.templateData(channel.GuildID, nil)
+		data.Removed = n
+		if text, err := RenderTemplate(rconn, channel.GuildID, "request-revoked", data); err != nil {
+			ResponderLog.WithError(err).Error("Couldn't render template")
+		} else if text != "" {
+			r.Session.ChannelMessageSend(msg.ChannelID, text)
+		}
+	}
+}
+
+// reply sends a message mentioning a user.
+func (r *Responder) reply(cid, uid, text string) {
+	r.Session.ChannelMessageSend(cid, fmt.Sprintf("<@!%s> %s", uid, text))
+}
+
+// hasPermission returns whether a user has a permission in a channel.
+func (r *Responder) hasPermission(uid, cid string, perm int) bool {
+	perms, err := r.Session.State.UserChannelPermissions(uid, cid)
+	if err != nil {
+		var gid string
+		if channel, err := r.channel(cid); err == nil {
+			gid = channel.GuildID
+		}
+		perms, err = r.cache.Permissions(uid, cid, gid, r.Session.UserChannelPermissions)
 		if err != nil {
-			log.WithError(err).Error("Couldn't marshal envelope")
-			return
+			ResponderLog.WithError(err).Error("Couldn't get permissions")
+			return false
 		}
+	}
+	return perms&perm == perm
+}
 
-		// Push the track onto the playlist.
-		if _, err := rconn.Do("RPUSH", playlistKey, data); err != nil {
-			log.WithError(err).Error("Couldn't push to playlist")
+// templateData returns the data templates get about a guild and user (if any).
+func (r *Responder) templateData(gid string, user *discordgo.User) TemplateData {
+	data := TemplateData{Guild: TemplateGuild{ID: gid}}
+	if guild, err := r.Session.State.Guild(gid); err == nil {
+		data.Guild.Name = guild.Name
+	}
+	if user != nil {
+		data.User = TemplateUser{ID: user.ID, Name: user.Username, Mention: user.Mention()}
+	}
+	return data
+}
+
+// replyTemplate replies to a user with a rendered template, unless it renders to nothing.
+func (r *Responder) replyTemplate(rconn redis.Conn, cid, name string, data TemplateData) {
+	text, err := RenderTemplate(rconn, data.Guild.ID, name, data)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't render template")
+		return
+	}
+	if text != "" {
+		r.reply(cid, data.User.ID, text)
+	}
+}
+
+// enqueue pushes the playable tracks a URL resolved to onto a playlist, on behalf of a message,
+// returning the ones that were skipped.
+func (r *Responder) enqueue(rconn redis.Conn, q Queue, mid string, nsfw bool, res resolvedURL) []SkippedTrack {
+	envelopes, skipped := PlayableEnvelopes(rconn, q.GuildID, mid, nsfw, res)
+	if err := r.Store.Push(q, envelopes...); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't push to playlist")
+	}
+	return skipped
+}
+
+// requestPlaylist returns the queue a request went into, falling back to the one for the bot's
+// active channel if it's no longer on record.
+func (r *Responder) requestPlaylist(rconn redis.Conn, q Queue, req StoredRequest) Queue {
+	cid := req.ChannelID
+	if cid == "" {
+		var err error
+		if cid, err = r.Store.Channel(q); err != nil {
+			ResponderLog.WithError(err).Error("Couldn't get active channel")
 		}
 	}
+	return PlaylistQueue(rconn, q, cid)
+}
+
+// claim marks an event about a message as handled, returning false if it already was, and shouldn't
+// be handled again. If that can't be checked, it's handled anyway.
+func (r *Responder) claim(q Queue, id string) bool {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	ok, err := ClaimMessage(rconn, q, id)
+	if err != nil {
+		ResponderLog.WithError(err).WithField("mid", id).Warn("Couldn't check if message was handled")
+		return true
+	}
+	if !ok {
+		ResponderLog.WithField("mid", id).Debug("Ignoring message that's already been handled")
+	}
+	return ok
+}
 
-	// Set the bot's active voice channel.
-	if _, err := rconn.Do("SET", channelKey, voiceState.ChannelID); err != nil {
-		log.WithError(err).Error("Couldn't set active channel")
+// queue returns the queue requests made to the responder's bot go into.
+func (r *Responder) queue(gid string) Queue {
+	return SessionQueue(r.Session, gid, r.Linked)
+}
+
+// channel returns info about a channel.
+func (r *Responder) channel(cid string) (*discordgo.Channel, error) {
+	// Having to make a REST call for the channel info should be an exceedingly rare case, but it
+	// is technically possible to receive messages before guild info is sent out. In case it's
+	// not sent out for a while, hold on to what we get.
+	channel, err := r.Session.State.Channel(cid)
+	if err != nil {
+		channel, err = r.cache.Channel(cid, r.Session.Channel)
 	}
+	return channel, err
+}
 
-	// Set the bot's player state.
-	if _, err := rconn.Do("SET", stateKey, StatePlaying); err != nil {
-		log.WithError(err).Error("Couldn't set player state")
+// resolveURLs resolves URLs into tracks, reporting errors to the requesting user. URLs that no
+// service is interested in, or that resolve to nothing, are omitted from the result. URLs are
+// resolved concurrently, but the result is in the same order as the input.
+func (r *Responder) resolveURLs(ctx context.Context, cid, uid string, urls []string, received time.Time) []resolvedURL {
+	type result struct {
+		Tracks   []media.Track
+		Err      error
+		Resolved time.Time
 	}
+	results := make([]result, len(urls))
 
-	// Visually report queued tracks.
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, MaxConcurrentResolves)
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			rconn := r.Pool.Get()
+			defer rconn.Close()
+
+			_, span := tracer().Start(ctx, LatencyResolve,
+				trace.WithTimestamp(received),
+				trace.WithAttributes(attribute.String("url", url)),
+			)
+			tracks, err := ResolveURL(rconn, url)
+			results[i] = result{tracks, err, time.Now()}
+			endSpan(span, err)
+		}(i, url)
+	}
+	wg.Wait()
+
+	resolved := []resolvedURL{}
+	for i, res := range results {
+		if res.Err != nil {
+			msg := friendlyError(res.Err)
+			if len(urls) > 1 {
+				msg = fmt.Sprintf("<%s>: %s", urls[i], msg)
+			}
+			r.reply(cid, uid, msg)
+			continue
+		}
+		if len(res.Tracks) > 0 {
+			resolved = append(resolved, resolvedURL{
+				URL:       urls[i],
+				Tracks:    res.Tracks,
+				Timing:    RequestTiming{Trace: injectTrace(ctx), Received: received, Resolved: res.Resolved},
+				Requester: uid,
+			})
+		}
+	}
+	return resolved
+}
+
+// announce visually reports queued tracks. More than a handful at once are summed up in a single
+// embed instead, so queueing a big playlist doesn't run into rate limits. Requesters who'd rather
+// have less, per their announcements preference, get a line per track, or nothing but errors.
+func (r *Responder) announce(rconn redis.Conn, gid, cid string, nsfw bool, requester *discordgo.User, tracks []media.Track) {
+	switch r.preference(rconn, requester, PreferenceAnnouncements) {
+	case AnnouncementsBrief:
+		r.announceBrief(rconn, gid, cid, nsfw, requester, tracks, false)
+		return
+	case AnnouncementsOff:
+		r.announceBrief(rconn, gid, cid, nsfw, requester, tracks, true)
+		return
+	}
+	if len(tracks) > MaxAnnouncedTracks {
+		r.announceBatch(rconn, gid, cid, nsfw, requester, tracks)
+		return
+	}
 	for _, track := range tracks {
+		svc := media.Lookup(track.GetServiceID())
+		if svc == nil {
+			continue // Unregistered by a reload since it was resolved
+		}
 		info := track.GetInfo()
-		attribution := media.Services[track.GetServiceID()].Attribution()
+		attribution := svc.Attribution()
 		embed := &discordgo.MessageEmbed{
 			Color:       0x99ff99,
 			Title:       info.Title,
@@ -182,12 +623,232 @@ func (r *Responder) HandleMessageCreate(_ *discordgo.Session, msg *discordgo.Mes
 			},
 		}
 
-		playable, reason := track.GetPlayable()
+		if info.Duration > 0 {
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Duration", Value: formatDuration(info.Duration), Inline: true})
+		}
+		if info.Genre != "" {
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Genre", Value: info.Genre, Inline: true})
+		}
+		if info.License.Name != "" {
+			license := info.License.Name
+			if info.License.URL != "" {
+				license = fmt.Sprintf("[%s](%s)", info.License.Name, info.License.URL)
+			}
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "License", Value: license, Inline: true})
+		}
+
+		switch {
+		case info.AgeRestricted:
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Rating", Value: "Age-restricted", Inline: true})
+		case info.Explicit:
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Rating", Value: "Explicit", Inline: true})
+		}
+
+		playable, reason := Playable(rconn, gid, nsfw, track)
 		if !playable {
 			embed.Color = 0xff3333
 			embed.Footer = &discordgo.MessageEmbedFooter{Text: "Error: " + reason}
 		}
 
-		r.Session.ChannelMessageSendEmbed(msg.ChannelID, embed)
+		data := r.templateData(gid, requester)
+		data.Track, data.Service = info, track.GetServiceID()
+		content, err := RenderTemplate(rconn, gid, "announce", data)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't render template")
+		}
+
+		r.Session.ChannelMessageSendComplex(cid, &discordgo.MessageSend{Content: content, Embed: embed})
+	}
+}
+
+// announceBatch reports a batch of queued tracks in a single embed.
+func (r *Responder) announceBatch(rconn redis.Conn, gid, cid string, nsfw bool, requester *discordgo.User, tracks []media.Track) {
+	queued := []media.Track{}
+	for _, track := range tracks {
+		if ok, _ := Playable(rconn, gid, nsfw, track); ok {
+			queued = append(queued, track)
+		}
+	}
+
+	data := r.templateData(gid, requester)
+	data.Added = len(queued)
+	content, err := RenderTemplate(rconn, gid, "announce-batch", data)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't render template")
+	}
+
+	embed := batchEmbed(queued, len(tracks)-len(queued))
+	r.Session.ChannelMessageSendComplex(cid, &discordgo.MessageSend{Content: content, Embed: embed})
+}
+
+// announceBrief reports queued tracks in a reply, rather than embeds; with onlyErrors, only the ones
+// that couldn't be queued are reported, if any.
+func (r *Responder) announceBrief(rconn redis.Conn, gid, cid string, nsfw bool, requester *discordgo.User, tracks []media.Track, onlyErrors bool) {
+	queued := []media.Track{}
+	skipped := []SkippedTrack{}
+	for _, track := range tracks {
+		if ok, reason := Playable(rconn, gid, nsfw, track); ok {
+			queued = append(queued, track)
+		} else {
+			skipped = append(skipped, SkippedTrack{track, reason})
+		}
+	}
+	if text := briefAnnouncement(queued, skipped, onlyErrors); text != "" {
+		r.reply(cid, requester.ID, text)
+	}
+}
+
+// briefAnnouncement reports queued tracks in a line each, up to a handful, and the ones that
+// couldn't be queued with the reason why.
+func briefAnnouncement(queued []media.Track, skipped []SkippedTrack, onlyErrors bool) string {
+	lines := []string{}
+	if !onlyErrors {
+		for i, track := range queued {
+			if i >= MaxAnnouncedTracks {
+				lines = append(lines, fmt.Sprintf("...and %d more.", len(queued)-MaxAnnouncedTracks))
+				break
+			}
+			info := track.GetInfo()
+			line := fmt.Sprintf("Queued **%s**", info.Title)
+			if info.Duration > 0 {
+				line += " (" + formatDuration(info.Duration) + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+	for _, s := range skipped {
+		lines = append(lines, fmt.Sprintf("Can't play **%s**: %s", s.Track.GetInfo().Title, s.Reason))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// batchEmbed sums up a batch of queued tracks: the first few, and their total duration. Tracks
+// that couldn't be queued are only counted.
+func batchEmbed(tracks []media.Track, unplayable int) *discordgo.MessageEmbed {
+	lines := []string{}
+	var total time.Duration
+	unknown := false
+	for i, track := range tracks {
+		info := track.GetInfo()
+		total += info.Duration
+		if info.Duration == 0 {
+			unknown = true
+		}
+		if i >= MaxAnnouncedTracks {
+			continue
+		}
+		line := fmt.Sprintf("`%d.` [%s](%s)", i+1, info.Title, info.URL)
+		if info.User.Name != "" {
+			line += " - " + info.User.Name
+		}
+		if info.Duration > 0 {
+			line += " (" + formatDuration(info.Duration) + ")"
+		}
+		lines = append(lines, line)
+	}
+	if len(tracks) > MaxAnnouncedTracks {
+		lines = append(lines, fmt.Sprintf("...and %d more.", len(tracks)-MaxAnnouncedTracks))
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Color:       0x99ff99,
+		Title:       fmt.Sprintf("Queued %d tracks", len(tracks)),
+		Description: strings.Join(lines, "\n"),
+	}
+	if total > 0 {
+		// Live streams and the like have no duration, so it's at least this long.
+		duration := formatDuration(total)
+		if unknown {
+			duration += "+"
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Total duration", Value: duration, Inline: true})
+	}
+	if unplayable > 0 {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("%d more couldn't be queued.", unplayable)}
+	}
+	return embed
+}
+
+// skippedSummary sums up the tracks from a playlist that couldn't be queued, grouped by reason.
+func skippedSummary(url string, total int, skipped []SkippedTrack) string {
+	reasons := []string{}
+	titles := map[string][]string{}
+	for _, s := range skipped {
+		if _, ok := titles[s.Reason]; !ok {
+			reasons = append(reasons, s.Reason)
+		}
+		titles[s.Reason] = append(titles[s.Reason], s.Track.GetInfo().Title)
+	}
+
+	lines := []string{fmt.Sprintf("Queued %d of %d tracks from <%s>; skipped %d:", total-len(skipped), total, url, len(skipped))}
+	for _, reason := range reasons {
+		ts := titles[reason]
+		line := fmt.Sprintf("%s (%d): %s", strings.TrimSuffix(reason, "."), len(ts), strings.Join(ts, ", "))
+		if runes := []rune(line); len(runes) > MaxSkippedSummaryLine {
+			line = string(runes[:MaxSkippedSummaryLine-3]) + "..."
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isSkipped returns whether a track is among the skipped ones.
+func isSkipped(skipped []SkippedTrack, track media.Track) bool {
+	for _, s := range skipped {
+		if s.Track == track {
+			return true
+		}
+	}
+	return false
+}
+
+// friendlyError returns a message explaining an error from a service to a user.
+func friendlyError(err error) string {
+	switch errors.Cause(err) {
+	case media.ErrNotFound:
+		return "I couldn't find anything at that link."
+	case media.ErrPrivate:
+		return "That's private, so I can't play it."
+	case media.ErrGeoBlocked:
+		return "That isn't available in the region I'm in."
+	case media.ErrRateLimited:
+		return "I'm making too many requests to that service right now; try again in a bit."
+	case media.ErrUnavailable:
+		return "That service isn't working right now, so I can't take links from it; see `status` for details."
+	}
+	return "Error: " + err.Error()
+}
+
+// formatDuration formats a duration as a timestamp, eg. 3:07 or 1:02:03.
+func formatDuration(d time.Duration) string {
+	secs := int64(d / time.Second)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// diffURLs returns the URLs that were added and removed between two lists.
+func diffURLs(before, after []string) (added, removed []string) {
+	for _, u := range after {
+		if !containsString(before, u) && !containsString(added, u) {
+			added = append(added, u)
+		}
+	}
+	for _, u := range before {
+		if !containsString(after, u) && !containsString(removed, u) {
+			removed = append(removed, u)
+		}
+	}
+	return added, removed
+}
+
+// containsString returns whether a slice contains the given string.
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
 	}
+	return false
 }
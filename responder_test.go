@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sencrash/hiqty/media"
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffURLs(t *testing.T) {
+	added, removed := diffURLs([]string{"a", "b", "c"}, []string{"b", "d", "d"})
+	assert.Equal(t, []string{"d"}, added)
+	assert.Equal(t, []string{"a", "c"}, removed)
+}
+
+func TestDiffURLsUnchanged(t *testing.T) {
+	added, removed := diffURLs([]string{"a", "b"}, []string{"b", "a"})
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "0:07", formatDuration(7*time.Second))
+	assert.Equal(t, "3:07", formatDuration(187*time.Second+500*time.Millisecond))
+	assert.Equal(t, "1:02:03", formatDuration(time.Hour+2*time.Minute+3*time.Second))
+}
+
+func TestIsOwner(t *testing.T) {
+	r := &Responder{Owners: []string{"1", "2"}}
+	assert.True(t, r.isOwner("2"))
+	assert.False(t, r.isOwner("3"))
+	assert.False(t, (&Responder{}).isOwner(""))
+}
+
+func TestSkippedSummary(t *testing.T) {
+	a, b, c := &soundcloud.Track{Title: "A"}, &soundcloud.Track{Title: "B"}, &soundcloud.Track{Title: "C"}
+	skipped := []SkippedTrack{{a, "This track is private."}, {b, "Geo-blocked."}, {c, "This track is private."}}
+	assert.Equal(t, "Queued 22 of 25 tracks from <https://example.com>; skipped 3:\n"+
+		"This track is private (2): A, C\n"+
+		"Geo-blocked (1): B", skippedSummary("https://example.com", 25, skipped))
+
+	assert.True(t, isSkipped(skipped, b))
+	assert.False(t, isSkipped(skipped, &soundcloud.Track{Title: "B"}))
+}
+
+func TestBatchEmbed(t *testing.T) {
+	tracks := []media.Track{}
+	for i := 1; i <= 7; i++ {
+		tracks = append(tracks, &soundcloud.Track{Title: fmt.Sprintf("T%d", i), PermalinkURL: fmt.Sprintf("https://example.com/%d", i), Duration: 60000})
+	}
+	embed := batchEmbed(tracks, 2)
+	assert.Equal(t, "Queued 7 tracks", embed.Title)
+	assert.Equal(t, "`1.` [T1](https://example.com/1) (1:00)", strings.Split(embed.Description, "\n")[0])
+	assert.True(t, strings.HasSuffix(embed.Description, "\n...and 2 more."))
+	assert.Equal(t, "7:00", embed.Fields[0].Value)
+	assert.Equal(t, "2 more couldn't be queued.", embed.Footer.Text)
+
+	// Tracks without a duration make the total a lower bound.
+	embed = batchEmbed(append(tracks, &soundcloud.Track{Title: "Live"}), 0)
+	assert.Equal(t, "7:00+", embed.Fields[0].Value)
+	assert.Nil(t, embed.Footer)
+}
+
+func TestBriefAnnouncement(t *testing.T) {
+	queued := []media.Track{}
+	for i := 1; i <= 7; i++ {
+		queued = append(queued, &soundcloud.Track{Title: fmt.Sprintf("T%d", i), Duration: 60000})
+	}
+	skipped := []SkippedTrack{{&soundcloud.Track{Title: "X"}, "This track is private."}}
+
+	lines := strings.Split(briefAnnouncement(queued, skipped, false), "\n")
+	assert.Equal(t, "Queued **T1** (1:00)", lines[0])
+	assert.Equal(t, "...and 2 more.", lines[MaxAnnouncedTracks])
+	assert.Equal(t, "Can't play **X**: This track is private.", lines[len(lines)-1])
+
+	assert.Equal(t, "Can't play **X**: This track is private.", briefAnnouncement(queued, skipped, true))
+	assert.Equal(t, "", briefAnnouncement(queued, nil, true))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"sync"
+	"time"
+)
+
+// How long channel, guild and permission info fetched over REST is kept for, if no event about it
+// comes in first.
+const RESTCacheTTL = 5 * time.Minute
+
+// A RESTCache holds on to channel, guild and permission info the Responder had to fetch over REST,
+// because the session's state didn't have it. In busy guilds, the same lookups would otherwise be
+// made for every message, burning through rate limits. Entries are dropped when an event says
+// they've changed (see Handlers), or after RESTCacheTTL at the latest.
+//
+// Guilds fetched over REST never come with voice states, so there's nothing about those to keep
+// up to date; the state still has to know about a guild to follow anyone into a voice channel.
+//
+// The zero value is ready to use.
+type RESTCache struct {
+	TTL time.Duration // Defaults to RESTCacheTTL
+
+	channels map[string]restCacheEntry            // Keyed by channel ID
+	guilds   map[string]restCacheEntry            // Keyed by guild ID
+	perms    map[string]map[string]restCacheEntry // Keyed by channel ID, then user ID
+	mutex    sync.Mutex
+}
+
+type restCacheEntry struct {
+	value   interface{}
+	gid     string // The guild it belongs to, if any
+	expires time.Time
+}
+
+// Channel returns info about a channel, fetching it with fetch if it's not cached.
+func (c *RESTCache) Channel(cid string, fetch func(string) (*discordgo.Channel, error)) (*discordgo.Channel, error) {
+	if v, ok := c.get(c.channels, cid); ok {
+		return v.(*discordgo.Channel), nil
+	}
+	channel, err := fetch(cid)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.channels == nil {
+		c.channels = map[string]restCacheEntry{}
+	}
+	c.channels[cid] = c.entry(channel, channel.GuildID)
+	return channel, nil
+}
+
+// Guild returns info about a guild, fetching it with fetch if it's not cached.
+func (c *RESTCache) Guild(gid string, fetch func(string) (*discordgo.Guild, error)) (*discordgo.Guild, error) {
+	if v, ok := c.get(c.guilds, gid); ok {
+		return v.(*discordgo.Guild), nil
+	}
+	guild, err := fetch(gid)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.guilds == nil {
+		c.guilds = map[string]restCacheEntry{}
+	}
+	c.guilds[gid] = c.entry(guild, gid)
+	return guild, nil
+}
+
+// Permissions returns a user's permissions in a channel, fetching them with fetch if they're not
+// cached. The guild ID is used to drop them when the guild's roles or members change, and may be
+// empty if it's not known.
+func (c *RESTCache) Permissions(uid, cid, gid string, fetch func(string, string) (int, error)) (int, error) {
+	c.mutex.Lock()
+	e, ok := c.perms[cid][uid]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.value.(int), nil
+	}
+	perms, err := fetch(uid, cid)
+	if err != nil {
+		return 0, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.perms == nil {
+		c.perms = map[string]map[string]restCacheEntry{}
+	}
+	if c.perms[cid] == nil {
+		c.perms[cid] = map[string]restCacheEntry{}
+	}
+	c.perms[cid][uid] = c.entry(perms, gid)
+	return perms, nil
+}
+
+// Handlers returns event handlers that drop entries when they change, for registering on the
+// session the entries were fetched with.
+func (c *RESTCache) Handlers() []interface{} {
+	return []interface{}{
+		func(_ *discordgo.Session, e *discordgo.ChannelUpdate) { c.dropChannel(e.ID) },
+		func(_ *discordgo.Session, e *discordgo.ChannelDelete) { c.dropChannel(e.ID) },
+		func(_ *discordgo.Session, e *discordgo.GuildUpdate) { c.dropGuild(e.ID) },
+		func(_ *discordgo.Session, e *discordgo.GuildDelete) { c.dropGuild(e.ID) },
+		func(_ *discordgo.Session, e *discordgo.GuildRoleUpdate) { c.dropGuildPermissions(e.GuildID) },
+		func(_ *discordgo.Session, e *discordgo.GuildRoleDelete) { c.dropGuildPermissions(e.GuildID) },
+		func(_ *discordgo.Session, e *discordgo.GuildMemberUpdate) { c.dropMember(e.Member) },
+		func(_ *discordgo.Session, e *discordgo.GuildMemberRemove) { c.dropMember(e.Member) },
+	}
+}
+
+// Len returns how many entries are cached, expired or not.
+func (c *RESTCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := len(c.channels) + len(c.guilds)
+	for _, users := range c.perms {
+		n += len(users)
+	}
+	return n
+}
+
+func (c *RESTCache) entry(value interface{}, gid string) restCacheEntry {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = RESTCacheTTL
+	}
+	return restCacheEntry{value: value, gid: gid, expires: time.Now().Add(ttl)}
+}
+
+func (c *RESTCache) get(m map[string]restCacheEntry, id string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := m[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(m, id)
+		return nil, false
+	}
+	return e.value, true
+}
+
+// dropChannel drops a channel, and everyone's permissions in it.
+func (c *RESTCache) dropChannel(cid string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.channels, cid)
+	delete(c.perms, cid)
+}
+
+// dropGuild drops a guild, along with its channels and permissions in them.
+func (c *RESTCache) dropGuild(gid string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.guilds, gid)
+	for cid, e := range c.channels {
+		if e.gid == gid {
+			delete(c.channels, cid)
+		}
+	}
+	c.dropPermissions(gid, "")
+}
+
+// dropGuildPermissions drops everyone's permissions in a guild, eg. when a role changes.
+func (c *RESTCache) dropGuildPermissions(gid string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dropPermissions(gid, "")
+}
+
+// dropMember drops a member's permissions in their guild, eg. when their roles change.
+func (c *RESTCache) dropMember(m *discordgo.Member) {
+	if m == nil || m.User == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dropPermissions(m.GuildID, m.User.ID)
+}
+
+// dropPermissions drops permissions in a guild, for a user or for everyone if uid is "". Must be
+// called with the mutex held.
+func (c *RESTCache) dropPermissions(gid, uid string) {
+	for cid, users := range c.perms {
+		for id, e := range users {
+			if e.gid == gid && (uid == "" || id == uid) {
+				delete(users, id)
+			}
+		}
+		if len(users) == 0 {
+			delete(c.perms, cid)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRESTCache(t *testing.T) {
+	var c RESTCache
+	fetches := 0
+	fetchChannel := func(cid string) (*discordgo.Channel, error) {
+		fetches++
+		return &discordgo.Channel{ID: cid, GuildID: "g"}, nil
+	}
+	fetchPerms := func(uid, cid string) (int, error) {
+		fetches++
+		return discordgo.PermissionSendMessages, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		channel, err := c.Channel("c", fetchChannel)
+		assert.NoError(t, err)
+		assert.Equal(t, "g", channel.GuildID)
+		perms, err := c.Permissions("u", "c", "g", fetchPerms)
+		assert.NoError(t, err)
+		assert.Equal(t, discordgo.PermissionSendMessages, perms)
+	}
+	assert.Equal(t, 2, fetches)
+	assert.Equal(t, 2, c.Len())
+
+	// A role changing in the guild invalidates permissions, but not the channel.
+	c.dropGuildPermissions("g")
+	assert.Equal(t, 1, c.Len())
+	c.Permissions("u", "c", "g", fetchPerms)
+	assert.Equal(t, 3, fetches)
+
+	// The guild going away invalidates everything in it.
+	c.dropGuild("g")
+	assert.Equal(t, 0, c.Len())
+
+	// Entries expire on their own.
+	c.TTL = time.Nanosecond
+	c.Channel("c", fetchChannel)
+	time.Sleep(time.Millisecond)
+	c.Channel("c", fetchChannel)
+	assert.Equal(t, 5, fetches)
+}
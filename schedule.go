@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mvdan/xurls"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often the scheduler checks for schedules that are due.
+const ScheduleCheckInterval = 15 * time.Second
+
+// How late a schedule can still run, eg. because the bot was restarting when it was due; if it's
+// any later than that, that run is skipped.
+const ScheduleGracePeriod = 10 * time.Minute
+
+// Most schedules a guild can have.
+const MaxSchedules = 25
+
+// A Schedule queues a URL, eg. a playlist, in a voice channel at set times, eg. every Friday evening.
+type Schedule struct {
+	ID            string `json:"id"`
+	GuildID       string `json:"guild"`
+	When          string `json:"when"`     // A cron expression; see ParseCron
+	Timezone      string `json:"timezone"` // What the When is in, eg. "Europe/Oslo"
+	URL           string `json:"url"`
+	ChannelID     string `json:"channel"`      // The voice channel to play in
+	TextChannelID string `json:"text_channel"` // Where it was scheduled from, to announce it in
+	NSFW          bool   `json:"nsfw"`         // Whether the text channel is NSFW
+	CreatedBy     string `json:"created_by"`
+}
+
+// Next returns the first time after t the schedule runs, or the zero time if it never does.
+func (s Schedule) Next(t time.Time) (time.Time, error) {
+	cron, err := ParseCron(s.When)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cron.Next(t.In(loc)), nil
+}
+
+// SaveSchedule stores a schedule, replacing any with the same ID, and returns when it runs next.
+func SaveSchedule(rconn redis.Conn, s Schedule, now time.Time) (time.Time, error) {
+	next, err := s.Next(now)
+	if err != nil {
+		return next, err
+	}
+	if next.IsZero() {
+		return next, errors.New("that never happens")
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return next, err
+	}
+	rconn.Send("MULTI")
+	rconn.Send("HSET", KeyForServerSchedules(s.GuildID), s.ID, data)
+	rconn.Send("ZADD", KeySchedules, next.Unix(), scheduleMember(s.GuildID, s.ID))
+	_, err = rconn.Do("EXEC")
+	return next, err
+}
+
+// Schedules returns a guild's schedules, by ID.
+func Schedules(rconn redis.Conn, gid string) ([]Schedule, error) {
+	data, err := redis.StringMap(rconn.Do("HGETALL", KeyForServerSchedules(gid)))
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]Schedule, 0, len(data))
+	for id, v := range data {
+		var s Schedule
+		if err := json.Unmarshal([]byte(v), &s); err != nil {
+			return nil, errors.Wrap(err, "schedule "+id)
+		}
+		schedules = append(schedules, s)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return schedules, nil
+}
+
+// CancelSchedule deletes one of a guild's schedules, returning false if there's no such schedule.
+func CancelSchedule(rconn redis.Conn, gid, id string) (bool, error) {
+	rconn.Send("MULTI")
+	rconn.Send("HDEL", KeyForServerSchedules(gid), id)
+	rconn.Send("ZREM", KeySchedules, scheduleMember(gid, id))
+	replies, err := redis.Ints(rconn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	return replies[0] > 0, nil
+}
+
+// A DueSchedule is a schedule that was due to run.
+type DueSchedule struct {
+	Schedule
+	Due time.Time
+}
+
+// ClaimDueSchedules returns the schedules that are due to run by a time, and moves them on to their
+// next runs. Each run is only ever claimed by one instance. Schedules that have since been deleted,
+// eg. along with the guild's keys, are forgotten.
+func ClaimDueSchedules(rconn redis.Conn, now time.Time) ([]DueSchedule, error) {
+	due, err := redis.Int64Map(rconn.Do("ZRANGEBYSCORE", KeySchedules, "-inf", now.Unix(), "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := []DueSchedule{}
+	for member, score := range due {
+		s, err := claimSchedule(rconn, member, score, now)
+		if err != nil {
+			log.WithError(err).WithField("schedule", member).Error("Couldn't claim schedule")
+			continue
+		}
+		if s != nil {
+			claimed = append(claimed, DueSchedule{*s, time.Unix(score, 0)})
+		}
+	}
+	return claimed, nil
+}
+
+// claimSchedule moves a schedule that was due at a time on to its next run, returning it, or nil if
+// another instance already did.
+func claimSchedule(rconn redis.Conn, member string, due int64, now time.Time) (*Schedule, error) {
+	if _, err := rconn.Do("WATCH", KeySchedules); err != nil {
+		return nil, err
+	}
+	defer rconn.Do("UNWATCH")
+
+	score, err := redis.Int64(rconn.Do("ZSCORE", KeySchedules, member))
+	if err == redis.ErrNil || (err == nil && score != due) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Schedule
+	gid, id := splitScheduleMember(member)
+	data, err := redis.Bytes(rconn.Do("HGET", KeyForServerSchedules(gid), id))
+	if err == nil {
+		err = json.Unmarshal(data, &s)
+	}
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	var next time.Time
+	if err == nil {
+		if next, err = s.Next(now); err != nil {
+			log.WithError(err).WithField("schedule", member).Warn("Schedule is broken; forgetting it")
+			s = Schedule{}
+		}
+	}
+
+	rconn.Send("MULTI")
+	if next.IsZero() {
+		rconn.Send("ZREM", KeySchedules, member)
+	} else {
+		rconn.Send("ZADD", KeySchedules, next.Unix(), member)
+	}
+	reply, err := rconn.Do("EXEC")
+	if err != nil || reply == nil || s.ID == "" {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func scheduleMember(gid, id string) string { return gid + ":" + id }
+
+func splitScheduleMember(member string) (gid, id string) {
+	if i := strings.LastIndex(member, ":"); i != -1 {
+		return member[:i], member[i+1:]
+	}
+	return member, ""
+}
+
+// newScheduleID generates a short, random ID for a schedule, that's easy enough to type to cancel it.
+func newScheduleID() (string, error) {
+	buf := make([]byte, 3)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// normalizeTimezone accepts an IANA timezone name, eg. "Europe/Oslo".
+func normalizeTimezone(v string) (string, error) {
+	loc, err := time.LoadLocation(v)
+	if err != nil || v == "" || strings.EqualFold(v, "local") {
+		return "", errors.New("expected a timezone, eg. Europe/Oslo or UTC")
+	}
+	return loc.String(), nil
+}
+
+// runScheduler runs schedules as they come due, until the context expires.
+func (c *PlayerController) runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(ScheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.runDueSchedules(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runDueSchedules runs the schedules that are due, skipping ones that are too late to.
+func (c *PlayerController) runDueSchedules(now time.Time) {
+	rconn := c.Pool.Get()
+	defer rconn.Close()
+
+	due, err := ClaimDueSchedules(rconn, now)
+	if err != nil {
+		PlayerLog.WithError(err).Error("PlayerController: Couldn't check schedules")
+		return
+	}
+	for _, s := range due {
+		fields := log.Fields{"gid": s.GuildID, "schedule": s.ID}
+		if late := now.Sub(s.Due); late > ScheduleGracePeriod {
+			PlayerLog.WithFields(fields).WithField("late", late).Warn("PlayerController: Skipped scheduled run that's too late")
+			continue
+		}
+		PlayerLog.WithFields(fields).Info("PlayerController: Running schedule")
+		c.runSchedule(rconn, s.Schedule, now)
+	}
+}
+
+// runSchedule queues a schedule's URL in its voice channel, and moves the bot there, unless a DJ
+// has the queue locked.
+func (c *PlayerController) runSchedule(rconn redis.Conn, s Schedule, now time.Time) {
+	q := GuildQueue(s.GuildID)
+	if holder, err := DJLock(rconn, q); err != nil {
+		PlayerLog.WithError(err).WithField("gid", s.GuildID).Error("PlayerController: Couldn't check DJ lock")
+	} else if holder != "" {
+		c.Session.ChannelMessageSend(s.TextChannelID, fmt.Sprintf("Skipped scheduled <%s>, as <@!%s> has the queue locked.", s.URL, holder))
+		return
+	}
+
+	tracks, err := ResolveURL(rconn, s.URL)
+	if err != nil {
+		c.Session.ChannelMessageSendEmbed(s.TextChannelID, ErrorEmbed("Couldn't play scheduled "+s.URL, errors.New(friendlyError(err))))
+		return
+	}
+	res := resolvedURL{URL: s.URL, Tracks: tracks, Timing: RequestTiming{Received: now, Resolved: time.Now()}}
+	envelopes, _ := PlayableEnvelopes(rconn, s.GuildID, "", s.NSFW, res)
+	if len(envelopes) == 0 {
+		return
+	}
+	if err := c.Store.Push(PlaylistQueue(rconn, q, s.ChannelID), envelopes...); err != nil {
+		PlayerLog.WithError(err).WithField("gid", s.GuildID).Error("PlayerController: Couldn't push to playlist")
+		return
+	}
+
+	if err := c.Store.SetChannel(q, s.ChannelID); err != nil {
+		PlayerLog.WithError(err).WithField("gid", s.GuildID).Error("PlayerController: Couldn't set active channel")
+	}
+	if _, err := rconn.Do("SET", q.TextChannelKey(), s.TextChannelID); err != nil {
+		PlayerLog.WithError(err).WithField("gid", s.GuildID).Error("PlayerController: Couldn't set text channel")
+	}
+	if err := c.Store.SetState(q, StatePlaying); err != nil {
+		PlayerLog.WithError(err).WithField("gid", s.GuildID).Error("PlayerController: Couldn't set player state")
+	}
+
+	data := TemplateData{Guild: TemplateGuild{ID: s.GuildID}, Added: len(envelopes)}
+	if text, err := RenderTemplate(rconn, s.GuildID, "schedule-queued", data); err != nil {
+		PlayerLog.WithError(err).WithField("gid", s.GuildID).Error("PlayerController: Couldn't render template")
+	} else if text != "" {
+		c.Session.ChannelMessageSend(s.TextChannelID, text)
+	}
+}
+
+// cmdSchedule lists, adds or cancels a guild's schedules, which queue a URL in a voice channel at
+// set times. To add one, give a cron expression (see ParseCron), the URL, and optionally a voice
+// channel (by default, the one you're in) and a timezone (by default, the timezone setting's), eg.
+// "schedule every friday 20:00 <url> #music Europe/Oslo".
+func cmdSchedule(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	if len(args) == 0 {
+		schedules, err := Schedules(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't list schedules")
+			return
+		}
+		if len(schedules) == 0 {
+			r.reply(msg.ChannelID, msg.Author.ID, "Nothing's scheduled.")
+			return
+		}
+		lines := []string{}
+		for _, s := range schedules {
+			line := fmt.Sprintf("`%s`: `%s` (%s) - <%s> in <#%s>", s.ID, s.When, s.Timezone, s.URL, s.ChannelID)
+			if next, err := s.Next(time.Now()); err == nil && !next.IsZero() {
+				line += ", next on " + next.Format("Mon Jan 2 15:04 MST")
+			}
+			lines = append(lines, line)
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, "Schedules:\n"+strings.Join(lines, "\n"))
+		return
+	}
+
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to change schedules.")
+		return
+	}
+
+	if strings.ToLower(args[0]) == "cancel" {
+		if len(args) != 2 {
+			r.reply(msg.ChannelID, msg.Author.ID, "Usage: `schedule cancel <id>`")
+			return
+		}
+		ok, err := CancelSchedule(rconn, channel.GuildID, args[1])
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't cancel schedule")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no schedule `%s`.", args[1]))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Cancelled schedule `%s`.", args[1]))
+		return
+	}
+
+	// Everything before the URL says when, and everything after it says where.
+	i := 0
+	for i < len(args) && !xurls.Strict().MatchString(args[i]) {
+		i++
+	}
+	if i == 0 || i == len(args) {
+		r.reply(msg.ChannelID, msg.Author.ID, "Usage: `schedule <when> <url> [voice channel] [timezone]`, eg. `schedule every friday 20:00 <url> #music Europe/Oslo`")
+		return
+	}
+	s := Schedule{
+		GuildID:       channel.GuildID,
+		When:          strings.ToLower(strings.Join(args[:i], " ")),
+		URL:           strings.Trim(args[i], "<>"),
+		TextChannelID: msg.ChannelID,
+		NSFW:          channel.NSFW,
+		CreatedBy:     msg.Author.ID,
+	}
+	for _, arg := range args[i+1:] {
+		if strings.HasPrefix(arg, "<#") {
+			s.ChannelID = strings.TrimSuffix(strings.TrimPrefix(arg, "<#"), ">")
+			continue
+		}
+		tz, err := normalizeTimezone(arg)
+		if err != nil {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("`%s` isn't a voice channel or a timezone.", arg))
+			return
+		}
+		s.Timezone = tz
+	}
+	if s.Timezone == "" {
+		tz, err := ReadSetting(rconn, channel.GuildID, SettingTimezone)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't read setting")
+			return
+		}
+		s.Timezone = tz
+	}
+	if s.ChannelID == "" {
+		s.ChannelID = r.voiceChannel(channel.GuildID, msg.Author.ID)
+		if s.ChannelID == "" {
+			r.reply(msg.ChannelID, msg.Author.ID, "Which voice channel should it play in? Mention one, or join it first.")
+			return
+		}
+	}
+	if vc, err := r.channel(s.ChannelID); err != nil || vc.GuildID != channel.GuildID || vc.Type != discordgo.ChannelTypeGuildVoice {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("<#%s> isn't a voice channel here.", s.ChannelID))
+		return
+	}
+	if _, err := ParseCron(s.When); err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("I don't know when `%s` is: %s", s.When, err.Error()))
+		return
+	}
+
+	// Make sure there's something there to play, so a typo doesn't go unnoticed until it's due.
+	if tracks, err := ResolveURL(rconn, s.URL); err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, friendlyError(err))
+		return
+	} else if len(tracks) == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, "That's not a link I can play.")
+		return
+	}
+
+	existing, err := Schedules(rconn, channel.GuildID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't list schedules")
+		return
+	}
+	if len(existing) >= MaxSchedules {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There can only be %d schedules; cancel one first.", MaxSchedules))
+		return
+	}
+	if s.ID, err = newScheduleID(); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't generate schedule ID")
+		return
+	}
+	next, err := SaveSchedule(rconn, s, time.Now())
+	if err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Couldn't schedule that: %s", err.Error()))
+		return
+	}
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Scheduled as `%s`; it'll play in <#%s> next on %s.", s.ID, s.ChannelID, next.Format("Mon Jan 2 15:04 MST")))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// A Migration upgrades data in Redis from the previous schema version to its own.
+type Migration struct {
+	Version     int
+	Description string
+	Run         func(rconn redis.Conn) error
+}
+
+// Migrations, in order; the last one's version is the current schema version. Add one whenever
+// something stored changes in a way older data has to be rewritten for, eg. TrackEnvelope gaining
+// a field that has to be filled in, and never change one that's been released.
+var Migrations = []Migration{
+	{1, "Re-encode queued track envelopes", migrateEnvelopes},
+}
+
+// CurrentSchemaVersion is the schema version this release uses.
+func CurrentSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the data in Redis; 0 if it predates versioning.
+func SchemaVersion(rconn redis.Conn) (int, error) {
+	v, err := redis.Int(rconn.Do("GET", KeySchemaVersion))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return v, err
+}
+
+// CheckSchema returns an error unless the data in Redis is at the current schema version. Empty
+// databases are stamped with it, as there's nothing to migrate.
+func CheckSchema(rconn redis.Conn) error {
+	v, err := SchemaVersion(rconn)
+	if err != nil {
+		return err
+	}
+	current := CurrentSchemaVersion()
+	switch {
+	case v == current:
+		return nil
+	case v > current:
+		return errors.Errorf("data is at schema version %d, but this release only knows up to %d; upgrade hiqty", v, current)
+	case v == 0:
+		keys, err := scanKeys(rconn, "hiqty:*")
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			_, err := rconn.Do("SET", KeySchemaVersion, current)
+			return err
+		}
+	}
+	return errors.Errorf("data is at schema version %d, but this release needs %d; run hiqty migrate", v, current)
+}
+
+// Migrate runs all migrations newer than the data's schema version, in order, recording the new
+// version after each one. Progress is reported through logf.
+func Migrate(rconn redis.Conn, logf func(format string, args ...interface{})) error {
+	v, err := SchemaVersion(rconn)
+	if err != nil {
+		return err
+	}
+	if v > CurrentSchemaVersion() {
+		return errors.Errorf("data is at schema version %d, which is newer than this release", v)
+	}
+
+	for _, m := range Migrations {
+		if m.Version <= v {
+			continue
+		}
+		logf("Migrating to version %d: %s...", m.Version, m.Description)
+		if err := m.Run(rconn); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("migration %d", m.Version))
+		}
+		if _, err := rconn.Do("SET", KeySchemaVersion, m.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateEnvelopes rewrites every queued envelope through TrackEnvelope, so fields it's gained
+// since it was queued are filled in. Envelopes of services that aren't available are left alone.
+func migrateEnvelopes(rconn redis.Conn) error {
+	keys, err := scanKeys(rconn, "hiqty:server:*playlist")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		items, err := redis.ByteSlices(rconn.Do("LRANGE", key, 0, -1))
+		if err != nil {
+			return err
+		}
+		for i, data := range items {
+			var envelope TrackEnvelope
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				continue
+			}
+			fresh, err := json.Marshal(envelope)
+			if err != nil {
+				return err
+			}
+			if string(fresh) == string(data) {
+				continue
+			}
+			if _, err := rconn.Do("LSET", key, i, fresh); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
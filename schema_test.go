@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range Migrations {
+		assert.Equal(t, i+1, m.Version, m.Description)
+		assert.NotNil(t, m.Run, m.Description)
+	}
+	assert.Equal(t, len(Migrations), CurrentSchemaVersion())
+}
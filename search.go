@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"strings"
+)
+
+// cmdSearch searches for a track on the preferred service of whoever asked, and queues the best
+// match in the voice channel they're in.
+func cmdSearch(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	query := strings.Join(args, " ")
+	if query == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, "Usage: `search <query>`")
+		return
+	}
+
+	preferred := r.preference(rconn, msg.Author, PreferenceSearchService)
+	found, err := SearchTracks(rconn, query, preferred, 1)
+	if err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, friendlyError(err))
+		return
+	}
+	if len(found) == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, "Couldn't find anything like that.")
+		return
+	}
+
+	best := found[0]
+	envelope := TrackEnvelope{ServiceID: best.GetServiceID(), Track: best, URL: best.GetInfo().URL}
+	tracks, skipped, ok := r.queueSaved(rconn, msg, channel, []TrackEnvelope{envelope})
+	if !ok {
+		return
+	}
+	if len(skipped) > 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, "Found **"+best.GetInfo().Title+"**, but can't play it here: "+skipped[0].Reason)
+		return
+	}
+	r.announce(rconn, channel.GuildID, msg.ChannelID, channel.NSFW, msg.Author, tracks)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/joho/godotenv"
+	"github.com/sencrash/hiqty/media"
+	"github.com/sencrash/hiqty/media/plugin"
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"gopkg.in/urfave/cli.v2"
+	"os"
+	"strings"
+)
+
+// A ServiceConfig holds the credentials and addresses services are created from. Unlike the rest
+// of the configuration, it can be reloaded at runtime (on SIGHUP), so credentials can be rotated
+// without dropping every voice connection.
+type ServiceConfig struct {
+	SoundcloudClientID string
+	Plugins            []string
+}
+
+// Flags a ServiceConfig is made from, and the environment variables they can be set from.
+var serviceConfigEnvVars = map[string]string{
+	"soundcloud-client-id": "SOUNDCLOUD_CLIENT_ID",
+	"plugin":               "HIQTY_PLUGINS",
+}
+
+// Global flags given on the command line, which a reload can't change.
+var commandLineFlags = map[string]bool{}
+
+// ServiceConfigFromContext reads a ServiceConfig from flags.
+func ServiceConfigFromContext(cc *cli.Context) ServiceConfig {
+	return ServiceConfig{
+		SoundcloudClientID: cc.String("soundcloud-client-id"),
+		Plugins:            cc.StringSlice("plugin"),
+	}
+}
+
+// ReloadServiceConfig re-reads a ServiceConfig from .env and the config file, with the usual
+// precedence; anything given on the command line is kept as it is.
+func ReloadServiceConfig(cc *cli.Context) (ServiceConfig, error) {
+	if err := godotenv.Overload(); err != nil && !os.IsNotExist(err) {
+		return ServiceConfig{}, err
+	}
+	var file ConfigFile
+	if path := cc.String("config"); path != "" {
+		f, err := LoadConfigFile(path)
+		if err != nil {
+			return ServiceConfig{}, err
+		}
+		file = f
+	}
+
+	lookup := func(name string, current []string) []string {
+		if commandLineFlags[name] {
+			return current
+		}
+		if v := os.Getenv(serviceConfigEnvVars[name]); v != "" {
+			return strings.Split(v, ",")
+		}
+		return file[name]
+	}
+	cfg := ServiceConfig{Plugins: lookup("plugin", cc.StringSlice("plugin"))}
+	if v := lookup("soundcloud-client-id", []string{cc.String("soundcloud-client-id")}); len(v) > 0 {
+		cfg.SoundcloudClientID = v[0]
+	}
+	return cfg, nil
+}
+
+// RegisterServices creates services from a config, and replaces the registered ones with them.
+func RegisterServices(cfg ServiceConfig) {
+	svcs := []media.Service{}
+
+	// SoundCloud
+	if cfg.SoundcloudClientID != "" {
+		svcs = append(svcs, soundcloud.New(cfg.SoundcloudClientID))
+		log.Info("Service Registered: soundcloud")
+	} else {
+		log.Warn("Service Unavailable: soundcloud")
+	}
+
+	// Plugins
+	for _, addr := range cfg.Plugins {
+		svc, err := plugin.New(addr)
+		if err != nil {
+			log.WithError(err).WithField("addr", addr).Warn("Plugin Unavailable")
+			continue
+		}
+		svcs = append(svcs, svc)
+		log.WithField("addr", addr).Info("Service Registered: " + svc.ID())
+	}
+
+	media.SetServices(svcs...)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadServiceConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiqty")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hiqty.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("soundcloud-client-id: old\n"), 0644))
+
+	var cfg ServiceConfig
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config"},
+			&cli.StringFlag{Name: "soundcloud-client-id"},
+			&cli.StringSliceFlag{Name: "plugin"},
+		},
+		Action: func(cc *cli.Context) error {
+			// The file is re-read, but command line flags stay as they are.
+			assert.NoError(t, ioutil.WriteFile(path, []byte("soundcloud-client-id: new\nplugin: [http://b]\n"), 0644))
+			cfg, err = ReloadServiceConfig(cc)
+			return err
+		},
+	}
+	commandLineFlags = map[string]bool{"plugin": true}
+	defer func() { commandLineFlags = map[string]bool{} }()
+
+	os.Unsetenv("SOUNDCLOUD_CLIENT_ID")
+	assert.NoError(t, app.Run([]string{"hiqty", "--config", path, "--plugin", "http://a"}))
+	assert.Equal(t, ServiceConfig{SoundcloudClientID: "new", Plugins: []string{"http://a"}}, cfg)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	SettingRevokeOnDelete  = "revoke-on-delete"
+	SettingLicenseFilter   = "license-filter"
+	SettingSelfDeafen      = "self-deafen"
+	SettingExplicitFilter  = "explicit-filter"
+	SettingQueuePerChannel = "queue-per-channel"
+	SettingWaitForVoice    = "wait-for-voice"
+	SettingErrorChannel    = "error-channel"
+	SettingVolume          = "volume"
+	SettingNormalize       = "normalize"
+	SettingFade            = "fade"
+	SettingFilter          = "filter"
+	SettingKaraoke         = "karaoke"
+	SettingTimezone        = "timezone"
+	SettingSpeakTracks     = "speak-tracks"
+	SettingVoteQueue       = "vote-queue"
+)
+
+const (
+	LicenseFilterAny        = "any"
+	LicenseFilterCC         = "cc"
+	LicenseFilterCommercial = "commercial"
+)
+
+const (
+	ErrorChannelAuto = "auto"
+	ErrorChannelOff  = "off"
+)
+
+const (
+	ExplicitFilterAllow = "allow"
+	ExplicitFilterNSFW  = "nsfw"
+	ExplicitFilterBlock = "block"
+)
+
+// A Setting is a per-guild option, which can be changed with the settings command.
+type Setting struct {
+	Name        string
+	Description string
+	Default     string
+
+	// Normalize validates a value, returning it in canonical form.
+	Normalize func(v string) (string, error)
+}
+
+// Settings lists all available per-guild settings.
+var Settings = []Setting{
+	{
+		Name:        SettingRevokeOnDelete,
+		Description: "Remove tracks that haven't played yet if their request message is deleted.",
+		Default:     "off",
+		Normalize:   normalizeBool,
+	},
+	{
+		Name:        SettingLicenseFilter,
+		Description: "Only allow tracks under these licenses: `any`, `cc` (Creative Commons), or `commercial` (safe for monetized streams).",
+		Default:     LicenseFilterAny,
+		Normalize:   normalizeChoice(LicenseFilterAny, LicenseFilterCC, LicenseFilterCommercial),
+	},
+	{
+		Name:        SettingExplicitFilter,
+		Description: "Which channels explicit or age-restricted tracks can be requested from: `allow` (any), `nsfw` (NSFW channels only), or `block` (none).",
+		Default:     ExplicitFilterNSFW,
+		Normalize:   normalizeChoice(ExplicitFilterAllow, ExplicitFilterNSFW, ExplicitFilterBlock),
+	},
+	{
+		Name:        SettingQueuePerChannel,
+		Description: "Keep a separate queue for each voice channel, rather than one for the whole server.",
+		Default:     "off",
+		Normalize:   normalizeBool,
+	},
+	{
+		Name:        SettingWaitForVoice,
+		Description: "Hold requests from people who aren't in a voice channel, and queue them once they join one, for up to 2 minutes.",
+		Default:     "off",
+		Normalize:   normalizeBool,
+	},
+	{
+		Name:        SettingErrorChannel,
+		Description: "Where to post playback errors: a channel, `auto` (wherever music was last requested from), or `off`.",
+		Default:     ErrorChannelAuto,
+		Normalize:   normalizeChannel,
+	},
+	{
+		Name:        SettingVolume,
+		Description: "Volume of every track, as an adjustment in dB, on top of any made to the track itself with `gain`.",
+		Default:     "0dB",
+		Normalize:   normalizeVolume,
+	},
+	{
+		Name:        SettingNormalize,
+		Description: "Even out loudness between tracks, so quiet and loud ones play at about the same volume.",
+		Default:     "off",
+		Normalize:   normalizeBool,
+	},
+	{
+		Name:        SettingFade,
+		Description: "Fade tracks in and out over this many seconds, up to 10; 0 to not fade them.",
+		Default:     "0",
+		Normalize:   normalizeFade,
+	},
+	{
+		Name:        SettingFilter,
+		Description: "Filter preset to play tracks through: `" + strings.Join(FilterPresetNames(), "`, `") + "`, or a custom one saved with `filter save`.",
+		Default:     "flat",
+		Normalize:   normalizeFilter,
+	},
+	{
+		Name:        SettingKaraoke,
+		Description: "Karaoke mode: remove vocals from tracks, by cancelling out what's in the center of the mix. Works best on studio recordings; mono tracks go silent.",
+		Default:     "off",
+		Normalize:   normalizeBool,
+	},
+	{
+		Name:        SettingSpeakTracks,
+		Description: "Announce each track as it starts in voice, with text-to-speech, if it's set up.",
+		Default:     "off",
+		Normalize:   normalizeBool,
+	},
+	{
+		Name:        SettingVoteQueue,
+		Description: "Let people vote requests up or down the queue by reacting to them with " + VoteUp + " or " + VoteDown + "; the highest-voted play next.",
+		Default:     "off",
+		Normalize:   normalizeBool,
+	},
+	{
+		Name:        SettingTimezone,
+		Description: "Timezone schedules are in, unless they say otherwise, eg. `Europe/Oslo`.",
+		Default:     "UTC",
+		Normalize:   normalizeTimezone,
+	},
+	{
+		Name:        SettingSelfDeafen,
+		Description: "Deafen the bot in voice channels, so it can't hear anyone.",
+		Default:     "on",
+		Normalize:   normalizeBool,
+	},
+}
+
+// FindSetting looks up a setting by name, returning nil if there's no such setting.
+func FindSetting(name string) *Setting {
+	for i, s := range Settings {
+		if s.Name == name {
+			return &Settings[i]
+		}
+	}
+	return nil
+}
+
+// ReadSetting reads a guild's setting, falling back to the default if it's not set.
+func ReadSetting(rconn redis.Conn, gid, name string) (string, error) {
+	setting := FindSetting(name)
+	if setting == nil {
+		return "", errors.New("unknown setting: " + name)
+	}
+
+	v, err := redis.String(rconn.Do("HGET", KeyForServerSettings(gid), name))
+	if err == redis.ErrNil {
+		return setting.Default, nil
+	}
+	return v, err
+}
+
+// ReadBoolSetting reads a boolean setting.
+func ReadBoolSetting(rconn redis.Conn, gid, name string) (bool, error) {
+	v, err := ReadSetting(rconn, gid, name)
+	return v == "on", err
+}
+
+// WriteSetting validates and stores a guild's setting, returning the normalized value.
+func WriteSetting(rconn redis.Conn, gid, name, value string) (string, error) {
+	setting := FindSetting(name)
+	if setting == nil {
+		return "", errors.New("unknown setting: " + name)
+	}
+
+	v, err := setting.Normalize(value)
+	if err != nil {
+		return "", err
+	}
+	if _, err := rconn.Do("HSET", KeyForServerSettings(gid), name, v); err != nil {
+		return "", err
+	}
+
+	// Players notice eventually even if this doesn't get through, so it's fire and forget.
+	NotifyBus(KeyForServerSettings(gid))
+	return v, nil
+}
+
+func normalizeChoice(choices ...string) func(v string) (string, error) {
+	return func(v string) (string, error) {
+		v = strings.ToLower(v)
+		for _, c := range choices {
+			if v == c {
+				return v, nil
+			}
+		}
+		return "", errors.New("expected one of: " + strings.Join(choices, ", "))
+	}
+}
+
+// normalizeChannel accepts a channel mention or ID, which is stored as an ID, or auto or off.
+func normalizeChannel(v string) (string, error) {
+	v = strings.ToLower(v)
+	if v == ErrorChannelAuto || v == ErrorChannelOff {
+		return v, nil
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(v, "<#"), ">")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", errors.New("expected a channel, auto or off")
+	}
+	return id, nil
+}
+
+func normalizeBool(v string) (string, error) {
+	switch strings.ToLower(v) {
+	case "on", "yes", "true", "1":
+		return "on", nil
+	case "off", "no", "false", "0":
+		return "off", nil
+	default:
+		return "", errors.New("expected on or off")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalizeBool(t *testing.T) {
+	v, err := normalizeBool("Yes")
+	assert.NoError(t, err)
+	assert.Equal(t, "on", v)
+
+	v, err = normalizeBool("0")
+	assert.NoError(t, err)
+	assert.Equal(t, "off", v)
+
+	_, err = normalizeBool("maybe")
+	assert.Error(t, err)
+}
+
+func TestNormalizeChoice(t *testing.T) {
+	normalize := normalizeChoice(LicenseFilterAny, LicenseFilterCC)
+
+	v, err := normalize("CC")
+	assert.NoError(t, err)
+	assert.Equal(t, LicenseFilterCC, v)
+
+	_, err = normalize("commercial")
+	assert.Error(t, err)
+}
+
+func TestNormalizeChannel(t *testing.T) {
+	v, err := normalizeChannel("<#123456>")
+	assert.NoError(t, err)
+	assert.Equal(t, "123456", v)
+
+	v, err = normalizeChannel("123456")
+	assert.NoError(t, err)
+	assert.Equal(t, "123456", v)
+
+	v, err = normalizeChannel("Off")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorChannelOff, v)
+
+	_, err = normalizeChannel("#general")
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/sencrash/hiqty/media"
+	"strconv"
+)
+
+// How many similar tracks are queued, unless asked for a different number.
+const DefaultSimilarTracks = 5
+
+// Most similar tracks that can be queued at once.
+const MaxSimilarTracks = 20
+
+// similarTracks picks up to n of the tracks related to another that aren't the track itself, which
+// some services count as related to itself.
+func similarTracks(track media.Track, related []media.Track, n int) []media.Track {
+	similar := []media.Track{}
+	for _, t := range related {
+		if len(similar) == n {
+			break
+		}
+		if !t.Equals(track) {
+			similar = append(similar, t)
+		}
+	}
+	return similar
+}
+
+// cmdSimilar queues tracks similar to the one that's playing, as its service recommends them, in
+// the voice channel whoever asked is in.
+func cmdSimilar(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	n := DefaultSimilarTracks
+	if len(args) > 0 {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 || len(args) > 1 {
+			r.reply(msg.ChannelID, msg.Author.ID, "Usage: `similar [number]`")
+			return
+		}
+	}
+	if n > MaxSimilarTracks {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("I can only queue up to %d similar tracks at once.", MaxSimilarTracks))
+		return
+	}
+
+	playing, err := r.nowPlaying(rconn, channel.GuildID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get track")
+		return
+	}
+	if playing == nil {
+		r.reply(msg.ChannelID, msg.Author.ID, "Nothing's playing right now.")
+		return
+	}
+
+	if recommender(media.Lookup(playing.ServiceID)) == nil {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("I can't find tracks similar to ones from **%s**.", playing.ServiceID))
+		return
+	}
+	related, err := RelatedTracks(rconn, playing.Track, n+1)
+	if err != nil {
+		r.reply(msg.ChannelID, msg.Author.ID, friendlyError(err))
+		return
+	}
+	similar := similarTracks(playing.Track, related, n)
+	if len(similar) == 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Couldn't find anything similar to **%s**.", playing.Track.GetInfo().Title))
+		return
+	}
+
+	envelopes := make([]TrackEnvelope, len(similar))
+	for i, track := range similar {
+		envelopes[i] = TrackEnvelope{ServiceID: track.GetServiceID(), Track: track, URL: track.GetInfo().URL}
+	}
+	tracks, skipped, ok := r.queueSaved(rconn, msg, channel, envelopes)
+	if !ok {
+		return
+	}
+	if len(skipped) > 0 {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Skipped %d similar tracks that can't be played here.", len(skipped)))
+	}
+	r.announce(rconn, channel.GuildID, msg.ChannelID, channel.NSFW, msg.Author, tracks)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/sencrash/hiqty/media"
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSimilarTracks(t *testing.T) {
+	playing := &soundcloud.Track{ID: 1}
+	related := []media.Track{&soundcloud.Track{ID: 2}, &soundcloud.Track{ID: 1}, &soundcloud.Track{ID: 3}, &soundcloud.Track{ID: 4}}
+
+	assert.Equal(t, []media.Track{related[0], related[2]}, similarTracks(playing, related, 2))
+	assert.Equal(t, []media.Track{related[0], related[2], related[3]}, similarTracks(playing, related, 5))
+	assert.Empty(t, similarTracks(playing, related[1:2], 5))
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"strings"
+	"time"
+)
+
+// How far a station's followers may drift from where the leader is in a track before they skip to
+// where it is. Players reread the station every so often (see PlayerRecheckInterval), and starting
+// a stream takes a moment, so they're never quite in sync.
+const StationMaxDrift = 5 * time.Second
+
+// A StationTrack is what a station is playing, for its followers to play along with.
+type StationTrack struct {
+	Envelope TrackEnvelope `json:"envelope"`
+	Started  time.Time     `json:"started"` // When the leader would have started it from the top
+}
+
+// CreateStation creates a station led by a guild, returning false if one by that name exists. The
+// leader plays from its own queue as normal, and any guilds that join play along with it.
+func CreateStation(rconn redis.Conn, name, gid string) (bool, error) {
+	ok, err := redis.Bool(rconn.Do("HSETNX", KeyForStation(name), "leader", gid))
+	if err != nil || !ok {
+		return false, err
+	}
+	rconn.Send("MULTI")
+	rconn.Send("HSET", KeyForStation(name), "created", time.Now().Unix())
+	rconn.Send("SADD", KeyForStationGuilds(name), gid)
+	rconn.Send("SET", KeyForServerStation(gid), name)
+	if _, err := rconn.Do("EXEC"); err != nil {
+		return false, err
+	}
+	NotifyBus(KeyForServerStation(gid))
+	return true, nil
+}
+
+// JoinStation has a guild follow a station, returning false if there's no such station.
+func JoinStation(rconn redis.Conn, name, gid string) (bool, error) {
+	values, err := redis.Values(rconn.Do("HMGET", KeyForStation(name), "leader", "track"))
+	if err != nil {
+		return false, err
+	}
+	var leader, track []byte
+	if _, err := redis.Scan(values, &leader, &track); err != nil {
+		return false, err
+	}
+	if leader == nil {
+		return false, nil
+	}
+
+	rconn.Send("MULTI")
+	rconn.Send("SADD", KeyForStationGuilds(name), gid)
+	rconn.Send("SET", KeyForServerStation(gid), name)
+	if track != nil {
+		rconn.Send("SET", KeyForServerStationTrack(gid), track)
+	} else {
+		rconn.Send("DEL", KeyForServerStationTrack(gid))
+	}
+	if _, err := rconn.Do("EXEC"); err != nil {
+		return false, err
+	}
+	NotifyBus(KeyForServerStation(gid))
+	return true, nil
+}
+
+// LeaveStation takes a guild out of the station it's in, returning the station's name, or "" if it
+// wasn't in one. If it was the leader, the station is closed, and every other guild is taken out.
+func LeaveStation(rconn redis.Conn, gid string) (string, error) {
+	name, leader, err := GuildStation(rconn, gid)
+	if err != nil || name == "" {
+		return name, err
+	}
+
+	guilds := []string{gid}
+	if leader == gid || leader == "" {
+		if guilds, err = redis.Strings(rconn.Do("SMEMBERS", KeyForStationGuilds(name))); err != nil {
+			return "", err
+		}
+		if !containsString(guilds, gid) {
+			guilds = append(guilds, gid)
+		}
+	}
+
+	rconn.Send("MULTI")
+	if leader == gid || leader == "" {
+		rconn.Send("DEL", KeyForStation(name), KeyForStationGuilds(name))
+	} else {
+		rconn.Send("SREM", KeyForStationGuilds(name), gid)
+	}
+	for _, member := range guilds {
+		rconn.Send("DEL", KeyForServerStation(member), KeyForServerStationTrack(member))
+	}
+	if _, err := rconn.Do("EXEC"); err != nil {
+		return "", err
+	}
+	for _, member := range guilds {
+		NotifyBus(KeyForServerStation(member))
+	}
+	return name, nil
+}
+
+// GuildStation returns the name of the station a guild is in and the guild leading it, or "" if
+// it isn't in one. If the station's been closed from under it, the leader is "".
+func GuildStation(rconn redis.Conn, gid string) (name, leader string, err error) {
+	name, err = redis.String(rconn.Do("GET", KeyForServerStation(gid)))
+	if err == redis.ErrNil {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	leader, err = redis.String(rconn.Do("HGET", KeyForStation(name), "leader"))
+	if err == redis.ErrNil {
+		return name, "", nil
+	}
+	return name, leader, err
+}
+
+// StationGuilds returns the guilds in a station, leader included.
+func StationGuilds(rconn redis.Conn, name string) ([]string, error) {
+	return redis.Strings(rconn.Do("SMEMBERS", KeyForStationGuilds(name)))
+}
+
+// BroadcastStationTrack tells every guild following a station what its leader is playing, or that
+// it's playing nothing, if track is nil.
+func BroadcastStationTrack(rconn redis.Conn, name, leader string, track *StationTrack) error {
+	guilds, err := StationGuilds(rconn, name)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if track != nil {
+		if data, err = json.Marshal(track); err != nil {
+			return err
+		}
+	}
+
+	rconn.Send("MULTI")
+	if data != nil {
+		rconn.Send("HSET", KeyForStation(name), "track", data)
+	} else {
+		rconn.Send("HDEL", KeyForStation(name), "track")
+	}
+	for _, gid := range guilds {
+		switch {
+		case gid == leader:
+		case data != nil:
+			rconn.Send("SET", KeyForServerStationTrack(gid), data)
+		default:
+			rconn.Send("DEL", KeyForServerStationTrack(gid))
+		}
+	}
+	if _, err := rconn.Do("EXEC"); err != nil {
+		return err
+	}
+	for _, gid := range guilds {
+		if gid != leader {
+			NotifyBus(KeyForServerStationTrack(gid))
+		}
+	}
+	return nil
+}
+
+// ReadStationTrack returns what the station a guild follows is playing, or nil if nothing is.
+func ReadStationTrack(rconn redis.Conn, gid string) (*StationTrack, error) {
+	data, err := redis.Bytes(rconn.Do("GET", KeyForServerStationTrack(gid)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var track StationTrack
+	if err := json.Unmarshal(data, &track); err != nil {
+		return nil, err
+	}
+	return &track, nil
+}
+
+// Offset returns how far into the track the leader is.
+func (t StationTrack) Offset(now time.Time) time.Duration {
+	offset := now.Sub(t.Started)
+	if offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// readStation rereads the station the player's guild is in, and whether it follows rather than
+// leads it. Only a guild's main bot takes part in stations; linked bots play their own queues.
+func (p *Player) readStation() {
+	p.station, p.following = "", false
+	if p.BotID != "" {
+		return
+	}
+
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	name, leader, err := GuildStation(rconn, p.GuildID)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't get station")
+		return
+	}
+	p.station, p.following = name, name != "" && leader != p.GuildID
+}
+
+// readStationTrack returns what the station the player follows is playing, with its offset set to
+// where the leader is in it, or nil if nothing is, or it's finished or been skipped here already.
+func (p *Player) readStationTrack() *TrackEnvelope {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	track, err := ReadStationTrack(rconn, p.GuildID)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't get station track")
+		return nil
+	}
+	if track == nil || track.Envelope.Track.Equals(p.stationDone) {
+		return nil
+	}
+
+	// Joining just as a track ends would only get as far as finding nothing left of it.
+	envelope := track.Envelope
+	envelope.Offset = track.Offset(time.Now())
+	if length := envelope.Track.GetInfo().Duration; length > 0 && envelope.Offset >= length {
+		return nil
+	}
+	return &envelope
+}
+
+// broadcastStation tells the station the player leads what it's playing, having started it at
+// offset, or that it's playing nothing, if envelope is nil.
+func (p *Player) broadcastStation(envelope *TrackEnvelope, offset time.Duration) {
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	var track *StationTrack
+	if envelope != nil {
+		track = &StationTrack{Envelope: *envelope, Started: time.Now().Add(-offset)}
+		track.Envelope.Offset = 0
+	}
+	if err := BroadcastStationTrack(rconn, p.station, p.GuildID, track); err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't broadcast to station")
+	}
+}
+
+// cmdStation shows, creates, joins or leaves a station: a shared listening party across guilds,
+// where every guild that joins plays whatever the one that created it is playing, in near-sync.
+func cmdStation(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	if r.Linked {
+		r.reply(msg.ChannelID, msg.Author.ID, "Only the main bot can take part in stations.")
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	if len(args) == 0 {
+		name, leader, err := GuildStation(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't get station")
+			return
+		}
+		if name == "" || leader == "" {
+			r.reply(msg.ChannelID, msg.Author.ID, "This server isn't in a station; start one with `station create <name>`, or join one with `station join <name>`.")
+			return
+		}
+		guilds, err := StationGuilds(rconn, name)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't list station guilds")
+			return
+		}
+		if leader == channel.GuildID {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("This server leads station `%s`, with %d servers in it.", name, len(guilds)))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("This server follows station `%s`, with %d servers in it.", name, len(guilds)))
+		return
+	}
+
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to manage stations.")
+		return
+	}
+
+	sub := strings.ToLower(args[0])
+	if sub == "leave" {
+		name, err := LeaveStation(rconn, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't leave station")
+			return
+		}
+		if name == "" {
+			r.reply(msg.ChannelID, msg.Author.ID, "This server isn't in a station.")
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Left station `%s`.", name))
+		return
+	}
+	if (sub != "create" && sub != "join") || len(args) != 2 {
+		r.reply(msg.ChannelID, msg.Author.ID, "Usage: `station [create <name>|join <name>|leave]`")
+		return
+	}
+	name := strings.ToLower(args[1])
+	if !namePattern.MatchString(name) {
+		r.reply(msg.ChannelID, msg.Author.ID, "Station names can only have letters, numbers, dashes and underscores.")
+		return
+	}
+
+	if current, _, err := GuildStation(rconn, channel.GuildID); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get station")
+		return
+	} else if current != "" {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("This server is in station `%s` already; `station leave` it first.", current))
+		return
+	}
+
+	if sub == "create" {
+		ok, err := CreateStation(rconn, name, channel.GuildID)
+		if err != nil {
+			ResponderLog.WithError(err).Error("Couldn't create station")
+			return
+		}
+		if !ok {
+			r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's a station called `%s` already.", name))
+			return
+		}
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Created station `%s`; other servers can play along with this one with `station join %s`.", name, name))
+		return
+	}
+
+	// Following a station takes over the bot, so it goes wherever whoever joined it is.
+	vcid := r.voiceChannel(channel.GuildID, msg.Author.ID)
+	if vcid == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, "You must be in a voice channel to join a station.")
+		return
+	}
+	q := r.queue(channel.GuildID)
+	if r.djLocked(rconn, q, msg.ChannelID, msg.Author.ID) {
+		return
+	}
+	ok, err := JoinStation(rconn, name, channel.GuildID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't join station")
+		return
+	}
+	if !ok {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("There's no station called `%s`.", name))
+		return
+	}
+
+	r.activate(rconn, q, msg.ChannelID, vcid)
+	r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Joined station `%s`; this server's queue is on hold until it leaves with `station leave`.", name))
+}
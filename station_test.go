@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStationKeys(t *testing.T) {
+	assert.Equal(t, "hiqty:station:friday", KeyForStation("friday"))
+	assert.Equal(t, "hiqty:station:friday:guilds", KeyForStationGuilds("friday"))
+	assert.Equal(t, "hiqty:server:123:station", KeyForServerStation("123"))
+	assert.Equal(t, "hiqty:server:123:station_track", KeyForServerStationTrack("123"))
+
+	// Followers are woken by changes to their own keys, which the bus routes by guild.
+	assert.Equal(t, "123", GIDFromKey(KeyForServerStationTrack("123")))
+}
+
+func TestStationTrackOffset(t *testing.T) {
+	now := time.Date(2026, 10, 15, 20, 0, 0, 0, time.UTC)
+	track := StationTrack{Started: now.Add(-90 * time.Second)}
+	assert.Equal(t, 90*time.Second, track.Offset(now))
+
+	// A leader's clock running slightly ahead mustn't make followers seek before the start.
+	track.Started = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), track.Offset(now))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long daily statistics are kept around for.
+const StatsRetention = 400 * 24 * time.Hour
+
+// Statistic counter names; per-service counters are suffixed with ":<service ID>".
+const (
+	StatRequests     = "requests"
+	StatPlays        = "plays"
+	StatResolveError = "errors:resolve"
+	StatPlayError    = "errors:play"
+
+	// Latencies are recorded as a sum in milliseconds, and a count to average it over.
+	StatLatency = "latency"
+)
+
+// Guild size buckets, by upper bound on member count.
+var statsGuildSizeBuckets = []struct {
+	Name string
+	Max  int
+}{
+	{"1-10", 10},
+	{"11-100", 100},
+	{"101-1000", 1000},
+	{"1001-10000", 10000},
+	{"10001+", -1},
+}
+
+// StatsDay holds the statistics for a single day.
+type StatsDay struct {
+	Date       string           `json:"date"`
+	Counters   map[string]int64 `json:"counters"`
+	GuildSizes map[string]int64 `json:"guild_sizes"`
+}
+
+// StatsReport aggregates statistics over a range of days.
+type StatsReport struct {
+	From       string             `json:"from"`
+	To         string             `json:"to"`
+	Days       []StatsDay         `json:"days"`
+	Totals     map[string]int64   `json:"totals"`
+	ErrorRates map[string]float64 `json:"error_rates"`
+	Latencies  map[string]float64 `json:"latencies_ms"`
+}
+
+// RecordStats increments the given counters for today. Failing to record statistics is never
+// fatal, so errors are merely logged.
+func RecordStats(rconn redis.Conn, counters ...string) {
+	key := KeyForStats(time.Now())
+	for _, c := range counters {
+		rconn.Send("HINCRBY", key, c, 1)
+	}
+	rconn.Send("PEXPIRE", key, int64(StatsRetention/time.Millisecond))
+	if err := rconn.Flush(); err != nil {
+		log.WithError(err).Warn("Couldn't record statistics")
+		return
+	}
+	for i := 0; i < len(counters)+1; i++ {
+		if _, err := rconn.Receive(); err != nil {
+			log.WithError(err).Warn("Couldn't record statistics")
+		}
+	}
+}
+
+// RecordLatency adds a request's stage latencies to today's statistics.
+func RecordLatency(rconn redis.Conn, stages []LatencyStage) {
+	key := KeyForStats(time.Now())
+	for _, stage := range stages {
+		name := StatLatency + ":" + stage.Name
+		rconn.Send("HINCRBY", key, name, int64(stage.Duration/time.Millisecond))
+		rconn.Send("HINCRBY", key, name+":count", 1)
+	}
+	rconn.Send("PEXPIRE", key, int64(StatsRetention/time.Millisecond))
+	if err := rconn.Flush(); err != nil {
+		log.WithError(err).Warn("Couldn't record latency")
+		return
+	}
+	for i := 0; i < 2*len(stages)+1; i++ {
+		if _, err := rconn.Receive(); err != nil {
+			log.WithError(err).Warn("Couldn't record latency")
+		}
+	}
+}
+
+// RecordGuildSize records a guild's member count for today.
+func RecordGuildSize(rconn redis.Conn, gid string, members int) {
+	key := KeyForStatsGuilds(time.Now())
+	if _, err := rconn.Do("HSET", key, gid, members); err != nil {
+		log.WithError(err).Warn("Couldn't record guild size")
+		return
+	}
+	if _, err := rconn.Do("PEXPIRE", key, int64(StatsRetention/time.Millisecond)); err != nil {
+		log.WithError(err).Warn("Couldn't record guild size")
+	}
+}
+
+// ReadStatsReport reads statistics for every day in the given range, inclusive.
+func ReadStatsReport(rconn redis.Conn, from, to time.Time) (StatsReport, error) {
+	report := StatsReport{
+		From:       from.Format("2006-01-02"),
+		To:         to.Format("2006-01-02"),
+		Days:       []StatsDay{},
+		Totals:     map[string]int64{},
+		ErrorRates: map[string]float64{},
+		Latencies:  map[string]float64{},
+	}
+
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		counters, err := redis.Int64Map(rconn.Do("HGETALL", KeyForStats(day)))
+		if err != nil {
+			return report, err
+		}
+		sizes, err := redis.IntMap(rconn.Do("HGETALL", KeyForStatsGuilds(day)))
+		if err != nil {
+			return report, err
+		}
+
+		report.Days = append(report.Days, StatsDay{
+			Date:       day.Format("2006-01-02"),
+			Counters:   counters,
+			GuildSizes: bucketGuildSizes(sizes),
+		})
+		for k, v := range counters {
+			report.Totals[k] += v
+		}
+	}
+
+	// Error rates are resolve errors per request, and playback errors per play.
+	for k, v := range report.Totals {
+		var base string
+		switch {
+		case strings.HasPrefix(k, StatResolveError+":"):
+			base = StatRequests + strings.TrimPrefix(k, StatResolveError)
+		case strings.HasPrefix(k, StatPlayError+":"):
+			base = StatPlays + strings.TrimPrefix(k, StatPlayError)
+		default:
+			continue
+		}
+		if total := report.Totals[base] + v; total > 0 {
+			report.ErrorRates[k] = float64(v) / float64(total)
+		}
+	}
+
+	// Latencies are averaged over the requests that made it through each stage.
+	for k, v := range report.Totals {
+		if !strings.HasPrefix(k, StatLatency+":") || strings.HasSuffix(k, ":count") {
+			continue
+		}
+		if count := report.Totals[k+":count"]; count > 0 {
+			report.Latencies[k] = float64(v) / float64(count)
+		}
+	}
+
+	return report, nil
+}
+
+// Rows flattens the report into (date, metric, value) rows, for tabular output. Totals, error
+// rates and average latencies are included with "total" in place of a date.
+func (r StatsReport) Rows() [][3]string {
+	rows := [][3]string{}
+	add := func(date string, m map[string]string) {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			rows = append(rows, [3]string{date, k, m[k]})
+		}
+	}
+
+	for _, day := range r.Days {
+		m := map[string]string{}
+		for k, v := range day.Counters {
+			m[k] = strconv.FormatInt(v, 10)
+		}
+		for k, v := range day.GuildSizes {
+			m["guilds:"+k] = strconv.FormatInt(v, 10)
+		}
+		add(day.Date, m)
+	}
+
+	m := map[string]string{}
+	for k, v := range r.Totals {
+		m[k] = strconv.FormatInt(v, 10)
+	}
+	for k, v := range r.ErrorRates {
+		m["rate:"+k] = strconv.FormatFloat(v, 'f', 4, 64)
+	}
+	for k, v := range r.Latencies {
+		m["avg:"+k] = strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	add("total", m)
+
+	return rows
+}
+
+// bucketGuildSizes counts guilds by size bucket.
+func bucketGuildSizes(sizes map[string]int) map[string]int64 {
+	buckets := map[string]int64{}
+	for _, members := range sizes {
+		for _, b := range statsGuildSizeBuckets {
+			if b.Max < 0 || members <= b.Max {
+				buckets[b.Name]++
+				break
+			}
+		}
+	}
+	return buckets
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBucketGuildSizes(t *testing.T) {
+	buckets := bucketGuildSizes(map[string]int{"a": 3, "b": 10, "c": 11, "d": 50000})
+	assert.Equal(t, map[string]int64{"1-10": 2, "11-100": 1, "10001+": 1}, buckets)
+}
+
+func TestStatsReportRows(t *testing.T) {
+	report := StatsReport{
+		Days: []StatsDay{
+			{Date: "2017-01-01", Counters: map[string]int64{"plays:soundcloud": 2}, GuildSizes: map[string]int64{"1-10": 1}},
+		},
+		Totals:     map[string]int64{"plays:soundcloud": 2},
+		ErrorRates: map[string]float64{"errors:play:soundcloud": 0.5},
+		Latencies:  map[string]float64{"latency:total": 1234.5},
+	}
+	assert.Equal(t, [][3]string{
+		{"2017-01-01", "guilds:1-10", "1"},
+		{"2017-01-01", "plays:soundcloud", "2"},
+		{"total", "avg:latency:total", "1234.5"},
+		{"total", "plays:soundcloud", "2"},
+		{"total", "rate:errors:play:soundcloud", "0.5000"},
+	}, report.Rows())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// How many upcoming tracks a status page lists.
+const StatusPageTracks = 20
+
+// EnableStatusPage gives a guild a public status page, returning its slug. Any page it already
+// had is replaced, so a slug that's been shared too widely can be rotated.
+//
+// Unlike tokens, slugs are stored as they are: the page is public to anyone who has it, and
+// admins need to be able to look it up again.
+func EnableStatusPage(rconn redis.Conn, gid string) (string, error) {
+	if err := DisableStatusPage(rconn, gid); err != nil {
+		return "", err
+	}
+	slug, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	rconn.Send("MULTI")
+	rconn.Send("SET", KeyForStatusPage(slug), gid)
+	rconn.Send("SET", KeyForServerStatusPage(gid), slug)
+	_, err = rconn.Do("EXEC")
+	return slug, err
+}
+
+// DisableStatusPage takes down a guild's status page, if it has one.
+func DisableStatusPage(rconn redis.Conn, gid string) error {
+	slug, err := StatusPageSlug(rconn, gid)
+	if err != nil || slug == "" {
+		return err
+	}
+	_, err = rconn.Do("DEL", KeyForStatusPage(slug), KeyForServerStatusPage(gid))
+	return err
+}
+
+// StatusPageSlug returns the slug of a guild's status page, or "" if it doesn't have one.
+func StatusPageSlug(rconn redis.Conn, gid string) (string, error) {
+	slug, err := redis.String(rconn.Do("GET", KeyForServerStatusPage(gid)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return slug, err
+}
+
+// LookupStatusPage returns the guild a status page belongs to, or "" if there's no such page.
+func LookupStatusPage(rconn redis.Conn, slug string) (string, error) {
+	gid, err := redis.String(rconn.Do("GET", KeyForStatusPage(slug)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return gid, err
+}
+
+// StatusPage is what a status page shows.
+type StatusPage struct {
+	State    string
+	Playing  *TrackSummary
+	Upcoming []*TrackSummary
+	More     int // Upcoming tracks that aren't listed
+}
+
+// ReadStatusPage reads what a guild's status page shows.
+func ReadStatusPage(rconn redis.Conn, gid string) (StatusPage, error) {
+	state, err := readAPIState(rconn, gid)
+	if err != nil {
+		return StatusPage{}, err
+	}
+	page := StatusPage{State: state, Upcoming: []*TrackSummary{}}
+
+	q := ActivePlaylistQueue(rconn, GuildQueue(gid))
+	playing, err := ReadNowPlaying(rconn, q)
+	if err != nil {
+		return page, err
+	}
+	if playing != nil && state != StateStopped {
+		page.Playing = SummarizeTrack(*playing)
+	}
+
+	rconn.Send("LRANGE", q.PlaylistKey(), 0, StatusPageTracks-1)
+	rconn.Send("LLEN", q.PlaylistKey())
+	rconn.Flush()
+	datas, err := redis.ByteSlices(rconn.Receive())
+	if err != nil {
+		return page, err
+	}
+	length, err := redis.Int(rconn.Receive())
+	if err != nil {
+		return page, err
+	}
+
+	for _, data := range datas {
+		var envelope TrackEnvelope
+		if json.Unmarshal(data, &envelope) != nil {
+			continue
+		}
+		page.Upcoming = append(page.Upcoming, SummarizeTrack(envelope))
+	}
+	if length > len(datas) {
+		page.More = length - len(datas)
+	}
+	return page, nil
+}
+
+// HandleStatusPage handles GET /status/<slug>, a read-only page showing what's playing in a guild,
+// for embedding in community sites. It refreshes itself every so often.
+func (s *HTTPServer) HandleStatusPage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	gid, err := LookupStatusPage(rconn, strings.TrimPrefix(req.URL.Path, "/status/"))
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't look up status page")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if gid == "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	page, err := ReadStatusPage(rconn, gid)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't read status page")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=10")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := statusPageTemplate.Execute(w, page); err != nil {
+		log.WithError(err).Warn("HTTPServer: Couldn't write status page")
+	}
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="30">
+<title>{{if .Playing}}{{.Playing.Title}}{{else}}Nothing playing{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+img { max-width: 6em; float: left; margin-right: 1em; }
+ol { clear: both; padding-left: 1.5em; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+{{with .Playing}}
+<p>{{if .CoverURL}}<img src="{{.CoverURL}}" alt="">{{end}}
+<strong><a href="{{.URL}}" target="_blank" rel="noopener">{{.Title}}</a></strong>
+{{if .Artist}}<br>{{.Artist}}{{end}}
+{{if eq $.State "paused"}}<br><span class="muted">Paused</span>{{end}}</p>
+{{else}}
+<p class="muted">Nothing playing.</p>
+{{end}}
+{{if .Upcoming}}
+<ol>
+{{range .Upcoming}}<li><a href="{{.URL}}" target="_blank" rel="noopener">{{.Title}}</a>{{if .Artist}} <span class="muted">{{.Artist}}</span>{{end}}</li>
+{{end}}</ol>
+{{if .More}}<p class="muted">...and {{.More}} more.</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
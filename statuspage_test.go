@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStatusPageTemplate(t *testing.T) {
+	page := StatusPage{
+		State:    StatePaused,
+		Playing:  &TrackSummary{Title: "<b>Song</b>", URL: "https://example.com/1", Artist: "Artist"},
+		Upcoming: []*TrackSummary{{Title: "Next", URL: "https://example.com/2"}},
+		More:     3,
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, statusPageTemplate.Execute(&buf, page))
+	assert.Contains(t, buf.String(), "&lt;b&gt;Song&lt;/b&gt;")
+	assert.Contains(t, buf.String(), "Paused")
+	assert.Contains(t, buf.String(), `<a href="https://example.com/2" target="_blank" rel="noopener">Next</a>`)
+	assert.Contains(t, buf.String(), "...and 3 more.")
+
+	buf.Reset()
+	assert.NoError(t, statusPageTemplate.Execute(&buf, StatusPage{State: StateStopped}))
+	assert.Contains(t, buf.String(), "Nothing playing.")
+	assert.NotContains(t, buf.String(), "<ol>")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"github.com/sencrash/hiqty/media"
+	"time"
+)
+
+// A Store holds the playback state the Responder, Player and PlayerController share: playlists,
+// player states, active voice channels, and what recent messages requested.
+//
+// RedisStore is the one the bot runs on. MemoryStore keeps everything within a single process, for
+// tests of what's built on a Store; it's not a way to run without Redis, as settings, templates,
+// statistics, locks and deduplicating messages still go through it directly.
+type Store interface {
+	// Push appends envelopes to a queue's playlist.
+	Push(q Queue, envelopes ...TrackEnvelope) error
+
+	// NowPlaying returns the envelope that's playing from a queue's playlist, or nil if nothing is.
+	// An envelope that can't be decoded is set aside as a DeadLetter.
+	NowPlaying(q Queue) (*TrackEnvelope, error)
+
+	// Advance takes the next envelope off a queue's playlist and makes it the one that's playing,
+	// returning it, or nil if the playlist is empty. Envelopes that can't be decoded are set aside as
+	// DeadLetters.
+	Advance(q Queue) (*TrackEnvelope, error)
+
+	// ReplaceNowPlaying replaces the envelope that's playing, if it's still for the given track.
+	ReplaceNowPlaying(q Queue, track media.Track, envelope TrackEnvelope) error
+
+	// Finish discards the envelope that's playing, if it's still for the given track.
+	Finish(q Queue, track media.Track) error
+
+	// Len returns the number of envelopes in a playlist, not including the one that's playing.
+	Len(q Queue) (int, error)
+
+	// Skip discards the envelope that's playing, returning false if nothing was.
+	Skip(q Queue) (bool, error)
+
+	// Remove removes envelopes that match a predicate from a playlist, returning the number
+	// removed. The one that's playing isn't in it anymore, so it's left alone.
+	Remove(q Queue, match func(TrackEnvelope) bool) (int, error)
+
+	// Migrate moves a playlist, and the envelope playing from it, to another queue, if that one's
+	// empty.
+	Migrate(from, to Queue) error
+
+	// Clear forgets a queue's playback state: its playlists, what's playing from them and their dead
+	// letters, its player state and channel, and the requests made into it and votes on them.
+	Clear(q Queue) error
+
+	// State returns a queue's player state, or "" if it has none.
+	State(q Queue) (string, error)
+
+	// SetState sets a queue's player state.
+	SetState(q Queue, state string) error
+
+	// Channel returns the voice channel a queue plays in, or "" if it has none.
+	Channel(q Queue) (string, error)
+
+	// SetChannel sets the voice channel a queue plays in.
+	SetChannel(q Queue, cid string) error
+
+	// Request returns what a message requested into a queue; if it's not on record (anymore), it
+	// has no URLs.
+	Request(q Queue, mid string) (StoredRequest, error)
+
+	// SetRequest records what a message requested into a queue, until its TTL runs out.
+	SetRequest(q Queue, mid string, req StoredRequest) error
+
+	// DeleteRequest forgets what a message requested.
+	DeleteRequest(q Queue, mid string) error
+
+	// Subscribe watches a queue's player state and voice channel, its guild's settings, and the
+	// soundboard clips and announcements waiting to be played in it (see QueueClip and
+	// QueueAnnouncement), and for a guild's main bot, the station it follows (see cmdStation), for
+	// changes.
+	Subscribe(q Queue)
+
+	// Unsubscribe undoes a previous Subscribe().
+	Unsubscribe(q Queue)
+
+	// SubscribePlaylist watches a playlist, and the envelope playing from it, for changes, so the
+	// Player playing from it can follow them.
+	SubscribePlaylist(q Queue)
+
+	// UnsubscribePlaylist undoes a previous SubscribePlaylist().
+	UnsubscribePlaylist(q Queue)
+
+	// Watch returns a pipeline of guild IDs whose subscribed keys have changed, until the context
+	// expires. Subscribing also sends an event, so the current state can be picked up.
+	Watch(ctx context.Context) (<-chan string, error)
+}
+
+// A StoredRequest is the record of what a message requested, so edits and deletions can be
+// reconciled with the playlist.
+type StoredRequest struct {
+	URLs      []string
+	ChannelID string        // The voice channel the request was made from
+	TTL       time.Duration // How much longer the record is kept around for
+}
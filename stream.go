@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Defaults for StreamConfig.
+const (
+	DefaultStreamChunkSize = 16 * 1024 // Bytes
+	DefaultStreamBuffer    = 16        // Chunks, ie. 256KiB
+)
+
+// How many Opus packets are buffered ahead of the voice connection; one is 20ms of audio.
+const PacketBuffer = 50
+
+// StreamConfig tunes the pipeline a track is streamed through, from its media response into the
+// encoder. Zero values are replaced with defaults.
+type StreamConfig struct {
+	ChunkSize int // How much to read from the response at a time, in bytes
+	Buffer    int // How many chunks to read ahead of the encoder
+}
+
+func (c StreamConfig) chunkSize() int {
+	if c.ChunkSize <= 0 {
+		return DefaultStreamChunkSize
+	}
+	return c.ChunkSize
+}
+
+func (c StreamConfig) buffer() int {
+	if c.Buffer <= 0 {
+		return DefaultStreamBuffer
+	}
+	return c.Buffer
+}
+
+// Chunks are recycled once the encoder is done with them, as allocating a fresh one for every read
+// adds up with many guilds playing at once. There's a pool for each chunk size in use.
+var chunkPools = map[int]*sync.Pool{}
+var chunkPoolsMutex sync.Mutex
+
+func chunkPool(size int) *sync.Pool {
+	chunkPoolsMutex.Lock()
+	defer chunkPoolsMutex.Unlock()
+
+	pool := chunkPools[size]
+	if pool == nil {
+		pool = &sync.Pool{New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		chunkPools[size] = pool
+	}
+	return pool
+}
+
+// getChunk returns a buffer to read a chunk into, which should be given back with releaseChunk once
+// it's been consumed.
+func getChunk(size int) []byte {
+	return *chunkPool(size).Get().(*[]byte)
+}
+
+// releaseChunk gives a chunk from getChunk back to be reused; nothing may hold on to it after.
+func releaseChunk(chunk []byte) {
+	buf := chunk[:cap(chunk)]
+	chunkPool(len(buf)).Put(&buf)
+}
+
+// The pipeline's stages each run in a goroutine, connected by bounded channels: a stage that gets
+// ahead of the next one blocks, rather than buffering the whole track, and every stage gives up as
+// soon as the context is cancelled, rather than blocking forever on a consumer that's gone.
+
+// streamResponse is a pipeline stage that reads a media response in chunks. Chunks come from
+// getChunk; whoever consumes them should release them.
+func (p *Player) streamResponse(ctx context.Context, body io.ReadCloser) <-chan []byte {
+	ch := make(chan []byte, p.Stream.buffer())
+
+	// Closing the body is the only way to interrupt a read that's blocked on a slow server.
+	var closeOnce sync.Once
+	closeBody := func() { closeOnce.Do(func() { body.Close() }) }
+	stop := make(chan struct{})
+	p.Supervisor.Go(ctx, p.GuildID, "download-closer", func() {
+		select {
+		case <-ctx.Done():
+			closeBody()
+		case <-stop:
+		}
+	})
+
+	p.Supervisor.Go(ctx, p.GuildID, "download", func() {
+		defer close(ch)
+		defer close(stop)
+		defer closeBody()
+
+		size := p.Stream.chunkSize()
+		for {
+			buf := getChunk(size)
+			l, err := body.Read(buf)
+
+			// Readers may return data along with an error, including io.EOF.
+			if l == 0 {
+				releaseChunk(buf)
+			} else if !sendChunk(ctx, ch, buf[:l]) {
+				releaseChunk(buf)
+				return
+			}
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					PlayerLog.WithError(err).WithField("gid", p.GuildID).Error("Player: Couldn't read HTTP response")
+				}
+				return
+			}
+		}
+	})
+	return ch
+}
+
+// streamPackets is the pipeline's last stage, buffering encoded packets ahead of the voice
+// connection, so it isn't starved by hiccups upstream.
+func (p *Player) streamPackets(ctx context.Context, indata <-chan []byte) <-chan []byte {
+	ch := make(chan []byte, PacketBuffer)
+	p.Supervisor.Go(ctx, p.GuildID, "packets", func() {
+		defer close(ch)
+
+		for {
+			select {
+			case pkt, ok := <-indata:
+				if !ok || !sendChunk(ctx, ch, pkt) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	return ch
+}
+
+// sendChunk sends a chunk or packet to the next stage, returning false if the context was
+// cancelled first.
+func sendChunk(ctx context.Context, ch chan<- []byte, b []byte) bool {
+	select {
+	case ch <- b:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// errOpusSendTimeout is returned by sendOpus when a voice connection stops taking packets.
+var errOpusSendTimeout = errors.New("voice connection stopped taking packets")
+
+// sendOpus sends an Opus packet to a voice connection, giving up if the player's stopped or its
+// context is cancelled, or if the connection doesn't take it within OpusSendTimeout.
+func sendOpus(ctx context.Context, stop <-chan interface{}, ch chan<- []byte, pkt []byte) error {
+	// The connection's almost always ready for it, so don't bother with a timer.
+	select {
+	case ch <- pkt:
+		return nil
+	default:
+	}
+
+	timeout := time.NewTimer(OpusSendTimeout)
+	defer timeout.Stop()
+	select {
+	case ch <- pkt:
+		return nil
+	case <-stop:
+		return context.Canceled
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout.C:
+		return errOpusSendTimeout
+	}
+}
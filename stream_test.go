@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// eofReader returns its last data along with io.EOF, as readers may.
+type eofReader struct{ r *bytes.Reader }
+
+func (e eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == nil && e.r.Len() == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestStreamResponse(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	p := &Player{Stream: StreamConfig{ChunkSize: 64, Buffer: 2}}
+	ch := p.streamResponse(context.Background(), ioutil.NopCloser(eofReader{bytes.NewReader(data)}))
+
+	var out []byte
+	for chunk := range ch {
+		assert.True(t, len(chunk) <= 64)
+		out = append(out, chunk...)
+	}
+	assert.Equal(t, data, out)
+}
+
+func TestStreamResponseCancel(t *testing.T) {
+	// Reads block until the body is closed, like a stalled download.
+	r, w := io.Pipe()
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := (&Player{}).streamResponse(ctx, r)
+	cancel()
+
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("stage didn't stop")
+	}
+}
+
+func TestStreamPacketsCancel(t *testing.T) {
+	in := make(chan []byte)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := (&Player{}).streamPackets(ctx, in)
+
+	// Fill the buffer, then stop reading; the stage must still stop once cancelled.
+	for i := 0; i < PacketBuffer+1; i++ {
+		in <- []byte{byte(i)}
+	}
+	cancel()
+
+	n := 0
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				assert.True(t, n <= PacketBuffer)
+				return
+			}
+			n++
+		case <-timeout:
+			t.Fatal("stage didn't stop")
+		}
+	}
+}
+
+func TestSendOpusCancel(t *testing.T) {
+	// Nothing reads from the sink, like a voice connection that's dropped.
+	sink := make(chan []byte)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- sendOpus(ctx, nil, sink, []byte{0}) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(OpusSendTimeout / 2):
+		t.Fatal("send didn't stop")
+	}
+}
+
+func TestSendOpusStop(t *testing.T) {
+	stop := make(chan interface{})
+	close(stop)
+	assert.Error(t, sendOpus(context.Background(), stop, make(chan []byte), []byte{0}))
+}
+
+func TestSendOpus(t *testing.T) {
+	sink := make(chan []byte, 1)
+	assert.NoError(t, sendOpus(context.Background(), nil, sink, []byte{1}))
+	assert.Equal(t, []byte{1}, <-sink)
+}
+
+func BenchmarkStreamResponse(b *testing.B) {
+	data := bytes.Repeat([]byte{0}, 1024*1024)
+	p := &Player{}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for chunk := range p.streamResponse(context.Background(), ioutil.NopCloser(bytes.NewReader(data))) {
+			releaseChunk(chunk)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// How long a player's goroutines get to exit once they've been told to, before they're reported as
+// overdue, and presumably leaked.
+const GoroutineShutdownDeadline = 10 * time.Second
+
+// A Supervisor keeps track of the goroutines players run: the stages of their pipelines, and
+// anything else they leave running in the background. Goroutines can't be killed, but ones that
+// keep running long after their context has ended, eg. because they're blocked on a channel nobody
+// reads anymore, are logged and counted (see MetricOverdueGoroutines), so leaks are caught before
+// they pile up.
+//
+// A nil Supervisor runs goroutines without keeping track of them.
+type Supervisor struct {
+	Deadline time.Duration // Defaults to GoroutineShutdownDeadline
+
+	running map[string]map[*supervisedGoroutine]bool // Keyed by guild ID
+	mutex   sync.Mutex
+}
+
+type supervisedGoroutine struct {
+	stage    string
+	ctx      context.Context
+	stopping time.Time // When its context was first seen to have ended
+	overdue  bool
+	done     chan struct{}
+}
+
+// Go runs fn in a goroutine, on behalf of a guild. The goroutine should return soon after the
+// context ends; stage names it in logs and metrics.
+func (s *Supervisor) Go(ctx context.Context, gid, stage string, fn func()) {
+	if s == nil {
+		go fn()
+		return
+	}
+
+	g := &supervisedGoroutine{stage: stage, ctx: ctx, done: make(chan struct{})}
+	s.mutex.Lock()
+	if s.running == nil {
+		s.running = map[string]map[*supervisedGoroutine]bool{}
+	}
+	if s.running[gid] == nil {
+		s.running[gid] = map[*supervisedGoroutine]bool{}
+	}
+	s.running[gid][g] = true
+	s.mutex.Unlock()
+	MetricGoroutines.AddFor(stage, 1)
+
+	go func() {
+		defer func() {
+			s.mutex.Lock()
+			delete(s.running[gid], g)
+			if len(s.running[gid]) == 0 {
+				delete(s.running, gid)
+			}
+			s.mutex.Unlock()
+			MetricGoroutines.AddFor(stage, -1)
+			close(g.done)
+		}()
+		fn()
+	}()
+}
+
+// Wait waits for a guild's goroutines to exit, for up to a timeout, and returns the stages of the
+// ones that are still running.
+func (s *Supervisor) Wait(gid string, timeout time.Duration) []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	gs := make([]*supervisedGoroutine, 0, len(s.running[gid]))
+	for g := range s.running[gid] {
+		gs = append(gs, g)
+	}
+	s.mutex.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	var stages []string
+	for _, g := range gs {
+		select {
+		case <-g.done:
+			continue
+		case <-deadline.C:
+		}
+		select {
+		case <-g.done:
+		default:
+			stages = append(stages, g.stage)
+		}
+	}
+	return stages
+}
+
+// Run checks for overdue goroutines every so often, until the context expires. It should outlive
+// the players it supervises, to keep an eye on them while they shut down.
+func (s *Supervisor) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.deadline() / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.check(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Supervisor) deadline() time.Duration {
+	if s.Deadline <= 0 {
+		return GoroutineShutdownDeadline
+	}
+	return s.Deadline
+}
+
+// check reports goroutines whose contexts ended more than a deadline ago, once each.
+func (s *Supervisor) check(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for gid, gs := range s.running {
+		for g := range gs {
+			if g.overdue || g.ctx.Err() == nil {
+				continue
+			}
+			if g.stopping.IsZero() {
+				g.stopping = now
+				continue
+			}
+			if now.Sub(g.stopping) < s.deadline() {
+				continue
+			}
+			g.overdue = true
+			MetricOverdueGoroutines.IncFor(g.stage)
+			log.WithFields(log.Fields{"gid": gid, "stage": g.stage}).Warn("Supervisor: Goroutine didn't stop in time, and may have leaked")
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	s := &Supervisor{Deadline: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// One goroutine stops when told to; the other is stuck on a channel nobody sends on.
+	stuck := make(chan struct{})
+	s.Go(ctx, "1", "good", func() { <-ctx.Done() })
+	s.Go(ctx, "1", "stuck", func() { <-stuck })
+	cancel()
+
+	assert.Equal(t, []string{"stuck"}, s.Wait("1", 50*time.Millisecond))
+	assert.Nil(t, s.Wait("2", time.Second))
+
+	// It's reported once it's been stopping for longer than the deadline.
+	now := time.Now()
+	s.check(now)
+	s.check(now.Add(time.Second))
+	s.mutex.Lock()
+	for g := range s.running["1"] {
+		assert.True(t, g.overdue)
+	}
+	s.mutex.Unlock()
+
+	close(stuck)
+	assert.Nil(t, s.Wait("1", time.Second))
+	assert.Len(t, s.running, 0)
+}
+
+func TestSupervisorNil(t *testing.T) {
+	var s *Supervisor
+	done := make(chan struct{})
+	s.Go(context.Background(), "1", "test", func() { close(done) })
+	<-done
+	assert.Nil(t, s.Wait("1", time.Second))
+}
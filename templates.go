@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sencrash/hiqty/media"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Maximum length of a rendered template; Discord refuses longer messages.
+const MaxTemplateOutput = 2000
+
+// Templates holds the text templates for announcements and replies, by name. They can be overridden
+// for the whole deployment with --template-dir, and per guild with the template command.
+var Templates = map[string]string{
+	// Posted along with each queued track's embed; nothing by default.
+	"announce": "",
+	// Posted along with the summary of a batch of tracks queued at once (see MaxAnnouncedTracks);
+	// nothing by default.
+	"announce-batch": "",
+
+	"not-in-voice":      "You must be in a voice channel to request tracks.",
+	"waiting-for-voice": "Join a voice channel in the next 2 minutes, and I'll queue that for you.",
+	"deferred-queued":   "You joined a voice channel, so I've queued {{.Added}} track(s) from your request.",
+	"request-updated":   "Updated your request: removed {{.Removed}} track(s), added {{.Added}}.",
+	"request-revoked":   "Removed {{.Removed}} track(s) requested by a deleted message.",
+	"schedule-queued":   "It's time! I've queued {{.Added}} scheduled track(s).",
+
+	// Spoken when a track starts, with the speak-tracks setting on.
+	"now-playing-spoken": "Now playing: {{.Track.Title}}, by {{.Track.User.Name}}.",
+}
+
+// TemplateData is what templates have to work with.
+type TemplateData struct {
+	Track   media.TrackInfo // The track concerned, if any
+	Service string          // ID of the track's service
+
+	User  TemplateUser
+	Guild TemplateGuild
+
+	Added   int
+	Removed int
+}
+
+type TemplateUser struct {
+	ID      string
+	Name    string
+	Mention string
+}
+
+type TemplateGuild struct {
+	ID   string
+	Name string
+}
+
+// LoadTemplates overrides templates with files named after them in a directory, eg.
+// "announce.tmpl". Files for unknown templates are an error, as they're most likely typos.
+func LoadTemplates(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".tmpl")
+		if _, ok := Templates[name]; !ok {
+			return errors.New("unknown template: " + name)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		text := strings.TrimRight(string(data), "\n")
+		if _, err := parseTemplate(name, text); err != nil {
+			return err
+		}
+		Templates[name] = text
+	}
+	return nil
+}
+
+// ReadTemplate returns a guild's template, falling back to the deployment's.
+func ReadTemplate(rconn redis.Conn, gid, name string) (string, error) {
+	text, err := redis.String(rconn.Do("HGET", KeyForServerTemplates(gid), name))
+	if err == redis.ErrNil {
+		return Templates[name], nil
+	}
+	return text, err
+}
+
+// WriteTemplate validates and stores a guild's template.
+func WriteTemplate(rconn redis.Conn, gid, name, text string) error {
+	if _, ok := Templates[name]; !ok {
+		return errors.New("unknown template: " + name)
+	}
+	if _, err := parseTemplate(name, text); err != nil {
+		return err
+	}
+	_, err := rconn.Do("HSET", KeyForServerTemplates(gid), name, text)
+	return err
+}
+
+// ResetTemplate reverts a guild's template to the deployment's.
+func ResetTemplate(rconn redis.Conn, gid, name string) error {
+	_, err := rconn.Do("HDEL", KeyForServerTemplates(gid), name)
+	return err
+}
+
+// RenderTemplate renders a guild's template. If it's broken, eg. referring to a field that no
+// longer exists, the deployment's is used instead.
+func RenderTemplate(rconn redis.Conn, gid, name string, data TemplateData) (string, error) {
+	text, err := ReadTemplate(rconn, gid, name)
+	if err != nil {
+		return "", err
+	}
+	out, err := executeTemplate(name, text, data)
+	if err != nil && text != Templates[name] {
+		out, err = executeTemplate(name, Templates[name], data)
+	}
+	return out, err
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+func executeTemplate(name, text string, data TemplateData) (string, error) {
+	tmpl, err := parseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	out := strings.TrimSpace(buf.String())
+	if len(out) > MaxTemplateOutput {
+		out = strings.ToValidUTF8(out[:MaxTemplateOutput], "")
+	}
+	return out, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/sencrash/hiqty/media"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestExecuteTemplate(t *testing.T) {
+	data := TemplateData{
+		Track: media.TrackInfo{Title: "Song", User: media.TrackUserInfo{Name: "Artist"}},
+		User:  TemplateUser{Mention: "<@1>"},
+		Added: 2,
+	}
+
+	out, err := executeTemplate("test", "  {{.User.Mention}} queued {{.Track.Title}} by {{.Track.User.Name}} (+{{.Added}})\n", data)
+	assert.NoError(t, err)
+	assert.Equal(t, "<@1> queued Song by Artist (+2)", out)
+
+	_, err = executeTemplate("test", "{{.Nope}}", data)
+	assert.Error(t, err)
+
+	// Output is capped to what Discord accepts.
+	out, err = executeTemplate("test", strings.Repeat("x", 3000), data)
+	assert.NoError(t, err)
+	assert.Len(t, out, MaxTemplateOutput)
+}
+
+func TestBuiltinTemplates(t *testing.T) {
+	for name, text := range Templates {
+		_, err := executeTemplate(name, text, TemplateData{})
+		assert.NoError(t, err, name)
+	}
+}
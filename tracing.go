@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+// A request's trace is made up of a "request" span, started by the Responder when a message comes
+// in, with spans for resolving each of its URLs and for enqueueing what they resolved to. Its span
+// context travels with the tracks it queued, in their envelopes' timing, and the Player adds spans
+// for how long each waited in the queue, and how long it took to start playing; a track that's
+// dropped before it's heard has that span marked as failed, with why.
+//
+// Without --otlp-endpoint, the global tracer provider is a no-op, and so are all of these.
+
+// Propagates span contexts in envelopes, as W3C Trace Context headers.
+var tracePropagator = propagation.TraceContext{}
+
+// NewTracerProvider creates a tracer provider that exports spans in batches to an OpenTelemetry
+// collector, over OTLP/HTTP; eg. "http://localhost:4318".
+func NewTracerProvider(ctx context.Context, endpoint, serviceName string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimRight(endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	), nil
+}
+
+// tracer returns the tracer spans are started with, from whichever provider is in use.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/sencrash/hiqty")
+}
+
+// injectTrace returns the span context of a context's span, to be stored along with a request, or
+// nil if it has none.
+func injectTrace(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTrace returns a context with a span context stored by injectTrace, to start child spans
+// of it with.
+func extractTrace(carrier map[string]string) context.Context {
+	return tracePropagator.Extract(context.Background(), propagation.MapCarrier(carrier))
+}
+
+// endSpan ends a span, marking it as failed if there's an error.
+func endSpan(span trace.Span, err error, opts ...trace.SpanEndOption) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(opts...)
+}
+
+// startRequestSpan starts the span of a request, received at a given time, in a guild.
+func startRequestSpan(gid string, received time.Time) (context.Context, trace.Span) {
+	return tracer().Start(context.Background(), "request",
+		trace.WithTimestamp(received),
+		trace.WithAttributes(attribute.String("guild.id", gid)),
+	)
+}
+
+// startPlaySpan adds the time a track waited in the queue to its request's trace, if it's traced,
+// and starts a span for starting it, at the given time; it's to be ended once the track's first
+// frame has been sent, or it's dropped before then.
+func startPlaySpan(gid string, envelope TrackEnvelope, started time.Time) trace.Span {
+	ctx := extractTrace(envelope.Timing.Trace)
+	attrs := trace.WithAttributes(
+		attribute.String("guild.id", gid),
+		attribute.String("track.service", envelope.ServiceID),
+		attribute.String("track.url", envelope.Track.GetInfo().URL),
+	)
+	if enqueued := envelope.Timing.Enqueued; !enqueued.IsZero() {
+		_, wait := tracer().Start(ctx, LatencyWait, trace.WithTimestamp(enqueued), attrs)
+		wait.End(trace.WithTimestamp(started))
+	}
+	_, span := tracer().Start(ctx, LatencyStart, trace.WithTimestamp(started), attrs)
+	return span
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sencrash/hiqty/media/soundcloud"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+// recordSpans has spans recorded instead of exported, until the test is over.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return recorder
+}
+
+func TestInjectTrace(t *testing.T) {
+	recordSpans(t)
+
+	// Nothing to inject without a span.
+	assert.Nil(t, injectTrace(context.Background()))
+
+	ctx, span := startRequestSpan("123", time.Now())
+	defer span.End()
+	carrier := injectTrace(ctx)
+	assert.Contains(t, carrier, "traceparent")
+
+	// It survives being stored in an envelope.
+	data, err := json.Marshal(RequestTiming{Trace: carrier})
+	assert.NoError(t, err)
+	var timing RequestTiming
+	assert.NoError(t, json.Unmarshal(data, &timing))
+	extracted := trace.SpanContextFromContext(extractTrace(timing.Trace))
+	assert.Equal(t, span.SpanContext().TraceID(), extracted.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), extracted.SpanID())
+}
+
+func TestStartPlaySpan(t *testing.T) {
+	recorder := recordSpans(t)
+
+	t0 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx, request := startRequestSpan("123", t0)
+	request.End(trace.WithTimestamp(t0.Add(300 * time.Millisecond)))
+
+	envelope := TrackEnvelope{
+		ServiceID: "soundcloud",
+		Track:     &soundcloud.Track{ID: 1},
+		Timing:    RequestTiming{Trace: injectTrace(ctx), Enqueued: t0.Add(300 * time.Millisecond)},
+	}
+	span := startPlaySpan("123", envelope, t0.Add(1*time.Second))
+	endSpan(span, errors.New("skipped"), trace.WithTimestamp(t0.Add(1200*time.Millisecond)))
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	wait, start := spans[1], spans[2]
+	assert.Equal(t, LatencyWait, wait.Name())
+	assert.Equal(t, envelope.Timing.Enqueued, wait.StartTime())
+	assert.Equal(t, t0.Add(1*time.Second), wait.EndTime())
+	assert.Equal(t, LatencyStart, start.Name())
+	assert.Equal(t, t0.Add(1200*time.Millisecond), start.EndTime())
+	assert.Equal(t, codes.Error, start.Status().Code)
+	assert.Equal(t, "skipped", start.Status().Description)
+	for _, s := range []sdktrace.ReadOnlySpan{wait, start} {
+		assert.Equal(t, request.SpanContext().TraceID(), s.Parent().TraceID())
+		assert.Equal(t, request.SpanContext().SpanID(), s.Parent().SpanID())
+	}
+}
+
+func TestStartPlaySpanUntraced(t *testing.T) {
+	recorder := recordSpans(t)
+
+	// Tracks that weren't requested in a message start traces of their own.
+	span := startPlaySpan("123", TrackEnvelope{ServiceID: "soundcloud", Track: &soundcloud.Track{ID: 1}}, time.Now())
+	span.End()
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	assert.Equal(t, LatencyStart, spans[0].Name())
+	assert.False(t, spans[0].Parent().IsValid())
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/sencrash/hiqty/media"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Longest announcement that can be spoken, in characters.
+const MaxAnnouncementLength = 200
+
+// How long a TTS backend gets to speak an announcement.
+const TTSTimeout = 10 * time.Second
+
+// A TTS turns text into speech, for announcements in voice channels; see --tts.
+type TTS interface {
+	// Speak returns audio of the text being spoken, in any format ffmpeg understands.
+	Speak(ctx context.Context, text string) (io.ReadCloser, error)
+}
+
+// NewTTS creates a TTS backend from a spec: an HTTP(S) URL for an HTTPTTS, or else a command line
+// for a CommandTTS.
+func NewTTS(spec string) (TTS, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		if _, err := neturl.Parse(spec); err != nil {
+			return nil, err
+		}
+		return &HTTPTTS{URL: spec}, nil
+	}
+	args := strings.Fields(spec)
+	if len(args) == 0 {
+		return nil, errors.New("empty TTS command")
+	}
+	return &CommandTTS{Command: args}, nil
+}
+
+// An HTTPTTS speaks with an HTTP service, eg. a MaryTTS, Coqui TTS or Piper server: text is sent as
+// the "text" query parameter, added to any already in the URL, and the response is the audio.
+type HTTPTTS struct {
+	URL    string
+	Client http.Client
+}
+
+func (t *HTTPTTS) Speak(ctx context.Context, text string) (io.ReadCloser, error) {
+	u, err := neturl.Parse(t.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("text", text)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.Errorf("TTS service responded with %s", res.Status)
+	}
+	return res.Body, nil
+}
+
+// A CommandTTS speaks by running a command, which is given the text on stdin and writes the audio
+// to stdout, eg. "espeak-ng --stdin --stdout".
+type CommandTTS struct {
+	Command []string
+}
+
+func (t *CommandTTS) Speak(ctx context.Context, text string) (io.ReadCloser, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.Command[0], t.Command[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return nil, errors.Wrap(err, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(out)), nil
+}
+
+// QueueAnnouncement has a queue's Player speak an announcement as soon as it can, returning false
+// if too many are waiting already. They wait along with soundboard clips, and have the same limits.
+func QueueAnnouncement(rconn redis.Conn, q Queue, text string) (bool, error) {
+	key := q.AnnouncementQueueKey()
+	rconn.Send("MULTI")
+	rconn.Send("LLEN", key)
+	rconn.Send("RPUSH", key, text)
+	rconn.Send("LTRIM", key, 0, MaxQueuedClips-1)
+	rconn.Send("PEXPIRE", key, int64(ClipQueueExpiry/time.Millisecond))
+	replies, err := redis.Ints(rconn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+	NotifyBus(key)
+	return replies[0] < MaxQueuedClips, nil
+}
+
+// TakeAnnouncement takes the next announcement waiting to be spoken by a queue's Player, returning
+// "" if there is none.
+func TakeAnnouncement(rconn redis.Conn, q Queue) (string, error) {
+	text, err := redis.String(rconn.Do("LPOP", q.AnnouncementQueueKey()))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return text, err
+}
+
+// speak starts speaking an announcement, returning a channel of Opus packets and a function to stop
+// it.
+func (p *Player) speak(text string, opts EncodeOptions) (<-chan []byte, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), TTSTimeout)
+	audio, err := p.TTS.Speak(ctx, text)
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	return p.streamPackets(ctx, p.encode(ctx, p.streamResponse(ctx, audio), opts, nil)), cancel, nil
+}
+
+// trackAnnouncement returns what to announce about a track starting, per the guild's speak-tracks
+// setting and its now-playing-spoken template, or "" if nothing.
+func (p *Player) trackAnnouncement(track media.Track) string {
+	if p.TTS == nil {
+		return ""
+	}
+
+	rconn := p.Pool.Get()
+	defer rconn.Close()
+
+	speak, err := ReadBoolSetting(rconn, p.GuildID, SettingSpeakTracks)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't read setting")
+	}
+	if !speak {
+		return ""
+	}
+	data := TemplateData{Track: track.GetInfo(), Service: track.GetServiceID(), Guild: TemplateGuild{ID: p.GuildID}}
+	text, err := RenderTemplate(rconn, p.GuildID, "now-playing-spoken", data)
+	if err != nil {
+		PlayerLog.WithError(err).WithField("gid", p.GuildID).Warn("Player: Couldn't render template")
+	}
+	return text
+}
+
+// cmdSay has the bot speak an announcement in the voice channel it's in, over the music.
+func cmdSay(r *Responder, msg *discordgo.MessageCreate, channel *discordgo.Channel, args []string) {
+	if !r.TTS {
+		r.reply(msg.ChannelID, msg.Author.ID, "I can't speak; text-to-speech isn't set up.")
+		return
+	}
+	if !r.hasPermission(msg.Author.ID, msg.ChannelID, discordgo.PermissionManageServer) {
+		r.reply(msg.ChannelID, msg.Author.ID, "You need the Manage Server permission to make announcements.")
+		return
+	}
+	text := strings.Join(args, " ")
+	if text == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, "Usage: `say <text>`")
+		return
+	}
+	if len([]rune(text)) > MaxAnnouncementLength {
+		r.reply(msg.ChannelID, msg.Author.ID, fmt.Sprintf("Announcements can be %d characters long at most.", MaxAnnouncementLength))
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	q := r.queue(channel.GuildID)
+	if cid, err := r.activeChannel(q); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get active channel")
+		return
+	} else if cid == "" {
+		r.reply(msg.ChannelID, msg.Author.ID, "I'm not in a voice channel right now.")
+		return
+	}
+	ok, err := QueueAnnouncement(rconn, q, text)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't queue announcement")
+		return
+	}
+	if !ok {
+		r.reply(msg.ChannelID, msg.Author.ID, "There are too many announcements waiting to be made already.")
+	}
+}
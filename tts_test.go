@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTTS(t *testing.T) {
+	tts, err := NewTTS("http://localhost:5002/api/tts?voice=en")
+	assert.NoError(t, err)
+	assert.Equal(t, &HTTPTTS{URL: "http://localhost:5002/api/tts?voice=en"}, tts)
+
+	tts, err = NewTTS("espeak-ng --stdin --stdout")
+	assert.NoError(t, err)
+	assert.Equal(t, &CommandTTS{Command: []string{"espeak-ng", "--stdin", "--stdout"}}, tts)
+
+	_, err = NewTTS(" ")
+	assert.Error(t, err)
+}
+
+func TestHTTPTTS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("voice") != "en" {
+			http.Error(w, "no such voice", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("audio of " + req.URL.Query().Get("text")))
+	}))
+	defer server.Close()
+
+	audio, err := (&HTTPTTS{URL: server.URL + "?voice=en"}).Speak(context.Background(), "Now playing: a song & more")
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(audio)
+		audio.Close()
+		assert.Equal(t, "audio of Now playing: a song & more", string(data))
+	}
+
+	_, err = (&HTTPTTS{URL: server.URL + "?voice=xx"}).Speak(context.Background(), "Hi")
+	assert.EqualError(t, err, "TTS service responded with 400 Bad Request")
+}
+
+func TestCommandTTS(t *testing.T) {
+	audio, err := (&CommandTTS{Command: []string{"cat"}}).Speak(context.Background(), "Hello")
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(audio)
+		assert.Equal(t, "Hello", string(data))
+	}
+
+	_, err = (&CommandTTS{Command: []string{"false"}}).Speak(context.Background(), "Hello")
+	assert.Error(t, err)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mvdan/xurls"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Address of Twitch's chat server.
+const TwitchChatAddr = "irc.chat.twitch.tv:6697"
+
+// The TwitchBridge subsystem listens for song requests (`!sr <url>`) in a Twitch channel's chat,
+// and queues them in a Discord guild.
+type TwitchBridge struct {
+	Pool *redis.Pool
+
+	Nick    string // Twitch username to log in as
+	Token   string // OAuth token, with or without the "oauth:" prefix
+	Channel string // Channel to listen in, without the leading #
+	GuildID string // Guild to queue tracks in
+
+	// Each viewer may make at most Quota requests per QuotaWindow; 0 means unlimited.
+	Quota       int
+	QuotaWindow time.Duration
+}
+
+// An ircMessage is a parsed IRC protocol line.
+type ircMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// Nick returns the nickname part of the message's prefix.
+func (m ircMessage) Nick() string {
+	if i := strings.IndexRune(m.Prefix, '!'); i != -1 {
+		return m.Prefix[:i]
+	}
+	return m.Prefix
+}
+
+// parseIRCMessage parses a line of IRC, ignoring IRCv3 tags.
+func parseIRCMessage(line string) ircMessage {
+	var msg ircMessage
+	if strings.HasPrefix(line, "@") {
+		if i := strings.IndexRune(line, ' '); i != -1 {
+			line = line[i+1:]
+		} else {
+			line = ""
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		if i := strings.IndexRune(line, ' '); i != -1 {
+			msg.Prefix, line = line[1:i], line[i+1:]
+		} else {
+			msg.Prefix, line = line[1:], ""
+		}
+	}
+
+	var trailing string
+	hasTrailing := false
+	if i := strings.Index(line, " :"); i != -1 {
+		line, trailing, hasTrailing = line[:i], line[i+2:], true
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		msg.Command, msg.Params = fields[0], fields[1:]
+	}
+	if hasTrailing {
+		msg.Params = append(msg.Params, trailing)
+	}
+	return msg
+}
+
+// Run runs the bridge, reconnecting if the connection drops, until the context expires.
+func (b *TwitchBridge) Run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		if err := b.session(ctx); err != nil {
+			log.WithError(err).Warn("TwitchBridge: Disconnected")
+		}
+
+		// Don't back off if we were connected for a while, it was probably just a blip.
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 5*time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// session connects to Twitch chat, and handles messages until the connection drops.
+func (b *TwitchBridge) session(ctx context.Context) error {
+	conn, err := tls.Dial("tcp", TwitchChatAddr, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Closing the connection is the only way to interrupt a blocking read.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	tc := textproto.NewConn(conn)
+	channel := "#" + strings.ToLower(b.Channel)
+	token := b.Token
+	if !strings.HasPrefix(token, "oauth:") {
+		token = "oauth:" + token
+	}
+	if err := tc.PrintfLine("PASS %s", token); err != nil {
+		return err
+	}
+	if err := tc.PrintfLine("NICK %s", strings.ToLower(b.Nick)); err != nil {
+		return err
+	}
+	if err := tc.PrintfLine("JOIN %s", channel); err != nil {
+		return err
+	}
+	log.WithField("channel", channel).Info("TwitchBridge: Connected")
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+		line, err := tc.ReadLine()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		msg := parseIRCMessage(line)
+		switch msg.Command {
+		case "PING":
+			if err := tc.PrintfLine("PONG :%s", strings.Join(msg.Params, " ")); err != nil {
+				return err
+			}
+		case "NOTICE":
+			log.WithField("notice", strings.Join(msg.Params, " ")).Warn("TwitchBridge: Notice")
+		case "PRIVMSG":
+			if len(msg.Params) < 2 {
+				continue
+			}
+			text := msg.Params[1]
+			if text != "!sr" && !strings.HasPrefix(text, "!sr ") {
+				continue
+			}
+			if reply := b.handleRequest(msg.Nick(), text); reply != "" {
+				if err := tc.PrintfLine("PRIVMSG %s :@%s %s", channel, msg.Nick(), reply); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// handleRequest handles a song request from a viewer, returning a reply.
+func (b *TwitchBridge) handleRequest(viewer, text string) string {
+	url := xurls.Strict().FindString(text)
+	if url == "" {
+		return "Usage: !sr <url>"
+	}
+
+	rconn := b.Pool.Get()
+	defer rconn.Close()
+
+	if b.Quota > 0 {
+		quotaKey := KeyForServerTwitchQuota(b.GuildID, viewer)
+		n, err := redis.Int(rconn.Do("INCR", quotaKey))
+		if err != nil {
+			log.WithError(err).Error("TwitchBridge: Couldn't check quota")
+			return "Something went wrong, try again later."
+		}
+		if n == 1 {
+			rconn.Do("PEXPIRE", quotaKey, int64(b.QuotaWindow/time.Millisecond))
+		}
+		if n > b.Quota {
+			return fmt.Sprintf("You can only request %d track(s) every %s.", b.Quota, b.QuotaWindow)
+		}
+	}
+
+	// There's no voice state to follow, so the bot has to already be active in the guild.
+	cid, err := redis.String(rconn.Do("GET", KeyForServerChannel(b.GuildID)))
+	if err != nil && err != redis.ErrNil {
+		log.WithError(err).Error("TwitchBridge: Couldn't get active channel")
+		return "Something went wrong, try again later."
+	}
+	if cid == "" {
+		return "Song requests are closed right now."
+	}
+	if holder, err := DJLock(rconn, GuildQueue(b.GuildID)); err != nil {
+		log.WithError(err).Error("TwitchBridge: Couldn't check DJ lock")
+	} else if holder != "" {
+		return "Song requests are closed while a DJ has the queue."
+	}
+
+	tracks, err := ResolveURL(rconn, url)
+	if err != nil {
+		return friendlyError(err)
+	}
+	if len(tracks) == 0 {
+		return "That's not a link I can play."
+	}
+
+	log.WithFields(log.Fields{"gid": b.GuildID, "url": url, "viewer": viewer}).Info("TwitchBridge: Song request")
+	n, skipped := Enqueue(rconn, ActivePlaylistQueue(rconn, GuildQueue(b.GuildID)), "", false, resolvedURL{URL: url, Tracks: tracks})
+	if n == 0 {
+		if len(skipped) == 0 {
+			return "Something went wrong, try again later."
+		}
+		return "Can't play that: " + skipped[0].Reason
+	}
+	if err := SetQueueState(rconn, GuildQueue(b.GuildID), StatePlaying); err != nil {
+		log.WithError(err).Error("TwitchBridge: Couldn't set player state")
+	}
+
+	if n == 1 {
+		return "Queued: " + tracks[0].GetInfo().Title
+	}
+	if len(skipped) > 0 {
+		return fmt.Sprintf("Queued %d tracks; skipped %d that can't be played.", n, len(skipped))
+	}
+	return fmt.Sprintf("Queued %d tracks.", n)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseIRCMessage(t *testing.T) {
+	msg := parseIRCMessage(":viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #channel :!sr https://soundcloud.com/a/b")
+	assert.Equal(t, "PRIVMSG", msg.Command)
+	assert.Equal(t, "viewer", msg.Nick())
+	assert.Equal(t, []string{"#channel", "!sr https://soundcloud.com/a/b"}, msg.Params)
+}
+
+func TestParseIRCMessageTags(t *testing.T) {
+	msg := parseIRCMessage("@badge-info=;color=#FF0000 :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #channel :hi")
+	assert.Equal(t, "PRIVMSG", msg.Command)
+	assert.Equal(t, []string{"#channel", "hi"}, msg.Params)
+}
+
+func TestParseIRCMessagePing(t *testing.T) {
+	msg := parseIRCMessage("PING :tmi.twitch.tv")
+	assert.Equal(t, "", msg.Prefix)
+	assert.Equal(t, "PING", msg.Command)
+	assert.Equal(t, []string{"tmi.twitch.tv"}, msg.Params)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/sencrash/hiqty/media"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// Maximum number of redirects to follow when unshortening a URL.
+const MaxUnshortenHops = 5
+
+// ShortenerHosts lists URL shorteners whose links are followed to see where they lead, as services
+// won't recognize them otherwise. Only these are followed, so requests can't make the bot fetch
+// arbitrary URLs.
+var ShortenerHosts = map[string]bool{
+	"bit.ly":            true,
+	"goo.gl":            true,
+	"on.soundcloud.com": true,
+	"snd.sc":            true,
+	"spoti.fi":          true,
+	"spotify.link":      true,
+	"t.co":              true,
+	"tinyurl.com":       true,
+	"youtu.be":          true,
+}
+
+// unshortenClient fetches shortened URLs without following their redirects, so each hop can be
+// checked before following it.
+var unshortenClient = http.Client{
+	Transport: media.DefaultTransport,
+	Timeout:   5 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// UnshortenURL follows a shortened URL's redirects to where it leads. URLs that aren't from a known
+// shortener, or that can't be followed, are returned as-is.
+func UnshortenURL(u *neturl.URL) *neturl.URL {
+	for hop := 0; hop < MaxUnshortenHops && ShortenerHosts[strings.TrimPrefix(u.Host, "www.")]; hop++ {
+		next, err := nextHop(u)
+		if err != nil || next == nil {
+			break
+		}
+		u = next
+	}
+	return u
+}
+
+// nextHop returns where a URL redirects to, or nil if it doesn't. Some shorteners refuse HEAD
+// requests, so those fall back to GET.
+func nextHop(u *neturl.URL) (*neturl.URL, error) {
+	res, err := unshortenClient.Head(u.String())
+	if err == nil && res.StatusCode == http.StatusMethodNotAllowed {
+		res.Body.Close()
+		res, err = unshortenClient.Get(u.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 300 || res.StatusCode > 399 {
+		return nil, nil
+	}
+	loc, err := res.Location()
+	if err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
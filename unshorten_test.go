@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+)
+
+func TestUnshortenURL(t *testing.T) {
+	methods := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			// Refuses HEAD requests.
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			http.Redirect(w, r, "https://soundcloud.com/artist/track", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	base, _ := neturl.Parse(srv.URL)
+	ShortenerHosts[base.Host] = true
+	defer delete(ShortenerHosts, base.Host)
+
+	u, _ := neturl.Parse(srv.URL + "/a")
+	assert.Equal(t, "https://soundcloud.com/artist/track", UnshortenURL(u).String())
+	assert.Equal(t, []string{"HEAD", "HEAD", "GET"}, methods)
+
+	// Redirect loops give up eventually.
+	methods = nil
+	u, _ = neturl.Parse(srv.URL + "/loop")
+	assert.Equal(t, srv.URL+"/loop", UnshortenURL(u).String())
+	assert.Len(t, methods, MaxUnshortenHops)
+
+	// Anything else is left alone.
+	methods = nil
+	delete(ShortenerHosts, base.Host)
+	u, _ = neturl.Parse(srv.URL + "/a")
+	assert.Equal(t, srv.URL+"/a", UnshortenURL(u).String())
+	assert.Len(t, methods, 0)
+}
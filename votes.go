@@ -0,0 +1,220 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/gomodule/redigo/redis"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Reactions that vote a request's tracks up or down the queue, with the vote-queue setting on.
+const (
+	VoteUp   = "👍"
+	VoteDown = "👎"
+)
+
+// How long votes on a request are counted for; tracks rarely wait in a queue for longer.
+const VoteExpiry = 12 * time.Hour
+
+// The field of a request's votes that holds the voice channel it was queued in; the rest are votes,
+// by user ID.
+const voteChannelField = "channel"
+
+// OpenVote starts counting votes on a request, which queued tracks in a voice channel's playlist.
+func OpenVote(rconn redis.Conn, q Queue, mid, vcid string) error {
+	key := q.VotesKey(mid)
+	rconn.Send("MULTI")
+	rconn.Send("HSET", key, voteChannelField, vcid)
+	rconn.Send("PEXPIRE", key, int64(VoteExpiry/time.Millisecond))
+	_, err := rconn.Do("EXEC")
+	return err
+}
+
+// VoteChannel returns the voice channel a request that's being voted on was queued in, and false if
+// its votes aren't being counted.
+func VoteChannel(rconn redis.Conn, q Queue, mid string) (string, bool, error) {
+	vcid, err := redis.String(rconn.Do("HGET", q.VotesKey(mid), voteChannelField))
+	if err == redis.ErrNil {
+		return "", false, nil
+	}
+	return vcid, err == nil, err
+}
+
+// Vote records a user's vote on a request: 1 for up, -1 for down, replacing any they cast before.
+func Vote(rconn redis.Conn, q Queue, mid, uid string, vote int) error {
+	_, err := rconn.Do("HSET", q.VotesKey(mid), uid, vote)
+	return err
+}
+
+// Unvote withdraws a user's vote on a request, if it's the one they last cast; someone who reacted
+// both ways and takes back the first keeps the second.
+func Unvote(rconn redis.Conn, q Queue, mid, uid string, vote int) error {
+	current, err := redis.Int(rconn.Do("HGET", q.VotesKey(mid), uid))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil || current != vote {
+		return err
+	}
+	_, err = rconn.Do("HDEL", q.VotesKey(mid), uid)
+	return err
+}
+
+// VoteScore returns a request's score: its upvotes less its downvotes.
+func VoteScore(rconn redis.Conn, q Queue, mid string) (int, error) {
+	votes, err := redis.StringMap(rconn.Do("HGETALL", q.VotesKey(mid)))
+	if err != nil {
+		return 0, err
+	}
+	score := 0
+	for uid, vote := range votes {
+		if uid == voteChannelField {
+			continue
+		}
+		n, _ := strconv.Atoi(vote)
+		score += n
+	}
+	return score, nil
+}
+
+// SortByVotes reorders a playlist so the tracks of the highest-voted requests come first. Tracks
+// with the same score, such as those from the same request, keep their order.
+func SortByVotes(rconn redis.Conn, playlist, q Queue) error {
+	_, err := rewritePlaylist(rconn, playlist, func(items [][]byte) ([][]byte, bool) {
+		scores := map[string]int{}
+		return sortByScore(items, func(mid string) int {
+			score, ok := scores[mid]
+			if !ok && mid != "" {
+				var err error
+				if score, err = VoteScore(rconn, q, mid); err != nil {
+					log.WithError(err).WithField("mid", mid).Warn("Couldn't count votes")
+				}
+				scores[mid] = score
+			}
+			return score
+		})
+	})
+	return err
+}
+
+// sortByScore stably sorts encoded envelopes by the score of the request that queued them, highest
+// first, returning false if they're in order already. Ones that can't be decoded score 0.
+func sortByScore(items [][]byte, score func(mid string) int) ([][]byte, bool) {
+	scores := make([]int, len(items))
+	for i, data := range items {
+		fields, err := decodeEnvelopeFields(data)
+		if err == nil {
+			scores[i] = score(fields.MessageID)
+		}
+	}
+
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+
+	sorted := make([][]byte, len(items))
+	changed := false
+	for i, idx := range order {
+		sorted[i] = items[idx]
+		changed = changed || idx != i
+	}
+	return sorted, changed
+}
+
+// openVote starts counting votes on a request, if the guild has vote-queue on, and adds the voting
+// reactions to it for people to click. The playlist is resorted, so the new tracks go ahead of any
+// that have been voted down.
+func (r *Responder) openVote(rconn redis.Conn, gid, cid, mid, vcid string) {
+	on, err := ReadBoolSetting(rconn, gid, SettingVoteQueue)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't read setting")
+	}
+	if !on {
+		return
+	}
+
+	q := r.queue(gid)
+	if err := OpenVote(rconn, q, mid, vcid); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't open vote")
+		return
+	}
+	if err := SortByVotes(rconn, PlaylistQueue(rconn, q, vcid), q); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't sort playlist")
+	}
+	for _, emoji := range []string{VoteUp, VoteDown} {
+		if err := r.Session.MessageReactionAdd(cid, mid, emoji); err != nil {
+			ResponderLog.WithError(err).WithField("mid", mid).Warn("Couldn't add voting reaction")
+			return
+		}
+	}
+}
+
+// HandleMessageReactionAdd counts votes on requests, and reorders the playlist to match.
+func (r *Responder) HandleMessageReactionAdd(_ *discordgo.Session, e *discordgo.MessageReactionAdd) {
+	defer ReportPanic(ResponderLog, "Responder", log.Fields{"cid": e.ChannelID, "mid": e.MessageID})
+	r.handleVote(e.MessageReaction, true)
+}
+
+// HandleMessageReactionRemove counts withdrawn votes on requests, and reorders the playlist to
+// match.
+func (r *Responder) HandleMessageReactionRemove(_ *discordgo.Session, e *discordgo.MessageReactionRemove) {
+	defer ReportPanic(ResponderLog, "Responder", log.Fields{"cid": e.ChannelID, "mid": e.MessageID})
+	r.handleVote(e.MessageReaction, false)
+}
+
+// handleVote casts or withdraws a vote. Votes are recorded per user, so instances sharing the bot's
+// token can all count the same one; only requests the bot's counting votes on are affected, and
+// while a DJ has the queue locked, nobody's votes count.
+func (r *Responder) handleVote(e *discordgo.MessageReaction, add bool) {
+	var vote int
+	switch e.Emoji.Name {
+	case VoteUp:
+		vote = 1
+	case VoteDown:
+		vote = -1
+	default:
+		return
+	}
+	if r.Session.State.User != nil && e.UserID == r.Session.State.User.ID {
+		return
+	}
+
+	channel, err := r.channel(e.ChannelID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get channel info")
+		return
+	}
+
+	rconn := r.Pool.Get()
+	defer rconn.Close()
+
+	q := r.queue(channel.GuildID)
+	vcid, ok, err := VoteChannel(rconn, q, e.MessageID)
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't get vote")
+		return
+	}
+	if !ok {
+		return
+	}
+	if holder, err := DJLock(rconn, q); err != nil || holder != "" {
+		return
+	}
+
+	if add {
+		err = Vote(rconn, q, e.MessageID, e.UserID, vote)
+	} else {
+		err = Unvote(rconn, q, e.MessageID, e.UserID, vote)
+	}
+	if err != nil {
+		ResponderLog.WithError(err).Error("Couldn't record vote")
+		return
+	}
+	if err := SortByVotes(rconn, PlaylistQueue(rconn, q, vcid), q); err != nil {
+		ResponderLog.WithError(err).Error("Couldn't sort playlist")
+	}
+}
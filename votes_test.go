@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSortByScore(t *testing.T) {
+	var items [][]byte
+	for i, mid := range []string{"a", "a", "b", "c", "b"} {
+		data, _ := json.Marshal(testEnvelope(int64(i+1), mid))
+		items = append(items, data)
+	}
+	items = append(items, []byte("garbage"))
+	scores := map[string]int{"a": -1, "b": 2}
+	score := func(mid string) int { return scores[mid] }
+
+	// Tracks from the same request stay together, in order; the rest keep their order too.
+	sorted, changed := sortByScore(items, score)
+	assert.True(t, changed)
+	assert.Equal(t, [][]byte{items[2], items[4], items[3], items[5], items[0], items[1]}, sorted)
+
+	_, changed = sortByScore(sorted, score)
+	assert.False(t, changed)
+}
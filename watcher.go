@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	log "github.com/Sirupsen/logrus"
 	"github.com/gomodule/redigo/redis"
 )
 
@@ -22,29 +21,48 @@ func (w *Watcher) Unsubscribe(db int, key string) {
 	w.PS.Unsubscribe(TopicForKeyspaceEvent(db, key))
 }
 
-// Run returns a pipeline of keys that are subscribed, unsubscribed or modified.
+// Run returns a pipeline of keys that are subscribed, unsubscribed or modified. It's closed when
+// the connection fails, or once the context has expired and the Watcher's been unsubscribed from
+// everything (see Stop); a failed connection never recovers, so it's up to the caller to set up a
+// new Watcher (see KeyspaceBus.Run). The connection mustn't be closed until then.
 func (w *Watcher) Run(ctx context.Context) <-chan string {
 	ch := make(chan string)
 
 	go func() {
+		defer ReportPanic(WatcherLog, "Watcher", nil)
 		defer close(ch)
 
 		for {
+			var key string
 			switch v := w.PS.Receive().(type) {
 			case redis.Subscription:
-				ch <- KeyFromKeyspaceTopic(v.Channel)
+				if ctx.Err() != nil && v.Count == 0 {
+					return
+				}
+				key = KeyFromKeyspaceTopic(v.Channel)
 			case redis.Message:
-				ch <- KeyFromKeyspaceTopic(v.Channel)
+				key = KeyFromKeyspaceTopic(v.Channel)
 			case error:
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					log.WithError(v).Error("[Watcher] Receive failed")
+				if ctx.Err() == nil {
+					WatcherLog.WithError(v).Error("[Watcher] Receive failed")
 				}
+				return
+			}
+
+			// Once stopping, what's left is read only to get to the end of it.
+			select {
+			case ch <- key:
+			case <-ctx.Done():
 			}
 		}
 	}()
 
 	return ch
 }
+
+// Stop unsubscribes from everything, which is the only way to get a blocked Run to return without
+// the connection failing. It's safe to call while Run is receiving, but not along with Subscribe or
+// Unsubscribe.
+func (w *Watcher) Stop() error {
+	return w.PS.Unsubscribe()
+}
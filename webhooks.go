@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gomodule/redigo/redis"
+	"net/http"
+	"strings"
+)
+
+// A WebhookRequest asks for a URL to be queued in a webhook's guild.
+type WebhookRequest struct {
+	URL string `json:"url"`
+
+	// Who asked for it, eg. a Twitch username. Only used for logging.
+	Requester string `json:"requester"`
+}
+
+// A WebhookResponse lists the titles of the tracks that were queued, and of those that couldn't be.
+type WebhookResponse struct {
+	Queued  []string              `json:"queued"`
+	Skipped []WebhookSkippedTrack `json:"skipped"`
+}
+
+// A WebhookSkippedTrack is a track that couldn't be queued, and why.
+type WebhookSkippedTrack struct {
+	Title  string `json:"title"`
+	Reason string `json:"reason"`
+}
+
+// CreateWebhook creates a webhook for a guild, returning its secret token.
+func CreateWebhook(rconn redis.Conn, gid string) (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := rconn.Do("SET", KeyForWebhook(HashToken(token)), gid); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeWebhook deletes a webhook. Returns false if there was no such webhook.
+func RevokeWebhook(rconn redis.Conn, token string) (bool, error) {
+	n, err := redis.Int(rconn.Do("DEL", KeyForWebhook(HashToken(token))))
+	return n > 0, err
+}
+
+// LookupWebhook returns the guild a webhook belongs to, or "" if there's no such webhook.
+func LookupWebhook(rconn redis.Conn, token string) (string, error) {
+	gid, err := redis.String(rconn.Do("GET", KeyForWebhook(HashToken(token))))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return gid, err
+}
+
+// HandleWebhook handles POST /webhooks/<token>, resolving and queueing a URL in the webhook's
+// guild, exactly like a link posted in chat.
+func (s *HTTPServer) HandleWebhook(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rconn := s.Pool.Get()
+	defer rconn.Close()
+
+	token := strings.TrimPrefix(req.URL.Path, "/webhooks/")
+	gid, err := LookupWebhook(rconn, token)
+	if err != nil {
+		log.WithError(err).Error("HTTPServer: Couldn't look up webhook")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if gid == "" {
+		writeError(w, http.StatusNotFound, "no such webhook")
+		return
+	}
+
+	s.queueFromRequest(w, req, rconn, gid)
+}
+
+// queueFromRequest resolves and queues the URL in a WebhookRequest body.
+func (s *HTTPServer) queueFromRequest(w http.ResponseWriter, req *http.Request, rconn redis.Conn, gid string) {
+	var body WebhookRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+
+	// There's no voice state to follow here, so the bot has to already be active somewhere.
+	cid, err := redis.String(rconn.Do("GET", KeyForServerChannel(gid)))
+	if err != nil && err != redis.ErrNil {
+		log.WithError(err).Error("HTTPServer: Couldn't get active channel")
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if cid == "" {
+		writeError(w, http.StatusConflict, "the bot isn't in a voice channel in this server")
+		return
+	}
+
+	tracks, err := ResolveURL(rconn, body.URL)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, friendlyError(err))
+		return
+	}
+	if len(tracks) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "no service recognizes that URL")
+		return
+	}
+
+	log.WithFields(log.Fields{"gid": gid, "url": body.URL, "requester": body.Requester}).Info("HTTPServer: Queue request")
+	n, skipped := Enqueue(rconn, ActivePlaylistQueue(rconn, GuildQueue(gid)), "", false, resolvedURL{URL: body.URL, Tracks: tracks})
+	if n > 0 {
+		if err := SetQueueState(rconn, GuildQueue(gid), StatePlaying); err != nil {
+			log.WithError(err).Error("HTTPServer: Couldn't set player state")
+		}
+	}
+
+	res := WebhookResponse{Queued: []string{}, Skipped: []WebhookSkippedTrack{}}
+	for _, track := range tracks {
+		if !isSkipped(skipped, track) {
+			res.Queued = append(res.Queued, track.GetInfo().Title)
+		}
+	}
+	for _, s := range skipped {
+		res.Skipped = append(res.Skipped, WebhookSkippedTrack{s.Track.GetInfo().Title, s.Reason})
+	}
+	writeJSON(w, http.StatusOK, res)
+}